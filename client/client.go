@@ -0,0 +1,296 @@
+// Package client is a minimal Mailpit API client for use in Go integration tests,
+// waiting for messages via the Mailpit websocket rather than polling the API
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a Mailpit API client. A Client has no global state, so multiple clients
+// may be used concurrently, eg: for parallel tests against different Mailpit instances.
+type Client struct {
+	// BaseURL is the Mailpit web UI address including the webroot, eg: http://localhost:8025/
+	BaseURL string
+	// Username & Password for basic authentication (if set)
+	Username string
+	Password string
+	// APIKey is sent with each API request (if set)
+	APIKey string
+	// DeleteConfirmToken is sent when deleting all messages, if Mailpit requires a confirmation token
+	DeleteConfirmToken string
+	// HTTPClient used for API requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Address is an email address
+type Address struct {
+	Name    string
+	Address string
+}
+
+// MessageSummary is the summary of a message as returned by the Mailpit API
+type MessageSummary struct {
+	// Database ID
+	ID string
+	// Message ID
+	MessageID string
+	// Read status
+	Read bool
+	// From address
+	From *Address
+	// To addresses
+	To []*Address
+	// Cc addresses
+	Cc []*Address
+	// Bcc addresses
+	Bcc []*Address
+	// Reply-To addresses
+	ReplyTo []*Address
+	// Email subject
+	Subject string
+	// Created time
+	Created time.Time
+	// Message tags
+	Tags []string
+	// Message size in bytes
+	Size int
+	// Number of attachments
+	Attachments int
+	// Message snippet
+	Snippet string
+}
+
+// messagesResponse is the response of the messages & search API endpoints
+type messagesResponse struct {
+	MessagesCount int              `json:"messages_count"`
+	Messages      []MessageSummary `json:"messages"`
+}
+
+// event is a websocket notification
+type event struct {
+	Type string
+}
+
+// New returns a client for the Mailpit instance at baseURL, eg: http://localhost:8025
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/") + "/"}
+}
+
+// WaitForMessage returns the latest message matching the search query (all messages if empty),
+// waiting for a matching message to arrive if none exist yet. It returns the context error if the
+// context is cancelled before a matching message arrives.
+func (c *Client) WaitForMessage(ctx context.Context, query string) (*MessageSummary, error) {
+	var msg *MessageSummary
+
+	err := c.waitFor(ctx, func() (bool, error) {
+		res, err := c.search(ctx, query, 1)
+		if err != nil || len(res.Messages) == 0 {
+			return false, err
+		}
+
+		msg = &res.Messages[0]
+
+		return true, nil
+	})
+
+	return msg, err
+}
+
+// WaitForMessageCount returns the messages matching the search query (all messages if empty) once
+// there are at least n, latest first. It returns the context error if the context is cancelled before
+// n matching messages arrive.
+func (c *Client) WaitForMessageCount(ctx context.Context, n int, query string) ([]MessageSummary, error) {
+	var messages []MessageSummary
+
+	err := c.waitFor(ctx, func() (bool, error) {
+		res, err := c.search(ctx, query, n)
+		if err != nil || res.MessagesCount < n {
+			return false, err
+		}
+
+		messages = res.Messages
+
+		return true, nil
+	})
+
+	return messages, err
+}
+
+// DeleteAll deletes all messages
+func (c *Client) DeleteAll(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "api/v1/messages", strings.NewReader(`{"IDs":[]}`))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.DeleteConfirmToken != "" {
+		req.Header.Set("X-Confirm-Delete", c.DeleteConfirmToken)
+	}
+
+	_, err = c.do(req)
+
+	return err
+}
+
+// WaitFor calls check until it returns true or an error, first immediately and then each time a new
+// message notification is received via the websocket. The websocket is connected before the first
+// check so that no messages are missed.
+func (c *Client) waitFor(ctx context.Context, check func() (bool, error)) error {
+	conn, err := c.dialEvents(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	newMessages := make(chan struct{}, 1)
+	closed := make(chan error, 1)
+
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+
+			// multiple notifications may be sent in a single websocket message, separated by a newline
+			for _, line := range strings.Split(string(data), "\n") {
+				e := event{}
+				if err := json.Unmarshal([]byte(line), &e); err != nil || e.Type != "new" {
+					continue
+				}
+
+				select {
+				case newMessages <- struct{}{}:
+				default: // a check is already pending
+				}
+			}
+		}
+	}()
+
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-closed:
+			return fmt.Errorf("websocket closed: %s", err.Error())
+		case <-newMessages:
+		}
+	}
+}
+
+// DialEvents connects to the Mailpit websocket
+func (c *Client) dialEvents(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.BaseURL + "api/events")
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+
+	header := http.Header{}
+	if c.Username != "" || c.Password != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+	}
+	if c.APIKey != "" {
+		header.Set("X-API-Key", c.APIKey)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("error connecting to %s: %s", u.String(), resp.Status)
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Search returns up to limit messages matching the query, or the latest messages if the query is empty
+func (c *Client) search(ctx context.Context, query string, limit int) (messagesResponse, error) {
+	res := messagesResponse{}
+
+	path := fmt.Sprintf("api/v1/messages?limit=%d", limit)
+	if query != "" {
+		path = fmt.Sprintf("api/v1/search?query=%s&limit=%d", url.QueryEscape(query), limit)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return res, err
+	}
+
+	b, err := c.do(req)
+	if err != nil {
+		return res, err
+	}
+
+	err = json.Unmarshal(b, &res)
+
+	return res, err
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	return req, nil
+}
+
+// Do sends the request, returning the response body or an error for non-200 responses
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(req.Method + " " + req.URL.Path + " returned " + resp.Status + ": " + strings.TrimSpace(string(b)))
+	}
+
+	return b, nil
+}
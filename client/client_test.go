@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server"
+)
+
+var baseURL string
+
+// TestMain starts an embedded Mailpit instance (HTTP only) for the client tests
+func TestMain(m *testing.M) {
+	logger.NoLogging = true
+	config.DataFile = ""
+	config.MaxMessages = 0
+	config.POP3Listen = ""
+	config.IMAPListen = ""
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	config.HTTPListen = ln.Addr().String()
+	ln.Close()
+
+	if err := storage.InitDB(); err != nil {
+		panic(err)
+	}
+
+	go server.Listen()
+
+	baseURL = "http://" + config.HTTPListen + "/"
+
+	// wait for the HTTP server to start
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(baseURL + "livez"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	code := m.Run()
+
+	storage.Close()
+
+	os.Exit(code)
+}
+
+func TestWaitForMessage(t *testing.T) {
+	c := New(baseURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.DeleteAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	storeMessage(t, "Unrelated", "other@example.com")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		storeMessage(t, "Unrelated again", "other@example.com")
+		time.Sleep(100 * time.Millisecond)
+		storeMessage(t, "Password reset", "user@example.com")
+	}()
+
+	msg, err := c.WaitForMessage(ctx, "to:user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Subject != "Password reset" {
+		t.Errorf("expected the matching message, got %q", msg.Subject)
+	}
+
+	// existing messages are matched immediately
+	msg, err = c.WaitForMessage(ctx, "subject:Unrelated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Subject != "Unrelated again" {
+		t.Errorf("expected the latest matching message, got %q", msg.Subject)
+	}
+
+	// context cancellation
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+
+	if _, err := c.WaitForMessage(short, "subject:missing"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a context deadline error, got %v", err)
+	}
+}
+
+func TestWaitForMessageCount(t *testing.T) {
+	c := New(baseURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.DeleteAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			storeMessage(t, fmt.Sprintf("Newsletter %d", i), "list@example.com")
+		}
+	}()
+
+	messages, err := c.WaitForMessageCount(ctx, 3, "subject:Newsletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 3 {
+		t.Errorf("expected 3 messages, got %d", len(messages))
+	}
+
+	messages, err = c.WaitForMessageCount(ctx, 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 5 || messages[0].Subject != "Newsletter 4" {
+		t.Errorf("expected the latest 5 messages, got %d", len(messages))
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	c := New(baseURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	storeMessage(t, "Delete me", "user@example.com")
+
+	if err := c.DeleteAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := storage.CountTotal(); n != 0 {
+		t.Errorf("expected all messages to be deleted, got %d", n)
+	}
+
+	// the websocket is notified of messages stored after deleting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		storeMessage(t, "After delete", "user@example.com")
+	}()
+
+	if _, err := c.WaitForMessage(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeMessage(t *testing.T, subject, to string) {
+	raw := []byte("From: sender@example.com\r\nTo: " + to + "\r\nSubject: " + subject + "\r\n\r\nTest\r\n")
+	if _, err := storage.Store(&raw); err != nil {
+		t.Error(err)
+	}
+}
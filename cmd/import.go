@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importMbox []string
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import [--mbox <file>] [file|folder] ...[file|folder]",
+	Short: "Import mbox files or emails into the database",
+	Long: `Import mbox files or emails (EML files) into the database.
+
+Messages are stored directly in the database (--db-file), so this does not require Mailpit
+to be running. Each email file in a folder must be a separate message (eg: Maildir format),
+mbox files must be imported with --mbox. Messages with a Message-ID which already exists
+in the database are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(importMbox) == 0 && len(args) == 0 {
+			_ = cmd.Help()
+			os.Exit(1)
+		}
+
+		if config.DataFile == "" {
+			logger.Log().Error("a database file (--db-file) is required")
+			os.Exit(1)
+		}
+
+		if err := storage.InitDB(); err != nil {
+			logger.Log().Error(err)
+			os.Exit(1)
+		}
+		defer storage.Close()
+
+		var imported, skipped int
+
+		for _, path := range importMbox {
+			f, err := os.Open(filepath.Clean(path))
+			if err != nil {
+				logger.Log().Errorf("%s: %s", path, err.Error())
+				continue
+			}
+
+			i, s, err := storage.ImportMbox(f)
+			_ = f.Close()
+			imported += i
+			skipped += s
+			if err != nil {
+				logger.Log().Errorf("%s: %s", path, err.Error())
+			}
+		}
+
+		for _, a := range args {
+			err := filepath.Walk(a,
+				func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						logger.Log().Error(err)
+						return nil
+					}
+					if !isFile(path) {
+						return nil
+					}
+
+					body, err := os.ReadFile(filepath.Clean(path))
+					if err != nil {
+						logger.Log().Errorf("%s: %s", path, err.Error())
+						return nil
+					}
+
+					id, err := storage.ImportEML(body)
+					if err != nil {
+						logger.Log().Errorf("%s: %s", path, err.Error())
+						return nil
+					}
+
+					if id == "" {
+						skipped++
+					} else {
+						imported++
+					}
+
+					return nil
+				})
+			if err != nil {
+				logger.Log().Error(err)
+			}
+		}
+
+		logger.Log().Infof("imported %d messages (%d skipped)", imported, skipped)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&config.DataFile, "db-file", "d", config.DataFile, "Database file to import the messages into")
+	importCmd.Flags().StringSliceVar(&importMbox, "mbox", importMbox, "Import an mbox file (can be repeated)")
+}
@@ -5,16 +5,20 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/auth"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/selftest"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/internal/watcher"
 	"github.com/axllent/mailpit/server"
 	"github.com/axllent/mailpit/server/smtpd"
 	"github.com/axllent/mailpit/server/webhook"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var cfgFile string
@@ -35,13 +39,30 @@ Documentation:
 			logger.Log().Error(err.Error())
 			os.Exit(1)
 		}
+		if err := webhook.LoadTemplate(); err != nil {
+			logger.Log().Error(err.Error())
+			os.Exit(1)
+		}
 		if err := storage.InitDB(); err != nil {
 			logger.Log().Error(err.Error())
 			os.Exit(1)
 		}
 
+		watcher.Watch()
+
 		go server.Listen()
 
+		if config.SelfTest {
+			go func() {
+				if err := selftest.RunSelfTest(config.SMTPListen); err != nil {
+					logger.Log().Error(err.Error())
+					if config.SelfTestExit {
+						os.Exit(1)
+					}
+				}
+			}()
+		}
+
 		if err := smtpd.Listen(); err != nil {
 			logger.Log().Error(err.Error())
 			os.Exit(1)
@@ -84,41 +105,117 @@ func init() {
 
 	rootCmd.Flags().StringVarP(&config.DataFile, "db-file", "d", config.DataFile, "Database file to store persistent data")
 	rootCmd.Flags().IntVarP(&config.MaxMessages, "max", "m", config.MaxMessages, "Max number of messages to store")
+	rootCmd.Flags().IntVar(&config.HardMaxMessages, "hard-max", config.HardMaxMessages, "Hard max number of messages to store, pruned immediately when exceeded (0 = unlimited)")
 	rootCmd.Flags().BoolVar(&config.UseMessageDates, "use-message-dates", config.UseMessageDates, "Use message dates as the received dates")
 	rootCmd.Flags().BoolVar(&config.IgnoreDuplicateIDs, "ignore-duplicate-ids", config.IgnoreDuplicateIDs, "Ignore duplicate messages (by Message-Id)")
+	rootCmd.Flags().StringVar(&config.DuplicateAction, "duplicate-action", config.DuplicateAction, "Action for duplicate messages (by Message-Id): store, ignore, reject or overwrite")
+	rootCmd.Flags().StringArrayVar(&config.StorageHookCommands, "storage-hook", config.StorageHookCommands, "Shell command to process raw messages (stdin to stdout) before storing (repeatable, alias --pre-store-hook-cmd)")
+	rootCmd.Flags().StringArrayVar(&config.StorageHookURLs, "storage-hook-url", config.StorageHookURLs, "URL to POST raw messages to before storing, the response body replaces the message (repeatable, alias --pre-store-hook-url)")
+	rootCmd.Flags().DurationVar(&config.StorageHookTimeout, "storage-hook-timeout", config.StorageHookTimeout, "Maximum time each storage hook is allowed to run (alias --hook-timeout)")
+	rootCmd.Flags().StringVar(&config.TagRetentionFile, "tag-retention", config.TagRetentionFile, "Yaml file of per-tag auto-delete rules (max messages and/or age)")
+	rootCmd.Flags().StringVar(&config.ValidationRulesFile, "validation-rules", config.ValidationRulesFile, "Yaml file of content rules to reject or warn about messages before storing")
+	rootCmd.Flags().StringSliceVar(&config.IndexedHeaders, "indexed-headers", config.IndexedHeaders, "Custom message headers to index for lookups, eg: X-Test-ID (comma-separated)")
+	rootCmd.Flags().StringSliceVar(&config.PreferredContentTypes, "preferred-content-types", config.PreferredContentTypes, "Preferred order of multipart/alternative content types to display (comma-separated)")
+	rootCmd.Flags().StringSliceVar(&config.BlockedAttachmentTypes, "block-attachment-types", config.BlockedAttachmentTypes, "Reject messages containing attachments of these MIME types or extensions (comma-separated)")
 	rootCmd.Flags().StringVar(&logger.LogFile, "log-file", logger.LogFile, "Log output to file instead of stdout")
+	rootCmd.Flags().BoolVar(&logger.SyslogEnabled, "syslog", logger.SyslogEnabled, "Log output to the system syslog daemon")
+	rootCmd.Flags().StringVar(&logger.SyslogFacility, "syslog-facility", logger.SyslogFacility, "Syslog facility, eg: daemon, user, mail or local0-local7")
+	rootCmd.Flags().StringVar(&logger.SyslogTag, "syslog-tag", logger.SyslogTag, "Syslog tag")
 	rootCmd.Flags().BoolVarP(&logger.QuietLogging, "quiet", "q", logger.QuietLogging, "Quiet logging (errors only)")
 	rootCmd.Flags().BoolVarP(&logger.VerboseLogging, "verbose", "v", logger.VerboseLogging, "Verbose logging")
+	rootCmd.Flags().IntVar(&config.DBBusyRetries, "db-busy-retries", config.DBBusyRetries, "Number of times to retry database writes if the database is busy")
+	rootCmd.Flags().IntVar(&config.DecompressionWorkers, "decompression-workers", config.DecompressionWorkers, "Number of messages to decompress concurrently in batch operations")
+	rootCmd.Flags().IntVar(&config.MessageCacheSize, "message-cache-size", config.MessageCacheSize, "Number of decompressed raw messages to cache in memory (0 = disabled)")
+	rootCmd.Flags().DurationVar(&config.DBIdleTimeout, "db-idle-timeout", config.DBIdleTimeout, "Close the database file after a period of inactivity, eg: 1h (0 to disable)")
+	rootCmd.Flags().StringVar(&config.DBOnCorruption, "db-on-corruption", config.DBOnCorruption, "Action when the database is corrupted on startup: fail or truncate (delete & recreate)")
+	rootCmd.Flags().DurationVar(&config.DBVacuumInterval, "db-vacuum-interval", config.DBVacuumInterval, "Interval to vacuum the database when idle to reclaim space (0 to disable)")
+	rootCmd.Flags().DurationVar(&config.MigrationTimeout, "migration-timeout", config.MigrationTimeout, "Maximum time allowed for data migrations on startup (0 to disable)")
+	rootCmd.Flags().DurationVar(&config.DeletedMessagesLogRetention, "deleted-messages-log", config.DeletedMessagesLogRetention, "Log deleted message IDs for this duration for delta syncing (0 to disable)")
+	rootCmd.Flags().BoolVar(&config.WatchConfigFiles, "watch-config-files", config.WatchConfigFiles, "Reload password files when they are changed")
+	rootCmd.Flags().BoolVar(&config.SelfTest, "self-test", config.SelfTest, "Send a test message through the SMTP server on startup")
+	rootCmd.Flags().BoolVar(&config.SelfTestExit, "self-test-exit", config.SelfTestExit, "Exit if the startup self-test fails")
+	rootCmd.Flags().StringVar(&config.SelfTestRecipient, "self-test-recipient", config.SelfTestRecipient, "Recipient of the startup self-test message")
+	rootCmd.Flags().StringVar(&config.SentryDSN, "sentry-dsn", config.SentryDSN, "Sentry DSN for error reporting")
 
 	// Web UI / API
 	rootCmd.Flags().StringVarP(&config.HTTPListen, "listen", "l", config.HTTPListen, "HTTP bind interface and port for UI")
 	rootCmd.Flags().StringVar(&config.Webroot, "webroot", config.Webroot, "Set the webroot for web UI & API")
 	rootCmd.Flags().StringVar(&config.UIAuthFile, "ui-auth-file", config.UIAuthFile, "A password file for web UI & API authentication")
+	rootCmd.Flags().StringVar(&config.APITokenFile, "api-token-file", config.APITokenFile, "A YAML file of scoped (read, write or admin) API bearer tokens required for API requests outside of the web UI (the web UI is only protected by --ui-auth-file)")
+	rootCmd.Flags().StringVar(&config.APIKey, "api-key", config.APIKey, "Require an API key (X-API-Key header) for API requests outside of the web UI")
+	rootCmd.Flags().StringSliceVar(&config.AdminIPRanges, "admin-ip-ranges", config.AdminIPRanges, "Restrict admin API requests to these IP ranges (comma-separated CIDRs)")
+	rootCmd.Flags().BoolVar(&config.PreventDeleteAll, "prevent-delete-all", config.PreventDeleteAll, "Require a confirmation token (X-Confirm-Delete header) to delete all messages")
+	rootCmd.Flags().StringVar(&config.DeleteAllConfirmToken, "delete-all-token", config.DeleteAllConfirmToken, "Confirmation token required to delete all messages - requires prevent-delete-all")
 	rootCmd.Flags().StringVar(&config.UITLSCert, "ui-tls-cert", config.UITLSCert, "TLS certificate for web UI (HTTPS) - requires ui-tls-key")
 	rootCmd.Flags().StringVar(&config.UITLSKey, "ui-tls-key", config.UITLSKey, "TLS key for web UI (HTTPS) - requires ui-tls-cert")
+	rootCmd.Flags().StringArrayVar(&config.HTTPTLSCertificateArgs, "ui-tls-sni", config.HTTPTLSCertificateArgs, "Additional web UI TLS certificate for a domain (SNI) as domain,cert,key (repeatable)")
+	rootCmd.Flags().IntVar(&config.APIDefaultPageSize, "api-default-page-size", config.APIDefaultPageSize, "Default number of results for paginated API requests")
+	rootCmd.Flags().IntVar(&config.APIMaxPageSize, "api-max-page-size", config.APIMaxPageSize, "Maximum limit allowed for paginated API requests")
+	rootCmd.Flags().StringToStringVar(&config.SecurityHeaders, "security-headers", config.SecurityHeaders, "Custom HTTP response headers, eg: X-Frame-Options=SAMEORIGIN (empty value removes a default)")
 	rootCmd.Flags().StringVar(&server.AccessControlAllowOrigin, "api-cors", server.AccessControlAllowOrigin, "Set API CORS Access-Control-Allow-Origin header")
 	rootCmd.Flags().BoolVar(&config.DisableHTMLCheck, "disable-html-check", config.DisableHTMLCheck, "Disable the HTML check functionality (web UI & API)")
+	rootCmd.Flags().DurationVar(&config.LinkCheckTimeout, "link-check-timeout", config.LinkCheckTimeout, "Maximum time allowed for each link of the link checker")
+	rootCmd.Flags().DurationVar(&config.LinkCheckCacheTTL, "link-check-cache-ttl", config.LinkCheckCacheTTL, "How long link check results are cached for (0 = disabled)")
+	rootCmd.Flags().BoolVar(&config.EnableMetrics, "enable-metrics", config.EnableMetrics, "Expose Prometheus metrics via /metrics")
 	rootCmd.Flags().BoolVar(&config.BlockRemoteCSSAndFonts, "block-remote-css-and-fonts", config.BlockRemoteCSSAndFonts, "Block access to remote CSS & fonts")
+	rootCmd.Flags().StringVar(&config.CSPPolicy, "csp-policy", config.CSPPolicy, "Override the web UI & API Content-Security-Policy header")
+	rootCmd.Flags().StringVar(&config.CSPReportURI, "csp-report-uri", config.CSPReportURI, "URI to report Content-Security-Policy violations to")
 	rootCmd.Flags().StringVar(&config.EnableSpamAssassin, "enable-spamassassin", config.EnableSpamAssassin, "Enable integration with SpamAssassin")
 	rootCmd.Flags().BoolVar(&config.AllowUntrustedTLS, "allow-untrusted-tls", config.AllowUntrustedTLS, "Do not verify HTTPS certificates (link checker & screenshots)")
+	rootCmd.Flags().DurationVar(&config.WebSocketPingInterval, "websocket-ping-interval", config.WebSocketPingInterval, "Interval to ping web UI websocket clients")
+	rootCmd.Flags().DurationVar(&config.WebSocketPongTimeout, "websocket-pong-timeout", config.WebSocketPongTimeout, "Remove web UI websocket clients not responding within this time")
 
 	// SMTP server
 	rootCmd.Flags().StringVarP(&config.SMTPListen, "smtp", "s", config.SMTPListen, "SMTP bind interface and port")
+	rootCmd.Flags().StringSliceVar(&config.SMTPListenAddrs, "smtp-listen-addrs", config.SMTPListenAddrs, "Multiple SMTP bind interfaces and ports, overrides --smtp (comma-separated)")
+	rootCmd.Flags().StringVar(&config.SMTPHostname, "smtp-hostname", config.SMTPHostname, "SMTP server hostname used in greetings (default system hostname)")
 	rootCmd.Flags().StringVar(&config.SMTPAuthFile, "smtp-auth-file", config.SMTPAuthFile, "A password file for SMTP authentication")
 	rootCmd.Flags().BoolVar(&config.SMTPAuthAcceptAny, "smtp-auth-accept-any", config.SMTPAuthAcceptAny, "Accept any SMTP username and password, including none")
 	rootCmd.Flags().StringVar(&config.SMTPTLSCert, "smtp-tls-cert", config.SMTPTLSCert, "TLS certificate for SMTP (STARTTLS) - requires smtp-tls-key")
 	rootCmd.Flags().StringVar(&config.SMTPTLSKey, "smtp-tls-key", config.SMTPTLSKey, "TLS key for SMTP (STARTTLS) - requires smtp-tls-cert")
+	rootCmd.Flags().BoolVar(&config.SMTPTLSAuto, "smtp-tls-auto", config.SMTPTLSAuto, "Generate a self-signed TLS certificate for SMTP if no certificate is set")
 	rootCmd.Flags().BoolVar(&config.SMTPRequireSTARTTLS, "smtp-require-starttls", config.SMTPRequireSTARTTLS, "Require SMTP client use STARTTLS")
 	rootCmd.Flags().BoolVar(&config.SMTPRequireTLS, "smtp-require-tls", config.SMTPRequireTLS, "Require client use SSL/TLS")
+	rootCmd.Flags().BoolVar(&config.SMTPAutoDetectTLS, "smtp-autodetect-tls", config.SMTPAutoDetectTLS, "Accept both SSL/TLS and STARTTLS connections on the SMTP port")
 	rootCmd.Flags().BoolVar(&config.SMTPAuthAllowInsecure, "smtp-auth-allow-insecure", config.SMTPAuthAllowInsecure, "Allow insecure PLAIN & LOGIN SMTP authentication")
+	rootCmd.Flags().StringSliceVar(&config.SMTPAuthMethods, "smtp-auth-methods", config.SMTPAuthMethods, "Restrict advertised SMTP authentication methods (comma-separated, default PLAIN,LOGIN)")
+	rootCmd.Flags().BoolVar(&config.SMTPDevVerbose, "smtp-dev-verbose", config.SMTPDevVerbose, "Print a summary of every new message to the terminal")
 	rootCmd.Flags().BoolVar(&config.SMTPStrictRFCHeaders, "smtp-strict-rfc-headers", config.SMTPStrictRFCHeaders, "Return SMTP error if message headers contain <CR><CR><LF>")
 	rootCmd.Flags().IntVar(&config.SMTPMaxRecipients, "smtp-max-recipients", config.SMTPMaxRecipients, "Maximum SMTP recipients allowed")
+	rootCmd.Flags().IntVar(&config.SMTPMaxMessageSize, "smtp-max-message-size", config.SMTPMaxMessageSize, "Maximum SMTP message size in bytes (default unlimited)")
+	rootCmd.Flags().IntVar(&config.ResubmitMaxSize, "resubmit-max-size", config.ResubmitMaxSize, "Maximum size in bytes of messages which can be resubmitted (0 = unlimited)")
+	rootCmd.Flags().StringVar(&config.SMTPBanner, "smtp-banner", config.SMTPBanner, "Custom SMTP greeting text following the hostname (default \"Mailpit ESMTP Service ready\")")
 	rootCmd.Flags().StringVar(&config.SMTPAllowedRecipients, "smtp-allowed-recipients", config.SMTPAllowedRecipients, "Only allow SMTP recipients matching a regular expression (default allow all)")
 	rootCmd.Flags().BoolVar(&smtpd.DisableReverseDNS, "smtp-disable-rdns", smtpd.DisableReverseDNS, "Disable SMTP reverse DNS lookups")
+	rootCmd.Flags().BoolVar(&config.SMTPDSNEnabled, "smtp-dsn", config.SMTPDSNEnabled, "Enable SMTP DSN (Delivery Status Notification) support")
+	rootCmd.Flags().BoolVar(&config.SMTP8BitMIME, "smtp-8bitmime", config.SMTP8BitMIME, "Advertise the SMTP 8BITMIME extension")
+	rootCmd.Flags().BoolVar(&config.SMTPBDATEnabled, "smtp-bdat", config.SMTPBDATEnabled, "Advertise the SMTP CHUNKING (BDAT) extension")
+	rootCmd.Flags().DurationVar(&config.SMTPTransactionLogRetention, "smtp-transaction-log", config.SMTPTransactionLogRetention, "Log SMTP transactions for this duration, eg: 24h (default disabled)")
+	rootCmd.Flags().BoolVar(&config.SMTPConnectionLogEnabled, "smtp-connection-log", config.SMTPConnectionLogEnabled, "Log all inbound SMTP connections")
+	rootCmd.Flags().DurationVar(&config.SMTPConnectionLogRetention, "smtp-connection-log-retention", config.SMTPConnectionLogRetention, "Keep logged SMTP connections for this duration (0 = indefinitely)")
+	rootCmd.Flags().BoolVar(&config.SMTPTraceLog, "smtp-trace-log", config.SMTPTraceLog, "Log every SMTP command & response with structured fields")
+	rootCmd.Flags().BoolVar(&config.InjectSessionHeader, "smtp-session-header", config.InjectSessionHeader, "Add an X-Mailpit-Session header with the SMTP session ID to each message")
+	rootCmd.Flags().StringVar(&config.SMTPSessionLogFile, "smtp-session-log", config.SMTPSessionLogFile, "Log SMTP session entries to a dedicated file")
+	rootCmd.Flags().StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "Export SMTP traces to an OpenTelemetry (OTLP/HTTP) endpoint, eg: http://localhost:4318")
+	rootCmd.Flags().DurationVar(&config.SMTPTarpitDelay, "smtp-tarpit-delay", config.SMTPTarpitDelay, "Delay the SMTP greeting for clients connecting too frequently, eg: 10s (default disabled)")
+	rootCmd.Flags().IntVar(&config.SMTPTarpitThreshold, "smtp-tarpit-threshold", config.SMTPTarpitThreshold, "Connections per minute before a client is tarpitted")
+	rootCmd.Flags().BoolVar(&config.SMTPRateLimitReject, "smtp-rate-limit-reject", config.SMTPRateLimitReject, "Reject messages from clients exceeding the tarpit threshold")
+	rootCmd.Flags().IntVar(&config.SMTPRateLimitResponseCode, "smtp-rate-limit-code", config.SMTPRateLimitResponseCode, "SMTP response code for messages from rate-limited clients or exceeding the message rate limits")
+	rootCmd.Flags().StringVar(&config.SMTPRateLimitMessage, "smtp-rate-limit-message", config.SMTPRateLimitMessage, "SMTP response text for messages from rate-limited clients or exceeding the message rate limits")
+	rootCmd.Flags().IntVar(&config.SMTPMaxMessagesPerMinute, "smtp-max-messages-per-minute", config.SMTPMaxMessagesPerMinute, "Maximum messages accepted per minute from all clients (default unlimited)")
+	rootCmd.Flags().IntVar(&config.SMTPMaxRecipientsPerSecond, "smtp-max-recipients-per-second", config.SMTPMaxRecipientsPerSecond, "Maximum message recipients accepted per second from all clients (default unlimited)")
+	rootCmd.Flags().IntVar(&config.SMTPMaxPerIPPerMinute, "smtp-max-per-ip-per-minute", config.SMTPMaxPerIPPerMinute, "Maximum messages accepted per minute from each client IP address (default unlimited)")
+	rootCmd.Flags().BoolVar(&config.SMTPXCLIENTEnabled, "smtp-xclient", config.SMTPXCLIENTEnabled, "Enable the SMTP XCLIENT extension for trusted proxies")
+	rootCmd.Flags().StringSliceVar(&config.SMTPXCLIENTTrustedIPs, "smtp-xclient-trusted", config.SMTPXCLIENTTrustedIPs, "Proxy IP addresses trusted to use XCLIENT (comma-separated)")
 
 	// SMTP relay
 	rootCmd.Flags().StringVar(&config.SMTPRelayConfigFile, "smtp-relay-config", config.SMTPRelayConfigFile, "SMTP configuration file to allow releasing messages")
 	rootCmd.Flags().BoolVar(&config.SMTPRelayAllIncoming, "smtp-relay-all", config.SMTPRelayAllIncoming, "Relay all incoming messages via external SMTP server (caution!)")
+	rootCmd.Flags().StringVar(&config.SMTPRelayConfig.Host, "smtp-relay-host", config.SMTPRelayConfig.Host, "SMTP relay server host, used if not set in the relay configuration file")
+	rootCmd.Flags().IntVar(&config.SMTPRelayConfig.Port, "smtp-relay-port", config.SMTPRelayConfig.Port, "SMTP relay server port (default 25)")
+	rootCmd.Flags().StringVar(&config.SMTPRelayStrategy, "smtp-relay-strategy", config.SMTPRelayStrategy, "Relay rule selection for multiple matching rules (first-match, round-robin, random)")
+	rootCmd.Flags().BoolVar(&config.ForwardAsync, "smtp-forward-async", config.ForwardAsync, "Forward messages matching relay config forward rules in the background")
+	rootCmd.Flags().StringSliceVar(&config.ForwardAllowedHosts, "smtp-forward-allowed-hosts", config.ForwardAllowedHosts, "Additional SMTP servers (host:port) messages may be forwarded to via the API (comma-separated)")
 
 	// POP3 server
 	rootCmd.Flags().StringVar(&config.POP3Listen, "pop3", config.POP3Listen, "POP3 server bind interface and port")
@@ -126,13 +223,31 @@ func init() {
 	rootCmd.Flags().StringVar(&config.POP3TLSCert, "pop3-tls-cert", config.POP3TLSCert, "Optional TLS certificate for POP3 server - requires pop3-tls-key")
 	rootCmd.Flags().StringVar(&config.POP3TLSKey, "pop3-tls-key", config.POP3TLSKey, "Optional TLS key for POP3 server - requires pop3-tls-cert")
 
+	// IMAP server
+	rootCmd.Flags().StringVar(&config.IMAPListen, "imap-listen", config.IMAPListen, "Read-only IMAP server bind interface and port, eg: [::]:1143 (requires SMTP or UI credentials if set)")
+
+	// LMTP server
+	rootCmd.Flags().IntVar(&config.LMTPPort, "lmtp-port", config.LMTPPort, "LMTP server port, using the SMTP bind interface (enables LMTP server)")
+	rootCmd.Flags().StringVar(&config.LMTPSocket, "lmtp-socket", config.LMTPSocket, "LMTP server unix socket path, accessible to the Mailpit user & group (enables LMTP server)")
+
 	// Tagging
 	rootCmd.Flags().StringVarP(&config.SMTPCLITags, "tag", "t", config.SMTPCLITags, "Tag new messages matching filters")
+	rootCmd.Flags().StringVar(&config.RecipientTagCLIRules, "tag-recipient", config.RecipientTagCLIRules, "Tag new messages with recipients matching glob patterns")
+	rootCmd.Flags().StringVar(&config.TagHTMLOnly, "tag-html-only", config.TagHTMLOnly, "Tag new messages containing only HTML content")
+	rootCmd.Flags().StringVar(&config.TagTextOnly, "tag-text-only", config.TagTextOnly, "Tag new messages containing only text content")
 	rootCmd.Flags().BoolVar(&tools.TagsTitleCase, "tags-title-case", tools.TagsTitleCase, "Convert new tags automatically to TitleCase")
+	rootCmd.Flags().BoolVar(&config.TagsCaseSensitive, "tags-case-sensitive", config.TagsCaseSensitive, "Treat tags differing only in case as distinct tags")
+	rootCmd.Flags().IntVar(&config.MaxTagNameLength, "max-tag-length", config.MaxTagNameLength, "Maximum tag name length, longer tags are truncated (0 to disable)")
+	rootCmd.Flags().IntVar(&config.MaxTagCount, "max-tag-count", config.MaxTagCount, "Maximum number of distinct tags (0 to disable)")
 
 	// Webhook
 	rootCmd.Flags().StringVar(&config.WebhookURL, "webhook-url", config.WebhookURL, "Send a webhook request for new messages")
 	rootCmd.Flags().IntVar(&webhook.RateLimit, "webhook-limit", webhook.RateLimit, "Limit webhook requests per second")
+	rootCmd.Flags().Float64Var(&config.WebhookRateLimit, "webhook-rate-limit", config.WebhookRateLimit, "Max webhook deliveries per second, queuing excess deliveries (default disabled)")
+	rootCmd.Flags().IntVar(&config.WebhookQueueSize, "webhook-queue-size", config.WebhookQueueSize, "Max number of queued webhook deliveries when rate limited, or awaiting a retry")
+	rootCmd.Flags().DurationVar(&config.WebhookFailureLogRetention, "webhook-failure-log-retention", config.WebhookFailureLogRetention, "Keep failed webhook deliveries for this duration (0 = indefinitely)")
+	rootCmd.Flags().StringVar(&config.WebhookTemplate, "webhook-template", config.WebhookTemplate, "Go text/template file to render the webhook request body from the message summary")
+	rootCmd.Flags().StringArrayVar(&config.WebhookConditionArgs, "webhook-condition", config.WebhookConditionArgs, "Only send webhooks for messages matching a condition as JSONPath=value, eg: $.From.Address=user@example.com (repeatable)")
 
 	// DEPRECATED FLAGS 2023/03/12
 	rootCmd.Flags().StringVar(&config.UITLSCert, "ui-ssl-cert", config.UITLSCert, "SSL certificate for web UI - requires ui-ssl-key")
@@ -152,6 +267,22 @@ func init() {
 	rootCmd.Flags().BoolVar(&config.SMTPRequireSTARTTLS, "smtp-tls-required", config.SMTPRequireSTARTTLS, "smtp-require-starttls")
 	rootCmd.Flags().Lookup("smtp-tls-required").Hidden = true
 	rootCmd.Flags().Lookup("smtp-tls-required").Deprecated = "use --smtp-require-starttls"
+
+	rootCmd.Flags().SetNormalizeFunc(flagAliases)
+}
+
+// FlagAliases maps alternative flag names to their flags
+func flagAliases(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+	switch name {
+	case "pre-store-hook-cmd":
+		name = "storage-hook"
+	case "pre-store-hook-url":
+		name = "storage-hook-url"
+	case "hook-timeout":
+		name = "storage-hook-timeout"
+	}
+
+	return pflag.NormalizedName(name)
 }
 
 // Load settings from environment
@@ -161,21 +292,101 @@ func initConfigFromEnv() {
 	if len(os.Getenv("MP_MAX_MESSAGES")) > 0 {
 		config.MaxMessages, _ = strconv.Atoi(os.Getenv("MP_MAX_MESSAGES"))
 	}
+	if len(os.Getenv("MP_HARD_MAX_MESSAGES")) > 0 {
+		config.HardMaxMessages, _ = strconv.Atoi(os.Getenv("MP_HARD_MAX_MESSAGES"))
+	}
 	if getEnabledFromEnv("MP_USE_MESSAGE_DATES") {
 		config.UseMessageDates = true
 	}
 	if getEnabledFromEnv("MP_IGNORE_DUPLICATE_IDS") {
 		config.IgnoreDuplicateIDs = true
 	}
+	if len(os.Getenv("MP_DUPLICATE_ACTION")) > 0 {
+		config.DuplicateAction = os.Getenv("MP_DUPLICATE_ACTION")
+	}
+	if len(os.Getenv("MP_INDEXED_HEADERS")) > 0 {
+		config.IndexedHeaders = strings.Split(os.Getenv("MP_INDEXED_HEADERS"), ",")
+	}
+	if len(os.Getenv("MP_PREFERRED_CONTENT_TYPES")) > 0 {
+		config.PreferredContentTypes = strings.Split(os.Getenv("MP_PREFERRED_CONTENT_TYPES"), ",")
+	}
+	if len(os.Getenv("MP_BLOCK_ATTACHMENT_TYPES")) > 0 {
+		config.BlockedAttachmentTypes = strings.Split(os.Getenv("MP_BLOCK_ATTACHMENT_TYPES"), ",")
+	}
+	if len(os.Getenv("MP_STORAGE_HOOKS")) > 0 {
+		// one command per line
+		config.StorageHookCommands = strings.Split(os.Getenv("MP_STORAGE_HOOKS"), "\n")
+	}
+	if len(os.Getenv("MP_STORAGE_HOOK_URLS")) > 0 {
+		// one URL per line
+		config.StorageHookURLs = strings.Split(os.Getenv("MP_STORAGE_HOOK_URLS"), "\n")
+	}
+	if len(os.Getenv("MP_STORAGE_HOOK_TIMEOUT")) > 0 {
+		config.StorageHookTimeout, _ = time.ParseDuration(os.Getenv("MP_STORAGE_HOOK_TIMEOUT"))
+	}
+	if len(os.Getenv("MP_TAG_RETENTION")) > 0 {
+		config.TagRetentionFile = os.Getenv("MP_TAG_RETENTION")
+	}
+	if len(os.Getenv("MP_VALIDATION_RULES")) > 0 {
+		config.ValidationRulesFile = os.Getenv("MP_VALIDATION_RULES")
+	}
 	if len(os.Getenv("MP_LOG_FILE")) > 0 {
 		logger.LogFile = os.Getenv("MP_LOG_FILE")
 	}
+	if getEnabledFromEnv("MP_SYSLOG") {
+		logger.SyslogEnabled = true
+	}
+	if len(os.Getenv("MP_SYSLOG_FACILITY")) > 0 {
+		logger.SyslogFacility = os.Getenv("MP_SYSLOG_FACILITY")
+	}
+	if len(os.Getenv("MP_SYSLOG_TAG")) > 0 {
+		logger.SyslogTag = os.Getenv("MP_SYSLOG_TAG")
+	}
 	if getEnabledFromEnv("MP_QUIET") {
 		logger.QuietLogging = true
 	}
 	if getEnabledFromEnv("MP_VERBOSE") {
 		logger.VerboseLogging = true
 	}
+	if len(os.Getenv("MP_DB_BUSY_RETRIES")) > 0 {
+		config.DBBusyRetries, _ = strconv.Atoi(os.Getenv("MP_DB_BUSY_RETRIES"))
+	}
+	if len(os.Getenv("MP_DECOMPRESSION_WORKERS")) > 0 {
+		config.DecompressionWorkers, _ = strconv.Atoi(os.Getenv("MP_DECOMPRESSION_WORKERS"))
+	}
+	if len(os.Getenv("MP_MESSAGE_CACHE_SIZE")) > 0 {
+		config.MessageCacheSize, _ = strconv.Atoi(os.Getenv("MP_MESSAGE_CACHE_SIZE"))
+	}
+	if len(os.Getenv("MP_DB_IDLE_TIMEOUT")) > 0 {
+		config.DBIdleTimeout, _ = time.ParseDuration(os.Getenv("MP_DB_IDLE_TIMEOUT"))
+	}
+	if len(os.Getenv("MP_DB_ON_CORRUPTION")) > 0 {
+		config.DBOnCorruption = os.Getenv("MP_DB_ON_CORRUPTION")
+	}
+	if len(os.Getenv("MP_DB_VACUUM_INTERVAL")) > 0 {
+		config.DBVacuumInterval, _ = time.ParseDuration(os.Getenv("MP_DB_VACUUM_INTERVAL"))
+	}
+	if len(os.Getenv("MP_MIGRATION_TIMEOUT")) > 0 {
+		config.MigrationTimeout, _ = time.ParseDuration(os.Getenv("MP_MIGRATION_TIMEOUT"))
+	}
+	if len(os.Getenv("MP_DELETED_MESSAGES_LOG")) > 0 {
+		config.DeletedMessagesLogRetention, _ = time.ParseDuration(os.Getenv("MP_DELETED_MESSAGES_LOG"))
+	}
+	if getEnabledFromEnv("MP_WATCH_CONFIG_FILES") {
+		config.WatchConfigFiles = true
+	}
+	if getEnabledFromEnv("MP_SELF_TEST") {
+		config.SelfTest = true
+	}
+	if getEnabledFromEnv("MP_SELF_TEST_EXIT") {
+		config.SelfTestExit = true
+	}
+	if len(os.Getenv("MP_SELF_TEST_RECIPIENT")) > 0 {
+		config.SelfTestRecipient = os.Getenv("MP_SELF_TEST_RECIPIENT")
+	}
+	if len(os.Getenv("MP_SENTRY_DSN")) > 0 {
+		config.SentryDSN = os.Getenv("MP_SENTRY_DSN")
+	}
 
 	// Web UI & API
 	if len(os.Getenv("MP_UI_BIND_ADDR")) > 0 {
@@ -188,28 +399,85 @@ func initConfigFromEnv() {
 	if err := auth.SetUIAuth(os.Getenv("MP_UI_AUTH")); err != nil {
 		logger.Log().Errorf(err.Error())
 	}
+	if len(os.Getenv("MP_API_TOKEN_FILE")) > 0 {
+		config.APITokenFile = os.Getenv("MP_API_TOKEN_FILE")
+	}
+	config.APIKey = os.Getenv("MP_API_KEY")
+	if len(os.Getenv("MP_ADMIN_IP_RANGES")) > 0 {
+		config.AdminIPRanges = strings.Split(os.Getenv("MP_ADMIN_IP_RANGES"), ",")
+	}
+	if getEnabledFromEnv("MP_PREVENT_DELETE_ALL") {
+		config.PreventDeleteAll = true
+	}
+	if len(os.Getenv("MP_DELETE_ALL_TOKEN")) > 0 {
+		config.DeleteAllConfirmToken = os.Getenv("MP_DELETE_ALL_TOKEN")
+	}
 	config.UITLSCert = os.Getenv("MP_UI_TLS_CERT")
 	config.UITLSKey = os.Getenv("MP_UI_TLS_KEY")
+	if len(os.Getenv("MP_UI_TLS_SNI")) > 0 {
+		// one certificate per line
+		config.HTTPTLSCertificateArgs = strings.Split(os.Getenv("MP_UI_TLS_SNI"), "\n")
+	}
+	if len(os.Getenv("MP_API_DEFAULT_PAGE_SIZE")) > 0 {
+		config.APIDefaultPageSize, _ = strconv.Atoi(os.Getenv("MP_API_DEFAULT_PAGE_SIZE"))
+	}
+	if len(os.Getenv("MP_API_MAX_PAGE_SIZE")) > 0 {
+		config.APIMaxPageSize, _ = strconv.Atoi(os.Getenv("MP_API_MAX_PAGE_SIZE"))
+	}
+	if len(os.Getenv("MP_SECURITY_HEADERS")) > 0 {
+		config.SecurityHeaders = map[string]string{}
+		for _, h := range strings.Split(os.Getenv("MP_SECURITY_HEADERS"), ",") {
+			k, v, _ := strings.Cut(h, "=")
+			config.SecurityHeaders[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
 	if len(os.Getenv("MP_API_CORS")) > 0 {
 		server.AccessControlAllowOrigin = os.Getenv("MP_API_CORS")
 	}
+	if getEnabledFromEnv("MP_ENABLE_METRICS") {
+		config.EnableMetrics = true
+	}
 	if getEnabledFromEnv("MP_DISABLE_HTML_CHECK") {
 		config.DisableHTMLCheck = true
 	}
+	if len(os.Getenv("MP_LINK_CHECK_TIMEOUT")) > 0 {
+		config.LinkCheckTimeout, _ = time.ParseDuration(os.Getenv("MP_LINK_CHECK_TIMEOUT"))
+	}
+	if len(os.Getenv("MP_LINK_CHECK_CACHE_TTL")) > 0 {
+		config.LinkCheckCacheTTL, _ = time.ParseDuration(os.Getenv("MP_LINK_CHECK_CACHE_TTL"))
+	}
 	if getEnabledFromEnv("MP_BLOCK_REMOTE_CSS_AND_FONTS") {
 		config.BlockRemoteCSSAndFonts = true
 	}
+	if len(os.Getenv("MP_CSP_POLICY")) > 0 {
+		config.CSPPolicy = os.Getenv("MP_CSP_POLICY")
+	}
+	if len(os.Getenv("MP_CSP_REPORT_URI")) > 0 {
+		config.CSPReportURI = os.Getenv("MP_CSP_REPORT_URI")
+	}
 	if len(os.Getenv("MP_ENABLE_SPAMASSASSIN")) > 0 {
 		config.EnableSpamAssassin = os.Getenv("MP_ENABLE_SPAMASSASSIN")
 	}
 	if getEnabledFromEnv("MP_ALLOW_UNTRUSTED_TLS") {
 		config.AllowUntrustedTLS = true
 	}
+	if len(os.Getenv("MP_WEBSOCKET_PING_INTERVAL")) > 0 {
+		config.WebSocketPingInterval, _ = time.ParseDuration(os.Getenv("MP_WEBSOCKET_PING_INTERVAL"))
+	}
+	if len(os.Getenv("MP_WEBSOCKET_PONG_TIMEOUT")) > 0 {
+		config.WebSocketPongTimeout, _ = time.ParseDuration(os.Getenv("MP_WEBSOCKET_PONG_TIMEOUT"))
+	}
 
 	// SMTP server
 	if len(os.Getenv("MP_SMTP_BIND_ADDR")) > 0 {
 		config.SMTPListen = os.Getenv("MP_SMTP_BIND_ADDR")
 	}
+	if len(os.Getenv("MP_SMTP_LISTEN_ADDRS")) > 0 {
+		config.SMTPListenAddrs = strings.Split(os.Getenv("MP_SMTP_LISTEN_ADDRS"), ",")
+	}
+	if len(os.Getenv("MP_SMTP_HOSTNAME")) > 0 {
+		config.SMTPHostname = os.Getenv("MP_SMTP_HOSTNAME")
+	}
 	config.SMTPAuthFile = os.Getenv("MP_SMTP_AUTH_FILE")
 	if err := auth.SetSMTPAuth(os.Getenv("MP_SMTP_AUTH")); err != nil {
 		logger.Log().Errorf(err.Error())
@@ -219,34 +487,124 @@ func initConfigFromEnv() {
 	}
 	config.SMTPTLSCert = os.Getenv("MP_SMTP_TLS_CERT")
 	config.SMTPTLSKey = os.Getenv("MP_SMTP_TLS_KEY")
+	if getEnabledFromEnv("MP_SMTP_TLS_AUTO") {
+		config.SMTPTLSAuto = true
+	}
 	if getEnabledFromEnv("MP_SMTP_REQUIRE_STARTTLS") {
 		config.SMTPRequireSTARTTLS = true
 	}
 	if getEnabledFromEnv("MP_SMTP_REQUIRE_TLS") {
 		config.SMTPRequireTLS = true
 	}
+	if getEnabledFromEnv("MP_SMTP_AUTODETECT_TLS") {
+		config.SMTPAutoDetectTLS = true
+	}
 
 	if getEnabledFromEnv("MP_SMTP_AUTH_ALLOW_INSECURE") {
 		config.SMTPAuthAllowInsecure = true
 	}
+	if len(os.Getenv("MP_SMTP_AUTH_METHODS")) > 0 {
+		config.SMTPAuthMethods = strings.Split(os.Getenv("MP_SMTP_AUTH_METHODS"), ",")
+	}
+	if getEnabledFromEnv("MP_SMTP_DEV_VERBOSE") {
+		config.SMTPDevVerbose = true
+	}
 	if getEnabledFromEnv("MP_SMTP_STRICT_RFC_HEADERS") {
 		config.SMTPStrictRFCHeaders = true
 	}
 	if len(os.Getenv("MP_SMTP_MAX_RECIPIENTS")) > 0 {
 		config.SMTPMaxRecipients, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_RECIPIENTS"))
 	}
+	if len(os.Getenv("MP_SMTP_MAX_MESSAGE_SIZE")) > 0 {
+		config.SMTPMaxMessageSize, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_MESSAGE_SIZE"))
+	}
+	if len(os.Getenv("MP_RESUBMIT_MAX_SIZE")) > 0 {
+		config.ResubmitMaxSize, _ = strconv.Atoi(os.Getenv("MP_RESUBMIT_MAX_SIZE"))
+	}
+	if len(os.Getenv("MP_SMTP_BANNER")) > 0 {
+		config.SMTPBanner = os.Getenv("MP_SMTP_BANNER")
+	}
 	if len(os.Getenv("MP_SMTP_ALLOWED_RECIPIENTS")) > 0 {
 		config.SMTPAllowedRecipients = os.Getenv("MP_SMTP_ALLOWED_RECIPIENTS")
 	}
 	if getEnabledFromEnv("MP_SMTP_DISABLE_RDNS") {
 		smtpd.DisableReverseDNS = true
 	}
+	if getEnabledFromEnv("MP_SMTP_DSN") {
+		config.SMTPDSNEnabled = true
+	}
+	if len(os.Getenv("MP_SMTP_8BITMIME")) > 0 {
+		config.SMTP8BitMIME = getEnabledFromEnv("MP_SMTP_8BITMIME")
+	}
+	if len(os.Getenv("MP_SMTP_BDAT")) > 0 {
+		config.SMTPBDATEnabled = getEnabledFromEnv("MP_SMTP_BDAT")
+	}
+	if len(os.Getenv("MP_SMTP_TRANSACTION_LOG")) > 0 {
+		config.SMTPTransactionLogRetention, _ = time.ParseDuration(os.Getenv("MP_SMTP_TRANSACTION_LOG"))
+	}
+	if getEnabledFromEnv("MP_SMTP_CONNECTION_LOG") {
+		config.SMTPConnectionLogEnabled = true
+	}
+	if len(os.Getenv("MP_SMTP_CONNECTION_LOG_RETENTION")) > 0 {
+		config.SMTPConnectionLogRetention, _ = time.ParseDuration(os.Getenv("MP_SMTP_CONNECTION_LOG_RETENTION"))
+	}
+	if getEnabledFromEnv("MP_SMTP_TRACE_LOG") {
+		config.SMTPTraceLog = true
+	}
+	if getEnabledFromEnv("MP_SMTP_SESSION_HEADER") {
+		config.InjectSessionHeader = true
+	}
+	if len(os.Getenv("MP_SMTP_SESSION_LOG")) > 0 {
+		config.SMTPSessionLogFile = os.Getenv("MP_SMTP_SESSION_LOG")
+	}
+	if len(os.Getenv("MP_OTLP_ENDPOINT")) > 0 {
+		config.OTLPEndpoint = os.Getenv("MP_OTLP_ENDPOINT")
+	}
+	if len(os.Getenv("MP_SMTP_TARPIT_DELAY")) > 0 {
+		config.SMTPTarpitDelay, _ = time.ParseDuration(os.Getenv("MP_SMTP_TARPIT_DELAY"))
+	}
+	if len(os.Getenv("MP_SMTP_TARPIT_THRESHOLD")) > 0 {
+		config.SMTPTarpitThreshold, _ = strconv.Atoi(os.Getenv("MP_SMTP_TARPIT_THRESHOLD"))
+	}
+	if getEnabledFromEnv("MP_SMTP_RATE_LIMIT_REJECT") {
+		config.SMTPRateLimitReject = true
+	}
+	if len(os.Getenv("MP_SMTP_RATE_LIMIT_CODE")) > 0 {
+		config.SMTPRateLimitResponseCode, _ = strconv.Atoi(os.Getenv("MP_SMTP_RATE_LIMIT_CODE"))
+	}
+	if len(os.Getenv("MP_SMTP_RATE_LIMIT_MESSAGE")) > 0 {
+		config.SMTPRateLimitMessage = os.Getenv("MP_SMTP_RATE_LIMIT_MESSAGE")
+	}
+	if len(os.Getenv("MP_SMTP_MAX_MESSAGES_PER_MINUTE")) > 0 {
+		config.SMTPMaxMessagesPerMinute, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_MESSAGES_PER_MINUTE"))
+	}
+	if len(os.Getenv("MP_SMTP_MAX_RECIPIENTS_PER_SECOND")) > 0 {
+		config.SMTPMaxRecipientsPerSecond, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_RECIPIENTS_PER_SECOND"))
+	}
+	if len(os.Getenv("MP_SMTP_MAX_PER_IP_PER_MINUTE")) > 0 {
+		config.SMTPMaxPerIPPerMinute, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_PER_IP_PER_MINUTE"))
+	}
+	if getEnabledFromEnv("MP_SMTP_XCLIENT") {
+		config.SMTPXCLIENTEnabled = true
+	}
+	if len(os.Getenv("MP_SMTP_XCLIENT_TRUSTED")) > 0 {
+		config.SMTPXCLIENTTrustedIPs = strings.Split(os.Getenv("MP_SMTP_XCLIENT_TRUSTED"), ",")
+	}
 
 	// SMTP relay
 	config.SMTPRelayConfigFile = os.Getenv("MP_SMTP_RELAY_CONFIG")
 	if getEnabledFromEnv("MP_SMTP_RELAY_ALL") {
 		config.SMTPRelayAllIncoming = true
 	}
+	if len(os.Getenv("MP_SMTP_RELAY_STRATEGY")) > 0 {
+		config.SMTPRelayStrategy = os.Getenv("MP_SMTP_RELAY_STRATEGY")
+	}
+	if getEnabledFromEnv("MP_SMTP_FORWARD_ASYNC") {
+		config.ForwardAsync = true
+	}
+	if len(os.Getenv("MP_SMTP_FORWARD_ALLOWED_HOSTS")) > 0 {
+		config.ForwardAllowedHosts = strings.Split(os.Getenv("MP_SMTP_FORWARD_ALLOWED_HOSTS"), ",")
+	}
 	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
 	config.SMTPRelayConfig.Host = os.Getenv("MP_SMTP_RELAY_HOST")
 	if len(os.Getenv("MP_SMTP_RELAY_PORT")) > 0 {
@@ -272,13 +630,44 @@ func initConfigFromEnv() {
 	config.POP3TLSCert = os.Getenv("MP_POP3_TLS_CERT")
 	config.POP3TLSKey = os.Getenv("MP_POP3_TLS_KEY")
 
+	// IMAP server
+	if len(os.Getenv("MP_IMAP_BIND_ADDR")) > 0 {
+		config.IMAPListen = os.Getenv("MP_IMAP_BIND_ADDR")
+	}
+
+	// LMTP server
+	if len(os.Getenv("MP_LMTP_PORT")) > 0 {
+		config.LMTPPort, _ = strconv.Atoi(os.Getenv("MP_LMTP_PORT"))
+	}
+	if len(os.Getenv("MP_LMTP_SOCKET")) > 0 {
+		config.LMTPSocket = os.Getenv("MP_LMTP_SOCKET")
+	}
+
 	// Tagging
 	if len(os.Getenv("MP_TAG")) > 0 {
 		config.SMTPCLITags = os.Getenv("MP_TAG")
 	}
+	if len(os.Getenv("MP_TAG_HTML_ONLY")) > 0 {
+		config.TagHTMLOnly = os.Getenv("MP_TAG_HTML_ONLY")
+	}
+	if len(os.Getenv("MP_TAG_TEXT_ONLY")) > 0 {
+		config.TagTextOnly = os.Getenv("MP_TAG_TEXT_ONLY")
+	}
+	if len(os.Getenv("MP_TAG_RECIPIENT")) > 0 {
+		config.RecipientTagCLIRules = os.Getenv("MP_TAG_RECIPIENT")
+	}
 	if getEnabledFromEnv("MP_TAGS_TITLE_CASE") {
 		tools.TagsTitleCase = getEnabledFromEnv("MP_TAGS_TITLE_CASE")
 	}
+	if getEnabledFromEnv("MP_TAGS_CASE_SENSITIVE") {
+		config.TagsCaseSensitive = true
+	}
+	if len(os.Getenv("MP_MAX_TAG_LENGTH")) > 0 {
+		config.MaxTagNameLength, _ = strconv.Atoi(os.Getenv("MP_MAX_TAG_LENGTH"))
+	}
+	if len(os.Getenv("MP_MAX_TAG_COUNT")) > 0 {
+		config.MaxTagCount, _ = strconv.Atoi(os.Getenv("MP_MAX_TAG_COUNT"))
+	}
 
 	// Webhook
 	if len(os.Getenv("MP_WEBHOOK_URL")) > 0 {
@@ -287,6 +676,22 @@ func initConfigFromEnv() {
 	if len(os.Getenv("MP_WEBHOOK_LIMIT")) > 0 {
 		webhook.RateLimit, _ = strconv.Atoi(os.Getenv("MP_WEBHOOK_LIMIT"))
 	}
+	if len(os.Getenv("MP_WEBHOOK_RATE_LIMIT")) > 0 {
+		config.WebhookRateLimit, _ = strconv.ParseFloat(os.Getenv("MP_WEBHOOK_RATE_LIMIT"), 64)
+	}
+	if len(os.Getenv("MP_WEBHOOK_QUEUE_SIZE")) > 0 {
+		config.WebhookQueueSize, _ = strconv.Atoi(os.Getenv("MP_WEBHOOK_QUEUE_SIZE"))
+	}
+	if len(os.Getenv("MP_WEBHOOK_FAILURE_LOG_RETENTION")) > 0 {
+		config.WebhookFailureLogRetention, _ = time.ParseDuration(os.Getenv("MP_WEBHOOK_FAILURE_LOG_RETENTION"))
+	}
+	if len(os.Getenv("MP_WEBHOOK_TEMPLATE")) > 0 {
+		config.WebhookTemplate = os.Getenv("MP_WEBHOOK_TEMPLATE")
+	}
+	if len(os.Getenv("MP_WEBHOOK_CONDITIONS")) > 0 {
+		// one condition per line
+		config.WebhookConditionArgs = strings.Split(os.Getenv("MP_WEBHOOK_CONDITIONS"), "\n")
+	}
 }
 
 // load deprecated settings from environment and warn
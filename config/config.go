@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/PaesslerAG/jsonpath"
 	"github.com/axllent/mailpit/internal/auth"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/spamassassin"
@@ -23,6 +27,13 @@ var (
 	// SMTPListen to listen on <interface>:<port>
 	SMTPListen = "[::]:1025"
 
+	// SMTPListenAddrs are multiple <interface>:<port> addresses to listen on, eg: IPv4 & IPv6 separately.
+	// Overrides SMTPListen if set.
+	SMTPListenAddrs []string
+
+	// SMTPHostname is the hostname used in the SMTP greeting & EHLO responses (default os.Hostname())
+	SMTPHostname string
+
 	// HTTPListen to listen on <interface>:<port>
 	HTTPListen = "[::]:8025"
 
@@ -32,27 +43,114 @@ var (
 	// MaxMessages is the maximum number of messages a mailbox can have (auto-pruned every minute)
 	MaxMessages = 500
 
+	// HardMaxMessages is the maximum number of messages a mailbox can have, pruned immediately
+	// when a new message is stored (0 = unlimited)
+	HardMaxMessages = 0
+
 	// UseMessageDates sets the Created date using the message date, not the delivered date
 	UseMessageDates bool
 
+	// DBBusyRetries is the number of times database writes are retried if the database is busy (SQLITE_BUSY)
+	DBBusyRetries = 3
+
+	// DecompressionWorkers is the number of messages decompressed concurrently in batch operations
+	DecompressionWorkers = 4
+
+	// MessageCacheSize is the number of decompressed raw messages kept in memory (0 = disabled)
+	MessageCacheSize = 0
+
+	// DBVacuumInterval is the interval to vacuum the database (when idle) to reclaim space (0 to disable)
+	DBVacuumInterval = 24 * time.Hour
+
+	// DBIdleTimeout closes the database file after a period without database activity,
+	// reopening it when next required (0 to disable)
+	DBIdleTimeout time.Duration
+
+	// DBOnCorruption is the action when the database is corrupted on startup: fail (default),
+	// or truncate (delete & recreate the database)
+	DBOnCorruption = "fail"
+
+	// MigrationTimeout is the maximum time allowed for background data migrations on startup (0 to disable)
+	MigrationTimeout = 5 * time.Minute
+
+	// WatchConfigFiles will reload the UI, SMTP & POP3 password files when they are changed
+	WatchConfigFiles bool
+
+	// SelfTest will send a test message through the SMTP server on startup and verify it is stored
+	SelfTest bool
+
+	// SelfTestExit will exit the application if the startup self-test fails
+	SelfTestExit bool
+
+	// SelfTestRecipient is the recipient of the startup self-test message
+	SelfTestRecipient = "selftest@mailpit.local"
+
 	// UITLSCert file
 	UITLSCert string
 
 	// UITLSKey file
 	UITLSKey string
 
+	// HTTPTLSCertificateArgs are SNI certificates set via the CLI/env (domain,cert,key), used to populate HTTPTLSCertificates
+	HTTPTLSCertificateArgs []string
+
+	// HTTPTLSCertificates are additional web UI TLS certificates, selected by the requested (SNI) domain
+	HTTPTLSCertificates []TLSCertConfig
+
 	// UIAuthFile for UI & API authentication
 	UIAuthFile string
 
+	// APITokenFile is a yaml file mapping API bearer tokens to their scope (read, write or admin)
+	APITokenFile string
+
+	// APIKey if set is required (via the X-API-Key header or api_key query parameter)
+	// for all REST API requests made outside of the web UI
+	APIKey string
+
+	// AdminIPRanges if set restricts admin API requests (deleting messages & search history)
+	// to clients within these IP ranges (CIDR notation or single IP addresses)
+	AdminIPRanges []string
+
+	// PreventDeleteAll requires DeleteAllConfirmToken to be provided via an X-Confirm-Delete
+	// header in order to delete all messages via the API
+	PreventDeleteAll bool
+
+	// DeleteAllConfirmToken is the token required to delete all messages when PreventDeleteAll is set
+	DeleteAllConfirmToken string
+
+	// SecurityHeaders are custom headers added to all HTTP responses, overriding the defaults.
+	// A header with an empty value removes the default.
+	SecurityHeaders map[string]string
+
+	// APIDefaultPageSize is the number of results returned by paginated API requests when no limit is set
+	APIDefaultPageSize = 50
+
+	// APIMaxPageSize is the maximum limit allowed for paginated API requests
+	APIMaxPageSize = 1000
+
 	// Webroot to define the base path for the UI and API
 	Webroot = "/"
 
+	// EnableMetrics exposes Prometheus metrics via <webroot>metrics
+	EnableMetrics bool
+
+	// WebSocketPingInterval is the interval at which websocket clients are sent a ping
+	WebSocketPingInterval = 30 * time.Second
+
+	// WebSocketPongTimeout is the time allowed for a websocket client to respond to a ping
+	// before the connection is considered stale and removed
+	WebSocketPongTimeout = 60 * time.Second
+
 	// SMTPTLSCert file
 	SMTPTLSCert string
 
 	// SMTPTLSKey file
 	SMTPTLSKey string
 
+	// SMTPTLSAuto generates a self-signed SMTP TLS certificate & key in the data directory
+	// (reused on subsequent starts) if no certificate is provided
+	SMTPTLSAuto bool
+
 	// SMTPRequireSTARTTLS to enforce the use of STARTTLS
 	// The only allowed commands are NOOP, EHLO, STARTTLS and QUIT (as specified in RFC 3207) until
 	// the connection is upgraded to TLS i.e. until STARTTLS is issued.
@@ -62,6 +160,10 @@ var (
 	//
 	SMTPRequireTLS bool
 
+	// SMTPAutoDetectTLS accepts both SSL/TLS and unencrypted (with optional STARTTLS) connections
+	// on the same port, detected by the first byte sent by the client
+	SMTPAutoDetectTLS bool
+
 	// SMTPAuthFile for SMTP authentication
 	SMTPAuthFile string
 
@@ -71,14 +173,145 @@ var (
 	// SMTPAuthAcceptAny accepts any username/password including none
 	SMTPAuthAcceptAny bool
 
+	// SMTPAuthMethods restricts the SMTP authentication methods advertised to clients (PLAIN, LOGIN).
+	// All supported methods are advertised if empty.
+	SMTPAuthMethods []string
+
+	// SMTPTransactionLogRetention is how long SMTP transactions are logged for (0 disables the log)
+	SMTPTransactionLogRetention time.Duration
+
+	// SMTPConnectionLogEnabled logs all inbound SMTP connections (remote address, EHLO hostname, duration & messages delivered)
+	SMTPConnectionLogEnabled bool
+
+	// SMTPConnectionLogRetention is how long logged SMTP connections are kept for (0 = indefinitely)
+	SMTPConnectionLogRetention = 24 * time.Hour
+
+	// SMTPTraceLog logs every SMTP command & response with structured fields (session_id, cmd, arg, response, latency_ms)
+	SMTPTraceLog bool
+
+	// InjectSessionHeader adds an X-Mailpit-Session header to each message received via SMTP,
+	// containing the session ID (shared by all messages delivered in the same session)
+	InjectSessionHeader bool
+
+	// SMTPSessionLogFile is an optional file to log SMTP session entries to (connections, EHLO hostnames & stored messages),
+	// separate from the main log output
+	SMTPSessionLogFile string
+
+	// OTLPEndpoint is an optional OpenTelemetry (OTLP/HTTP) endpoint to export SMTP traces to,
+	// eg: http://localhost:4318
+	OTLPEndpoint string
+
+	// SMTPTarpitDelay is the delay before the SMTP greeting is sent to clients exceeding
+	// SMTPTarpitThreshold connections per minute (0 disables tarpitting)
+	SMTPTarpitDelay time.Duration
+
+	// SMTPTarpitThreshold is the number of connections per minute a client may make before being tarpitted
+	SMTPTarpitThreshold = 10
+
+	// SMTPRateLimitReject will reject new messages from clients exceeding SMTPTarpitThreshold
+	// connections per minute using SMTPRateLimitResponseCode & SMTPRateLimitMessage
+	SMTPRateLimitReject bool
+
+	// SMTPRateLimitResponseCode is the SMTP response code for messages from rate-limited clients,
+	// and messages exceeding SMTPMaxMessagesPerMinute, SMTPMaxRecipientsPerSecond or SMTPMaxPerIPPerMinute
+	SMTPRateLimitResponseCode = 452
+
+	// SMTPRateLimitMessage is the SMTP response text for messages from rate-limited clients,
+	// and messages exceeding SMTPMaxMessagesPerMinute, SMTPMaxRecipientsPerSecond or SMTPMaxPerIPPerMinute
+	SMTPRateLimitMessage = "Too many messages, try again later"
+
+	// SMTPMaxMessagesPerMinute is the maximum number of messages accepted per minute from all clients (0 to disable)
+	SMTPMaxMessagesPerMinute int
+
+	// SMTPMaxRecipientsPerSecond is the maximum number of message recipients accepted per second from all clients (0 to disable)
+	SMTPMaxRecipientsPerSecond int
+
+	// SMTPMaxPerIPPerMinute is the maximum number of messages accepted per minute from each client IP address (0 to disable)
+	SMTPMaxPerIPPerMinute int
+
+	// DeletedMessagesLogRetention is how long deleted message IDs are logged for delta syncing (0 disables the log)
+	DeletedMessagesLogRetention = 24 * time.Hour
+
 	// SMTPMaxRecipients is the maximum number of recipients a message may have.
 	// The SMTP RFC states that an server must handle a minimum of 100 recipients
 	// however some servers accept more.
 	SMTPMaxRecipients = 100
 
+	// SMTPMaxMessageSize is the maximum SMTP message size in bytes, advertised via the
+	// SIZE extension (RFC 1870). Larger messages are rejected (default 0 = unlimited).
+	SMTPMaxMessageSize int
+
+	// SMTPBanner is an optional SMTP greeting text following the hostname
+	SMTPBanner string
+
+	// ResubmitMaxSize is the maximum size in bytes of messages which can be resubmitted (0 = unlimited)
+	ResubmitMaxSize = 10 * 1024 * 1024
+
+	// SMTPDSNEnabled enables the SMTP DSN (Delivery Status Notification) extension (RFC 3461)
+	SMTPDSNEnabled bool
+
+	// SMTP8BitMIME advertises the SMTP 8BITMIME extension (RFC 6152)
+	SMTP8BitMIME = true
+
+	// SMTPBDATEnabled advertises the SMTP CHUNKING extension, allowing messages to be sent with BDAT (RFC 3030)
+	SMTPBDATEnabled = true
+
+	// SMTPXCLIENTEnabled enables the SMTP XCLIENT extension for trusted proxies
+	SMTPXCLIENTEnabled bool
+
+	// SMTPXCLIENTTrustedIPs are the proxy IP addresses allowed to use XCLIENT
+	SMTPXCLIENTTrustedIPs []string
+
 	// IgnoreDuplicateIDs will skip messages with the same ID
 	IgnoreDuplicateIDs bool
 
+	// DuplicateAction is the action for new messages with an existing Message-ID: store (default),
+	// ignore (same as IgnoreDuplicateIDs), reject (return an error) or overwrite (replace the existing
+	// message, keeping its ID). Messages without a Message-ID are always stored.
+	DuplicateAction = "store"
+
+	// BlockedAttachmentTypes is a list of attachment MIME types (eg: application/x-msdownload)
+	// and/or file extensions (eg: .exe). Messages containing a matching attachment are rejected.
+	BlockedAttachmentTypes []string
+
+	// IndexedHeaders is a list of custom message headers (eg: X-Test-ID) stored with each message,
+	// allowing messages to be looked up by header value
+	IndexedHeaders []string
+
+	// PreferredContentTypes is the order of preference when displaying multipart/alternative messages.
+	// If text/plain is preferred over text/html, the HTML of messages with a plain text alternative is not returned.
+	PreferredContentTypes = []string{"text/html", "text/plain"}
+
+	// StorageHookCommands are shell commands set via the CLI/env, used to populate StorageHooks
+	StorageHookCommands []string
+
+	// StorageHookURLs are HTTP endpoints set via the CLI/env, used to populate StorageHooks
+	StorageHookURLs []string
+
+	// StorageHooks are applied sequentially to the raw message before it is parsed & stored
+	StorageHooks []StorageHook
+
+	// StorageHookTimeout is the maximum time a storage hook is allowed to run
+	StorageHookTimeout = 5 * time.Second
+
+	// ValidationRulesFile is a yaml file of content rules used to populate ValidationRules
+	ValidationRulesFile string
+
+	// ValidationRules are applied to the raw message before it is parsed & stored
+	ValidationRules []ValidationRule
+
+	// TagRetentionFile is a yaml file of per-tag retention rules used to populate TagRetentionRules
+	TagRetentionFile string
+
+	// TagRetentionRules are applied by the database cron, in addition to MaxMessages
+	TagRetentionRules []TagRetentionRule
+
+	// LinkCheckTimeout is the maximum time allowed for each link of the link checker
+	LinkCheckTimeout = 5 * time.Second
+
+	// LinkCheckCacheTTL is how long link check results are cached & reused for (0 = disabled)
+	LinkCheckCacheTTL = time.Hour
+
 	// DisableHTMLCheck used to disable the HTML check in bother the API and web UI
 	DisableHTMLCheck = false
 
@@ -88,18 +321,53 @@ var (
 	// SMTPCLITags is used to map the CLI args
 	SMTPCLITags string
 
+	// HeaderNameRegexp represents a valid message header name
+	headerNameRegexp = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
 	// ValidTagRegexp represents a valid tag
 	ValidTagRegexp = regexp.MustCompile(`^([a-zA-Z0-9\-\ \_\.]){1,}$`)
 
 	// SMTPTags are expressions to apply tags to new mail
 	SMTPTags []AutoTag
 
+	// TagHTMLOnly is an optional tag to apply to new messages containing only HTML content
+	TagHTMLOnly string
+
+	// TagTextOnly is an optional tag to apply to new messages containing only text content
+	TagTextOnly string
+
+	// TagsCaseSensitive treats tags differing only in case (eg: "Bug" & "bug") as distinct tags
+	TagsCaseSensitive bool
+
+	// MaxTagNameLength is the maximum length of a tag name, longer tags are truncated (0 to disable)
+	MaxTagNameLength = 64
+
+	// MaxTagCount is the maximum number of distinct tags, new tags are ignored once reached (0 to disable)
+	MaxTagCount = 1000
+
+	// RecipientTagCLIRules is used to map the CLI args
+	RecipientTagCLIRules string
+
+	// RecipientTagRules are glob patterns matching To/Cc addresses to apply tags to new mail
+	RecipientTagRules []RecipientTagRule
+
 	// SMTPRelayConfigFile to parse a yaml file and store config of relay SMTP server
 	SMTPRelayConfigFile string
 
 	// SMTPRelayConfig to parse a yaml file and store config of relay SMTP server
 	SMTPRelayConfig SMTPRelayConfigStruct
 
+	// SMTPRelayRules are per-domain relay servers (parsed from the relay config file "rules").
+	// New messages to a matching recipient domain are automatically relayed via a matching rule (see SMTPRelayStrategy).
+	SMTPRelayRules []RelayRule
+
+	// SMTPRelayStrategy is how a relay rule is selected when multiple rules match a recipient domain:
+	// first-match (default), round-robin or random
+	SMTPRelayStrategy = "first-match"
+
+	// SMTPDevVerbose will print a summary of every new message to the terminal
+	SMTPDevVerbose bool
+
 	// SMTPStrictRFCHeaders will return an error if the email headers contain <CR><CR><LF> (\r\r\n)
 	// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
 	SMTPStrictRFCHeaders bool
@@ -117,6 +385,17 @@ var (
 	// Use with extreme caution!
 	SMTPRelayAllIncoming = false
 
+	// ForwardRules automatically forward new messages matching a header value to one or more
+	// addresses via the pre-configured SMTP server (parsed from the relay config file "forward")
+	ForwardRules []ForwardRule
+
+	// ForwardAsync will forward messages in the background rather than before the SMTP response
+	ForwardAsync bool
+
+	// ForwardAllowedHosts are the SMTP servers (host:port) messages may be forwarded to via the API,
+	// in addition to the pre-configured SMTP relay server
+	ForwardAllowedHosts []string
+
 	// POP3Listen address - if set then Mailpit will start the POP3 server and listen on this address
 	POP3Listen = "[::]:1110"
 
@@ -129,15 +408,58 @@ var (
 	// POP3TLSKey TLS certificate key
 	POP3TLSKey string
 
+	// IMAPListen address - if set then Mailpit will start the read-only IMAP server and listen on this address
+	IMAPListen string
+
+	// LMTPPort if set will start the LMTP server on this port, using the SMTP bind interface
+	LMTPPort int
+
+	// LMTPSocket if set will start the LMTP server on this unix socket path (mode 0660)
+	LMTPSocket string
+
 	// EnableSpamAssassin must be either <host>:<port> or "postmark"
 	EnableSpamAssassin string
 
 	// WebhookURL for calling
 	WebhookURL string
 
+	// WebhookRateLimit is the maximum number of webhook deliveries per second across all webhooks.
+	// Deliveries exceeding the limit are queued rather than dropped (0 to disable).
+	WebhookRateLimit float64
+
+	// WebhookQueueSize is the maximum number of webhook deliveries queued when WebhookRateLimit is exceeded,
+	// and the maximum number of failed deliveries awaiting a retry
+	WebhookQueueSize = 100
+
+	// WebhookFailureLogRetention is how long failed webhook deliveries are kept for (0 = indefinitely)
+	WebhookFailureLogRetention = 7 * 24 * time.Hour
+
+	// WebhookTemplate is an optional Go text/template file used to render the webhook request body
+	// from the message summary, instead of sending the message summary JSON
+	WebhookTemplate string
+
+	// WebhookConditionArgs are webhook conditions set via the CLI/env (JSONPath=value), used to populate WebhookConditions
+	WebhookConditionArgs []string
+
+	// WebhookConditions must all match the message summary for the webhook to be sent
+	WebhookConditions []WebhookCondition
+
+	// CSPPolicy overrides the default Content-Security-Policy header of the web UI & API
+	CSPPolicy string
+
+	// CSPReportURI is an optional URI to which Content-Security-Policy violations are reported
+	CSPReportURI string
+
 	// ContentSecurityPolicy for HTTP server - set via VerifyConfig()
 	ContentSecurityPolicy string
 
+	// MessagePreviewCSP is the Content-Security-Policy for rendered message HTML,
+	// sandboxing the message content - set via VerifyConfig()
+	MessagePreviewCSP string
+
+	// SentryDSN is an optional Sentry DSN for error reporting
+	SentryDSN string
+
 	// AllowUntrustedTLS allows untrusted HTTPS connections link checking & screenshot generation
 	AllowUntrustedTLS bool
 
@@ -157,6 +479,19 @@ type AutoTag struct {
 	Match string
 }
 
+// RecipientTagRule struct for auto-tagging based on recipient addresses
+type RecipientTagRule struct {
+	Pattern string
+	Tag     string
+}
+
+// TLSCertConfig is a TLS certificate & key used for a domain (or wildcard domain, eg: *.example.com)
+type TLSCertConfig struct {
+	Domain   string
+	CertFile string
+	KeyFile  string
+}
+
 // SMTPRelayConfigStruct struct for parsing yaml & storing variables
 type SMTPRelayConfigStruct struct {
 	Host                    string         `yaml:"host"`
@@ -174,6 +509,53 @@ type SMTPRelayConfigStruct struct {
 	RecipientAllowlist string `yaml:"recipient-allowlist"`
 }
 
+// ForwardRule forwards new messages with a header containing MatchValue (case-insensitive)
+type ForwardRule struct {
+	MatchField string   `yaml:"match-field"` // header name, eg: To, From, Subject
+	MatchValue string   `yaml:"match-value"`
+	ForwardTo  []string `yaml:"forward-to"`
+}
+
+// StorageHook is either a shell command which receives the raw message on stdin and returns
+// the (optionally modified) message on stdout, or a URL which the raw message is POSTed to,
+// returning the (optionally modified) message as the response body
+type StorageHook struct {
+	Command string
+	URL     string
+}
+
+// ValidationRule is a regular expression matched against the raw message (or part of it)
+// before it is stored. Matching messages are either rejected or logged with a warning.
+type ValidationRule struct {
+	Name    string `yaml:"name"`
+	Field   string `yaml:"field"`   // "raw" (default), "body", or a header name, eg: Subject
+	Pattern string `yaml:"pattern"` // regular expression
+	Action  string `yaml:"action"`  // reject (default) or warn
+
+	Regexp *regexp.Regexp `yaml:"-"`
+}
+
+// TagRetentionRule auto-deletes messages with the tag which are older than MaxAgeDays,
+// or exceed the latest MaxMessages messages with that tag. A zero value disables the limit.
+type TagRetentionRule struct {
+	Tag         string `yaml:"tag"`
+	MaxMessages int    `yaml:"max-messages"`
+	MaxAgeDays  int    `yaml:"max-age-days"`
+}
+
+// WebhookCondition is a JSONPath expression evaluated against the message summary JSON.
+// The condition matches if the result (or any result for expressions returning multiple values) equals the value.
+type WebhookCondition struct {
+	JSONPath string // eg: $.From.Address
+	Value    string
+}
+
+// RelayRule is a relay server used for recipients of a specific domain
+type RelayRule struct {
+	RecipientDomain string                `yaml:"recipient-domain"` // eg: example.com
+	SMTPConfig      SMTPRelayConfigStruct `yaml:"smtp"`
+}
+
 // VerifyConfig wil do some basic checking
 func VerifyConfig() error {
 	cssFontRestriction := "*"
@@ -181,22 +563,124 @@ func VerifyConfig() error {
 		cssFontRestriction = "'self'"
 	}
 
-	ContentSecurityPolicy = fmt.Sprintf("default-src 'self'; script-src 'self'; style-src %s 'unsafe-inline'; frame-src 'self'; img-src * data: blob:; font-src %s data:; media-src 'self'; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self';",
+	if CSPPolicy != "" {
+		ContentSecurityPolicy = strings.TrimSpace(CSPPolicy)
+	} else {
+		ContentSecurityPolicy = fmt.Sprintf("default-src 'self'; script-src 'self'; style-src %s 'unsafe-inline'; frame-src 'self'; img-src * data: blob:; font-src %s data:; media-src 'self'; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self';",
+			cssFontRestriction, cssFontRestriction,
+		)
+	}
+
+	MessagePreviewCSP = fmt.Sprintf("sandbox allow-same-origin; default-src 'none'; style-src %s 'unsafe-inline'; img-src * data: blob:; font-src %s data:; media-src *;",
 		cssFontRestriction, cssFontRestriction,
 	)
 
+	if CSPReportURI != "" {
+		if !isValidURL(CSPReportURI) {
+			return fmt.Errorf("[ui] CSP report URI is not a valid URL: %s", CSPReportURI)
+		}
+
+		if !strings.HasSuffix(ContentSecurityPolicy, ";") {
+			ContentSecurityPolicy = ContentSecurityPolicy + ";"
+		}
+
+		ContentSecurityPolicy = fmt.Sprintf("%s report-uri %s;", ContentSecurityPolicy, CSPReportURI)
+		MessagePreviewCSP = fmt.Sprintf("%s report-uri %s;", MessagePreviewCSP, CSPReportURI)
+	}
+
+	if SentryDSN != "" && !isValidURL(SentryDSN) {
+		return fmt.Errorf("[sentry] invalid Sentry DSN: %s", SentryDSN)
+	}
+
 	if DataFile != "" && isDir(DataFile) {
 		DataFile = filepath.Join(DataFile, "mailpit.db")
 	}
 
 	re := regexp.MustCompile(`.*:\d+$`)
+	listenAddrs := []string{}
+	for _, a := range SMTPListenAddrs {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if !re.MatchString(a) {
+			return fmt.Errorf("[smtp] bind should be in the format of <ip>:<port>: %s", a)
+		}
+		listenAddrs = append(listenAddrs, a)
+	}
+	SMTPListenAddrs = listenAddrs
+	if len(SMTPListenAddrs) > 0 {
+		SMTPListen = SMTPListenAddrs[0]
+	}
+
 	if !re.MatchString(SMTPListen) {
 		return errors.New("[smtp] bind should be in the format of <ip>:<port>")
 	}
+	SMTPHostname = strings.TrimSpace(SMTPHostname)
+	if strings.ContainsAny(SMTPHostname, " \t") {
+		return fmt.Errorf("[smtp] invalid hostname: %s", SMTPHostname)
+	}
 	if !re.MatchString(HTTPListen) {
 		return errors.New("[ui] HTTP bind should be in the format of <ip>:<port>")
 	}
 
+	if SMTPTransactionLogRetention < 0 {
+		return errors.New("[smtp] transaction log retention cannot be negative")
+	}
+
+	if DeletedMessagesLogRetention < 0 {
+		return errors.New("[db] deleted messages log retention cannot be negative")
+	}
+
+	if SMTPConnectionLogRetention < 0 {
+		return errors.New("[smtp] connection log retention cannot be negative")
+	}
+
+	if WebhookFailureLogRetention < 0 {
+		return errors.New("[webhook] failure log retention cannot be negative")
+	}
+
+	if DBBusyRetries < 0 {
+		return errors.New("[db] busy retries cannot be negative")
+	}
+
+	if DecompressionWorkers < 1 {
+		return errors.New("[db] decompression workers must be greater than 0")
+	}
+
+	if MessageCacheSize < 0 {
+		return errors.New("[db] message cache size cannot be negative")
+	}
+
+	if HardMaxMessages < 0 {
+		return errors.New("[db] hard max messages cannot be negative")
+	}
+
+	if DBIdleTimeout < 0 {
+		return errors.New("[db] idle timeout cannot be negative")
+	}
+
+	DBOnCorruption = strings.ToLower(strings.TrimSpace(DBOnCorruption))
+	switch DBOnCorruption {
+	case "":
+		DBOnCorruption = "fail"
+	case "fail", "truncate":
+	default:
+		return fmt.Errorf("[db] invalid database corruption action: %s", DBOnCorruption)
+	}
+
+	if DBVacuumInterval < 0 {
+		return errors.New("[db] vacuum interval cannot be negative")
+	}
+
+	if MigrationTimeout < 0 {
+		return errors.New("migration timeout cannot be negative")
+	}
+
+	if WebSocketPingInterval <= 0 || WebSocketPingInterval >= WebSocketPongTimeout {
+		return errors.New("[ui] websocket ping interval must be greater than 0 and less than the pong timeout")
+	}
+
 	if UIAuthFile != "" {
 		UIAuthFile = filepath.Clean(UIAuthFile)
 
@@ -214,6 +698,23 @@ func VerifyConfig() error {
 		}
 	}
 
+	if APITokenFile != "" {
+		APITokenFile = filepath.Clean(APITokenFile)
+
+		if !isFile(APITokenFile) {
+			return fmt.Errorf("[ui] API token file not found: %s", APITokenFile)
+		}
+
+		b, err := os.ReadFile(APITokenFile)
+		if err != nil {
+			return err
+		}
+
+		if err := auth.SetAPITokens(b); err != nil {
+			return fmt.Errorf("[ui] API token file %s: %s", APITokenFile, err.Error())
+		}
+	}
+
 	if UITLSCert != "" && UITLSKey == "" || UITLSCert == "" && UITLSKey != "" {
 		return errors.New("[ui] you must provide both a UI TLS certificate and a key")
 	}
@@ -231,6 +732,106 @@ func VerifyConfig() error {
 		}
 	}
 
+	if len(HTTPTLSCertificateArgs) > 0 {
+		certs := []TLSCertConfig{}
+		for _, a := range HTTPTLSCertificateArgs {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+
+			parts := strings.Split(a, ",")
+			if len(parts) != 3 {
+				return fmt.Errorf("[ui] invalid TLS certificate (domain,cert,key): %s", a)
+			}
+
+			c := TLSCertConfig{
+				Domain:   strings.ToLower(strings.TrimSpace(parts[0])),
+				CertFile: filepath.Clean(strings.TrimSpace(parts[1])),
+				KeyFile:  filepath.Clean(strings.TrimSpace(parts[2])),
+			}
+
+			if c.Domain == "" {
+				return fmt.Errorf("[ui] TLS certificate domain not set: %s", a)
+			}
+
+			if !isFile(c.CertFile) {
+				return fmt.Errorf("[ui] TLS certificate not found: %s", c.CertFile)
+			}
+
+			if !isFile(c.KeyFile) {
+				return fmt.Errorf("[ui] TLS key not found: %s", c.KeyFile)
+			}
+
+			certs = append(certs, c)
+		}
+		HTTPTLSCertificates = certs
+	}
+
+	if APIDefaultPageSize < 1 {
+		return errors.New("[ui] API default page size must be greater than 0")
+	}
+
+	if APIMaxPageSize < APIDefaultPageSize {
+		return errors.New("[ui] API maximum page size cannot be less than the default page size")
+	}
+
+	for k := range SecurityHeaders {
+		if k == "" || strings.ContainsAny(k, " \t:") {
+			return fmt.Errorf("[ui] invalid security header name: %q", k)
+		}
+	}
+
+	adminIPRanges := []string{}
+	for _, r := range AdminIPRanges {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return fmt.Errorf("[ui] invalid admin IP range: %s", r)
+			}
+			if ip.To4() != nil {
+				r = r + "/32"
+			} else {
+				r = r + "/128"
+			}
+		}
+
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return fmt.Errorf("[ui] invalid admin IP range: %s", r)
+		}
+
+		adminIPRanges = append(adminIPRanges, r)
+	}
+	AdminIPRanges = adminIPRanges
+
+	if PreventDeleteAll && DeleteAllConfirmToken == "" {
+		return errors.New("[ui] a delete confirmation token is required to prevent deleting all messages")
+	}
+
+	if SMTPTLSAuto && SMTPTLSCert == "" && SMTPTLSKey == "" {
+		// the certificate is only persisted with a database file
+		dir := filepath.Dir(DataFile)
+		if DataFile == "" {
+			tmp, err := os.MkdirTemp("", "mailpit-tls-")
+			if err != nil {
+				return fmt.Errorf("[smtp] %s", err.Error())
+			}
+			dir = tmp
+			tlsTempDir = tmp
+		}
+
+		cert, key, err := SelfSignedCertificate(dir)
+		if err != nil {
+			return fmt.Errorf("[smtp] unable to generate a self-signed TLS certificate: %s", err.Error())
+		}
+		SMTPTLSCert, SMTPTLSKey = cert, key
+	}
+
 	if SMTPTLSCert != "" && SMTPTLSKey == "" || SMTPTLSCert == "" && SMTPTLSKey != "" {
 		return errors.New("[smtp] You must provide both an SMTP TLS certificate and a key")
 	}
@@ -250,6 +851,8 @@ func VerifyConfig() error {
 		return errors.New("[smtp] TLS cannot be required without an SMTP TLS certificate and key")
 	} else if SMTPRequireSTARTTLS {
 		return errors.New("[smtp] STARTTLS cannot be required without an SMTP TLS certificate and key")
+	} else if SMTPAutoDetectTLS {
+		return errors.New("[smtp] TLS cannot be detected without an SMTP TLS certificate and key")
 	}
 	if SMTPRequireSTARTTLS && SMTPAuthAllowInsecure || SMTPRequireTLS && SMTPAuthAllowInsecure {
 		return errors.New("[smtp] TLS cannot be required with --smtp-auth-allow-insecure")
@@ -257,6 +860,9 @@ func VerifyConfig() error {
 	if SMTPRequireSTARTTLS && SMTPRequireTLS {
 		return errors.New("[smtp] TLS & STARTTLS cannot be required together")
 	}
+	if SMTPAutoDetectTLS && SMTPRequireTLS {
+		return errors.New("[smtp] TLS cannot be detected when TLS is required")
+	}
 
 	if SMTPAuthFile != "" {
 		SMTPAuthFile = filepath.Clean(SMTPAuthFile)
@@ -317,6 +923,13 @@ func VerifyConfig() error {
 			return fmt.Errorf("[pop3] %s", err.Error())
 		}
 	}
+	// IMAP server
+	if IMAPListen != "" {
+		if _, err := net.ResolveTCPAddr("tcp", IMAPListen); err != nil {
+			return fmt.Errorf("[imap] %s", err.Error())
+		}
+	}
+
 	if POP3AuthFile != "" {
 		POP3AuthFile = filepath.Clean(POP3AuthFile)
 
@@ -334,6 +947,24 @@ func VerifyConfig() error {
 		}
 	}
 
+	// LMTP server
+	if LMTPPort < 0 || LMTPPort > 65535 {
+		return fmt.Errorf("[lmtp] invalid port: %d", LMTPPort)
+	}
+	if LMTPPort > 0 {
+		_, smtpPort, err := net.SplitHostPort(SMTPListen)
+		if err == nil && smtpPort == fmt.Sprintf("%d", LMTPPort) {
+			return fmt.Errorf("[lmtp] port %d is already used by the SMTP server", LMTPPort)
+		}
+	}
+	if LMTPSocket != "" {
+		LMTPSocket = filepath.Clean(LMTPSocket)
+
+		if !isDir(filepath.Dir(LMTPSocket)) {
+			return fmt.Errorf("[lmtp] socket directory not found: %s", filepath.Dir(LMTPSocket))
+		}
+	}
+
 	// Web root
 	validWebrootRe := regexp.MustCompile(`[^0-9a-zA-Z\/\-\_\.@]`)
 	if validWebrootRe.MatchString(Webroot) {
@@ -343,10 +974,40 @@ func VerifyConfig() error {
 	s := strings.TrimRight(path.Join("/", Webroot, "/"), "/") + "/"
 	Webroot = s
 
+	if OTLPEndpoint != "" && !isValidURL(OTLPEndpoint) {
+		return fmt.Errorf("[smtp] OTLP endpoint does not appear to be a valid URL (%s)", OTLPEndpoint)
+	}
+
 	if WebhookURL != "" && !isValidURL(WebhookURL) {
 		return fmt.Errorf("webhook URL does not appear to be a valid URL (%s)", WebhookURL)
 	}
 
+	if WebhookRateLimit < 0 {
+		return errors.New("webhook rate limit cannot be negative")
+	}
+
+	if WebhookRateLimit > 0 && WebhookQueueSize < 1 {
+		return errors.New("webhook queue size must be greater than 0")
+	}
+
+	if WebhookTemplate != "" && !isFile(WebhookTemplate) {
+		return fmt.Errorf("webhook template not found: %s", WebhookTemplate)
+	}
+
+	WebhookConditions = []WebhookCondition{}
+	for _, a := range WebhookConditionArgs {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		c, err := parseWebhookCondition(a)
+		if err != nil {
+			return err
+		}
+		WebhookConditions = append(WebhookConditions, c)
+	}
+
 	if EnableSpamAssassin != "" {
 		spamassassin.SetService(EnableSpamAssassin)
 		logger.Log().Infof("[spamassassin] enabled via %s", EnableSpamAssassin)
@@ -379,6 +1040,220 @@ func VerifyConfig() error {
 		}
 	}
 
+	DuplicateAction = strings.ToLower(strings.TrimSpace(DuplicateAction))
+	switch DuplicateAction {
+	case "", "store":
+		DuplicateAction = "store"
+		if IgnoreDuplicateIDs {
+			DuplicateAction = "ignore"
+		}
+	case "ignore":
+		IgnoreDuplicateIDs = true
+	case "overwrite":
+		if IgnoreDuplicateIDs {
+			return errors.New("[db] duplicate messages cannot be both ignored & overwritten")
+		}
+	case "reject":
+		if IgnoreDuplicateIDs {
+			return errors.New("[db] duplicate messages cannot be both ignored & rejected")
+		}
+	default:
+		return fmt.Errorf("[db] invalid duplicate action: %s", DuplicateAction)
+	}
+
+	blockedTypes := []string{}
+	for _, t := range BlockedAttachmentTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, ".") && !strings.Contains(t, "/") {
+			return fmt.Errorf("[smtp] invalid blocked attachment type (MIME type or .extension): %s", t)
+		}
+		blockedTypes = append(blockedTypes, t)
+	}
+	BlockedAttachmentTypes = blockedTypes
+
+	indexedHeaders := []string{}
+	for _, h := range IndexedHeaders {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if !headerNameRegexp.MatchString(h) {
+			return fmt.Errorf("[db] invalid indexed header name: %s", h)
+		}
+		indexedHeaders = append(indexedHeaders, textproto.CanonicalMIMEHeaderKey(h))
+	}
+	IndexedHeaders = indexedHeaders
+
+	contentTypes := []string{}
+	for _, t := range PreferredContentTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if t != "text/html" && t != "text/plain" {
+			return fmt.Errorf("[db] invalid preferred content type (text/html or text/plain): %s", t)
+		}
+		contentTypes = append(contentTypes, t)
+	}
+	PreferredContentTypes = contentTypes
+
+	if len(StorageHookCommands) > 0 || len(StorageHookURLs) > 0 {
+		hooks := []StorageHook{}
+		for _, c := range StorageHookCommands {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				continue
+			}
+			hooks = append(hooks, StorageHook{Command: c})
+		}
+		for _, u := range StorageHookURLs {
+			u = strings.TrimSpace(u)
+			if u == "" {
+				continue
+			}
+			if !isValidURL(u) {
+				return fmt.Errorf("[db] invalid storage hook URL: %s", u)
+			}
+			hooks = append(hooks, StorageHook{URL: u})
+		}
+		StorageHooks = hooks
+	}
+
+	if LinkCheckTimeout <= 0 {
+		return errors.New("[link-check] link check timeout must be greater than 0")
+	}
+
+	if LinkCheckCacheTTL < 0 {
+		return errors.New("[link-check] link check cache TTL cannot be negative")
+	}
+
+	if len(StorageHooks) > 0 && StorageHookTimeout <= 0 {
+		return errors.New("[db] storage hook timeout must be greater than 0")
+	}
+
+	if err := parseValidationRules(ValidationRulesFile); err != nil {
+		return err
+	}
+
+	if err := parseTagRetentionRules(TagRetentionFile); err != nil {
+		return err
+	}
+
+	for i, m := range SMTPAuthMethods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		SMTPAuthMethods[i] = m
+		if m != "PLAIN" && m != "LOGIN" {
+			return fmt.Errorf("[smtp] unsupported authentication method: %s", m)
+		}
+	}
+
+	if SMTPXCLIENTEnabled {
+		if len(SMTPXCLIENTTrustedIPs) == 0 {
+			return errors.New("[smtp] XCLIENT requires at least one trusted IP address")
+		}
+
+		for i, ip := range SMTPXCLIENTTrustedIPs {
+			ip = strings.TrimSpace(ip)
+			SMTPXCLIENTTrustedIPs[i] = ip
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("[smtp] invalid XCLIENT trusted IP address: %s", ip)
+			}
+		}
+	}
+
+	if MaxTagNameLength < 0 {
+		return errors.New("[tag] max tag name length cannot be negative")
+	}
+
+	if MaxTagCount < 0 {
+		return errors.New("[tag] max tag count cannot be negative")
+	}
+
+	for _, t := range []*string{&TagHTMLOnly, &TagTextOnly} {
+		if *t == "" {
+			continue
+		}
+		*t = tools.CleanTag(*t)
+		if !ValidTagRegexp.MatchString(*t) {
+			return fmt.Errorf("[tag] invalid tag (%s) - can only contain spaces, letters, numbers, - & _", *t)
+		}
+	}
+
+	RecipientTagRules = []RecipientTagRule{}
+
+	if RecipientTagCLIRules != "" {
+		args := tools.ArgsParser(RecipientTagCLIRules)
+
+		for _, a := range args {
+			t := strings.Split(a, "=")
+			if len(t) > 1 {
+				tag := tools.CleanTag(t[0])
+				if !ValidTagRegexp.MatchString(tag) || len(tag) == 0 {
+					return fmt.Errorf("[tag] invalid tag (%s) - can only contain spaces, letters, numbers, - & _", tag)
+				}
+				pattern := strings.TrimSpace(strings.ToLower(strings.Join(t[1:], "=")))
+				if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+					return fmt.Errorf("[tag] invalid recipient pattern (%s)", pattern)
+				}
+				RecipientTagRules = append(RecipientTagRules, RecipientTagRule{Pattern: pattern, Tag: tag})
+			} else {
+				return fmt.Errorf("[tag] error parsing recipient tags (%s)", a)
+			}
+		}
+	}
+
+	if SMTPTarpitDelay < 0 {
+		return errors.New("[smtp] tarpit delay cannot be negative")
+	}
+
+	if SMTPTarpitDelay > 0 && SMTPTarpitThreshold < 1 {
+		return errors.New("[smtp] tarpit threshold must be greater than 0")
+	}
+
+	if SMTPRateLimitReject && SMTPTarpitThreshold < 1 {
+		return errors.New("[smtp] tarpit threshold must be greater than 0 to reject rate-limited clients")
+	}
+
+	if SMTPMaxMessagesPerMinute < 0 || SMTPMaxRecipientsPerSecond < 0 || SMTPMaxPerIPPerMinute < 0 {
+		return errors.New("[smtp] rate limits cannot be negative")
+	}
+
+	// the rate limit response is used for both rate-limited clients & message rate limits
+	if SMTPRateLimitReject || SMTPMaxMessagesPerMinute > 0 || SMTPMaxRecipientsPerSecond > 0 || SMTPMaxPerIPPerMinute > 0 {
+		if SMTPRateLimitResponseCode < 400 || SMTPRateLimitResponseCode > 599 {
+			return fmt.Errorf("[smtp] invalid rate limit response code: %d", SMTPRateLimitResponseCode)
+		}
+
+		SMTPRateLimitMessage = strings.TrimSpace(SMTPRateLimitMessage)
+		if SMTPRateLimitMessage == "" || strings.ContainsAny(SMTPRateLimitMessage, "\r\n") {
+			return errors.New("[smtp] invalid rate limit response message")
+		}
+	}
+
+	if SMTPMaxRecipients < 1 {
+		return errors.New("[smtp] max recipients must be greater than 0")
+	}
+
+	if SMTPMaxMessageSize < 0 {
+		return errors.New("[smtp] max message size cannot be negative")
+	}
+
+	if ResubmitMaxSize < 0 {
+		return errors.New("[smtp] resubmit max size cannot be negative")
+	}
+
+	SMTPBanner = strings.TrimSpace(SMTPBanner)
+	if len(SMTPBanner) > 255 {
+		return errors.New("[smtp] banner cannot be longer than 255 characters")
+	}
+
+	if strings.ContainsAny(SMTPBanner, "\r\n") {
+		return errors.New("[smtp] banner cannot contain line breaks")
+	}
+
 	if SMTPAllowedRecipients != "" {
 		restrictRegexp, err := regexp.Compile(SMTPAllowedRecipients)
 		if err != nil {
@@ -389,6 +1264,16 @@ func VerifyConfig() error {
 		logger.Log().Infof("[smtp] only allowing recipients matching the following regexp: %s", SMTPAllowedRecipients)
 	}
 
+	if SelfTest {
+		if _, err := mail.ParseAddress(SelfTestRecipient); err != nil {
+			return fmt.Errorf("[selftest] invalid recipient: %s", SelfTestRecipient)
+		}
+
+		if SMTPAllowedRecipientsRegexp != nil && !SMTPAllowedRecipientsRegexp.MatchString(SelfTestRecipient) {
+			return fmt.Errorf("[selftest] recipient %s does not match smtp-allowed-recipients", SelfTestRecipient)
+		}
+	}
+
 	if err := parseRelayConfig(SMTPRelayConfigFile); err != nil {
 		return err
 	}
@@ -407,6 +1292,148 @@ func VerifyConfig() error {
 		logger.Log().Warnf("[smtp] enabling automatic relay of all new messages via %s:%d", SMTPRelayConfig.Host, SMTPRelayConfig.Port)
 	}
 
+	if len(ForwardRules) > 0 && !ReleaseEnabled {
+		return errors.New("[smtp] relay host must be set to forward messages")
+	}
+
+	for i, r := range ForwardRules {
+		r.MatchField = strings.TrimSpace(r.MatchField)
+		if r.MatchField == "" || r.MatchValue == "" {
+			return fmt.Errorf("[smtp] forward rule %d: match field and value must be set", i+1)
+		}
+
+		if len(r.ForwardTo) == 0 {
+			return fmt.Errorf("[smtp] forward rule %d: no forward addresses set", i+1)
+		}
+
+		for _, a := range r.ForwardTo {
+			if _, err := mail.ParseAddress(a); err != nil {
+				return fmt.Errorf("[smtp] forward rule %d: invalid address: %s", i+1, a)
+			}
+		}
+
+		ForwardRules[i].MatchField = r.MatchField
+		logger.Log().Infof("[smtp] forwarding new messages with %s matching %q to %s", r.MatchField, r.MatchValue, strings.Join(r.ForwardTo, ", "))
+	}
+
+	for _, h := range ForwardAllowedHosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			return fmt.Errorf("[smtp] invalid forward host (host:port): %s", h)
+		}
+	}
+
+	return nil
+}
+
+// Parse the ValidationRulesFile (if set)
+func parseValidationRules(c string) error {
+	if c == "" {
+		return nil
+	}
+
+	c = filepath.Clean(c)
+
+	if !isFile(c) {
+		return fmt.Errorf("[db] validation rules not found: %s", c)
+	}
+
+	data, err := os.ReadFile(c)
+	if err != nil {
+		return err
+	}
+
+	rules := struct {
+		Rules []ValidationRule `yaml:"rules"`
+	}{}
+
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+
+	for i, r := range rules.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		r.Field = strings.TrimSpace(r.Field)
+		if r.Field == "" {
+			r.Field = "raw"
+		}
+		if r.Field != "raw" && r.Field != "body" {
+			if !headerNameRegexp.MatchString(r.Field) {
+				return fmt.Errorf("[db] invalid validation rule field for %s: %s", r.Name, r.Field)
+			}
+			r.Field = textproto.CanonicalMIMEHeaderKey(r.Field)
+		}
+
+		r.Action = strings.ToLower(strings.TrimSpace(r.Action))
+		if r.Action == "" {
+			r.Action = "reject"
+		}
+		if r.Action != "reject" && r.Action != "warn" {
+			return fmt.Errorf("[db] invalid validation rule action for %s (reject or warn): %s", r.Name, r.Action)
+		}
+
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("[db] invalid validation rule pattern for %s: %s", r.Name, err.Error())
+		}
+		r.Regexp = re
+
+		rules.Rules[i] = r
+	}
+
+	ValidationRules = rules.Rules
+
+	return nil
+}
+
+// Parse the TagRetentionFile (if set)
+func parseTagRetentionRules(c string) error {
+	if c == "" {
+		return nil
+	}
+
+	c = filepath.Clean(c)
+
+	if !isFile(c) {
+		return fmt.Errorf("[db] tag retention rules not found: %s", c)
+	}
+
+	data, err := os.ReadFile(c)
+	if err != nil {
+		return err
+	}
+
+	rules := struct {
+		Rules []TagRetentionRule `yaml:"rules"`
+	}{}
+
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+
+	for i, r := range rules.Rules {
+		r.Tag = strings.TrimSpace(r.Tag)
+		if r.Tag == "" {
+			return fmt.Errorf("[db] tag retention rule %d is missing a tag", i+1)
+		}
+
+		if r.MaxMessages < 0 || r.MaxAgeDays < 0 {
+			return fmt.Errorf("[db] invalid tag retention rule for %s: limits cannot be negative", r.Tag)
+		}
+
+		if r.MaxMessages == 0 && r.MaxAgeDays == 0 {
+			return fmt.Errorf("[db] tag retention rule for %s requires max-messages and/or max-age-days", r.Tag)
+		}
+
+		logger.Log().Infof("[db] tag retention for %s: max messages %d, max age %d days", r.Tag, r.MaxMessages, r.MaxAgeDays)
+
+		rules.Rules[i] = r
+	}
+
+	TagRetentionRules = rules.Rules
+
 	return nil
 }
 
@@ -431,7 +1458,19 @@ func parseRelayConfig(c string) error {
 		return err
 	}
 
-	if SMTPRelayConfig.Host == "" {
+	rules := struct {
+		Rules   []RelayRule   `yaml:"rules"`
+		Forward []ForwardRule `yaml:"forward"`
+	}{}
+
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+
+	SMTPRelayRules = rules.Rules
+	ForwardRules = rules.Forward
+
+	if SMTPRelayConfig.Host == "" && len(SMTPRelayRules) == 0 {
 		return errors.New("[smtp] relay host not set")
 	}
 
@@ -446,52 +1485,88 @@ func parseRelayConfig(c string) error {
 	return nil
 }
 
-// Validate the SMTPRelayConfig (if Host is set)
+// Validate the SMTPRelayConfig (if Host is set) & SMTPRelayRules
 func validateRelayConfig() error {
-	if SMTPRelayConfig.Host == "" {
-		return nil
+	if SMTPRelayConfig.Host != "" {
+		if err := validateRelayServer(&SMTPRelayConfig); err != nil {
+			return err
+		}
+
+		ReleaseEnabled = true
+
+		logger.Log().Infof("[smtp] enabling message relaying via %s:%d", SMTPRelayConfig.Host, SMTPRelayConfig.Port)
+
+		if SMTPRelayConfig.AllowedRecipientsRegexp != nil {
+			logger.Log().Infof("[smtp] relay recipient allowlist is active with the following regexp: %s", SMTPRelayConfig.AllowedRecipients)
+		}
 	}
 
-	if SMTPRelayConfig.Port == 0 {
-		SMTPRelayConfig.Port = 25 // default
+	SMTPRelayStrategy = strings.ToLower(strings.TrimSpace(SMTPRelayStrategy))
+	switch SMTPRelayStrategy {
+	case "":
+		SMTPRelayStrategy = "first-match"
+	case "first-match", "round-robin", "random":
+	default:
+		return fmt.Errorf("[smtp] invalid relay strategy: %s", SMTPRelayStrategy)
 	}
 
-	SMTPRelayConfig.Auth = strings.ToLower(SMTPRelayConfig.Auth)
+	for i, r := range SMTPRelayRules {
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.RecipientDomain), "@"))
+		if domain == "" {
+			return fmt.Errorf("[smtp] relay rule %d: recipient domain not set", i+1)
+		}
+
+		SMTPRelayRules[i].RecipientDomain = domain
+
+		if SMTPRelayRules[i].SMTPConfig.Host == "" {
+			return fmt.Errorf("[smtp] relay rule for @%s: relay host not set", domain)
+		}
+
+		if err := validateRelayServer(&SMTPRelayRules[i].SMTPConfig); err != nil {
+			return err
+		}
+
+		logger.Log().Infof("[smtp] relaying all new messages for @%s via %s:%d", domain, SMTPRelayRules[i].SMTPConfig.Host, SMTPRelayRules[i].SMTPConfig.Port)
+	}
+
+	return nil
+}
+
+// Validate a relay server config, setting defaults where required
+func validateRelayServer(c *SMTPRelayConfigStruct) error {
+	if c.Port == 0 {
+		c.Port = 25 // default
+	}
 
-	if SMTPRelayConfig.Auth == "" || SMTPRelayConfig.Auth == "none" || SMTPRelayConfig.Auth == "false" {
-		SMTPRelayConfig.Auth = "none"
-	} else if SMTPRelayConfig.Auth == "plain" {
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Password == "" {
+	c.Auth = strings.ToLower(c.Auth)
+
+	if c.Auth == "" || c.Auth == "none" || c.Auth == "false" {
+		c.Auth = "none"
+	} else if c.Auth == "plain" {
+		if c.Username == "" || c.Password == "" {
 			return fmt.Errorf("[smtp] relay host username or password not set for PLAIN authentication")
 		}
-	} else if SMTPRelayConfig.Auth == "login" {
-		SMTPRelayConfig.Auth = "login"
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Password == "" {
+	} else if c.Auth == "login" {
+		c.Auth = "login"
+		if c.Username == "" || c.Password == "" {
 			return fmt.Errorf("[smtp] relay host username or password not set for LOGIN authentication")
 		}
-	} else if strings.HasPrefix(SMTPRelayConfig.Auth, "cram") {
-		SMTPRelayConfig.Auth = "cram-md5"
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Secret == "" {
+	} else if strings.HasPrefix(c.Auth, "cram") {
+		c.Auth = "cram-md5"
+		if c.Username == "" || c.Secret == "" {
 			return fmt.Errorf("[smtp] relay host username or secret not set for CRAM-MD5 authentication")
 		}
 	} else {
-		return fmt.Errorf("[smtp] relay authentication method not supported: %s", SMTPRelayConfig.Auth)
+		return fmt.Errorf("[smtp] relay authentication method not supported: %s", c.Auth)
 	}
 
-	ReleaseEnabled = true
-
-	logger.Log().Infof("[smtp] enabling message relaying via %s:%d", SMTPRelayConfig.Host, SMTPRelayConfig.Port)
-
-	allowlistRegexp, err := regexp.Compile(SMTPRelayConfig.AllowedRecipients)
-
-	if SMTPRelayConfig.AllowedRecipients != "" {
+	if c.AllowedRecipients != "" {
+		allowlistRegexp, err := regexp.Compile(c.AllowedRecipients)
 		if err != nil {
 			return fmt.Errorf("[smtp] failed to compile relay recipient allowlist regexp: %s", err.Error())
 		}
 
-		SMTPRelayConfig.AllowedRecipientsRegexp = allowlistRegexp
-		logger.Log().Infof("[smtp] relay recipient allowlist is active with the following regexp: %s", SMTPRelayConfig.AllowedRecipients)
-
+		c.AllowedRecipientsRegexp = allowlistRegexp
 	}
 
 	return nil
@@ -517,6 +1592,33 @@ func isDir(path string) bool {
 	return true
 }
 
+// ParseWebhookCondition parses a JSONPath=value webhook condition. The condition is split on
+// the first "=" outside of brackets, so JSONPath filter expressions may contain "=".
+func parseWebhookCondition(s string) (WebhookCondition, error) {
+	depth := 0
+	for i, c := range s {
+		switch c {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+		case '=':
+			if depth > 0 {
+				continue
+			}
+
+			cond := WebhookCondition{JSONPath: strings.TrimSpace(s[:i]), Value: s[i+1:]}
+			if _, err := jsonpath.New(cond.JSONPath); err != nil {
+				return cond, fmt.Errorf("invalid webhook condition JSONPath %s: %s", cond.JSONPath, err.Error())
+			}
+
+			return cond, nil
+		}
+	}
+
+	return WebhookCondition{}, fmt.Errorf("invalid webhook condition (JSONPath=value): %s", s)
+}
+
 func isValidURL(s string) bool {
 	u, err := url.ParseRequestURI(s)
 	if err != nil {
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+const (
+	selfSignedCertFile = "mailpit-smtp.crt"
+	selfSignedKeyFile  = "mailpit-smtp.key"
+)
+
+// tlsTempDir is the temporary directory of a self-signed certificate generated without a database file
+var tlsTempDir string
+
+// SelfSignedCertificate returns the paths of the self-signed TLS certificate & key in dir,
+// generating a new RSA-2048 certificate if they do not exist, are invalid, or expire within a day
+func SelfSignedCertificate(dir string) (string, string, error) {
+	certFile := filepath.Join(dir, selfSignedCertFile)
+	keyFile := filepath.Join(dir, selfSignedKeyFile)
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Add(24*time.Hour).Before(cert.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Mailpit", Organization: []string{"Mailpit"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		return "", "", err
+	}
+
+	logger.Log().Infof("[smtp] generated self-signed TLS certificate %s", certFile)
+
+	return certFile, keyFile, nil
+}
+
+// RemoveTLSTempDir deletes the temporary directory of a self-signed certificate, if one was generated
+func RemoveTLSTempDir() {
+	if tlsTempDir == "" {
+		return
+	}
+
+	logger.Log().Debugf("[smtp] deleting temporary TLS certificate directory %s", tlsTempDir)
+	if err := os.RemoveAll(tlsTempDir); err != nil {
+		logger.Log().Errorf("[smtp] %s", err.Error())
+	}
+
+	tlsTempDir = ""
+}
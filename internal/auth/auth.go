@@ -2,6 +2,10 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -74,6 +78,44 @@ func SetPOP3Auth(s string) error {
 	return nil
 }
 
+// ReloadAuthFile reloads the credentials for a service (ui, smtp or pop3) from a password file,
+// returning the number of credentials loaded. The existing credentials are kept if the file
+// cannot be read or does not contain any credentials. Credentials are replaced in place, which
+// is safe while they are in use, so the service must have been started with authentication.
+func ReloadAuthFile(service, file string) (int, error) {
+	var f *htpasswd.File
+	switch service {
+	case "ui":
+		f = UICredentials
+	case "smtp":
+		f = SMTPCredentials
+	case "pop3":
+		f = POP3Credentials
+	default:
+		return 0, fmt.Errorf("unknown service: %s", service)
+	}
+
+	if f == nil {
+		return 0, errors.New("authentication is not enabled")
+	}
+
+	b, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return 0, err
+	}
+
+	credentials := credentialsFromString(string(b))
+	if len(credentials) == 0 {
+		return 0, errors.New("no credentials found")
+	}
+
+	if err := f.ReloadFromReader(strings.NewReader(strings.Join(credentials, "\n")), nil); err != nil {
+		return 0, err
+	}
+
+	return len(credentials), nil
+}
+
 func credentialsFromString(s string) []string {
 	// split string by any whitespace character
 	re := regexp.MustCompile(`\s+`)
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReloadAuthFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "passwords")
+
+	if err := os.WriteFile(file, []byte("new:{PLAIN}secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReloadAuthFile("smtp", file); err == nil {
+		t.Error("expected an error reloading credentials without authentication")
+	}
+
+	if _, err := ReloadAuthFile("invalid", file); err == nil {
+		t.Error("expected an error reloading credentials for an unknown service")
+	}
+
+	if err := SetSMTPAuth("old:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { SMTPCredentials = nil }()
+
+	// credentials are replaced while in use
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				SMTPCredentials.Match("old", "pass")
+			}
+		}
+	}()
+
+	n, err := ReloadAuthFile("smtp", file)
+	close(stop)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 credential, got %d", n)
+	}
+
+	if SMTPCredentials.Match("old", "pass") {
+		t.Error("expected the old credentials to be replaced")
+	}
+	if !SMTPCredentials.Match("new", "secret") {
+		t.Error("expected the new credentials to match")
+	}
+
+	// the existing credentials are kept if the file is empty
+	if err := os.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReloadAuthFile("smtp", file); err == nil {
+		t.Error("expected an error reloading an empty file")
+	}
+	if !SMTPCredentials.Match("new", "secret") {
+		t.Error("expected the existing credentials to be kept")
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"sync"
+)
+
+// SelfTestUser is the SMTP username of the startup self-test
+const SelfTestUser = "mailpit-selftest"
+
+var (
+	// one-time SMTP password of the startup self-test, as the configured
+	// SMTP passwords are hashed so cannot be used by the self-test
+	selfTestPassword   string
+	selfTestPasswordMu sync.RWMutex
+
+	// Message-ID of the startup self-test message, which is not relayed, forwarded
+	// or sent to webhooks
+	selfTestMessageID   string
+	selfTestMessageIDMu sync.RWMutex
+)
+
+// SetSelfTestPassword sets the SMTP password of the startup self-test.
+// An empty password disables the self-test login.
+func SetSelfTestPassword(password string) {
+	selfTestPasswordMu.Lock()
+	defer selfTestPasswordMu.Unlock()
+
+	selfTestPassword = password
+}
+
+// SelfTestLogin returns whether the SMTP credentials are those of the startup self-test
+func SelfTestLogin(username, password string) bool {
+	selfTestPasswordMu.RLock()
+	defer selfTestPasswordMu.RUnlock()
+
+	return selfTestPassword != "" && username == SelfTestUser &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(selfTestPassword)) == 1
+}
+
+// SetSelfTestMessageID sets the Message-ID of the startup self-test message.
+// An empty Message-ID clears it.
+func SetSelfTestMessageID(messageID string) {
+	selfTestMessageIDMu.Lock()
+	defer selfTestMessageIDMu.Unlock()
+
+	selfTestMessageID = messageID
+}
+
+// IsSelfTestMessage returns whether the Message-ID is that of the startup self-test message
+func IsSelfTestMessage(messageID string) bool {
+	selfTestMessageIDMu.RLock()
+	defer selfTestMessageIDMu.RUnlock()
+
+	return selfTestMessageID != "" && messageID == selfTestMessageID
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIScope is the access level of an API token
+type APIScope int
+
+const (
+	// ScopeRead allows read-only (GET) API requests
+	ScopeRead APIScope = iota + 1
+	// ScopeWrite additionally allows requests modifying data (POST, PUT & DELETE)
+	ScopeWrite
+	// ScopeAdmin additionally allows admin requests (eg: vacuum & backup)
+	ScopeAdmin
+)
+
+// APITokens maps API bearer tokens to their scope, nil if no tokens are configured
+var APITokens map[string]APIScope
+
+// String returns the name of the scope
+func (s APIScope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeWrite:
+		return "write"
+	case ScopeAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+type apiTokenConfig struct {
+	Scope string `yaml:"scope"`
+}
+
+// SetAPITokens parses a YAML document mapping API tokens to their scope, eg:
+//
+//	my-read-token:
+//	  scope: read
+//	my-admin-token:
+//	  scope: admin
+func SetAPITokens(b []byte) error {
+	conf := map[string]apiTokenConfig{}
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+
+	if len(conf) == 0 {
+		return errors.New("no API tokens found")
+	}
+
+	tokens := map[string]APIScope{}
+	for token, c := range conf {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			return errors.New("API tokens cannot be empty")
+		}
+
+		var scope APIScope
+		switch strings.ToLower(strings.TrimSpace(c.Scope)) {
+		case "read":
+			scope = ScopeRead
+		case "write":
+			scope = ScopeWrite
+		case "admin":
+			scope = ScopeAdmin
+		default:
+			return fmt.Errorf("invalid API token scope %q (must be read, write or admin)", c.Scope)
+		}
+
+		tokens[token] = scope
+	}
+
+	APITokens = tokens
+
+	return nil
+}
+
+// APITokenScope returns the scope of the API token, or 0 if the token is not valid
+func APITokenScope(token string) APIScope {
+	var scope APIScope
+	for t, s := range APITokens {
+		// compare all tokens in constant time
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			scope = s
+		}
+	}
+
+	return scope
+}
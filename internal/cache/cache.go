@@ -0,0 +1,75 @@
+// Package cache is an in-memory LRU cache of decompressed raw messages
+package cache
+
+import (
+	"sync"
+
+	"github.com/axllent/mailpit/config"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+var (
+	messages *lru.Cache[string, []byte]
+	initOnce sync.Once
+)
+
+// Cache returns the message cache, or nil if config.MessageCacheSize is 0
+func cache() *lru.Cache[string, []byte] {
+	initOnce.Do(func() {
+		if config.MessageCacheSize < 1 {
+			return
+		}
+
+		// only errors with a size <= 0
+		messages, _ = lru.New[string, []byte](config.MessageCacheSize)
+	})
+
+	return messages
+}
+
+// Get returns a copy of the cached raw message, and whether it was found
+func Get(id string) ([]byte, bool) {
+	c := cache()
+	if c == nil {
+		return nil, false
+	}
+
+	raw, ok := c.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), raw...), true
+}
+
+// Add a copy of the raw message to the cache
+func Add(id string, raw []byte) {
+	c := cache()
+	if c == nil {
+		return
+	}
+
+	c.Add(id, append([]byte(nil), raw...))
+}
+
+// Remove messages from the cache, eg: when deleted or overwritten
+func Remove(ids ...string) {
+	c := cache()
+	if c == nil {
+		return
+	}
+
+	for _, id := range ids {
+		c.Remove(id)
+	}
+}
+
+// Purge removes all messages from the cache
+func Purge() {
+	c := cache()
+	if c == nil {
+		return
+	}
+
+	c.Purge()
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestMessageCache(t *testing.T) {
+	config.MessageCacheSize = 2
+
+	Add("1", []byte("message 1"))
+	Add("2", []byte("message 2"))
+
+	raw, ok := Get("1")
+	if !ok || string(raw) != "message 1" {
+		t.Errorf("expected cached message 1, got %q", raw)
+	}
+
+	// returned messages are copies
+	raw[0] = 'x'
+	if raw, _ := Get("1"); string(raw) != "message 1" {
+		t.Errorf("cached message was modified: %q", raw)
+	}
+
+	// "2" is the least recently used
+	Add("3", []byte("message 3"))
+	if _, ok := Get("2"); ok {
+		t.Error("expected message 2 to be evicted")
+	}
+
+	Remove("1")
+	if _, ok := Get("1"); ok {
+		t.Error("expected message 1 to be removed")
+	}
+
+	Purge()
+	if _, ok := Get("3"); ok {
+		t.Error("expected cache to be empty")
+	}
+}
@@ -0,0 +1,113 @@
+package cspcheck
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+func TestAnalyzeCSP(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	t.Log("Testing CSP analysis")
+
+	html, err := os.ReadFile("testdata/csp.html")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	raw := []byte("From: sender@example.com\r\nSubject: CSP\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" + string(html))
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	report, err := AnalyzeCSP(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, report.Policy, DefaultPolicy, "incorrect policy")
+
+	violations := []string{}
+	for _, v := range report.Violations {
+		violations = append(violations, fmt.Sprintf("%s[%s]=%s (%s)", v.Element, v.Attribute, v.Value, v.Directive))
+	}
+
+	expected := []string{
+		`link[href]=https://cdn.example.com/styles.css (style-src)`,
+		`script[]=document.title = "Tracking"; (default-src)`,
+		`script[src]=https://cdn.example.com/app.js (default-src)`,
+		`body[onload]=init() (default-src)`,
+		`img[src]=http://images.example.com/banner.png (img-src)`,
+		`img[src]=images/relative.png (img-src)`,
+		`a[href]=javascript:alert(1) (default-src)`,
+		`iframe[src]=https://video.example.com/embed (default-src)`,
+	}
+
+	assertEqual(t, strings.Join(violations, "\n"), strings.Join(expected, "\n"), "incorrect violations")
+	assertEqual(t, len(report.Recommendations), 5, "incorrect number of recommendations")
+	assertEqual(t, storage.IsUnread(id), true, "message should not be marked read")
+
+	if _, err := AnalyzeCSP("missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestAnalyzePolicy(t *testing.T) {
+	t.Log("Testing CSP policy evaluation")
+
+	html := `<img src="https://cdn.example.com/a.png"><img src="https://other.example.net/b.png">` +
+		`<img src="data:image/png;base64,AAAA"><p style="margin: 0">Test</p>` +
+		`<script src="https://static.example.com/app.js"></script>`
+
+	report, err := analyze(html, "img-src *.example.com; script-src http://static.example.com; style-src 'self'")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	violations := []string{}
+	for _, v := range report.Violations {
+		violations = append(violations, v.Value+" ("+v.Directive+")")
+	}
+
+	// data: is not matched by host sources, http: sources allow https
+	assertEqual(t, strings.Join(violations, ", "), "https://other.example.net/b.png (img-src), data:image/png;base64,AAAA (img-src), margin: 0 (style-src)", "incorrect violations")
+
+	report, err = analyze(html, "")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(report.Violations), 0, "an empty policy should not block anything")
+}
+
+func setup() {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		panic(err)
+	}
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	message = fmt.Sprintf("%s: \"%v\" != \"%v\"", message, a, b)
+	t.Fatal(message)
+}
@@ -0,0 +1,200 @@
+// Package cspcheck handles the Content-Security-Policy analysis of message HTML
+package cspcheck
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/jhillyerd/enmime"
+)
+
+// DefaultPolicy is a strict Content-Security-Policy similar to that enforced by most email clients:
+// scripts, frames & plugins are blocked, styles must be inline, and remote content must use HTTPS.
+const DefaultPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src https: data: cid:; font-src https: data:; media-src https:"
+
+// maxInlineLength is the maximum length of inline content included in a violation
+const maxInlineLength = 100
+
+// resource is a reference to external or inline content in the HTML
+type resource struct {
+	element   string
+	attribute string
+	value     string
+	directive string
+	inline    bool
+}
+
+// AnalyzeCSP returns the Content-Security-Policy analysis of the HTML of a message.
+// The message is not marked as read.
+func AnalyzeCSP(id string) (*CSPReport, error) {
+	raw, err := storage.GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return analyze(env.HTML, DefaultPolicy)
+}
+
+// Analyze evaluates the HTML against the policy, returning the content which would be blocked
+func analyze(html, policy string) (*CSPReport, error) {
+	report := &CSPReport{
+		Policy:          policy,
+		Violations:      []CSPViolation{},
+		Recommendations: []string{},
+	}
+
+	if strings.TrimSpace(html) == "" {
+		return report, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return nil, err
+	}
+
+	p := parsePolicy(policy)
+
+	blocked := map[string]bool{}
+	for _, r := range extractResources(doc) {
+		if p.allows(r) {
+			continue
+		}
+
+		report.Violations = append(report.Violations, CSPViolation{
+			Element:   r.element,
+			Attribute: r.attribute,
+			Value:     r.value,
+			Directive: p.effectiveDirective(r.directive),
+		})
+
+		blocked[recommendationFor(r)] = true
+	}
+
+	for rec := range blocked {
+		if rec != "" {
+			report.Recommendations = append(report.Recommendations, rec)
+		}
+	}
+	sort.Strings(report.Recommendations)
+
+	return report, nil
+}
+
+// ExtractResources returns all inline & external content of the HTML in document order
+func extractResources(doc *goquery.Document) []resource {
+	resources := []resource{}
+
+	doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+		node := s.Get(0)
+		element := strings.ToLower(node.Data)
+
+		for _, a := range node.Attr {
+			name := strings.ToLower(a.Key)
+			value := strings.TrimSpace(a.Val)
+
+			switch {
+			case strings.HasPrefix(name, "on"):
+				resources = append(resources, resource{element, name, truncate(value), "script-src", true})
+			case name == "style" && value != "":
+				resources = append(resources, resource{element, name, truncate(value), "style-src", true})
+			case (name == "href" || name == "src") && strings.HasPrefix(strings.ToLower(value), "javascript:"):
+				resources = append(resources, resource{element, name, truncate(value), "script-src", true})
+			}
+		}
+
+		switch element {
+		case "script":
+			if src, ok := s.Attr("src"); ok {
+				resources = append(resources, resource{element, "src", src, "script-src", false})
+			} else if strings.TrimSpace(s.Text()) != "" {
+				resources = append(resources, resource{element, "", truncate(s.Text()), "script-src", true})
+			}
+		case "style":
+			if strings.TrimSpace(s.Text()) != "" {
+				resources = append(resources, resource{element, "", truncate(s.Text()), "style-src", true})
+			}
+		case "link":
+			href, ok := s.Attr("href")
+			if !ok {
+				return
+			}
+			rel := strings.ToLower(s.AttrOr("rel", ""))
+			if strings.Contains(rel, "stylesheet") {
+				resources = append(resources, resource{element, "href", href, "style-src", false})
+			} else if strings.Contains(rel, "icon") {
+				resources = append(resources, resource{element, "href", href, "img-src", false})
+			}
+		case "img":
+			if src, ok := s.Attr("src"); ok {
+				resources = append(resources, resource{element, "src", src, "img-src", false})
+			}
+		case "body", "table", "td", "th":
+			if bg, ok := s.Attr("background"); ok && bg != "" {
+				resources = append(resources, resource{element, "background", bg, "img-src", false})
+			}
+		case "video", "audio", "source", "track":
+			if src, ok := s.Attr("src"); ok {
+				resources = append(resources, resource{element, "src", src, "media-src", false})
+			}
+		case "iframe", "frame":
+			if src, ok := s.Attr("src"); ok {
+				resources = append(resources, resource{element, "src", src, "frame-src", false})
+			}
+		case "object":
+			if data, ok := s.Attr("data"); ok {
+				resources = append(resources, resource{element, "data", data, "object-src", false})
+			}
+		case "embed":
+			if src, ok := s.Attr("src"); ok {
+				resources = append(resources, resource{element, "src", src, "object-src", false})
+			}
+		case "form":
+			if action, ok := s.Attr("action"); ok {
+				resources = append(resources, resource{element, "action", action, "form-action", false})
+			}
+		}
+	})
+
+	return resources
+}
+
+// RecommendationFor returns the recommendation for blocked content
+func recommendationFor(r resource) string {
+	switch {
+	case r.directive == "script-src":
+		return "Remove all JavaScript (scripts, event handlers & javascript: links), as email clients do not execute it"
+	case r.directive == "style-src" && r.inline:
+		return "Avoid inline styles, as they are blocked by the policy"
+	case r.directive == "style-src":
+		return "Inline the CSS of external stylesheets, as most email clients do not load them"
+	case r.directive == "frame-src" || r.directive == "object-src":
+		return "Remove embedded frames, objects & plugins, as email clients do not display them"
+	case r.directive == "form-action":
+		return "Avoid forms, link to a web page instead"
+	case strings.HasPrefix(strings.ToLower(r.value), "http:"):
+		return "Serve all remote content over HTTPS to avoid mixed-content blocking"
+	case !strings.Contains(r.value, ":"):
+		return "Use absolute HTTPS URLs for remote content, as relative URLs cannot be resolved in email clients"
+	default:
+		return "Ensure remote content is allowed by the " + r.directive + " directive"
+	}
+}
+
+// Truncate returns the trimmed string, truncated to maxInlineLength characters
+func truncate(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if r := []rune(s); len(r) > maxInlineLength {
+		return string(r[:maxInlineLength]) + "..."
+	}
+
+	return s
+}
@@ -0,0 +1,147 @@
+package cspcheck
+
+import (
+	"net/url"
+	"strings"
+)
+
+// policy is a parsed Content-Security-Policy, mapping directives to their source lists
+type policy map[string][]string
+
+// fallbacks are the directives used (in order) when a fetch directive is not set
+var fallbacks = map[string][]string{
+	"script-src": {"default-src"},
+	"style-src":  {"default-src"},
+	"img-src":    {"default-src"},
+	"font-src":   {"default-src"},
+	"media-src":  {"default-src"},
+	"object-src": {"default-src"},
+	"frame-src":  {"child-src", "default-src"},
+}
+
+// ParsePolicy parses a Content-Security-Policy header value. As per the specification,
+// only the first occurrence of a directive is used.
+func parsePolicy(s string) policy {
+	p := policy{}
+
+	for _, d := range strings.Split(s, ";") {
+		parts := strings.Fields(d)
+		if len(parts) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(parts[0])
+		if _, ok := p[name]; ok {
+			continue
+		}
+
+		sources := []string{}
+		for _, src := range parts[1:] {
+			sources = append(sources, strings.ToLower(src))
+		}
+
+		p[name] = sources
+	}
+
+	return p
+}
+
+// EffectiveDirective returns the directive which applies to the fetch directive, following the fallbacks
+func (p policy) effectiveDirective(directive string) string {
+	if _, ok := p[directive]; ok {
+		return directive
+	}
+
+	for _, f := range fallbacks[directive] {
+		if _, ok := p[f]; ok {
+			return f
+		}
+	}
+
+	return directive
+}
+
+// Allows returns whether the resource is allowed by the policy
+func (p policy) allows(r resource) bool {
+	sources, ok := p[p.effectiveDirective(r.directive)]
+	if !ok {
+		// the directive (nor any fallback) is not set
+		return true
+	}
+
+	if r.inline {
+		for _, src := range sources {
+			if src == "'unsafe-inline'" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	u, err := url.Parse(strings.TrimSpace(r.value))
+	if err != nil {
+		return false
+	}
+
+	for _, src := range sources {
+		if sourceMatches(src, u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SourceMatches returns whether the URL matches the source expression. Relative URLs only match
+// 'self' & *, as email messages do not have an origin of their own.
+func sourceMatches(src string, u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	relative := scheme == "" && u.Host == ""
+
+	switch {
+	case src == "'self'":
+		return relative
+	case src == "*":
+		// * does not match schemes such as data:, blob: or cid:
+		return relative || scheme == "" || scheme == "http" || scheme == "https" || scheme == "ws" || scheme == "wss"
+	case strings.HasPrefix(src, "'"):
+		// keywords, nonces & hashes do not apply to URLs
+		return false
+	case strings.HasSuffix(src, ":"):
+		return schemeMatches(strings.TrimSuffix(src, ":"), scheme)
+	}
+
+	// host source: [scheme://]host[:port][/path]
+	host := src
+	if i := strings.Index(host, "://"); i >= 0 {
+		if !schemeMatches(host[:i], scheme) {
+			return false
+		}
+		host = host[i+3:]
+	} else if scheme != "" && scheme != "http" && scheme != "https" {
+		return false
+	}
+
+	if i := strings.IndexAny(host, ":/"); i >= 0 {
+		host = host[:i]
+	}
+
+	hostname := strings.ToLower(u.Hostname())
+	if hostname == "" {
+		return false
+	}
+
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(hostname, host[1:])
+	}
+
+	return hostname == host
+}
+
+// SchemeMatches returns whether the scheme matches the expected scheme, allowing secure upgrades
+func schemeMatches(expected, scheme string) bool {
+	return expected == scheme ||
+		expected == "http" && scheme == "https" ||
+		expected == "ws" && scheme == "wss"
+}
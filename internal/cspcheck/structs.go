@@ -0,0 +1,27 @@
+package cspcheck
+
+// CSPReport represents the Content-Security-Policy analysis of a message
+//
+// swagger:model CSPReport
+type CSPReport struct {
+	// The Content-Security-Policy the message HTML was evaluated against
+	Policy string
+	// Elements & attributes which would be blocked by the policy
+	Violations []CSPViolation
+	// Suggested changes to the message HTML
+	Recommendations []string
+}
+
+// CSPViolation is a single element or attribute which would be blocked by the policy
+//
+// swagger:model CSPViolation
+type CSPViolation struct {
+	// HTML element, eg: img
+	Element string
+	// Element attribute, blank for inline content
+	Attribute string
+	// Attribute value or (truncated) inline content
+	Value string
+	// CSP directive which would block the content, eg: img-src
+	Directive string
+}
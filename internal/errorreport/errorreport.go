@@ -0,0 +1,66 @@
+// Package errorreport sends error events & panics to Sentry (if configured)
+package errorreport
+
+import (
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/getsentry/sentry-go"
+)
+
+var enabled bool
+
+// Init will initialise the Sentry client if a Sentry DSN is configured
+func Init() error {
+	if config.SentryDSN == "" || enabled {
+		return nil
+	}
+
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:     config.SentryDSN,
+		Release: "mailpit@" + config.Version,
+	}); err != nil {
+		return err
+	}
+
+	enabled = true
+
+	logger.Log().Info("[sentry] error reporting enabled")
+
+	return nil
+}
+
+// CaptureError will send an error event to Sentry, tagged with the operation
+// name and optional message ID
+func CaptureError(err error, operation, messageID string) {
+	if !enabled || err == nil {
+		return
+	}
+
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("operation", operation)
+		if messageID != "" {
+			scope.SetTag("message_id", messageID)
+		}
+		sentry.CaptureException(err)
+	})
+}
+
+// Recover will report a panic to Sentry before re-panicking.
+// It must be called directly via defer.
+func Recover(operation string) {
+	if !enabled {
+		return
+	}
+
+	if r := recover(); r != nil {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("operation", operation)
+			sentry.CurrentHub().Recover(r)
+		})
+		sentry.Flush(2 * time.Second)
+
+		panic(r)
+	}
+}
@@ -0,0 +1,74 @@
+// Package export handles exporting messages to archive files
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/jhillyerd/enmime"
+)
+
+// ExportZIP writes a ZIP archive of the given messages to w. Each message is stored as <ID>.eml,
+// and its attachments as <ID>/<filename>. The archive is streamed to w as it is created,
+// and the messages are not marked as read.
+func ExportZIP(w io.Writer, ids []string) error {
+	zw := zip.NewWriter(w)
+
+	for _, id := range ids {
+		raw, err := storage.GetMessageRaw(id)
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err.Error())
+		}
+
+		env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err.Error())
+		}
+
+		date, err := env.Date()
+		if err != nil {
+			date = time.Now()
+		}
+
+		if err := writeFile(zw, id+".eml", date, raw); err != nil {
+			return err
+		}
+
+		used := map[string]bool{}
+
+		for _, a := range env.Attachments {
+			if a.FileName == "" && a.ContentID == "" {
+				continue
+			}
+
+			name := storage.ZipFileName(a, used)
+			used[name] = true
+
+			if err := writeFile(zw, id+"/"+name, date, a.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+// WriteFile adds a compressed file to the archive
+func writeFile(zw *zip.Writer, name string, modified time.Time, data []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	return err
+}
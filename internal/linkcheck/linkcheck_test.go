@@ -0,0 +1,138 @@
+package linkcheck
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+var testEmail = []byte("From: sender@example.com\r\n" +
+	"Subject: Link check\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	`<p><a href="https://example.com/ok">OK</a> <a href="https://example.com/missing">Missing</a> ` +
+	`<a href="https://unreachable.example.com/">Unreachable</a> <img src="https://example.com/ok"></p>` + "\r\n")
+
+type mockTransport struct {
+	sync.Mutex
+	requests map[string]int
+}
+
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.Lock()
+	m.requests[req.URL.String()]++
+	m.Unlock()
+
+	if req.URL.Host == "unreachable.example.com" {
+		return nil, errors.New("dial tcp: lookup unreachable.example.com: no such host")
+	}
+
+	code := http.StatusOK
+	if strings.HasSuffix(req.URL.Path, "/missing") {
+		code = http.StatusNotFound
+	}
+
+	return &http.Response{StatusCode: code, Body: http.NoBody, Request: req}, nil
+}
+
+func TestRunTests(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	mock := &mockTransport{requests: map[string]int{}}
+	httpTransport = mock
+	defer func() { httpTransport = nil }()
+
+	t.Log("Testing link check")
+
+	id, err := storage.Store(&testEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	for i := 0; i < 2; i++ {
+		summary, err := RunTests(msg, false)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		assertEqual(t, len(summary.Links), 3, "incorrect number of links")
+		assertEqual(t, summary.Errors, 2, "incorrect number of errors")
+
+		statuses := []string{}
+		for _, l := range summary.Links {
+			statuses = append(statuses, fmt.Sprintf("%s %d", l.URL, l.StatusCode))
+		}
+		sort.Strings(statuses)
+
+		assertEqual(t, strings.Join(statuses, ", "), "https://example.com/missing 404, https://example.com/ok 200, https://unreachable.example.com/ 0", "incorrect link statuses")
+	}
+
+	// successful responses are cached, connection errors are checked again
+	assertEqual(t, mock.requests["https://example.com/ok"], 1, "link should be cached")
+	assertEqual(t, mock.requests["https://example.com/missing"], 1, "link should be cached")
+	assertEqual(t, mock.requests["https://unreachable.example.com/"], 2, "unreachable link should not be cached")
+
+	if _, err := RunTests(msg, true); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, mock.requests["https://example.com/ok"], 2, "links should be checked again when following redirects")
+
+	// cached link checks keep the time they were checked
+	time.Sleep(10 * time.Millisecond)
+	summary, err := RunTests(msg, false)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, time.Since(summary.CheckedAt()) >= 10*time.Millisecond, true, "cached link checks should keep their check time")
+
+	// expired link checks are checked again
+	config.LinkCheckCacheTTL = time.Millisecond
+	defer func() { config.LinkCheckCacheTTL = time.Hour }()
+
+	if _, err := RunTests(msg, false); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, mock.requests["https://example.com/missing"], 3, "expired link should be checked again")
+}
+
+func setup() {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		panic(err)
+	}
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	message = fmt.Sprintf("%s: \"%v\" != \"%v\"", message, a, b)
+	t.Fatal(message)
+}
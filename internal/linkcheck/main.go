@@ -4,8 +4,10 @@ package linkcheck
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/tools"
 )
@@ -14,11 +16,44 @@ var linkRe = regexp.MustCompile(`(?m)\b(http|ftp|https):\/\/([\w_-]+(?:(?:\.[\w_
 
 // RunTests will run all tests on an HTML string
 func RunTests(msg *storage.Message, followRedirects bool) (Response, error) {
-	s := Response{}
+	s := Response{Links: []Link{}, checkedAt: time.Now()}
 
 	allLinks := extractHTMLLinks(msg)
 	allLinks = strUnique(append(allLinks, extractTextLinks(msg)...))
-	s.Links = getHTTPStatuses(allLinks, followRedirects)
+
+	// links of a message which have already been checked are not checked again
+	cached, err := storage.GetLinkChecks(msg.ID, followRedirects)
+	if err != nil {
+		return s, err
+	}
+
+	links := []string{}
+	for _, l := range allLinks {
+		if c, ok := cached[l]; ok {
+			s.Links = append(s.Links, Link{URL: c.URL, StatusCode: c.StatusCode, Status: c.Status})
+			if c.CheckedAt.Before(s.checkedAt) {
+				s.checkedAt = c.CheckedAt
+			}
+		} else {
+			links = append(links, l)
+		}
+	}
+
+	checked := getHTTPStatuses(links, followRedirects)
+	s.Links = append(s.Links, checked...)
+
+	// connection errors & timeouts are not cached, as these are often temporary
+	toCache := []storage.LinkCheck{}
+	now := time.Now()
+	for _, l := range checked {
+		if l.StatusCode != 0 {
+			toCache = append(toCache, storage.LinkCheck{URL: l.URL, StatusCode: l.StatusCode, Status: l.Status, CheckedAt: now})
+		}
+	}
+
+	if err := storage.SetLinkChecks(msg.ID, followRedirects, toCache); err != nil {
+		logger.Log().Errorf("[link-check] error caching link checks: %s", err.Error())
+	}
 
 	for _, l := range s.Links {
 		if l.StatusCode >= 400 || l.StatusCode == 0 {
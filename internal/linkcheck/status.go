@@ -5,12 +5,15 @@ import (
 	"net/http"
 	"regexp"
 	"sync"
-	"time"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
+// HTTPTransport is used for link check requests, allowing the HTTP client to be mocked.
+// The default transport is used if nil.
+var httpTransport http.RoundTripper
+
 func getHTTPStatuses(links []string, followRedirects bool) []Link {
 	// allow 5 threads
 	threads := make(chan int, 5)
@@ -58,16 +61,19 @@ func getHTTPStatuses(links []string, followRedirects bool) []Link {
 // Do a HEAD request to return HTTP status code
 func doHead(link string, followRedirects bool) (int, error) {
 
-	timeout := time.Duration(10 * time.Second)
+	var tr http.RoundTripper = httpTransport
+	if tr == nil {
+		t := &http.Transport{}
 
-	tr := &http.Transport{}
+		if config.AllowUntrustedTLS {
+			t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec
+		}
 
-	if config.AllowUntrustedTLS {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec
+		tr = t
 	}
 
 	client := http.Client{
-		Timeout:   timeout,
+		Timeout:   config.LinkCheckTimeout,
 		Transport: tr,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if followRedirects {
@@ -1,5 +1,7 @@
 package linkcheck
 
+import "time"
+
 // Response represents the Link check response
 //
 // swagger:model LinkCheckResponse
@@ -8,6 +10,15 @@ type Response struct {
 	Errors int `json:"Errors"`
 	// Tested links
 	Links []Link `json:"Links"`
+
+	// time the oldest (possibly cached) link was checked
+	checkedAt time.Time
+}
+
+// CheckedAt returns the time the oldest link of the response was checked,
+// which is earlier than the response if any cached link checks were used
+func (r Response) CheckedAt() time.Time {
+	return r.checkedAt
 }
 
 // Link struct
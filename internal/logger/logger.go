@@ -4,6 +4,7 @@ package logger
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -21,6 +22,12 @@ var (
 	NoLogging bool
 	// LogFile sets a log file
 	LogFile string
+	// SyslogEnabled sends log entries to the system syslog daemon
+	SyslogEnabled bool
+	// SyslogFacility is the syslog facility, eg: daemon, user, mail or local0-local7
+	SyslogFacility = "daemon"
+	// SyslogTag is the syslog tag (program name)
+	SyslogTag = "mailpit"
 )
 
 // Log returns the logger instance
@@ -51,6 +58,19 @@ func Log() *logrus.Logger {
 			log.Out = os.Stdout
 		}
 
+		if SyslogEnabled {
+			hook, err := NewSyslogHook(SyslogFacility, SyslogTag)
+			if err == nil {
+				log.AddHook(hook)
+				if LogFile == "" {
+					// log to syslog only, unless also logging to a file
+					log.Out = io.Discard
+				}
+			} else {
+				log.Warnf("Failed to log to syslog: %s", err.Error())
+			}
+		}
+
 		log.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp:   true,
 			TimestampFormat: "2006/01/02 15:04:05",
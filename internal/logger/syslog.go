@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// syslogFacilities are the supported syslog facility names
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"mail":   syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"syslog": syslog.LOG_SYSLOG,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// NewSyslogHook returns a logrus hook sending log entries to the local syslog daemon using
+// the facility & tag, with the syslog severity matching the level of each entry
+func NewSyslogHook(facility, tag string) (logrus.Hook, error) {
+	return newSyslogHook("", "", facility, tag)
+}
+
+// NewSyslogHook connects to the syslog daemon at raddr using network,
+// or the local syslog daemon if network is empty
+func newSyslogHook(network, raddr, facility, tag string) (logrus.Hook, error) {
+	p, ok := syslogFacilities[strings.ToLower(strings.TrimSpace(facility))]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog facility: %s", facility)
+	}
+
+	return lSyslog.NewSyslogHook(network, raddr, p|syslog.LOG_INFO, tag)
+}
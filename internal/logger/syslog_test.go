@@ -0,0 +1,79 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSyslogHook(t *testing.T) {
+	if _, err := NewSyslogHook("invalid", "mailpit"); err == nil || !strings.Contains(err.Error(), "invalid syslog facility") {
+		t.Fatalf("expected an invalid facility error, got %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hook, err := newSyslogHook("udp", conn.LocalAddr().String(), "Mail", "mailpit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.Out = io.Discard
+	l.SetLevel(logrus.InfoLevel)
+	l.AddHook(hook)
+
+	read := func() string {
+		t.Helper()
+
+		buf := make([]byte, 1024)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(buf[:n])
+	}
+
+	// the priority is the facility (mail = 2) * 8 + the severity of the level
+	tests := []struct {
+		log      func(...interface{})
+		msg      string
+		priority string
+	}{
+		{l.Error, "error message", "<19>"},
+		{l.Warn, "warning message", "<20>"},
+		{l.Info, "info message", "<22>"},
+	}
+
+	for _, test := range tests {
+		test.log(test.msg)
+
+		p := read()
+		if !strings.HasPrefix(p, test.priority) {
+			t.Errorf("expected priority %s for %q, got %q", test.priority, test.msg, p)
+		}
+		if !strings.Contains(p, "mailpit-test") || !strings.Contains(p, test.msg) {
+			t.Errorf("expected the tag & message in %q", p)
+		}
+	}
+
+	// entries below the log level are not sent
+	l.Debug("debug message")
+	l.Info("after debug")
+
+	if p := read(); !strings.Contains(p, "after debug") {
+		t.Errorf("expected only entries at the log level to be sent, got %q", p)
+	}
+}
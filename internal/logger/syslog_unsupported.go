@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logger
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewSyslogHook is not supported on this platform
+func NewSyslogHook(_, _ string) (logrus.Hook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
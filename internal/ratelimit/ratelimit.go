@@ -0,0 +1,68 @@
+// Package ratelimit tracks the connection frequency of SMTP clients
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+var (
+	// Window is the period over which client connections are counted
+	Window = time.Minute
+
+	mu          sync.Mutex
+	connections = map[string][]time.Time{}
+	lastCleanup time.Time
+)
+
+// RecordConnection records a new connection from the IP address
+func RecordConnection(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+
+	// periodically remove clients without any recent connections
+	if now.Sub(lastCleanup) > Window {
+		for k, times := range connections {
+			if len(recent(times, now)) == 0 {
+				delete(connections, k)
+			}
+		}
+		lastCleanup = now
+	}
+
+	k := ip.String()
+	connections[k] = append(recent(connections[k], now), now)
+}
+
+// ShouldTarpit returns whether the IP address has connected more than config.SMTPTarpitThreshold
+// times within the Window
+func ShouldTarpit(ip net.IP) bool {
+	if ip == nil || config.SMTPTarpitThreshold < 1 {
+		return false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return len(recent(connections[ip.String()], time.Now())) > config.SMTPTarpitThreshold
+}
+
+// Recent returns the connection times within the Window
+func recent(times []time.Time, now time.Time) []time.Time {
+	for i, t := range times {
+		if now.Sub(t) <= Window {
+			return times[i:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestShouldTarpit(t *testing.T) {
+	config.SMTPTarpitThreshold = 3
+	defer func() { config.SMTPTarpitThreshold = 10 }()
+
+	ip := net.ParseIP("192.0.2.1")
+	other := net.ParseIP("192.0.2.2")
+
+	for i := 0; i < 3; i++ {
+		RecordConnection(ip)
+	}
+
+	if ShouldTarpit(ip) {
+		t.Error("client should not be tarpitted at the threshold")
+	}
+
+	RecordConnection(ip)
+
+	if !ShouldTarpit(ip) {
+		t.Error("client should be tarpitted above the threshold")
+	}
+
+	if ShouldTarpit(other) {
+		t.Error("other clients should not be tarpitted")
+	}
+
+	Window = 50 * time.Millisecond
+	defer func() { Window = time.Minute }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if ShouldTarpit(ip) {
+		t.Error("client should not be tarpitted once the connections have expired")
+	}
+}
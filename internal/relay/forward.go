@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+)
+
+// ForwardMatching forwards a new message to the addresses of all forwarding rules matching
+// the message headers. Messages are forwarded in the background if config.ForwardAsync is set.
+func ForwardMatching(id string, header mail.Header) {
+	for _, r := range config.ForwardRules {
+		if !forwardRuleMatches(r, header) {
+			continue
+		}
+
+		if config.ForwardAsync {
+			go forward(id, r.ForwardTo)
+		} else {
+			forward(id, r.ForwardTo)
+		}
+	}
+}
+
+// ErrForwardHostNotAllowed is returned when forwarding via an SMTP server which is neither
+// the pre-configured SMTP relay server nor one of the allowed forward hosts
+var ErrForwardHostNotAllowed = errors.New("SMTP server not allowed")
+
+// ForwardMessage forwards a stored message to one or more addresses via the given SMTP server
+// address (host:port), or the pre-configured SMTP server if smtpAddr is empty. The message is
+// sent unchanged, excluding any Bcc header. The relay recipient allowlist applies to all servers.
+func ForwardMessage(id string, to []string, smtpAddr string) error {
+	rc := &config.SMTPRelayConfig
+	if smtpAddr != "" && !strings.EqualFold(smtpAddr, net.JoinHostPort(rc.Host, strconv.Itoa(rc.Port))) {
+		host, p, err := net.SplitHostPort(smtpAddr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address: %s", smtpAddr)
+		}
+
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid SMTP port: %s", p)
+		}
+
+		if !forwardHostAllowed(smtpAddr) {
+			return ErrForwardHostNotAllowed
+		}
+
+		rc = &config.SMTPRelayConfigStruct{
+			Host:                    host,
+			Port:                    port,
+			Auth:                    "none",
+			AllowedRecipients:       rc.AllowedRecipients,
+			AllowedRecipientsRegexp: rc.AllowedRecipientsRegexp,
+		}
+	} else if rc.Host == "" {
+		return errors.New("relay host not set")
+	}
+
+	msg, err := storage.GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+
+	from := strings.Trim(m.Header.Get("Return-Path"), "<>")
+	if froms, err := m.Header.AddressList("From"); from == "" && err == nil && len(froms) > 0 {
+		from = froms[0].Address
+	}
+
+	msg, err = tools.RemoveMessageHeaders(msg, []string{"Bcc"})
+	if err != nil {
+		return err
+	}
+
+	// set the Return-Path and SMTP mfrom
+	if rc.ReturnPath != "" {
+		if m.Header.Get("Return-Path") != "<"+rc.ReturnPath+">" {
+			msg, err = tools.RemoveMessageHeaders(msg, []string{"Return-Path"})
+			if err != nil {
+				return err
+			}
+			msg = append([]byte("Return-Path: <"+rc.ReturnPath+">\r\n"), msg...)
+		}
+
+		from = rc.ReturnPath
+	}
+
+	return Send(rc, from, to, msg, nil)
+}
+
+// Returns whether the SMTP address is one of the allowed forward hosts
+func forwardHostAllowed(smtpAddr string) bool {
+	for _, h := range config.ForwardAllowedHosts {
+		if strings.EqualFold(strings.TrimSpace(h), smtpAddr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func forward(id string, to []string) {
+	if err := ForwardMessage(id, to, ""); err != nil {
+		logger.Log().Warnf("[smtp] error forwarding message %s: %s", id, err.Error())
+		return
+	}
+
+	logger.Log().Debugf("[smtp] forwarded message %s to %s", id, strings.Join(to, ", "))
+}
+
+// Returns whether any of the header values of the rule's match field contain the match value
+func forwardRuleMatches(r config.ForwardRule, header mail.Header) bool {
+	for _, v := range header[textproto.CanonicalMIMEHeaderKey(r.MatchField)] {
+		if strings.Contains(strings.ToLower(v), strings.ToLower(r.MatchValue)) {
+			return true
+		}
+	}
+
+	return false
+}
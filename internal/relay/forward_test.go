@@ -0,0 +1,31 @@
+package relay
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestForwardRuleMatches(t *testing.T) {
+	header := mail.Header{
+		"To":      []string{"Alice <alice@example.com>"},
+		"Subject": []string{"Your Order Confirmation"},
+	}
+
+	tests := []struct {
+		rule     config.ForwardRule
+		expected bool
+	}{
+		{config.ForwardRule{MatchField: "to", MatchValue: "ALICE@example.com"}, true},
+		{config.ForwardRule{MatchField: "Subject", MatchValue: "order"}, true},
+		{config.ForwardRule{MatchField: "Subject", MatchValue: "invoice"}, false},
+		{config.ForwardRule{MatchField: "Cc", MatchValue: "alice"}, false},
+	}
+
+	for _, test := range tests {
+		if res := forwardRuleMatches(test.rule, header); res != test.expected {
+			t.Errorf("forward rule %s:%s: expected %v, got %v", test.rule.MatchField, test.rule.MatchValue, test.expected, res)
+		}
+	}
+}
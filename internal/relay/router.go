@@ -0,0 +1,112 @@
+// Package relay handles the routing of new messages to relay SMTP servers
+package relay
+
+import (
+	"math/rand"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"github.com/axllent/mailpit/config"
+)
+
+var (
+	// next rule index per recipient domain for the round-robin strategy
+	roundRobin   = map[string]int{}
+	roundRobinMu sync.Mutex
+)
+
+// Route is a relay server and the recipients to relay a message to via that server
+type Route struct {
+	Config     *config.SMTPRelayConfigStruct
+	Recipients []string
+}
+
+// Routes returns the relay routes for the recipients of a new message. Each recipient uses a relay
+// rule matching its domain (selected using config.SMTPRelayStrategy), falling back to the global relay server if all incoming
+// messages are relayed. Recipients without a matching route are not relayed (stored only).
+func Routes(to []string) []Route {
+	routes := []Route{}
+	index := map[*config.SMTPRelayConfigStruct]int{}
+
+	for _, recipient := range to {
+		c := match(recipient)
+		if c == nil {
+			continue
+		}
+
+		i, ok := index[c]
+		if !ok {
+			i = len(routes)
+			index[c] = i
+			routes = append(routes, Route{Config: c})
+		}
+
+		routes[i].Recipients = append(routes[i].Recipients, recipient)
+	}
+
+	return routes
+}
+
+// Match returns the relay server config for a recipient, or nil if it should not be relayed
+func match(recipient string) *config.SMTPRelayConfigStruct {
+	if r := SelectRelay(config.SMTPRelayRules, recipient, config.SMTPRelayStrategy); r != nil {
+		return &r.SMTPConfig
+	}
+
+	if config.SMTPRelayAllIncoming && config.SMTPRelayConfig.Host != "" {
+		return &config.SMTPRelayConfig
+	}
+
+	return nil
+}
+
+// SelectRelay returns the relay rule to use for a recipient, or nil if no rules match its domain.
+// If multiple rules match, the strategy determines which is used: "round-robin" rotates through
+// the matching rules, "random" selects one at random, and "first-match" (default) uses the first.
+func SelectRelay(rules []config.RelayRule, recipient string, strategy string) *config.RelayRule {
+	domain := recipientDomain(recipient)
+	if domain == "" {
+		return nil
+	}
+
+	matches := []int{}
+	for i, r := range rules {
+		if r.RecipientDomain == domain {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	switch strategy {
+	case "round-robin":
+		roundRobinMu.Lock()
+		n := roundRobin[domain] % len(matches)
+		roundRobin[domain] = n + 1
+		roundRobinMu.Unlock()
+
+		return &rules[matches[n]]
+	case "random":
+		return &rules[matches[rand.Intn(len(matches))]]
+	default:
+		return &rules[matches[0]]
+	}
+}
+
+// RecipientDomain returns the lowercase domain of an email address
+func recipientDomain(recipient string) string {
+	address := recipient
+	if a, err := mail.ParseAddress(recipient); err == nil {
+		address = a.Address
+	}
+
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(address[i+1:])
+}
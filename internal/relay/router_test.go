@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestRoutes(t *testing.T) {
+	config.SMTPRelayRules = []config.RelayRule{
+		{RecipientDomain: "example.com", SMTPConfig: config.SMTPRelayConfigStruct{Host: "smtp.example.com"}},
+		{RecipientDomain: "example.net", SMTPConfig: config.SMTPRelayConfigStruct{Host: "smtp.example.net"}},
+		{RecipientDomain: "example.com", SMTPConfig: config.SMTPRelayConfigStruct{Host: "ignored.example.com"}},
+	}
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: "smtp.global.com"}
+
+	defer func() {
+		config.SMTPRelayRules = nil
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
+		config.SMTPRelayAllIncoming = false
+	}()
+
+	to := []string{"one@example.com", "two@Example.NET", "three@example.org", "four@EXAMPLE.com"}
+
+	routes := Routes(to)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+
+	assertRoute(t, routes[0], "smtp.example.com", []string{"one@example.com", "four@EXAMPLE.com"})
+	assertRoute(t, routes[1], "smtp.example.net", []string{"two@Example.NET"})
+
+	// unmatched recipients relayed via the global relay server
+	config.SMTPRelayAllIncoming = true
+
+	routes = Routes(to)
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+
+	assertRoute(t, routes[2], "smtp.global.com", []string{"three@example.org"})
+}
+
+func TestSelectRelay(t *testing.T) {
+	rules := []config.RelayRule{
+		{RecipientDomain: "example.com", SMTPConfig: config.SMTPRelayConfigStruct{Host: "one.example.com"}},
+		{RecipientDomain: "example.net", SMTPConfig: config.SMTPRelayConfigStruct{Host: "smtp.example.net"}},
+		{RecipientDomain: "example.com", SMTPConfig: config.SMTPRelayConfigStruct{Host: "two.example.com"}},
+	}
+
+	if r := SelectRelay(rules, "test@example.org", "first-match"); r != nil {
+		t.Errorf("expected no relay rule, got %s", r.SMTPConfig.Host)
+	}
+
+	for i := 0; i < 3; i++ {
+		if r := SelectRelay(rules, "test@example.com", "first-match"); r == nil || r.SMTPConfig.Host != "one.example.com" {
+			t.Errorf("expected first matching relay rule")
+		}
+	}
+
+	hosts := []string{}
+	for i := 0; i < 4; i++ {
+		r := SelectRelay(rules, "test@Example.com", "round-robin")
+		if r == nil {
+			t.Fatalf("expected a relay rule")
+		}
+		hosts = append(hosts, r.SMTPConfig.Host)
+	}
+
+	expected := []string{"one.example.com", "two.example.com", "one.example.com", "two.example.com"}
+	for i, h := range expected {
+		if hosts[i] != h {
+			t.Errorf("expected round-robin relay host %s, got %s", h, hosts[i])
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		r := SelectRelay(rules, "test@example.com", "random")
+		if r == nil || r.RecipientDomain != "example.com" {
+			t.Errorf("expected a random matching relay rule")
+		}
+	}
+}
+
+func assertRoute(t *testing.T, r Route, host string, recipients []string) {
+	if r.Config.Host != host {
+		t.Errorf("expected relay host %s, got %s", host, r.Config.Host)
+	}
+
+	if len(r.Recipients) != len(recipients) {
+		t.Errorf("expected %d recipients for %s, got %d", len(recipients), host, len(r.Recipients))
+		return
+	}
+
+	for i, rcpt := range recipients {
+		if r.Recipients[i] != rcpt {
+			t.Errorf("expected recipient %s for %s, got %s", rcpt, host, r.Recipients[i])
+		}
+	}
+}
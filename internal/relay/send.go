@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/smtp"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// Params are optional ESMTP parameters of the MAIL & RCPT commands (eg: DSN),
+// which are only sent if the relay server supports the SMTP extension
+type Params struct {
+	// SMTP extension the parameters require, eg: DSN
+	Extension string
+	// MAIL command parameters
+	Mail string
+	// RCPT command parameters, keyed by recipient address
+	Rcpt map[string]string
+}
+
+// Send will connect to the given SMTP relay server and send a message to one or more recipients.
+func Send(rc *config.SMTPRelayConfigStruct, from string, to []string, msg []byte, params *Params) error {
+	recipients := allowedRecipients(rc, to)
+
+	if len(recipients) == 0 {
+		return errors.New("no valid recipients")
+	}
+
+	addr := fmt.Sprintf("%s:%d", rc.Host, rc.Port)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %s", addr, err.Error())
+	}
+
+	defer c.Close()
+
+	if rc.STARTTLS {
+		conf := &tls.Config{ServerName: rc.Host} // #nosec
+
+		conf.InsecureSkipVerify = rc.AllowInsecure
+
+		if err = c.StartTLS(conf); err != nil {
+			return fmt.Errorf("error creating StartTLS config: %s", err.Error())
+		}
+	}
+
+	auth := authFromConfig(rc)
+
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			return fmt.Errorf("error response to AUTH command: %s", err.Error())
+		}
+	}
+
+	if params != nil {
+		if ok, _ := c.Extension(params.Extension); !ok {
+			logger.Log().Debugf("[smtp] %s does not support %s, ignoring %s parameters", addr, params.Extension, params.Extension)
+			params = nil
+		}
+	}
+
+	if params != nil {
+		err = relayCmd(c, 250, "MAIL FROM:<%s>%s", from, params.Mail)
+	} else {
+		err = c.Mail(from)
+	}
+	if err != nil {
+		return fmt.Errorf("error response to MAIL command: %s", err.Error())
+	}
+
+	for _, addr := range recipients {
+		if params != nil {
+			err = relayCmd(c, 25, "RCPT TO:<%s>%s", addr, params.Rcpt[addr])
+		} else {
+			err = c.Rcpt(addr)
+		}
+		if err != nil {
+			logger.Log().Warnf("error response to RCPT command for %s: %s", addr, err.Error())
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error response to DATA command: %s", err.Error())
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error sending message: %s", err.Error())
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error closing connection: %s", err.Error())
+	}
+
+	return c.Quit()
+}
+
+func allowedRecipients(rc *config.SMTPRelayConfigStruct, to []string) []string {
+	if rc.AllowedRecipientsRegexp == nil {
+		return to
+	}
+
+	var ar []string
+
+	for _, recipient := range to {
+		address, err := mail.ParseAddress(recipient)
+
+		if err != nil {
+			logger.Log().Warnf("ignoring invalid email address: %s", recipient)
+			continue
+		}
+
+		if !rc.AllowedRecipientsRegexp.MatchString(address.Address) {
+			logger.Log().Debugf("[smtp] not allowed to relay to %s: does not match the allowlist %s", recipient, rc.AllowedRecipients)
+		} else {
+			ar = append(ar, recipient)
+		}
+	}
+
+	return ar
+}
+
+// Send a raw command to the SMTP server and read the response
+func relayCmd(c *smtp.Client, expectCode int, format string, args ...interface{}) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, _, err = c.Text.ReadResponse(expectCode)
+
+	return err
+}
+
+// Return the SMTP relay authentication based on config
+func authFromConfig(rc *config.SMTPRelayConfigStruct) smtp.Auth {
+	var a smtp.Auth
+
+	if rc.Auth == "plain" {
+		a = smtp.PlainAuth("", rc.Username, rc.Password, rc.Host)
+	}
+
+	if rc.Auth == "login" {
+		a = LoginAuth(rc.Username, rc.Password)
+	}
+
+	if rc.Auth == "cram-md5" {
+		a = smtp.CRAMMD5Auth(rc.Username, rc.Secret)
+	}
+
+	return a
+}
+
+// Custom implementation of LOGIN SMTP authentication
+// @see https://gist.github.com/andelf/5118732
+type loginAuth struct {
+	username, password string
+}
+
+// LoginAuth authentication
+func LoginAuth(username, password string) smtp.Auth {
+	return &loginAuth{username, password}
+}
+
+func (a *loginAuth) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", []byte{}, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		switch string(fromServer) {
+		case "Username:":
+			return []byte(a.username), nil
+		case "Password:":
+			return []byte(a.password), nil
+		default:
+			return nil, errors.New("Unknown fromServer")
+		}
+	}
+
+	return nil, nil
+}
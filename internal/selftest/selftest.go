@@ -0,0 +1,194 @@
+// Package selftest sends a test message through the SMTP server on startup
+package selftest
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/relay"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// Timeout is the maximum time allowed for the test message to be delivered & stored
+var Timeout = 5 * time.Second
+
+// RunSelfTest sends a test message to the SMTP server listening on smtpAddr and verifies
+// that it is stored in the database within the timeout. The test message is deleted afterwards.
+func RunSelfTest(smtpAddr string) error {
+	deadline := time.Now().Add(Timeout)
+	addr := dialAddr(smtpAddr)
+	messageID := shortuuid.New() + "@mailpit.selftest"
+
+	// the SMTP server accepts a one-time password for the duration of the self-test
+	password := shortuuid.New()
+	auth.SetSelfTestPassword(password)
+	defer auth.SetSelfTestPassword("")
+
+	// the test message is not relayed, forwarded or sent to webhooks
+	auth.SetSelfTestMessageID(messageID)
+	defer auth.SetSelfTestMessageID("")
+
+	if err := sendTestMessage(addr, messageID, password, deadline); err != nil {
+		return fmt.Errorf("[selftest] %s", err.Error())
+	}
+
+	for time.Now().Before(deadline) {
+		results, _, err := storage.Search("message-id:"+messageID, 0, 1)
+		if err != nil {
+			return fmt.Errorf("[selftest] %s", err.Error())
+		}
+
+		if len(results) == 1 {
+			if err := storage.DeleteOneMessage(results[0].ID); err != nil {
+				logger.Log().Warnf("[selftest] unable to delete test message: %s", err.Error())
+			}
+
+			logger.Log().Info("[selftest] test message successfully received")
+
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("[selftest] test message not stored within %s", Timeout)
+}
+
+// SendTestMessage delivers the test message, retrying the connection until the
+// SMTP server is accepting connections or the deadline is reached
+func sendTestMessage(addr, messageID, password string, deadline time.Time) error {
+	var conn net.Conn
+	var err error
+
+	for {
+		if config.SMTPRequireTLS {
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true}) // #nosec
+		} else {
+			conn, err = net.DialTimeout("tcp", addr, time.Second)
+		}
+
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_ = conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(addr)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !config.SMTPRequireTLS {
+		if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil { // #nosec
+			return err
+		}
+	}
+
+	if ok, mechs := c.Extension("AUTH"); ok && (auth.SMTPCredentials != nil || config.SMTPAuthAcceptAny) {
+		if err := c.Auth(smtpAuth(mechs, password)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail("selftest@mailpit.local"); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(config.SelfTestRecipient); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	msg := strings.Join([]string{
+		"From: Mailpit <selftest@mailpit.local>",
+		"To: <" + config.SelfTestRecipient + ">",
+		"Subject: Mailpit self-test",
+		"Message-ID: <" + messageID + ">",
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"",
+		"This is a Mailpit startup self-test message.",
+		"",
+	}, "\r\n")
+
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// SmtpAuth returns the PLAIN authentication of the self-test user if advertised, else LOGIN
+func smtpAuth(mechs, password string) smtp.Auth {
+	for _, m := range strings.Fields(strings.ToUpper(mechs)) {
+		if m == "PLAIN" {
+			return &plainAuth{username: auth.SelfTestUser, password: password}
+		}
+	}
+
+	return relay.LoginAuth(auth.SelfTestUser, password)
+}
+
+// PlainAuth is PLAIN authentication without the net/smtp requirement for TLS, as the
+// SMTP server only advertises PLAIN without TLS when insecure authentication is allowed
+type plainAuth struct {
+	username, password string
+}
+
+func (a *plainAuth) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+
+	return nil, nil
+}
+
+// DialAddr returns a dialable address for the SMTP listen address,
+// replacing unspecified (all interfaces) hosts with localhost
+func dialAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port)
+}
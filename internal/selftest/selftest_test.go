@@ -0,0 +1,161 @@
+package selftest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/axllent/mailpit/server/webhook"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	setup(t)
+	defer storage.Close()
+
+	if err := RunSelfTest(listen(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStorageEmpty(t)
+}
+
+func TestRunSelfTestAuth(t *testing.T) {
+	setup(t)
+	defer storage.Close()
+
+	if err := auth.SetSMTPAuth("user:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	config.SMTPAuthAllowInsecure = true
+	config.SelfTestRecipient = "selftest@example.com"
+	config.SMTPAllowedRecipientsRegexp = regexp.MustCompile(`@example\.com$`)
+	defer func() {
+		auth.SMTPCredentials = nil
+		config.SMTPAuthAllowInsecure = false
+		config.SelfTestRecipient = "selftest@mailpit.local"
+		config.SMTPAllowedRecipientsRegexp = nil
+	}()
+
+	if err := RunSelfTest(listen(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStorageEmpty(t)
+
+	// the one-time password is revoked once the self-test completes
+	if auth.SelfTestLogin(auth.SelfTestUser, "") {
+		t.Error("self-test login accepted after the self-test")
+	}
+}
+
+func TestRunSelfTestSideEffects(t *testing.T) {
+	setup(t)
+	defer storage.Close()
+
+	relayed := make(chan []byte, 2)
+	relay := &smtpd.Server{
+		Hostname: "localhost",
+		Appname:  "Relay",
+		Handler: func(_ net.Addr, _ string, _ string, _ []string, data []byte, _ *smtpd.DSN) error {
+			relayed <- data
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	webhooks := make(chan []byte, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		webhooks <- b
+	}))
+	defer ts.Close()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	config.SMTPRelayConfig.Host = host
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	config.SMTPRelayAllIncoming = true
+	config.WebhookURL = ts.URL
+	webhook.RateLimit = 0
+	defer func() {
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
+		config.SMTPRelayAllIncoming = false
+		config.WebhookURL = ""
+		webhook.RateLimit = 1
+	}()
+
+	addr := listen(t)
+
+	if err := RunSelfTest(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// the self-test message is neither relayed nor sent to the webhook, unlike other messages
+	msg := "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Regular\r\n\r\nTest\r\n"
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{"recipient@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := <-relayed; !bytes.Contains(data, []byte("Subject: Regular")) {
+		t.Errorf("expected only the regular message to be relayed, got %q", data)
+	}
+
+	select {
+	case data := <-webhooks:
+		if !bytes.Contains(data, []byte(`"Subject":"Regular"`)) {
+			t.Errorf("expected only the regular message to be sent to the webhook, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the regular message to be sent to the webhook")
+	}
+}
+
+func setup(t *testing.T) {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Listen starts the SMTP server on a free local port, returning its address
+func listen(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	smtpListen := config.SMTPListen
+	config.SMTPListen = addr
+	t.Cleanup(func() { config.SMTPListen = smtpListen })
+
+	go func() { _ = smtpd.Listen() }()
+
+	return addr
+}
+
+func assertStorageEmpty(t *testing.T) {
+	if total := storage.CountTotal(); total != 0 {
+		t.Errorf("expected the test message to be deleted, got %d messages", total)
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/updater"
+	"github.com/axllent/mailpit/server/metrics"
 )
 
 var (
@@ -38,6 +40,8 @@ type AppInformation struct {
 	Database string
 	// Database size in bytes
 	DatabaseSize int64
+	// Database logical & physical size details
+	DatabaseSizeInfo storage.DBSizeInfo
 	// Total number of messages in the database
 	Messages int
 	// Total number of messages in the database
@@ -103,6 +107,12 @@ func Load() AppInformation {
 		info.DatabaseSize = db.Size()
 	}
 
+	sizeInfo, err := storage.GetDatabaseSize()
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+	info.DatabaseSizeInfo = sizeInfo
+
 	info.Messages = storage.CountTotal()
 	info.Unread = storage.CountUnread()
 
@@ -122,6 +132,8 @@ func LogSMTPAccepted(size int) {
 	smtpAccepted = smtpAccepted + 1
 	smtpAcceptedSize = smtpAcceptedSize + size
 	mu.Unlock()
+
+	metrics.SMTPReceived()
 }
 
 // LogSMTPRejected logs a rejected SMTP transaction
@@ -129,6 +141,8 @@ func LogSMTPRejected() {
 	mu.Lock()
 	smtpRejected = smtpRejected + 1
 	mu.Unlock()
+
+	metrics.SMTPError()
 }
 
 // LogSMTPIgnored logs an ignored SMTP transaction
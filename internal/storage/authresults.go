@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"strings"
+)
+
+// ParseAuthenticationResults parses the method results of Authentication-Results headers
+// (RFC 8601), eg: `mx.example.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com`.
+// The results are not verified, they are returned as written by the receiving server.
+// Commonly seen malformed headers, such as a missing authserv-id or multiple methods
+// without a semicolon separator, are also handled.
+func parseAuthenticationResults(headers []string) []AuthResult {
+	results := []AuthResult{}
+
+	for _, h := range headers {
+		for i, segment := range splitQuoted(stripHeaderComments(h), ';') {
+			tokens := strings.Fields(segment)
+			if len(tokens) == 0 {
+				continue
+			}
+
+			// the first segment is the authserv-id (with optional version), unless missing
+			if i == 0 && !strings.Contains(tokens[0], "=") {
+				continue
+			}
+
+			var r *AuthResult
+			for _, token := range splitQuoted(segment, ' ', '\t', '\r', '\n') {
+				k, v, found := strings.Cut(strings.TrimSpace(token), "=")
+				if !found || k == "" {
+					continue
+				}
+
+				k = strings.ToLower(k)
+				v = strings.Trim(strings.TrimSpace(v), `"`)
+
+				if isAuthMethod(k) {
+					if r != nil {
+						results = append(results, *r)
+					}
+
+					// strip the optional method version, eg: dkim/1
+					method, _, _ := strings.Cut(k, "/")
+					r = &AuthResult{Method: method, Result: strings.ToLower(v), Properties: map[string]string{}}
+					continue
+				}
+
+				if r != nil {
+					r.Properties[k] = v
+				}
+			}
+
+			if r != nil {
+				results = append(results, *r)
+			}
+		}
+	}
+
+	return results
+}
+
+// IsAuthMethod returns whether a key is a method (eg: spf) rather than a property (eg: smtp.mailfrom).
+// Properties are always in the ptype.property format, apart from the reason (and non-standard action).
+func isAuthMethod(k string) bool {
+	return !strings.Contains(k, ".") && k != "reason" && k != "action"
+}
+
+// StripHeaderComments removes (nested) comments from a structured header value, ignoring
+// parentheses within quoted strings
+func stripHeaderComments(v string) string {
+	var b strings.Builder
+	depth := 0
+	quoted := false
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '\\' && i+1 < len(v):
+			if depth == 0 {
+				b.WriteByte(c)
+				b.WriteByte(v[i+1])
+			}
+			i++
+		case c == '"' && depth == 0:
+			quoted = !quoted
+			b.WriteByte(c)
+		case c == '(' && !quoted:
+			depth++
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			if depth == 0 {
+				b.WriteByte(' ')
+			}
+		case depth == 0:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// SplitQuoted splits a string by any of the separators, ignoring separators within quoted strings
+func splitQuoted(v string, separators ...byte) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == '"' {
+			quoted = !quoted
+			continue
+		}
+
+		if quoted {
+			continue
+		}
+
+		for _, s := range separators {
+			if c == s {
+				parts = append(parts, v[start:i])
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	return append(parts, v[start:])
+}
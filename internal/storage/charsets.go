@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// GetMessageCharsets returns the charset of each text part (plain, HTML, calendar etc.) of a message,
+// keyed by part ID. The charset is read from the Content-Type header of the part, or is empty if the
+// part does not specify a charset.
+func GetMessageCharsets(id string) (map[string]string, error) {
+	charsets := make(map[string]string)
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return charsets, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return charsets, err
+	}
+
+	for _, p := range env.Root.DepthMatchAll(func(p *enmime.Part) bool {
+		return strings.HasPrefix(p.ContentType, "text/")
+	}) {
+		charset := ""
+		if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil {
+			charset = params["charset"]
+		}
+
+		charsets[p.PartID] = charset
+	}
+
+	return charsets, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// LogSMTPConnection records an inbound SMTP connection if the connection log is enabled
+// (config.SMTPConnectionLogEnabled)
+func LogSMTPConnection(c SMTPConnection) {
+	if !config.SMTPConnectionLogEnabled {
+		return
+	}
+
+	if c.DisconnectedAt.IsZero() {
+		c.DisconnectedAt = time.Now()
+	}
+
+	if c.ConnectedAt.IsZero() {
+		c.ConnectedAt = c.DisconnectedAt
+	}
+
+	if _, err := sqlf.InsertInto("smtp_connections").
+		Set("RemoteAddr", c.RemoteAddr).
+		Set("ConnectedAt", c.ConnectedAt.UnixMilli()).
+		Set("DisconnectedAt", c.DisconnectedAt.UnixMilli()).
+		Set("MessagesDelivered", c.MessagesDelivered).
+		Set("BytesReceived", c.BytesReceived).
+		Set("EHLOHostname", c.EHLOHostname).
+		ExecAndClose(nil, db); err != nil {
+		logger.Log().Errorf("[db] error logging SMTP connection: %s", err.Error())
+	}
+}
+
+// GetRecentConnections returns a subset of the logged SMTP connections, sorted latest to oldest,
+// as well as the total number of logged connections
+func GetRecentConnections(start, limit int) ([]SMTPConnection, int, error) {
+	results := []SMTPConnection{}
+	var total int
+
+	q := sqlf.From("smtp_connections").
+		Select("RemoteAddr, ConnectedAt, DisconnectedAt, MessagesDelivered, BytesReceived, EHLOHostname").
+		OrderBy("ConnectedAt DESC", "ID DESC").
+		Limit(limit).
+		Offset(start)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var c SMTPConnection
+		var connected, disconnected int64
+
+		if err := row.Scan(&c.RemoteAddr, &connected, &disconnected, &c.MessagesDelivered, &c.BytesReceived, &c.EHLOHostname); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		c.ConnectedAt = time.UnixMilli(connected)
+		c.DisconnectedAt = time.UnixMilli(disconnected)
+
+		results = append(results, c)
+	}); err != nil {
+		return results, 0, err
+	}
+
+	if err := sqlf.From("smtp_connections").
+		Select("COUNT(*)").To(&total).
+		QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	return results, total, nil
+}
+
+// PruneSMTPConnections removes logged SMTP connections older than config.SMTPConnectionLogRetention
+func pruneSMTPConnections() {
+	if config.SMTPConnectionLogRetention <= 0 {
+		return
+	}
+
+	before := time.Now().Add(-config.SMTPConnectionLogRetention).UnixMilli()
+
+	res, err := sqlf.DeleteFrom("smtp_connections").
+		Where("ConnectedAt < ?", before).
+		ExecAndClose(nil, db)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Log().Debugf("[db] pruned %d SMTP connection log entries", n)
+	}
+}
@@ -5,28 +5,39 @@ import (
 	"database/sql"
 	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/cache"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/server/websockets"
 	"github.com/leporo/sqlf"
 )
 
+// LastVacuum is the time the database was last vacuumed in Unix nanoseconds, accessed atomically
+var lastVacuum = time.Now().UnixNano()
+
 // Database cron runs every minute
 func dbCron() {
 	for {
 		time.Sleep(60 * time.Second)
 
+		// the database is not reopened just to be pruned or vacuumed, as nothing
+		// is stored or deleted while it is idle
+		if isDBIdle() {
+			continue
+		}
+
 		currentTime := time.Now()
-		sinceLastDbAction := currentTime.Sub(dbLastAction)
+		sinceLastDbAction := currentTime.Sub(getDBLastAction())
 
 		// only run the database has been idle for 5 minutes
 		if math.Floor(sinceLastDbAction.Minutes()) == 5 {
 			deletedSize := getDeletedSize()
 
 			if deletedSize > 0 {
-				total := totalMessagesSize()
+				total := GetMailboxSizeBytes()
 				var deletedPercent int64
 				if total == 0 {
 					deletedPercent = 100
@@ -41,7 +52,25 @@ func dbCron() {
 			}
 		}
 
+		// scheduled vacuum, only if there has been no database activity for at least 10 minutes
+		if config.DBVacuumInterval > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&lastVacuum))) >= config.DBVacuumInterval && sinceLastDbAction >= 10*time.Minute {
+			logger.Log().Debug("[db] running scheduled vacuum")
+			vacuumDb()
+		}
+
 		pruneMessages()
+
+		pruneTagRetention()
+
+		pruneSMTPTransactions()
+
+		pruneSMTPConnections()
+
+		pruneWebhookFailures()
+
+		pruneDeletedMessagesLog()
+
+		closeIdleDB(time.Now())
 	}
 }
 
@@ -52,13 +81,79 @@ func pruneMessages() {
 		return
 	}
 
+	pruneMessagesOver(config.MaxMessages)
+}
+
+// PruneTagRetention applies config.TagRetentionRules, deleting messages with the rule's tag which
+// are older than the maximum age, or exceed the maximum number of messages (latest first)
+func pruneTagRetention() {
+	for _, rule := range config.TagRetentionRules {
+		if err := pruneTag(rule); err != nil {
+			logger.Log().Errorf("[db] error pruning messages tagged %s: %s", rule.Tag, err.Error())
+		}
+	}
+}
+
+// PruneTag deletes the messages of a single tag retention rule
+func pruneTag(rule config.TagRetentionRule) error {
+	start := time.Now()
+	ids := []string{}
+
+	tagged := `m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE ` + tagCollation() + `)`
+
+	if rule.MaxAgeDays > 0 {
+		var id string
+		q := sqlf.From("mailbox m").
+			Select("m.ID").To(&id).
+			Where(tagged, rule.Tag).
+			Where("m.Created < ?", start.AddDate(0, 0, -rule.MaxAgeDays).UnixMilli())
+
+		if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+			ids = append(ids, id)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if rule.MaxMessages > 0 {
+		var id string
+		q := sqlf.From("mailbox m").
+			Select("m.ID").To(&id).
+			Where(tagged, rule.Tag).
+			OrderBy("m.Created DESC", "m.rowid DESC").
+			Limit(-1).
+			Offset(rule.MaxMessages)
+
+		if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+			ids = append(ids, id)
+		}); err != nil {
+			return err
+		}
+	}
+
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := DeleteMessages(ids); err != nil {
+		return err
+	}
+
+	logger.Log().Debugf("[db] auto-pruned %d messages tagged %s in %s", len(ids), rule.Tag, time.Since(start))
+
+	return nil
+}
+
+// PruneMessagesOver deletes the oldest messages exceeding max (in batches of up to 5000)
+func pruneMessagesOver(max int) {
 	start := time.Now()
 
 	q := sqlf.Select("ID, Size").
 		From("mailbox").
 		OrderBy("Created DESC").
 		Limit(5000).
-		Offset(config.MaxMessages)
+		Offset(max)
 
 	ids := []string{}
 	var prunedSize int64
@@ -93,6 +188,11 @@ func pruneMessages() {
 		args[i] = id
 	}
 
+	if err := logDeletedMessages(tx, ids...); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
 	_, err = tx.Query(`DELETE FROM mailbox WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
 	if err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
@@ -111,6 +211,47 @@ func pruneMessages() {
 		return
 	}
 
+	_, err = tx.Query(`DELETE FROM message_dsn WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Query(`DELETE FROM message_bounces WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Query(`DELETE FROM attachment_hashes WHERE MessageID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Query(`DELETE FROM message_recipients WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Query(`DELETE FROM link_check_results WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Query(`DELETE FROM link_checks WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if err := deleteMessageHeaders(tx, ids...); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -118,14 +259,19 @@ func pruneMessages() {
 		if err := tx.Rollback(); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 		}
+	} else {
+		atomic.AddInt64(&messageCounter, -int64(len(ids)))
+		atomic.StoreInt64(&compressedSize, -1)
 	}
 
+	cache.Remove(ids...)
+
 	if err := pruneUnusedTags(); err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
 	}
 
 	addDeletedSize(prunedSize)
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	elapsed := time.Since(start)
 	logger.Log().Debugf("[db] auto-pruned %d messages in %s", len(ids), elapsed)
@@ -137,30 +283,49 @@ func pruneMessages() {
 
 // Vacuum the database to reclaim space from deleted messages
 func vacuumDb() {
+	if err := Vacuum(); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+}
+
+// Vacuum checkpoints the WAL file & vacuums the database to reclaim space from deleted messages
+func Vacuum() error {
 	start := time.Now()
 
+	before, err := GetDatabaseSize()
+	if err != nil {
+		return err
+	}
+
 	// set WAL file checkpoint
 	if _, err := db.Exec("PRAGMA wal_checkpoint"); err != nil {
-		logger.Log().Errorf("[db] %s", err.Error())
-		return
+		return err
 	}
 
 	// vacuum database
 	if _, err := db.Exec("VACUUM"); err != nil {
-		logger.Log().Errorf("[db] %s", err.Error())
-		return
+		return err
 	}
 
 	// truncate WAL file
 	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
-		logger.Log().Errorf("[db] %s", err.Error())
-		return
+		return err
 	}
 
+	atomic.StoreInt64(&lastVacuum, time.Now().UnixNano())
+
 	if err := SettingPut("DeletedSize", "0"); err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
 	}
 
+	after, err := GetDatabaseSize()
+	if err != nil {
+		return err
+	}
+
 	elapsed := time.Since(start)
-	logger.Log().Debugf("[db] vacuumed database in %s", elapsed)
+	logger.Log().Debugf("[db] vacuumed database in %s (%d bytes before, %d bytes after)", elapsed,
+		before.PhysicalBytes+before.WALBytes, after.PhysicalBytes+after.WALBytes)
+
+	return nil
 }
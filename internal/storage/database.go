@@ -2,29 +2,60 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/errorreport"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/metrics"
+	"github.com/axllent/mailpit/server/webhook"
 	"github.com/klauspost/compress/zstd"
 	"github.com/leporo/sqlf"
 
 	// sqlite (native) - https://gitlab.com/cznic/sqlite
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
+// dbMaxIdleConns is the number of idle database connections kept open (the database/sql default)
+const dbMaxIdleConns = 2
+
 var (
-	db           *sql.DB
-	dbFile       string
-	dbIsTemp     bool
-	dbLastAction time.Time
+	// db is the single database used by every storage function. Multiple inboxes backed by
+	// separate databases are deliberately not supported: the message counter, cache, stats,
+	// cron & migrations below all assume one database, so per-inbox databases would require
+	// an inbox parameter on every storage function. Teams needing isolated inboxes should run
+	// a Mailpit instance (with its own --database) each, or route recipients to tags with
+	// --tag-recipient.
+	db       *sql.DB
+	dbFile   string
+	dbIsTemp bool
+
+	// time of the last database activity in Unix nanoseconds, accessed atomically
+	dbLastAction int64
+
+	// whether the database connections were closed after config.DBIdleTimeout
+	dbIsIdle bool
+	dbIdleMu sync.Mutex
+
+	// total number of messages, maintained atomically so it can be read without a database query
+	messageCounter int64
+
+	// total compressed size of all messages, maintained atomically when messages are stored
+	// & reset to -1 when messages are deleted, to be recalculated on the next request
+	compressedSize int64 = -1
 
 	// zstd compression encoder & decoder
 	dbEncoder, _ = zstd.NewWriter(nil)
@@ -43,38 +74,37 @@ func InitDB() error {
 		logger.Log().Debugf("[db] using temporary database: %s", p)
 	} else {
 		p = filepath.Clean(p)
+		dbIsTemp = false
 	}
 
 	config.DataFile = p
 
-	logger.Log().Debugf("[db] opening database %s", p)
-
-	var err error
-
-	dsn := fmt.Sprintf("file:%s?cache=shared", p)
-
-	db, err = sql.Open("sqlite", dsn)
-	if err != nil {
+	if err := errorreport.Init(); err != nil {
 		return err
 	}
 
-	// prevent "database locked" errors
-	// @see https://github.com/mattn/go-sqlite3#faq
-	db.SetMaxOpenConns(1)
+	if err := openDB(p); err != nil {
+		if !isCorruptionError(err) || !dbIsTemp && config.DBOnCorruption != "truncate" {
+			return err
+		}
 
-	// SQLite performance tuning (https://phiresky.github.io/blog/2020/sqlite-performance-tuning/)
-	_, err = db.Exec("PRAGMA journal_mode = WAL; PRAGMA synchronous = normal;")
-	if err != nil {
-		return err
+		// recovery is only attempted once, any further error is returned
+		if err := recreateDB(p, err); err != nil {
+			return err
+		}
 	}
 
-	// create tables if necessary & apply migrations
-	if err := dbApplyMigrations(); err != nil {
-		return err
+	atomic.StoreInt64(&messageCounter, int64(CountTotal()))
+	atomic.StoreInt64(&compressedSize, -1)
+
+	webhook.FailureHandler = LogWebhookFailure
+
+	if config.EnableMetrics {
+		BroadcastMailboxStats()
 	}
 
 	dbFile = p
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	sigs := make(chan os.Signal, 1)
 	// catch all signals since not explicitly listing
@@ -98,6 +128,65 @@ func InitDB() error {
 	return nil
 }
 
+// OpenDB opens the database & applies any migrations
+func openDB(p string) error {
+	logger.Log().Debugf("[db] opening database %s", p)
+
+	// SQLite performance tuning (https://phiresky.github.io/blog/2020/sqlite-performance-tuning/),
+	// synchronous is set per connection so is applied to connections reopened after being idle
+	dsn := fmt.Sprintf("file:%s?cache=shared&_pragma=synchronous(normal)", p)
+
+	db = sql.OpenDB(idleConnector{dsn: dsn, driver: &sqlite.Driver{}})
+
+	// prevent "database locked" errors
+	// @see https://github.com/mattn/go-sqlite3#faq
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA journal_mode = WAL;"); err != nil {
+		return err
+	}
+
+	// create tables if necessary & apply migrations
+	return dbApplyMigrations()
+}
+
+// RecreateDB deletes the corrupted database (including the WAL & shared-memory files),
+// and opens a new empty database in its place
+func recreateDB(p string, cause error) error {
+	if dbIsTemp {
+		logger.Log().Debugf("[db] temporary database %s is corrupted, recreating: %s", p, cause.Error())
+	} else {
+		logger.Log().Warnf("[db] database %s is corrupted, deleting & recreating: %s", p, cause.Error())
+	}
+
+	if err := db.Close(); err != nil {
+		logger.Log().Warnf("[db] error closing corrupted database: %s", err.Error())
+	}
+
+	for _, f := range []string{p, p + "-wal", p + "-shm"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := openDB(p); err != nil {
+		return err
+	}
+
+	metrics.DBCorruptionRecovered()
+
+	return nil
+}
+
+// IsCorruptionError returns whether the error is the result of a corrupted database file. Files which
+// are not SQLite databases (eg: encrypted, or the wrong path) are not treated as corrupted, so are never deleted.
+func isCorruptionError(err error) bool {
+	msg := err.Error()
+
+	return strings.Contains(msg, "SQLITE_CORRUPT") ||
+		strings.Contains(msg, "database disk image is malformed")
+}
+
 // Close will close the database, and delete if a temporary table
 func Close() {
 	if db != nil {
@@ -112,6 +201,111 @@ func Close() {
 			logger.Log().Errorf("[db] %s", err.Error())
 		}
 	}
+
+	config.RemoveTLSTempDir()
+}
+
+// IdleConnector opens SQLite database connections, reopening the database if the
+// connections were closed by closeIdleDB()
+type idleConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+// Connect opens a new database connection
+func (c idleConnector) Connect(context.Context) (driver.Conn, error) {
+	dbIdleMu.Lock()
+	if dbIsIdle {
+		logger.Log().Debugf("[db] reopening idle database %s", dbFile)
+		db.SetMaxIdleConns(dbMaxIdleConns)
+		dbIsIdle = false
+		// the database is not closed again until it has been idle for config.DBIdleTimeout
+		setDBLastAction()
+	}
+	dbIdleMu.Unlock()
+
+	return c.driver.Open(c.dsn)
+}
+
+// Driver returns the SQLite driver
+func (c idleConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// CloseIdleDB closes all database connections (releasing the database file) if there has been no database
+// activity for config.DBIdleTimeout, returning whether the database was closed. The database is reopened
+// transparently when the next connection is required.
+func closeIdleDB(now time.Time) bool {
+	if config.DBIdleTimeout <= 0 || now.Sub(getDBLastAction()) <= config.DBIdleTimeout {
+		return false
+	}
+
+	dbIdleMu.Lock()
+	defer dbIdleMu.Unlock()
+
+	if dbIsIdle {
+		return false
+	}
+
+	logger.Log().Debugf("[db] closing idle database %s", dbFile)
+
+	// closes all connections once they are no longer in use
+	db.SetMaxIdleConns(0)
+	dbIsIdle = true
+
+	return true
+}
+
+// IsDBIdle returns whether the database connections were closed by closeIdleDB()
+func isDBIdle() bool {
+	dbIdleMu.Lock()
+	defer dbIdleMu.Unlock()
+
+	return dbIsIdle
+}
+
+// SetDBLastAction records database activity, delaying the next idle close & vacuum
+func setDBLastAction() {
+	atomic.StoreInt64(&dbLastAction, time.Now().UnixNano())
+}
+
+// GetDBLastAction returns the time of the last database activity
+func getDBLastAction() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&dbLastAction))
+}
+
+// BackupDB writes a consistent copy of the database to w, without stopping Mailpit.
+// The copy is created in a temporary file with VACUUM INTO (so is also compacted),
+// which is deleted once written.
+func BackupDB(w io.Writer) error {
+	start := time.Now()
+
+	dir, err := os.MkdirTemp("", "mailpit-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	backup := filepath.Join(dir, fmt.Sprintf("mailpit-backup-%d.db", start.UnixNano()))
+
+	if _, err := db.Exec("VACUUM INTO ?", backup); err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Clean(backup))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+
+	logger.Log().Debugf("[db] backed up database (%d bytes) in %s", n, time.Since(start))
+
+	return nil
 }
 
 // StatsGet returns the total/unread statistics for a mailbox
@@ -119,18 +313,33 @@ func StatsGet() MailboxStats {
 	var (
 		total  = CountTotal()
 		unread = CountUnread()
-		tags   = GetAllTags()
+		tags   = GetTagStats()
+		size   = GetMailboxSizeBytes()
+		stored = GetMailboxCompressedSizeBytes()
+		ratio  float64
 	)
 
-	dbLastAction = time.Now()
+	if stored > 0 {
+		ratio = float64(size) / float64(stored)
+	}
+
+	setDBLastAction()
 
 	return MailboxStats{
-		Total:  total,
-		Unread: unread,
-		Tags:   tags,
+		Total:            total,
+		Unread:           unread,
+		Tags:             tags,
+		Size:             size,
+		CompressedSize:   stored,
+		CompressionRatio: ratio,
 	}
 }
 
+// FastCountTotal returns the number of emails in the database without querying the database
+func FastCountTotal() int64 {
+	return atomic.LoadInt64(&messageCounter)
+}
+
 // CountTotal returns the number of emails in the database
 func CountTotal() int {
 	var total int
@@ -155,6 +364,195 @@ func CountUnread() int {
 	return total
 }
 
+// CountMessagesSince returns the number of emails in the database received within the duration
+func CountMessagesSince(d time.Duration) int {
+	var total int
+
+	q := sqlf.From("mailbox").
+		Select("COUNT(*)").To(&total).
+		Where("Created >= ?", time.Now().Add(-d).UnixMilli())
+
+	_ = q.QueryRowAndClose(nil, db)
+
+	return total
+}
+
+// CountMessagesBetween returns the number of emails in the database received between
+// the two times (inclusive)
+func CountMessagesBetween(from, to time.Time) int {
+	var total int
+
+	q := sqlf.From("mailbox").
+		Select("COUNT(*)").To(&total).
+		Where("Created >= ?", from.UnixMilli()).
+		Where("Created <= ?", to.UnixMilli())
+
+	_ = q.QueryRowAndClose(nil, db)
+
+	return total
+}
+
+// GetMailboxGrowthRate returns the average number of messages received per hour over the last 24 hours
+func GetMailboxGrowthRate() (float64, error) {
+	var total int
+
+	q := sqlf.From("mailbox").
+		Select("COUNT(*)").To(&total).
+		Where("Created >= ?", time.Now().Add(-24*time.Hour).UnixMilli())
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		return 0, err
+	}
+
+	return float64(total) / 24, nil
+}
+
+// GetGrowthRateByHour returns the number of messages received per hour (UTC) for the last
+// number of hours, including the current hour, sorted oldest to latest
+func GetGrowthRateByHour(hours int) ([]HourlyRate, error) {
+	tsStart := time.Now()
+
+	results := []HourlyRate{}
+
+	if hours < 1 {
+		return results, fmt.Errorf("invalid number of hours: %d", hours)
+	}
+
+	from := time.Now().UTC().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+
+	counts := map[string]int{}
+
+	q := sqlf.From("mailbox").
+		Select(`strftime('%Y-%m-%d %H', datetime(Created/1000, 'unixepoch')) AS Hour, COUNT(*)`).
+		Where("Created >= ?", from.UnixMilli()).
+		GroupBy("Hour")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var hour string
+		var count int
+
+		if err := row.Scan(&hour, &count); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		counts[hour] = count
+	}); err != nil {
+		return results, err
+	}
+
+	// include hours without messages
+	for i := 0; i < hours; i++ {
+		h := from.Add(time.Duration(i) * time.Hour)
+		results = append(results, HourlyRate{Hour: h, Count: counts[h.Format("2006-01-02 15")]})
+	}
+
+	logger.Log().Debugf("[db] message growth rate by hour in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// maxStatsBuckets is the maximum number of time buckets returned by GetMessageStats()
+const maxStatsBuckets = 1000
+
+// GetMessageStats returns the number, total size & unread count of messages received since the given
+// time, grouped into periods of the granularity, sorted oldest to latest. Periods are aligned to the
+// Unix epoch (so since is rounded down), and periods without messages are included.
+func GetMessageStats(since time.Time, granularity time.Duration) ([]TimeBucket, error) {
+	tsStart := time.Now()
+
+	results := []TimeBucket{}
+
+	step := granularity.Milliseconds()
+	if step < 1 {
+		return results, fmt.Errorf("invalid granularity: %s", granularity)
+	}
+
+	from := since.UnixMilli() / step * step
+	now := time.Now().UnixMilli()
+
+	if (now-from)/step+1 > maxStatsBuckets {
+		return results, fmt.Errorf("too many buckets, maximum is %d", maxStatsBuckets)
+	}
+
+	buckets := map[int64]TimeBucket{}
+
+	q := sqlf.From("mailbox").
+		Select(`Created / ? * ? AS Bucket, COUNT(*), COALESCE(SUM(Size), 0), SUM(CASE WHEN Read = 0 THEN 1 ELSE 0 END)`, step, step).
+		Where("Created >= ?", from).
+		GroupBy("Bucket")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var bucket int64
+		b := TimeBucket{}
+
+		if err := row.Scan(&bucket, &b.Count, &b.TotalSizeBytes, &b.Unread); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		buckets[bucket] = b
+	}); err != nil {
+		return results, err
+	}
+
+	for ts := from; ts <= now; ts += step {
+		b := buckets[ts]
+		b.Timestamp = time.UnixMilli(ts).UTC()
+		results = append(results, b)
+	}
+
+	logger.Log().Debugf("[db] message stats in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// GetSizeHistogram returns the number of messages within logarithmic size ranges, ie: < 1 KB,
+// 1-10 KB, 10-100 KB etc, where the last bucket contains all larger messages
+func GetSizeHistogram(buckets int) ([]SizeBucket, error) {
+	tsStart := time.Now()
+
+	results := []SizeBucket{}
+
+	if buckets < 2 || buckets > 10 {
+		return results, fmt.Errorf("invalid number of buckets: %d", buckets)
+	}
+
+	cases := []string{}
+	var lower, upper int64 = 0, 1024
+	for i := 0; i < buckets; i++ {
+		if i == buckets-1 {
+			upper = 0
+		} else {
+			cases = append(cases, fmt.Sprintf("WHEN Size < %d THEN %d", upper, i))
+		}
+
+		results = append(results, SizeBucket{Min: lower, Max: upper})
+		lower, upper = upper, upper*10
+	}
+
+	q := sqlf.From("mailbox").
+		Select(fmt.Sprintf(`CASE %s ELSE %d END AS Bucket, COUNT(*)`, strings.Join(cases, " "), buckets-1)).
+		GroupBy("Bucket")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var bucket, count int
+
+		if err := row.Scan(&bucket, &count); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		results[bucket].Count = count
+	}); err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] message size histogram in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
 // CountRead returns the number of emails in the database that are read.
 func CountRead() int {
 	var total int
@@ -195,3 +593,24 @@ func MessageIDExists(id string) bool {
 
 	return total != 0
 }
+
+// GetIDByMessageID returns the database ID of the latest message with the given Message-ID,
+// or an empty string if no message is found
+func GetIDByMessageID(messageID string) (string, error) {
+	var id string
+
+	q := sqlf.From("mailbox").
+		Select("ID").To(&id).
+		Where("MessageID = ?", strings.Trim(messageID, "<>")).
+		OrderBy("Created DESC").
+		Limit(1)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/leporo/sqlf"
+)
+
+// SetMessageDelivery stores the SMTP envelope & session details of a message.
+// The SMTP hops are parsed from the message headers and are not stored.
+func SetMessageDelivery(id string, d DeliveryDetails) error {
+	to := d.EnvelopeTo
+	if to == nil {
+		to = []string{}
+	}
+
+	b, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlf.Update("mailbox").
+		Set("SenderIP", d.SenderIP).
+		Set("EnvelopeFrom", d.EnvelopeFrom).
+		Set("EnvelopeTo", string(b)).
+		Set("SessionID", d.SessionID).
+		Set("ReceivedAt", d.ReceivedAt.UnixMilli()).
+		Where("ID = ?", id).
+		ExecAndClose(nil, db)
+
+	return err
+}
+
+// GetMessageDeliveryDetails returns the SMTP envelope & session details of a message, along with
+// the hops parsed from its Received headers. Details are blank for messages not received via SMTP.
+func GetMessageDeliveryDetails(id string) (DeliveryDetails, error) {
+	d := DeliveryDetails{EnvelopeTo: []string{}, SMTPHops: []SMTPHop{}}
+
+	var to string
+	var received, created int64
+
+	q := sqlf.From("mailbox").
+		Select("SenderIP").To(&d.SenderIP).
+		Select("EnvelopeFrom").To(&d.EnvelopeFrom).
+		Select("EnvelopeTo").To(&to).
+		Select("SessionID").To(&d.SessionID).
+		Select("ReceivedAt").To(&received).
+		Select("Created").To(&created).
+		Where("ID = ?", id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return d, errors.New("message not found")
+		}
+
+		return d, err
+	}
+
+	if err := json.Unmarshal([]byte(to), &d.EnvelopeTo); err != nil {
+		return d, err
+	}
+
+	// messages not received via SMTP, or stored before delivery details were recorded
+	if received == 0 {
+		received = created
+	}
+	d.ReceivedAt = time.UnixMilli(received)
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return d, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return d, err
+	}
+
+	// Received headers are prepended by each host, so the oldest is last
+	headers := msg.Header["Received"]
+	for i := len(headers) - 1; i >= 0; i-- {
+		hop := parseReceivedHeader(headers[i])
+		hop.Raw = headers[i]
+		d.SMTPHops = append(d.SMTPHops, hop)
+	}
+
+	// hops with unparsable dates are excluded from the transit time
+	var first, last time.Time
+	for _, h := range d.SMTPHops {
+		if h.Date.IsZero() {
+			continue
+		}
+		if first.IsZero() {
+			first = h.Date
+		}
+		last = h.Date
+	}
+	d.TransitTime = last.Sub(first).Seconds()
+
+	return d, nil
+}
+
+// GetMessageEnvelope returns the SMTP envelope of a message. The envelope is blank for messages
+// not received via SMTP, or stored before delivery details were recorded.
+func getMessageEnvelope(id string) (SMTPEnvelope, error) {
+	e := SMTPEnvelope{RcptTo: []string{}}
+
+	var to string
+
+	q := sqlf.From("mailbox").
+		Select("EnvelopeFrom").To(&e.MailFrom).
+		Select("EnvelopeTo").To(&to).
+		Select("SenderIP").To(&e.RemoteIP).
+		Where("ID = ?", id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, errors.New("message not found")
+		}
+
+		return e, err
+	}
+
+	if err := json.Unmarshal([]byte(to), &e.RcptTo); err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// ParseReceivedHeader parses the clauses (from, by, with, id & for) and date of a Received
+// header as per RFC 5321, section 4.4. Comments are ignored.
+func parseReceivedHeader(v string) SMTPHop {
+	hop := SMTPHop{}
+
+	clauses := v
+	if i := strings.LastIndex(v, ";"); i >= 0 {
+		clauses = v[:i]
+		hop.Date = parseReceivedDate(v[i+1:])
+	}
+
+	words := []string{}
+	depth := 0
+	var word strings.Builder
+	for _, c := range clauses {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(c)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+
+	for i := 0; i < len(words)-1; i++ {
+		value := strings.Trim(words[i+1], "<>")
+
+		var field *string
+		switch strings.ToLower(words[i]) {
+		case "from":
+			field = &hop.From
+		case "by":
+			field = &hop.By
+		case "with":
+			field = &hop.With
+		case "id":
+			field = &hop.ID
+		case "for":
+			field = &hop.For
+		default:
+			continue
+		}
+
+		if *field == "" {
+			*field = value
+		}
+		i++
+	}
+
+	return hop
+}
+
+// receivedDateLayouts are fallback date formats seen in Received headers which are not RFC 5322 compliant
+var receivedDateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700 MST",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+}
+
+// ParseReceivedDate parses the date of a Received header, returning a zero time if it cannot be parsed
+func parseReceivedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+
+	if date, err := mail.ParseDate(s); err == nil {
+		return date
+	}
+
+	// strip any trailing comment, eg: "(PST)"
+	if i := strings.Index(s, "("); i > 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	s = strings.Join(strings.Fields(s), " ")
+
+	for _, layout := range receivedDateLayouts {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// GetMessagesDelta returns the messages created after since, as well as the IDs of messages
+// which existed at since but have been deleted since then. Deleted IDs are only available
+// for the duration of config.DeletedMessagesLogRetention.
+func GetMessagesDelta(since time.Time) (newMessages []MessageSummary, deletedIDs []string, err error) {
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Created > ?", since.UnixMilli()).
+		OrderBy("m.Created DESC")
+
+	newMessages, err = queryMessageSummaries(q)
+	if err != nil {
+		return newMessages, deletedIDs, err
+	}
+
+	deletedIDs = []string{}
+	var id string
+
+	// ignore IDs which have since been re-added
+	err = sqlf.From("deleted_messages").
+		Select("DISTINCT ID").To(&id).
+		Where("Created <= ?", since.UnixMilli()).
+		Where("Deleted >= ?", since.UnixMilli()).
+		Where("ID NOT IN (SELECT ID FROM mailbox)").
+		OrderBy("ID").
+		QueryAndClose(nil, db, func(_ *sql.Rows) {
+			deletedIDs = append(deletedIDs, id)
+		})
+
+	return newMessages, deletedIDs, err
+}
+
+// LogDeletedMessages records the IDs of messages about to be deleted within a transaction.
+// Passing no IDs logs all messages which are not starred (ie: the mailbox is being emptied).
+func logDeletedMessages(tx *sql.Tx, ids ...string) error {
+	if config.DeletedMessagesLogRetention <= 0 {
+		return nil
+	}
+
+	sqlInsert := `INSERT INTO deleted_messages (ID, Created, Deleted) SELECT ID, Created, ? FROM mailbox`
+	args := []interface{}{time.Now().UnixMilli()}
+
+	if len(ids) == 0 {
+		sqlInsert += ` WHERE Starred = 0`
+	} else {
+		sqlInsert += ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	_, err := tx.Exec(sqlInsert, args...)
+
+	return err
+}
+
+// PruneDeletedMessagesLog removes logged deleted message IDs older than config.DeletedMessagesLogRetention
+func pruneDeletedMessagesLog() {
+	if config.DeletedMessagesLogRetention <= 0 {
+		return
+	}
+
+	before := time.Now().Add(-config.DeletedMessagesLogRetention).UnixMilli()
+
+	res, err := sqlf.DeleteFrom("deleted_messages").
+		Where("Deleted < ?", before).
+		ExecAndClose(nil, db)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Log().Debugf("[db] pruned %d deleted message log entries", n)
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// GetMessageDKIMDetails parses the DKIM-Signature headers of a message. The signatures are not
+// verified (no DNS lookups are made), this only returns details of the signing configuration.
+func GetMessageDKIMDetails(id string) ([]DKIMHeader, error) {
+	headers := []DKIMHeader{}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return headers, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return headers, err
+	}
+
+	for _, v := range msg.Header["Dkim-Signature"] {
+		headers = append(headers, parseDKIMSignature(v))
+	}
+
+	return headers, nil
+}
+
+// ParseDKIMSignature parses the tag=value list of a DKIM-Signature header (RFC 6376 section 3.5)
+func parseDKIMSignature(v string) DKIMHeader {
+	d := DKIMHeader{HeaderFields: []string{}}
+
+	for _, tag := range strings.Split(v, ";") {
+		k, val, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+
+		k = strings.ToLower(strings.TrimSpace(k))
+		val = strings.TrimSpace(val)
+
+		switch k {
+		case "d":
+			d.Domain = val
+		case "s":
+			d.Selector = val
+		case "a":
+			d.Algorithm = strings.ToLower(val)
+		case "h":
+			for _, h := range strings.Split(val, ":") {
+				if h = strings.TrimSpace(h); h != "" {
+					d.HeaderFields = append(d.HeaderFields, h)
+				}
+			}
+		case "bh":
+			d.BodyHash = stripWhitespace(val)
+		case "b":
+			d.Signature = stripWhitespace(val)
+		}
+	}
+
+	return d
+}
+
+// StripWhitespace removes all whitespace (eg: from folded base64 values)
+func stripWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
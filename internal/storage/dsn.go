@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// SetMessageDSN will store the SMTP DSN parameters of a message
+func SetMessageDSN(id string, dsn DSN) error {
+	recipients, err := json.Marshal(dsn.Recipients)
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlf.InsertInto("message_dsn").
+		Set("ID", id).
+		Set("Ret", dsn.Ret).
+		Set("EnvID", dsn.EnvID).
+		Set("Recipients", string(recipients)).
+		ExecAndClose(nil, db)
+
+	return err
+}
+
+// GetMessageDSN returns the SMTP DSN parameters of a message, or nil if none were supplied
+func GetMessageDSN(id string) (*DSN, error) {
+	var dsn *DSN
+
+	q := sqlf.From("message_dsn").
+		Select("Ret").
+		Select("EnvID").
+		Select("Recipients").
+		Where("ID = ?", id)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var ret, envID, recipients string
+
+		if err := row.Scan(&ret, &envID, &recipients); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		d := DSN{Ret: ret, EnvID: envID}
+		if err := json.Unmarshal([]byte(recipients), &d.Recipients); err != nil {
+			logger.Log().Errorf("[json] %s", err.Error())
+			return
+		}
+
+		dsn = &d
+	}); err != nil {
+		return nil, err
+	}
+
+	return dsn, nil
+}
+
+// GetMessageBounces returns the database IDs of any DSN bounce messages
+// which reference the original message (via its Message-ID)
+func GetMessageBounces(id string) ([]string, error) {
+	ids := []string{}
+
+	q := sqlf.From("message_bounces b").
+		Select("b.ID").
+		Join("mailbox m", "m.MessageID = b.OriginalMessageID").
+		Where("m.ID = ?", id).
+		Where("b.ID != ?", id)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var bounceID string
+
+		if err := row.Scan(&bounceID); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		ids = append(ids, bounceID)
+	}); err != nil {
+		return ids, err
+	}
+
+	return ids, nil
+}
+
+// Store the cross-reference of a DSN bounce message to the original Message-ID
+func storeBounceReference(id, originalMessageID string) error {
+	_, err := sqlf.InsertInto("message_bounces").
+		Set("ID", id).
+		Set("OriginalMessageID", originalMessageID).
+		ExecAndClose(nil, db)
+
+	return err
+}
+
+// Returns the Message-ID of the original message if the envelope is a DSN
+// bounce (multipart/report; report-type=delivery-status), else an empty string
+func bounceOriginalMessageID(env *enmime.Envelope) string {
+	mediaType, params, err := mime.ParseMediaType(env.Root.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return ""
+	}
+
+	for _, p := range env.Root.DepthMatchAll(func(p *enmime.Part) bool {
+		return p.ContentType == "message/rfc822" || p.ContentType == "text/rfc822-headers"
+	}) {
+		// the returned headers may not include the header/body separator
+		msg, err := mail.ReadMessage(bytes.NewReader(append(p.Content, []byte("\r\n\r\n")...)))
+		if err != nil {
+			continue
+		}
+
+		if messageID := strings.Trim(msg.Header.Get("Message-Id"), "<>"); messageID != "" {
+			return messageID
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// AttachmentHash is the SHA-256 hash of the decoded content of a message part
+type attachmentHash struct {
+	PartID      string
+	Hash        string
+	ContentType string
+	Size        int
+}
+
+// AttachmentHashes returns the content hashes, content types & sizes of all attachments & inline parts of a message
+func attachmentHashes(env *enmime.Envelope) []attachmentHash {
+	hashes := []attachmentHash{}
+
+	for _, parts := range [][]*enmime.Part{env.Attachments, env.Inlines} {
+		for _, p := range parts {
+			sum := sha256.Sum256(p.Content)
+			hashes = append(hashes, attachmentHash{PartID: p.PartID, Hash: hex.EncodeToString(sum[:]), ContentType: strings.ToLower(p.ContentType), Size: len(p.Content)})
+		}
+	}
+
+	return hashes
+}
+
+// StoreAttachmentHashes replaces the attachment hashes of a message within a transaction
+func storeAttachmentHashes(tx *sql.Tx, id string, hashes []attachmentHash) error {
+	if _, err := tx.Exec("DELETE FROM attachment_hashes WHERE MessageID = ?", id); err != nil {
+		return err
+	}
+
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO attachment_hashes(MessageID, PartID, Hash, ContentType, Size) values(?,?,?,?,?)", id, h.PartID, h.Hash, h.ContentType, h.Size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetMessagesByAttachmentHash returns all messages containing an attachment with the
+// given (hex-encoded) SHA-256 content hash, sorted latest to oldest
+func GetMessagesByAttachmentHash(hash string) ([]MessageSummary, error) {
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`m.ID IN (SELECT MessageID FROM attachment_hashes WHERE Hash = ?)`, strings.ToLower(strings.TrimSpace(hash))).
+		OrderBy("m.Created DESC")
+
+	return queryMessageSummaries(q)
+}
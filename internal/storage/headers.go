@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// customHeaderPrefix is the prefix of the message headers returned by GetMessageHeaders()
+const customHeaderPrefix = "X-"
+
+// CustomHeaders returns a JSON object of the config.IndexedHeaders found in the message,
+// using the first value of each header
+func customHeaders(env *enmime.Envelope) string {
+	headers := map[string]string{}
+
+	for _, h := range config.IndexedHeaders {
+		if v := strings.TrimSpace(env.Root.Header.Get(h)); v != "" {
+			headers[h] = v
+		}
+	}
+
+	b, err := json.Marshal(headers)
+	if err != nil {
+		logger.Log().Errorf("[json] %s", err.Error())
+		return "{}"
+	}
+
+	return string(b)
+}
+
+// GetMessagesByCustomHeader returns a subset of messages, sorted latest to oldest, where the
+// indexed header matches the value, as well as the total number of matching messages.
+// The header must be one of config.IndexedHeaders.
+func GetMessagesByCustomHeader(name, value string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+
+	if !inArray(name, config.IndexedHeaders) {
+		return []MessageSummary{}, 0, fmt.Errorf("header is not indexed: %s", name)
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return []MessageSummary{}, 0, errors.New("no header value specified")
+	}
+
+	path := `$."` + name + `"`
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`json_extract(m.CustomHeaders, ?) = ?`, path, value).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where(`json_extract(m.CustomHeaders, ?) = ?`, path, value)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by header %s in %s", name, time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// StoreMessageHeaders replaces the stored headers of a message within a transaction,
+// which are used for header: searches
+func storeMessageHeaders(tx *sql.Tx, id string, header textproto.MIMEHeader) error {
+	if err := deleteMessageHeaders(tx, id); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, v := range header[name] {
+			if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "INSERT INTO message_headers(ID, Name, Value) values(?,?,?)", id, name, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteMessageHeaders deletes the stored headers of the messages within a transaction
+func deleteMessageHeaders(tx *sql.Tx, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	_, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `DELETE FROM message_headers WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+
+	return err
+}
+
+// GetMessageHeaders returns the X- headers of a message, which are stored separately when
+// the message is received so they can be read without parsing the raw message
+func GetMessageHeaders(id string) (http.Header, error) {
+	var exists string
+
+	if err := sqlf.From("mailbox").
+		Select("ID").To(&exists).
+		Where("ID = ?", id).
+		QueryRowAndClose(nil, db); err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+
+	var name, value string
+
+	q := sqlf.From("message_headers").
+		Select("Name").To(&name).
+		Select("Value").To(&value).
+		Where("ID = ?", id).
+		Where("Name LIKE ?", customHeaderPrefix+"%").
+		OrderBy("rowid")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		headers.Add(name, value)
+	}); err != nil {
+		return nil, err
+	}
+
+	return headers, nil
+}
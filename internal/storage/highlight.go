@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/axllent/mailpit/internal/tools"
+)
+
+// SearchHighlighted returns the same results as Search, including the locations of the
+// search terms within the Subject, Snippet & From fields of each message. Plain search
+// terms are highlighted in all fields, subject: & from: terms in their respective fields only.
+// Excluded terms and other search filters (eg: is:read) are not highlighted.
+func SearchHighlighted(search string, start, limit int) ([]HighlightedSummary, int, error) {
+	return SearchHighlightedSorted(search, start, limit, SortCreated, SortDesc)
+}
+
+// SearchHighlightedSorted is the same as SearchHighlighted, with the results sorted as per SearchSorted
+func SearchHighlightedSorted(search string, start, limit int, field SortField, dir SortDir) ([]HighlightedSummary, int, error) {
+	messages, total, err := SearchSorted(search, start, limit, field, dir)
+	if err != nil {
+		return nil, total, err
+	}
+
+	text, subject, from := highlightTerms(search)
+	subject = append(subject, text...)
+	from = append(from, text...)
+
+	results := make([]HighlightedSummary, 0, len(messages))
+	for _, m := range messages {
+		h := HighlightedSummary{MessageSummary: m, Highlights: map[string][]MatchSpan{}}
+
+		fields := map[string][]string{
+			"Subject": subject,
+			"Snippet": text,
+		}
+
+		fieldValues := map[string]string{
+			"Subject": m.Subject,
+			"Snippet": m.Snippet,
+		}
+
+		if m.From != nil {
+			fields["From.Name"] = from
+			fields["From.Address"] = from
+			fieldValues["From.Name"] = m.From.Name
+			fieldValues["From.Address"] = m.From.Address
+		}
+
+		for field, terms := range fields {
+			if spans := matchSpans(fieldValues[field], terms); len(spans) > 0 {
+				h.Highlights[field] = spans
+			}
+		}
+
+		results = append(results, h)
+	}
+
+	return results, total, nil
+}
+
+// HighlightTerms returns the lowercase search terms to highlight, being the plain (search text)
+// terms, subject: terms and from: terms
+func highlightTerms(search string) (text, subject, from []string) {
+	filters := []string{"to:", "cc:", "bcc:", "reply-to:", "message-id:", "envfrom:", "envto:", "tag:", "is:", "has:", "attachment:", "mimetype:", "header:"}
+
+	for _, w := range tools.ArgsParser(search) {
+		if cleanString(w) == "" {
+			continue
+		}
+
+		// excluded terms are not part of the results
+		if len(w) > 1 && (strings.HasPrefix(w, "-") || strings.HasPrefix(w, "!")) {
+			continue
+		}
+
+		lw := strings.ToLower(w)
+
+		if strings.HasPrefix(lw, "subject:") {
+			if t := strings.TrimSpace(lw[8:]); t != "" {
+				subject = append(subject, t)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(lw, "from:") {
+			if t := cleanString(lw[5:]); t != "" {
+				from = append(from, t)
+			}
+			continue
+		}
+
+		isFilter := false
+		for _, f := range filters {
+			if strings.HasPrefix(lw, f) {
+				isFilter = true
+				break
+			}
+		}
+
+		for _, f := range []string{"after:", "before:", "on:"} {
+			if _, _, ok := parseSearchDate(w, f); ok {
+				isFilter = true
+				break
+			}
+		}
+
+		if !isFilter {
+			text = append(text, cleanString(lw))
+		}
+	}
+
+	return text, subject, from
+}
+
+// MatchSpans returns the (case-insensitive) matches of all terms within the value, sorted by
+// position. Overlapping matches (eg: of different terms) are merged into a single span.
+func matchSpans(value string, terms []string) []MatchSpan {
+	spans := []MatchSpan{}
+	if value == "" || len(terms) == 0 {
+		return spans
+	}
+
+	haystack := lowerRunes(value)
+
+	for _, term := range terms {
+		needle := lowerRunes(term)
+		if len(needle) == 0 {
+			continue
+		}
+
+		for i := 0; i+len(needle) <= len(haystack); {
+			if string(haystack[i:i+len(needle)]) == string(needle) {
+				spans = append(spans, MatchSpan{Start: i, End: i + len(needle)})
+				i += len(needle)
+			} else {
+				i++
+			}
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+
+	merged := []MatchSpan{}
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.Start < merged[n-1].End {
+			if s.End > merged[n-1].End {
+				merged[n-1].End = s.End
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	return merged
+}
+
+// LowerRunes returns the lowercase runes of a string. Runes are compared rather than strings,
+// as lowercasing a string may change its length in bytes.
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+
+	return runes
+}
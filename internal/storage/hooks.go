@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// ErrStorageHook is returned by Store() when one of config.StorageHooks fails
+var ErrStorageHook = errors.New("storage hook failed")
+
+// storageHookMaxResponse is the maximum size in bytes of a storage hook URL response
+// if config.SMTPMaxMessageSize is unlimited
+const storageHookMaxResponse = 100 * 1024 * 1024
+
+// RunStorageHooks passes the raw message through each of config.StorageHooks in turn,
+// returning the message as output by the last hook
+func runStorageHooks(body []byte) ([]byte, error) {
+	for _, h := range config.StorageHooks {
+		name := h.Command
+		run := runStorageHook
+		if h.URL != "" {
+			name = h.URL
+			run = runStorageHookURL
+		}
+
+		out, err := run(h, body)
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s): %s", ErrStorageHook, name, err.Error())
+		}
+
+		if len(bytes.TrimSpace(out)) == 0 {
+			return nil, fmt.Errorf("%w (%s): empty message returned", ErrStorageHook, name)
+		}
+
+		body = out
+	}
+
+	return body, nil
+}
+
+// RunStorageHook executes a single hook via the system shell, with the message on stdin
+func runStorageHook(h config.StorageHook, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.StorageHookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.Command) // #nosec
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.Command) // #nosec
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", config.StorageHookTimeout)
+		}
+
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err.Error(), msg)
+		}
+
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// RunStorageHookURL POSTs the message to the hook URL, returning the response body
+func runStorageHookURL(h config.StorageHook, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.StorageHookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("User-Agent", "Mailpit/"+config.Version)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", config.StorageHookTimeout)
+		}
+
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// the response replaces the message, so is limited to the maximum message size
+	limit := int64(storageHookMaxResponse)
+	if config.SMTPMaxMessageSize > 0 {
+		limit = int64(config.SMTPMaxMessageSize)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %s", config.StorageHookTimeout)
+		}
+
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if msg := strings.TrimSpace(string(out)); msg != "" && len(msg) <= 255 {
+			return nil, fmt.Errorf("%s: %s", res.Status, msg)
+		}
+
+		return nil, errors.New(res.Status)
+	}
+
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("response exceeds the maximum size of %d bytes", limit)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jhillyerd/enmime"
+)
+
+// GetMessageHTMLImages returns all images (<img src="...">) referenced in the HTML of a message.
+// CID references are resolved to the matching inline part, and external images are not fetched.
+// The message is not marked as read.
+func GetMessageHTMLImages(id string) ([]ImageMeta, error) {
+	images := []ImageMeta{}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return images, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return images, err
+	}
+
+	if env.HTML == "" {
+		return images, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(env.HTML))
+	if err != nil {
+		return images, err
+	}
+
+	doc.Find("img[src]").Each(func(_ int, s *goquery.Selection) {
+		src := strings.TrimSpace(s.AttrOr("src", ""))
+		if src == "" {
+			return
+		}
+
+		img := ImageMeta{
+			Src:    src,
+			Width:  s.AttrOr("width", ""),
+			Height: s.AttrOr("height", ""),
+		}
+
+		lower := strings.ToLower(src)
+
+		switch {
+		case strings.HasPrefix(lower, "data:"):
+			img.IsInline = true
+			// data:[<mediatype>][;base64],<data>
+			mediaType, _, _ := strings.Cut(src[5:], ",")
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			img.ResolvedType = strings.ToLower(strings.TrimSpace(mediaType))
+		case strings.HasPrefix(lower, "cid:"):
+			img.IsInline = true
+			img.ResolvedType = cidContentType(env, src[4:])
+		default:
+			if u, err := url.Parse(src); err == nil {
+				img.IsExternal = u.IsAbs() || strings.HasPrefix(src, "//")
+				if t := mime.TypeByExtension(strings.ToLower(path.Ext(u.Path))); t != "" {
+					img.ResolvedType, _, _ = strings.Cut(t, ";")
+				}
+			}
+		}
+
+		images = append(images, img)
+	})
+
+	return images, nil
+}
+
+// CidContentType returns the content type of the inline (or attached) part
+// matching a Content-ID, or an empty string if not found
+func cidContentType(env *enmime.Envelope, cid string) string {
+	cid = strings.Trim(cid, "<>")
+	if unescaped, err := url.PathUnescape(cid); err == nil {
+		cid = unescaped
+	}
+
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.OtherParts, env.Attachments} {
+		for _, a := range parts {
+			if strings.EqualFold(strings.Trim(a.ContentID, "<>"), cid) {
+				return a.ContentType
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// SetLinkCheckResult stores the result of the most recent link check of a message checked at
+// checkedAt, replacing any previous result. Links which did not return a 2xx HTTP status
+// (including connection errors, returned as status code 0) are counted as failed.
+func SetLinkCheckResult(id string, statusCodes []int, checkedAt time.Time) error {
+	failed := 0
+	for _, code := range statusCodes {
+		if code < 200 || code > 299 {
+			failed++
+		}
+	}
+
+	_, err := db.Exec(`INSERT INTO link_check_results (ID, CheckedAt, Links, Failed) VALUES (?, ?, ?, ?)
+		ON CONFLICT(ID) DO UPDATE SET CheckedAt = excluded.CheckedAt, Links = excluded.Links, Failed = excluded.Failed`,
+		id, checkedAt.UnixMilli(), len(statusCodes), failed)
+
+	return err
+}
+
+// GetMessagesWithExpiredLinks returns a subset of messages where the most recent link check found
+// any link not returning a 2xx HTTP status, sorted latest to oldest. Link checks older than the
+// timeout are ignored, unless the timeout is 0.
+func GetMessagesWithExpiredLinks(timeout time.Duration, start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Join("link_check_results l", "l.ID = m.ID").
+		Where("l.Failed > 0").
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	if timeout > 0 {
+		q.Where("l.CheckedAt >= ?", time.Now().Add(-timeout).UnixMilli())
+	}
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages with expired links in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// GetLinkChecks returns the cached link checks of a message which have not expired, keyed by URL
+func GetLinkChecks(id string, followRedirects bool) (map[string]LinkCheck, error) {
+	results := map[string]LinkCheck{}
+
+	if config.LinkCheckCacheTTL == 0 {
+		return results, nil
+	}
+
+	var l LinkCheck
+	var checkedAt int64
+	q := sqlf.From("link_checks").
+		Select("URL").To(&l.URL).
+		Select("StatusCode").To(&l.StatusCode).
+		Select("Status").To(&l.Status).
+		Select("CheckedAt").To(&checkedAt).
+		Where("ID = ?", id).
+		Where("FollowRedirects = ?", followRedirects).
+		Where("CheckedAt >= ?", time.Now().Add(-config.LinkCheckCacheTTL).UnixMilli())
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		l.CheckedAt = time.UnixMilli(checkedAt)
+		results[l.URL] = l
+	}); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// SetLinkChecks caches the link checks of a message, so links are not checked again on
+// subsequent link checks of the same message until the cache expires
+func SetLinkChecks(id string, followRedirects bool, checks []LinkCheck) error {
+	if len(checks) == 0 || config.LinkCheckCacheTTL == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, l := range checks {
+		hash := sha256.Sum256([]byte(l.URL))
+		if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `INSERT INTO link_checks (ID, URLHash, FollowRedirects, URL, StatusCode, Status, CheckedAt) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(ID, URLHash, FollowRedirects) DO UPDATE SET StatusCode = excluded.StatusCode, Status = excluded.Status, CheckedAt = excluded.CheckedAt`,
+			id, hex.EncodeToString(hash[:]), followRedirects, l.URL, l.StatusCode, l.Status, l.CheckedAt.UnixMilli()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
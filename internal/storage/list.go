@@ -0,0 +1,941 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// ListWithAttachments returns a subset of messages containing attachments,
+// sorted latest to oldest
+func ListWithAttachments(start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Attachments > 0").
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages with attachments in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListBulkMail returns a subset of messages with a bulk, junk or list Precedence header,
+// sorted latest to oldest
+func ListBulkMail(start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Precedence IN ('bulk', 'junk', 'list')").
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list bulk messages in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListWithMinAttachments returns a subset of messages with at least minCount attachments,
+// sorted latest to oldest, along with the total number of matching messages
+func ListWithMinAttachments(minCount int, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Attachments >= ?", minCount).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where("m.Attachments >= ?", minCount)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages with at least %d attachments in %s", minCount, time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListWithAttachmentSizeOver returns a subset of messages where the total decoded size of all
+// attachments & inline parts exceeds minBytes, sorted latest to oldest, along with the total
+// number of matching messages
+func ListWithAttachmentSizeOver(minBytes int64, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	where := `m.ID IN (SELECT MessageID FROM attachment_hashes GROUP BY MessageID HAVING SUM(Size) > ?)`
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(where, minBytes).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where(where, minBytes)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages with attachments over %d bytes in %s", minBytes, time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListWithInline returns a subset of messages containing inline attachments,
+// sorted latest to oldest
+func ListWithInline(start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Inline > 0").
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages with inline attachments in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListWithNoRecipients returns a subset of messages without any To, Cc or Bcc recipients,
+// sorted latest to oldest
+func ListWithNoRecipients(start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`COALESCE(json_array_length(m.Metadata, '$.To'), 0) = 0`).
+		Where(`COALESCE(json_array_length(m.Metadata, '$.Cc'), 0) = 0`).
+		Where(`COALESCE(json_array_length(m.Metadata, '$.Bcc'), 0) = 0`).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages with no recipients in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// StreamAllMessageSummaries streams the summaries of all messages (oldest to newest), fetching
+// them from the database in batches of 100. Both channels are closed once all messages have
+// been sent, an error occurs, or the context is cancelled.
+func StreamAllMessageSummaries(ctx context.Context) (<-chan MessageSummary, <-chan error) {
+	out := make(chan MessageSummary)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		defer close(errs)
+
+		var lastCreated int64
+		var lastID string
+
+		for {
+			q := sqlf.From("mailbox m").
+				Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+				OrderBy("m.Created ASC", "m.ID ASC").
+				Limit(100)
+
+			if lastID != "" {
+				// keyset pagination is unaffected by messages being added or deleted during the stream
+				q.Where("(m.Created > ? OR (m.Created = ? AND m.ID > ?))", lastCreated, lastCreated, lastID)
+			}
+
+			results, err := queryMessageSummaries(q)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for _, m := range results {
+				if err := ctx.Err(); err != nil {
+					errs <- err
+					return
+				}
+
+				select {
+				case out <- m:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+
+			if len(results) < 100 {
+				return
+			}
+
+			last := results[len(results)-1]
+			lastCreated = last.Created.UnixMilli()
+			lastID = last.ID
+		}
+	}()
+
+	return out, errs
+}
+
+// GetAllMessageSummariesStream streams the summaries of all messages (oldest to newest) like
+// StreamAllMessageSummaries, returning an error if the first batch cannot be fetched. Errors
+// once the stream has started are logged, and the channel is closed early.
+func GetAllMessageSummariesStream(ctx context.Context) (<-chan MessageSummary, error) {
+	messages, errs := StreamAllMessageSummaries(ctx)
+
+	first, ok := <-messages
+	if !ok {
+		if err := <-errs; err != nil {
+			return nil, err
+		}
+
+		out := make(chan MessageSummary)
+		close(out)
+
+		return out, nil
+	}
+
+	out := make(chan MessageSummary)
+
+	go func() {
+		defer close(out)
+
+		send := func(m MessageSummary) {
+			select {
+			case out <- m:
+			case <-ctx.Done():
+			}
+		}
+
+		send(first)
+		for m := range messages {
+			send(m)
+		}
+
+		if err := <-errs; err != nil && !errors.Is(err, context.Canceled) {
+			logger.Log().Errorf("[db] error streaming message summaries: %s", err.Error())
+		}
+	}()
+
+	return out, nil
+}
+
+// ListByReadState returns a subset of read or unread messages, optionally filtered to messages
+// containing all of the given tags, sorted latest to oldest. The total number of matching messages
+// is also returned.
+func ListByReadState(read bool, tags []string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	readState := 0
+	if read {
+		readState = 1
+	}
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Read = ?", readState).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where("m.Read = ?", readState)
+
+	for _, t := range tags {
+		t = cleanString(t)
+		if t == "" {
+			continue
+		}
+
+		q.Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, t)
+		c.Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, t)
+	}
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by read state in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListFilter is a set of optional message list filters. Nil or empty fields are not filtered on,
+// so a zero-value ListFilter matches all messages.
+type ListFilter struct {
+	// Unread filters on the read state of messages
+	Unread *bool
+	// Tags filters messages containing all of the given tags
+	Tags []string
+	// HasAttachments filters messages with or without attachments
+	HasAttachments *bool
+}
+
+// Apply adds the filter predicates to a mailbox query
+func (f ListFilter) apply(q *sqlf.Stmt) {
+	if f.Unread != nil {
+		if *f.Unread {
+			q.Where("m.Read = 0")
+		} else {
+			q.Where("m.Read = 1")
+		}
+	}
+
+	for _, t := range f.Tags {
+		t = cleanString(t)
+		if t == "" {
+			continue
+		}
+
+		q.Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, t)
+	}
+
+	if f.HasAttachments != nil {
+		if *f.HasAttachments {
+			q.Where("m.Attachments > 0")
+		} else {
+			q.Where("m.Attachments = 0")
+		}
+	}
+}
+
+// ListWithFilter returns a subset of messages matching the filter, sorted latest to oldest.
+// A zero-value filter returns the same messages as List().
+func ListWithFilter(start, limit int, f ListFilter) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := listQuery(limit)
+	if start > 0 {
+		q.Offset(start)
+	}
+
+	f.apply(q)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages with filter in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// CountWithFilter returns the total number of messages matching the filter
+func CountWithFilter(f ListFilter) (int, error) {
+	var total int
+
+	q := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total)
+
+	f.apply(q)
+
+	err := q.QueryRowAndClose(nil, db)
+
+	return total, err
+}
+
+// ListByPriority returns a subset of messages with the given normalized priority
+// (1 highest, 3 normal, 5 lowest), sorted latest to oldest
+func ListByPriority(priority, start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Priority = ?", priority).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages by priority in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListByTagSorted returns a subset of messages with the given tag, sorted by `created`, `size`,
+// `subject` or `from` in the given direction (`asc` or `desc`, default `desc`). Messages with
+// equal sort values are sorted latest to oldest. The total number of tagged messages is also returned.
+func ListByTagSorted(tag string, sortBy, sortDir string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	sortColumn, sortDir, err := parseSortOrder(sortBy, sortDir)
+	if err != nil {
+		return []MessageSummary{}, 0, err
+	}
+
+	tag = cleanString(tag)
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, tag).
+		OrderBy(sortColumn+" "+sortDir, "m.Created DESC", "m.ID DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, tag)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by tag in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListByMultipleTags returns a subset of messages matching any (`any`) or all (`all`) of the given
+// tags, sorted latest to oldest. The total number of matching messages is also returned.
+func ListByMultipleTags(tags []string, mode string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	unique := []string{}
+	names := []interface{}{}
+	for _, t := range tags {
+		t = cleanString(t)
+		if t == "" || tagInArray(t, unique) {
+			continue
+		}
+		unique = append(unique, t)
+		names = append(names, t)
+	}
+
+	if len(names) == 0 {
+		return []MessageSummary{}, 0, errors.New("no tags specified")
+	}
+
+	sub := `SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name COLLATE ` + tagCollation() +
+		` IN (?` + strings.Repeat(",?", len(names)-1) + `)` // #nosec
+
+	switch strings.ToLower(mode) {
+	case "", "any":
+	case "all":
+		sub += fmt.Sprintf(` GROUP BY mt.ID HAVING COUNT(DISTINCT t.Name COLLATE %s) = %d`, tagCollation(), len(names))
+	default:
+		return []MessageSummary{}, 0, fmt.Errorf("invalid tag mode: %s", mode)
+	}
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`m.ID IN (`+sub+`)`, names...).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where(`m.ID IN (`+sub+`)`, names...)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by multiple tags in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListByContentType returns a subset of messages, sorted latest to oldest, where either the
+// message or one of its attachments or inline parts matches the content type, as well as
+// the total number of matching messages. A `*` wildcard may be used, eg: `image/*`.
+func ListByContentType(ct string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if ct == "" {
+		return []MessageSummary{}, 0, errors.New("no content type specified")
+	}
+
+	pattern := strings.ReplaceAll(ct, "*", "%")
+
+	where := `m.ContentType LIKE ? OR m.ID IN (SELECT MessageID FROM attachment_hashes WHERE ContentType LIKE ?)`
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(where, pattern, pattern).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where(where, pattern, pattern)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by content type in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListBySenderDomain returns a subset of messages sent from the domain (case-insensitive),
+// sorted latest to oldest, along with the total number of matching messages
+func ListBySenderDomain(domain string, start, limit int) ([]MessageSummary, int, error) {
+	tsStart := time.Now()
+
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return []MessageSummary{}, 0, errors.New("no sender domain specified")
+	}
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.SenderDomain = ?", domain).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	var total int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&total).
+		Where("m.SenderDomain = ?", domain)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	logger.Log().Debugf("[db] list messages by sender domain in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// ListGroupedByDate returns the number of messages received per day (UTC) of the given month,
+// as a map of "YYYY-MM-DD" to count. Days without messages are omitted.
+func ListGroupedByDate(year, month int) (map[string]int, error) {
+	tsStart := time.Now()
+
+	results := map[string]int{}
+
+	if month < 1 || month > 12 {
+		return results, fmt.Errorf("invalid month: %d", month)
+	}
+
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	q := sqlf.From("mailbox").
+		Select(`strftime('%Y-%m-%d', datetime(Created/1000, 'unixepoch')) AS Day, COUNT(*)`).
+		Where("Created >= ?", from.UnixMilli()).
+		Where("Created < ?", to.UnixMilli()).
+		GroupBy("Day")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var day string
+		var count int
+
+		if err := row.Scan(&day, &count); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		results[day] = count
+	}); err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages grouped by date in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListBetween returns all messages received between (and including) two messages,
+// sorted latest to oldest. The messages may be given in either order.
+func ListBetween(fromID, toID string) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	var from, to int64
+
+	for _, m := range []struct {
+		id      string
+		created *int64
+	}{{fromID, &from}, {toID, &to}} {
+		q := sqlf.From("mailbox").
+			Select("Created").To(m.created).
+			Where("ID = ?", m.id)
+
+		if err := q.QueryRowAndClose(nil, db); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return []MessageSummary{}, fmt.Errorf("message not found: %s", m.id)
+			}
+
+			return []MessageSummary{}, err
+		}
+	}
+
+	if from > to {
+		from, to = to, from
+	}
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where("m.Created >= ? AND m.Created <= ?", from, to).
+		OrderBy("m.Created DESC")
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages between %s and %s in %s", fromID, toID, time.Since(tsStart))
+
+	return results, nil
+}
+
+// GetMessageNavigation returns the IDs of the messages immediately preceding & following a message
+// when all messages are sorted by `created`, `size`, `subject` or `from` in the given direction
+// (`asc` or `desc`, default `desc`), using the same order as ListByTagSorted.
+// A nil ID is returned if there is no preceding or following message.
+func GetMessageNavigation(id string, sortBy, sortDir string) (*string, *string, error) {
+	tsStart := time.Now()
+
+	sortColumn, sortDir, err := parseSortOrder(sortBy, sortDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sortValue interface{}
+	var created int64
+
+	q := sqlf.From("mailbox m").
+		Select(sortColumn).To(&sortValue).
+		Select("m.Created").To(&created).
+		Where("m.ID = ?", id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, errors.New("message not found")
+		}
+
+		return nil, nil, err
+	}
+
+	// keyset conditions for messages after (following) the message in the sort order,
+	// messages with equal sort values are sorted latest to oldest
+	after, before := "<", ">"
+	if sortDir == "ASC" {
+		after, before = ">", "<"
+	}
+
+	adjacent := func(op, tieOp, order, tieOrder string) (*string, error) {
+		var adjacentID string
+
+		q := sqlf.From("mailbox m").
+			Select("m.ID").To(&adjacentID).
+			Where(`(`+sortColumn+` `+op+` ? OR (`+sortColumn+` = ? AND (m.Created `+tieOp+` ? OR (m.Created = ? AND m.ID `+tieOp+` ?))))`,
+				sortValue, sortValue, created, created, id).
+			OrderBy(sortColumn+" "+order, "m.Created "+tieOrder, "m.ID "+tieOrder).
+			Limit(1)
+
+		if err := q.QueryRowAndClose(nil, db); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		return &adjacentID, nil
+	}
+
+	reverse := "ASC"
+	if sortDir == "ASC" {
+		reverse = "DESC"
+	}
+
+	prev, err := adjacent(before, ">", reverse, "ASC")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next, err := adjacent(after, "<", sortDir, "DESC")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Log().Debugf("[db] message navigation in %s", time.Since(tsStart))
+
+	return prev, next, nil
+}
+
+// GetMessageBySequenceNumber returns the summary of the nth (1-based) message, sorted oldest to
+// latest, as used by POP3 message numbers
+func GetMessageBySequenceNumber(n int) (*MessageSummary, error) {
+	if n < 1 {
+		return nil, errors.New("invalid sequence number")
+	}
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		OrderBy("m.Created ASC", "m.ID ASC").
+		Limit(1).
+		Offset(n - 1)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("message not found")
+	}
+
+	return &results[0], nil
+}
+
+// GetMessageSequenceNumber returns the 1-based sequence number of a message, sorted oldest
+// to latest, as used by POP3 message numbers
+func GetMessageSequenceNumber(id string) (int, error) {
+	var created int64
+
+	q := sqlf.From("mailbox m").
+		Select("m.Created").To(&created).
+		Where("m.ID = ?", id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errors.New("message not found")
+		}
+
+		return 0, err
+	}
+
+	var n int
+
+	c := sqlf.From("mailbox m").
+		Select("COUNT(*)").To(&n).
+		Where("(m.Created < ? OR (m.Created = ? AND m.ID <= ?))", created, created, id)
+
+	if err := c.QueryRowAndClose(nil, db); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// SortField is a field messages can be sorted by
+type SortField string
+
+// SortDir is the direction messages are sorted in
+type SortDir string
+
+const (
+	// SortCreated sorts messages by the time they were received
+	SortCreated SortField = "created"
+	// SortSize sorts messages by size
+	SortSize SortField = "size"
+	// SortSubject sorts messages by subject (case insensitive)
+	SortSubject SortField = "subject"
+	// SortFrom sorts messages by sender address (case insensitive)
+	SortFrom SortField = "from"
+
+	// SortAsc sorts messages in ascending order
+	SortAsc SortDir = "asc"
+	// SortDesc sorts messages in descending order
+	SortDesc SortDir = "desc"
+)
+
+// SQL sort columns of the sortable message fields
+var sortColumns = map[SortField]string{
+	SortCreated: "m.Created",
+	SortSize:    "m.Size",
+	SortSubject: "m.Subject COLLATE NOCASE",
+	SortFrom:    "m.FromAddress COLLATE NOCASE",
+}
+
+// ParseSortField returns the sort field matching the (case insensitive) name,
+// defaulting to SortCreated if empty
+func ParseSortField(name string) (SortField, error) {
+	if name == "" {
+		return SortCreated, nil
+	}
+
+	field := SortField(strings.ToLower(name))
+	if _, ok := sortColumns[field]; !ok {
+		return "", fmt.Errorf("invalid sort field: %s", name)
+	}
+
+	return field, nil
+}
+
+// ParseSortDir returns the sort direction matching the (case insensitive) name,
+// defaulting to SortDesc if empty
+func ParseSortDir(name string) (SortDir, error) {
+	switch dir := SortDir(strings.ToLower(name)); dir {
+	case "":
+		return SortDesc, nil
+	case SortAsc, SortDesc:
+		return dir, nil
+	}
+
+	return "", fmt.Errorf("invalid sort direction: %s", name)
+}
+
+// MessageSortOrder returns the SQL sort column & direction of the sort field & direction
+func messageSortOrder(field SortField, dir SortDir) (string, string, error) {
+	if field == "" {
+		field = SortCreated
+	}
+
+	sortColumn, ok := sortColumns[field]
+	if !ok {
+		return "", "", fmt.Errorf("invalid sort field: %s", field)
+	}
+
+	switch dir {
+	case "", SortDesc:
+		return sortColumn, "DESC", nil
+	case SortAsc:
+		return sortColumn, "ASC", nil
+	}
+
+	return "", "", fmt.Errorf("invalid sort direction: %s", dir)
+}
+
+// ParseSortOrder returns the SQL sort column & direction of the sort field & direction names
+func parseSortOrder(sortBy, sortDir string) (string, string, error) {
+	field, err := ParseSortField(sortBy)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir, err := ParseSortDir(sortDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	return messageSortOrder(field, dir)
+}
+
+// GetMessageSummaries returns the summaries of the given messages in the order requested.
+// IDs which do not exist are ignored.
+func GetMessageSummaries(ids []string) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	found := make(map[string]MessageSummary)
+
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	for _, chunk := range chunkBy(args, 1000) {
+		q := sqlf.From("mailbox m").
+			Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+			Where("m.ID").In(chunk...)
+
+		results, err := queryMessageSummaries(q)
+		if err != nil {
+			return []MessageSummary{}, err
+		}
+
+		for _, r := range results {
+			found[r.ID] = r
+		}
+	}
+
+	summaries := []MessageSummary{}
+	for _, id := range ids {
+		if s, ok := found[id]; ok {
+			summaries = append(summaries, s)
+			delete(found, id) // ignore duplicate IDs
+		}
+	}
+
+	logger.Log().Debugf("[db] fetched %d message summaries in %s", len(summaries), time.Since(tsStart))
+
+	return summaries, nil
+}
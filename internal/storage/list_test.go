@@ -0,0 +1,1388 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestListWithAttachments(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment listing")
+
+	for i := 0; i < 10; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		if _, err := Store(&testMimeEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	summaries, err := ListWithAttachments(0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 10, "Expected 10 messages with attachments")
+
+	for _, m := range summaries {
+		assertEqual(t, m.Attachments, 1, "Expected 1 attachment")
+	}
+
+	summaries, err = ListWithInline(0, 5)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 5, "Expected 5 messages with inline attachments")
+}
+
+func TestListWithAttachmentThresholds(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment count & size listing")
+
+	for i := 0; i < 5; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		if _, err := Store(&testMimeEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	summaries, total, err := ListWithMinAttachments(1, 0, 3)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 3, "incorrect number of messages returned")
+	assertEqual(t, total, 5, "incorrect total of messages with attachments")
+
+	_, total, err = ListWithMinAttachments(2, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 0, "incorrect total of messages with 2 or more attachments")
+
+	summaries, total, err = ListWithAttachmentSizeOver(1000, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 5, "incorrect number of messages returned")
+	assertEqual(t, total, 5, "incorrect total of messages with large attachments")
+
+	_, total, err = ListWithAttachmentSizeOver(100000000, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 0, "incorrect total of messages with very large attachments")
+}
+
+func TestListWithNoRecipients(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages with no recipients")
+
+	for _, raw := range []string{
+		"From: sender@example.com\r\nTo: to@example.com\r\nSubject: To\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nBcc: bcc@example.com\r\nSubject: Bcc\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nSubject: None\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nTo: \r\nCc: \r\nSubject: Empty\r\n\r\nTest\r\n",
+	} {
+		b := []byte(raw)
+		if _, err := Store(&b); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	messages, err := ListWithNoRecipients(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of messages with no recipients")
+	assertEqual(t, messages[0].Subject, "Empty", "messages not sorted latest to oldest")
+	assertEqual(t, messages[1].Subject, "None", "incorrect message")
+}
+
+func TestGetMessagesWithExpiredLinks(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages with expired links")
+
+	ids := []string{}
+	for _, subject := range []string{"OK", "Redirect", "Failed", "Unchecked"} {
+		b := []byte("From: sender@example.com\r\nSubject: " + subject + "\r\n\r\nTest\r\n")
+		id, err := Store(&b)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	for i, codes := range [][]int{{200, 204}, {200, 301}, {200, 0}} {
+		if err := SetLinkCheckResult(ids[i], codes, time.Now()); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	messages, err := GetMessagesWithExpiredLinks(0, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of messages with expired links")
+	assertEqual(t, messages[0].Subject, "Failed", "messages not sorted latest to oldest")
+	assertEqual(t, messages[1].Subject, "Redirect", "incorrect message")
+
+	// the most recent link check replaces the previous result
+	if err := SetLinkCheckResult(ids[1], []int{200}, time.Now()); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	messages, err = GetMessagesWithExpiredLinks(time.Hour, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), 1, "incorrect number of messages with expired links")
+	assertEqual(t, messages[0].Subject, "Failed", "incorrect message")
+
+	if err := DeleteOneMessage(ids[2]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	messages, err = GetMessagesWithExpiredLinks(0, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), 0, "deleted message should not be returned")
+}
+
+func TestStreamAllMessageSummaries(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message summary streaming")
+
+	for i := 0; i < 250; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	messages, errs := StreamAllMessageSummaries(context.Background())
+
+	ids := map[string]bool{}
+	for m := range messages {
+		ids[m.ID] = true
+	}
+
+	if err := <-errs; err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(ids), 250, "Expected 250 unique streamed messages")
+
+	// cancelling the context stops the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, errs = StreamAllMessageSummaries(ctx)
+	<-messages
+	cancel()
+
+	for range messages {
+	}
+
+	assertEqual(t, <-errs, context.Canceled, "Expected context cancelled error")
+
+	stream, err := GetAllMessageSummariesStream(context.Background())
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	ids = map[string]bool{}
+	for m := range stream {
+		ids[m.ID] = true
+	}
+
+	assertEqual(t, len(ids), 250, "Expected 250 unique streamed messages")
+
+	// a cancelled context returns an error before streaming
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	_, err = GetAllMessageSummariesStream(ctx)
+	assertEqual(t, err, context.Canceled, "Expected context cancelled error")
+}
+
+func TestListByReadState(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing read state listing")
+
+	for i := 0; i < 20; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if i%2 == 0 {
+			if err := MarkRead(id); err != nil {
+				t.Log("error ", err)
+				t.Fail()
+			}
+		}
+
+		if i%4 == 0 {
+			if err := SetMessageTags(id, []string{"Tag1"}); err != nil {
+				t.Log("error ", err)
+				t.Fail()
+			}
+		}
+	}
+
+	summaries, total, err := ListByReadState(false, nil, 0, 5)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 5, "Expected 5 unread results")
+	assertEqual(t, total, 10, "Expected 10 unread messages")
+
+	summaries, total, err = ListByReadState(true, []string{"Tag1"}, 0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 5, "Expected 5 read results with tag")
+	assertEqual(t, total, 5, "Expected 5 read messages with tag")
+
+	_, total, err = ListByReadState(false, []string{"Tag1"}, 0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 0, "Expected 0 unread messages with tag")
+}
+
+func TestListWithFilter(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing filtered listing")
+
+	for i := 0; i < 12; i++ {
+		body := testTextEmail
+		if i%3 == 0 {
+			body = testMimeEmail
+		}
+
+		id, err := Store(&body)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if i%2 == 0 {
+			if err := MarkRead(id); err != nil {
+				t.Log("error ", err)
+				t.FailNow()
+			}
+		}
+
+		tags := []string{"Foo"}
+		if i%4 == 0 {
+			tags = append(tags, "Bar")
+		}
+		if i%6 == 0 {
+			tags = []string{"Bar"}
+		}
+
+		if err := SetMessageTags(id, tags); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	// a zero-value filter matches List()
+	all, err := List(0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	filtered, err := ListWithFilter(0, 100, ListFilter{})
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(filtered), len(all), "Expected the same results as List()")
+	for i := range all {
+		assertEqual(t, filtered[i].ID, all[i].ID, "Expected the same order as List()")
+	}
+
+	unread := true
+	hasAttachments := true
+
+	tests := []struct {
+		filter ListFilter
+		count  int
+	}{
+		{ListFilter{Unread: &unread}, 6},
+		{ListFilter{HasAttachments: &hasAttachments}, 4},
+		{ListFilter{Tags: []string{"Foo"}}, 10},
+		{ListFilter{Tags: []string{"Bar"}}, 4},
+		// messages must contain all of the tags
+		{ListFilter{Tags: []string{"Foo", "Bar"}}, 2},
+		{ListFilter{Tags: []string{"foo", "Bar", "Missing"}}, 0},
+		{ListFilter{Unread: &unread, Tags: []string{"Foo"}}, 6},
+		{ListFilter{Unread: &unread, HasAttachments: &hasAttachments}, 2},
+	}
+
+	for _, test := range tests {
+		summaries, err := ListWithFilter(0, 100, test.filter)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		total, err := CountWithFilter(test.filter)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		assertEqual(t, len(summaries), test.count, fmt.Sprintf("Incorrect results for %+v", test.filter))
+		assertEqual(t, total, test.count, fmt.Sprintf("Incorrect count for %+v", test.filter))
+	}
+}
+
+func TestListByPriority(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing priority listing")
+
+	highPriority := append([]byte("X-Priority: 1 (Highest)\r\n"), testTextEmail...)
+	lowPriority := append([]byte("Importance: low\r\n"), testTextEmail...)
+
+	var highID string
+	for i := 0; i < 5; i++ {
+		id, err := Store(&highPriority)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		highID = id
+
+		if _, err := Store(&lowPriority); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	for p, expected := range map[int]int{PriorityHighest: 5, PriorityNormal: 5, PriorityLowest: 5, 2: 0} {
+		summaries, err := ListByPriority(p, 0, 100)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, len(summaries), expected, "Incorrect number of messages for priority")
+	}
+
+	priority, err := GetMessagePriority(highID)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, priority, PriorityHighest, "Incorrect message priority")
+}
+
+func TestListByTagSorted(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing sorted tag listing")
+
+	for i := 0; i < 10; i++ {
+		body := testTextEmail
+		if i%2 == 0 {
+			body = testMimeEmail
+		}
+
+		id, err := Store(&body)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if i < 6 {
+			if err := SetMessageTags(id, []string{"CI"}); err != nil {
+				t.Log("error ", err)
+				t.Fail()
+			}
+		}
+	}
+
+	summaries, total, err := ListByTagSorted("CI", "size", "asc", 0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 6, "Incorrect total of tagged messages")
+	assertEqual(t, len(summaries), 6, "Incorrect number of tagged messages")
+
+	for i := 1; i < len(summaries); i++ {
+		if summaries[i-1].Size > summaries[i].Size {
+			t.Errorf("messages not sorted by size ascending: %d > %d", summaries[i-1].Size, summaries[i].Size)
+		}
+	}
+
+	summaries, _, err = ListByTagSorted("CI", "size", "desc", 0, 3)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 3, "Incorrect number of tagged messages")
+	assertEqual(t, summaries[0].Size, len(testMimeEmail), "Incorrect largest message first")
+
+	if _, _, err := ListByTagSorted("CI", "invalid", "asc", 0, 100); err == nil {
+		t.Error("expected an error for an invalid sort field")
+	}
+}
+
+func TestListAndSearchSorted(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing sorted listing & search")
+
+	// stored in this order, with increasing sizes
+	messages := []struct {
+		from    string
+		subject string
+	}{
+		{"charlie@example.com", "Bravo"},
+		{"Alpha@example.com", "delta"},
+		{"bravo@example.com", "Charlie"},
+		{"delta@example.com", "alpha"},
+	}
+
+	for i, m := range messages {
+		raw := []byte(fmt.Sprintf("From: %s\r\nTo: recipient@example.com\r\nSubject: %s\r\n\r\nSorted message %s\r\n",
+			m.from, m.subject, strings.Repeat("x", i*100)))
+
+		if _, err := Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		// ensure distinct created timestamps
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	subjects := func(summaries []MessageSummary) string {
+		s := []string{}
+		for _, m := range summaries {
+			s = append(s, m.Subject)
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		sortBy   SortField
+		sortDir  SortDir
+		expected string
+	}{
+		{"", "", "alpha,Charlie,delta,Bravo"},
+		{SortCreated, SortAsc, "Bravo,delta,Charlie,alpha"},
+		{SortSize, SortDesc, "alpha,Charlie,delta,Bravo"},
+		{SortSize, SortAsc, "Bravo,delta,Charlie,alpha"},
+		{SortSubject, SortAsc, "alpha,Bravo,Charlie,delta"},
+		{SortSubject, SortDesc, "delta,Charlie,Bravo,alpha"},
+		{SortFrom, SortAsc, "delta,Charlie,Bravo,alpha"},
+		{SortFrom, SortDesc, "alpha,Bravo,Charlie,delta"},
+	}
+
+	for _, test := range tests {
+		summaries, err := ListSorted(0, 100, test.sortBy, test.sortDir)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		assertEqual(t, subjects(summaries), test.expected, fmt.Sprintf("incorrect list order for %s %s", test.sortBy, test.sortDir))
+
+		summaries, total, err := SearchSorted("sorted message", 0, 100, test.sortBy, test.sortDir)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		assertEqual(t, total, 4, "incorrect number of search results")
+		assertEqual(t, subjects(summaries), test.expected, fmt.Sprintf("incorrect search order for %s %s", test.sortBy, test.sortDir))
+	}
+
+	summaries, err := ListSorted(1, 2, SortSize, SortDesc)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, subjects(summaries), "Charlie,delta", "incorrect sorted page")
+
+	if _, err := ListSorted(0, 100, SortField("invalid"), SortDesc); err == nil {
+		t.Error("expected an error for an invalid sort field")
+	}
+
+	if _, _, err := SearchSorted("sorted", 0, 100, SortSize, SortDir("invalid")); err == nil {
+		t.Error("expected an error for an invalid sort direction")
+	}
+
+	// sort fields & directions are parsed case insensitively
+	field, err := ParseSortField("Size")
+	assertEqual(t, field, SortSize, "incorrect sort field")
+	assertEqual(t, err, nil, "unexpected sort field error")
+
+	dir, err := ParseSortDir("ASC")
+	assertEqual(t, dir, SortAsc, "incorrect sort direction")
+	assertEqual(t, err, nil, "unexpected sort direction error")
+
+	if _, err := ParseSortField("invalid"); err == nil {
+		t.Error("expected an error parsing an invalid sort field")
+	}
+
+	if _, err := ParseSortDir("invalid"); err == nil {
+		t.Error("expected an error parsing an invalid sort direction")
+	}
+}
+
+func TestListBetween(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing list between messages")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+
+		// ensure unique received timestamps
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	summaries, err := ListBetween(ids[1], ids[3])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 3, "incorrect number of messages")
+	assertEqual(t, summaries[0].ID, ids[3], "latest message should be first")
+	assertEqual(t, summaries[2].ID, ids[1], "oldest message should be last")
+
+	// reversed order
+	summaries, err = ListBetween(ids[4], ids[0])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 5, "incorrect number of messages")
+
+	summaries, err = ListBetween(ids[2], ids[2])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 1, "incorrect number of messages")
+
+	if _, err := ListBetween(ids[0], "invalid"); err == nil {
+		t.Log("expected error for missing message")
+		t.Fail()
+	}
+}
+
+func TestGetMessagesDelta(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages delta")
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+
+		// ensure unique received timestamps
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	newID, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if err := DeleteOneMessage(ids[0]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	// created & deleted after since, so not included in either list
+	if err := DeleteOneMessage(newID); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	newID, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	newMessages, deletedIDs, err := GetMessagesDelta(since)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(newMessages), 1, "incorrect number of new messages")
+	assertEqual(t, newMessages[0].ID, newID, "incorrect new message")
+	assertEqual(t, strings.Join(deletedIDs, ","), ids[0], "incorrect deleted IDs")
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	_, deletedIDs, err = GetMessagesDelta(since)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(deletedIDs), 3, "incorrect number of deleted IDs")
+}
+
+func TestGetMessagesByRecipient(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing list by recipient")
+
+	for _, rcpt := range []string{"To: one@example.com", "Cc: One <ONE@example.com>", "Bcc: one@example.com", "To: two@example.com"} {
+		raw := []byte("From: sender@example.com\r\n" + rcpt + "\r\nSubject: Recipient\r\n\r\nTest\r\n")
+		if _, err := Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	results, err := GetMessagesByRecipient("One@Example.com", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(results), 3, "incorrect number of messages for recipient")
+
+	results, err = GetMessagesByRecipient("one@example.com", 1, 1)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(results), 1, "incorrect number of paginated messages for recipient")
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	results, err = GetMessagesByRecipient("two@example.com", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(results), 0, "expected no messages after delete")
+}
+
+func TestGetMessageNavigation(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message navigation")
+
+	for i := 0; i < 6; i++ {
+		body := testTextEmail
+		if i%2 == 0 {
+			body = testMimeEmail
+		}
+
+		id, err := Store(&body)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if err := SetMessageTags(id, []string{"nav"}); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	for _, sort := range [][]string{{"created", "desc"}, {"size", "asc"}, {"subject", "asc"}, {"from", "desc"}} {
+		// navigation must follow the same order as the sorted list
+		summaries, _, err := ListByTagSorted("nav", sort[0], sort[1], 0, 100)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		for i, m := range summaries {
+			prev, next, err := GetMessageNavigation(m.ID, sort[0], sort[1])
+			if err != nil {
+				t.Log("error ", err)
+				t.Fail()
+				continue
+			}
+
+			if i == 0 {
+				assertEqual(t, prev == nil, true, "first message should not have a previous message")
+			} else if prev == nil || *prev != summaries[i-1].ID {
+				t.Logf("incorrect previous message for %s %s at position %d", sort[0], sort[1], i)
+				t.Fail()
+			}
+
+			if i == len(summaries)-1 {
+				assertEqual(t, next == nil, true, "last message should not have a next message")
+			} else if next == nil || *next != summaries[i+1].ID {
+				t.Logf("incorrect next message for %s %s at position %d", sort[0], sort[1], i)
+				t.Fail()
+			}
+		}
+	}
+
+	if _, _, err := GetMessageNavigation("invalid", "", ""); err == nil {
+		t.Log("expected error for missing message")
+		t.Fail()
+	}
+
+	if _, _, err := GetMessageNavigation("invalid", "invalid", ""); err == nil {
+		t.Log("expected error for invalid sort field")
+		t.Fail()
+	}
+}
+
+func TestGetMessageSequenceNumbers(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message sequence numbers")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for i, id := range ids {
+		m, err := GetMessageBySequenceNumber(i + 1)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+			continue
+		}
+		assertEqual(t, m.ID, id, "incorrect message for sequence number")
+
+		n, err := GetMessageSequenceNumber(id)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		assertEqual(t, n, i+1, "incorrect sequence number")
+	}
+
+	if _, err := GetMessageBySequenceNumber(6); err == nil {
+		t.Log("expected an error for a sequence number out of range")
+		t.Fail()
+	}
+
+	if _, err := GetMessageBySequenceNumber(0); err == nil {
+		t.Log("expected an error for an invalid sequence number")
+		t.Fail()
+	}
+
+	if _, err := GetMessageSequenceNumber("invalid"); err == nil {
+		t.Log("expected an error for a missing message")
+		t.Fail()
+	}
+}
+
+func TestGetMessageSummaries(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message summaries by ID")
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	request := []string{ids[7], "does-not-exist", ids[2], ids[7], ids[0]}
+
+	summaries, err := GetMessageSummaries(request)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 3, "Incorrect number of message summaries")
+
+	for i, id := range []string{ids[7], ids[2], ids[0]} {
+		assertEqual(t, summaries[i].ID, id, "Message summaries not in requested order")
+	}
+}
+
+func TestGetMessagesByCustomHeader(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.IndexedHeaders = []string{"X-Test-Id"}
+	defer func() { config.IndexedHeaders = []string{} }()
+
+	t.Log("Testing messages by custom header")
+
+	for i, testID := range []string{"abc123", "def456", "abc123", ""} {
+		raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\n")
+		if testID != "" {
+			raw = append(raw, []byte("X-Test-ID: "+testID+"\r\n")...)
+		}
+		raw = append(raw, []byte(fmt.Sprintf("Subject: Message %d\r\n\r\nTest\r\n", i))...)
+
+		if _, err := Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	messages, total, err := GetMessagesByCustomHeader("x-test-id", "abc123", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 2, "incorrect number of matching messages")
+	assertEqual(t, len(messages), 2, "incorrect number of returned messages")
+	assertEqual(t, messages[0].Subject, "Message 2", "messages not sorted latest to oldest")
+
+	_, total, err = GetMessagesByCustomHeader("X-Test-ID", "missing", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 0, "incorrect number of matching messages")
+
+	if _, _, err := GetMessagesByCustomHeader("X-Other", "abc123", 0, 10); err == nil {
+		t.Error("expected an error for a header which is not indexed")
+	}
+}
+
+func TestListByContentType(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages by content type")
+
+	for _, m := range [][]byte{testTextEmail, testMimeEmail, testTextEmail} {
+		if _, err := Store(&m); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	for ct, expected := range map[string]int{
+		"multipart/mixed": 1,
+		"application/pdf": 1,
+		"image/*":         1,
+		"text/calendar":   0,
+	} {
+		messages, total, err := ListByContentType(ct, 0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, total, expected, fmt.Sprintf("incorrect number of %s messages", ct))
+		assertEqual(t, len(messages), expected, fmt.Sprintf("incorrect number of returned %s messages", ct))
+	}
+
+	if _, _, err := ListByContentType(" ", 0, 10); err == nil {
+		t.Error("expected an error for an empty content type")
+	}
+}
+
+func TestListGroupedByDate(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.UseMessageDates = true
+	defer func() { config.UseMessageDates = false }()
+
+	t.Log("Testing messages grouped by date")
+
+	for _, date := range []string{
+		"Mon, 03 Jun 2024 10:00:00 +0000",
+		"Mon, 03 Jun 2024 23:59:59 +0000",
+		"Sat, 15 Jun 2024 08:30:00 +0000",
+		"Fri, 31 May 2024 12:00:00 +0000",
+		"Mon, 01 Jul 2024 00:00:00 +0000",
+	} {
+		raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\nDate: " + date + "\r\nSubject: Test\r\n\r\nTest\r\n")
+		if _, err := Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	days, err := ListGroupedByDate(2024, 6)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(days), 2, "incorrect number of days")
+	assertEqual(t, days["2024-06-03"], 2, "incorrect count for 2024-06-03")
+	assertEqual(t, days["2024-06-15"], 1, "incorrect count for 2024-06-15")
+
+	if _, err := ListGroupedByDate(2024, 13); err == nil {
+		t.Error("expected an error for an invalid month")
+	}
+}
+
+func TestListBySenderDomain(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages by sender domain")
+
+	for _, raw := range []string{
+		"From: sender@Example.com\r\nSubject: One\r\n\r\nTest\r\n",
+		"From: sender@example.org\r\nSubject: Two\r\n\r\nTest\r\n",
+		"From: Sender <other@example.com>\r\nSubject: Three\r\n\r\nTest\r\n",
+		"From: sender@sub.example.com\r\nSubject: Four\r\n\r\nTest\r\n",
+	} {
+		b := []byte(raw)
+		if _, err := Store(&b); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	messages, total, err := ListBySenderDomain("EXAMPLE.com", 0, 1)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 2, "incorrect total number of messages from domain")
+	assertEqual(t, len(messages), 1, "incorrect number of messages returned")
+	assertEqual(t, messages[0].Subject, "Three", "messages not sorted latest to oldest")
+
+	if _, _, err := ListBySenderDomain(" ", 0, 10); err == nil {
+		t.Log("expected an error for an empty domain")
+		t.Fail()
+	}
+}
+
+func TestListBulkMail(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk messages")
+
+	ids := []string{}
+	for _, raw := range []string{
+		"From: sender@example.com\r\nPrecedence: bulk\r\nSubject: Bulk\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nSubject: Normal\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nPrecedence: first-class\r\nSubject: First class\r\n\r\nTest\r\n",
+		"From: sender@example.com\r\nPrecedence:  List \r\nSubject: List\r\n\r\nTest\r\n",
+	} {
+		b := []byte(raw)
+		id, err := Store(&b)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	messages, err := ListBulkMail(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of bulk messages")
+	assertEqual(t, messages[0].Subject, "List", "messages not sorted latest to oldest")
+	assertEqual(t, messages[1].Subject, "Bulk", "incorrect message")
+
+	precedence, err := GetMessagePrecedenceHeader(ids[3])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, precedence, "List", "incorrect Precedence header")
+
+	precedence, err = GetMessagePrecedenceHeader(ids[1])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, precedence, "", "unexpected Precedence header")
+}
+
+func TestCountMessagesSince(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message counts within a period")
+
+	for i := 0; i < 3; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	assertEqual(t, CountMessagesSince(time.Hour), 3, "incorrect number of messages in the last hour")
+
+	// backdate one message
+	if _, err := db.Exec("UPDATE mailbox SET Created = ? WHERE ID IN (SELECT ID FROM mailbox LIMIT 1)", time.Now().Add(-2*time.Hour).UnixMilli()); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, CountMessagesSince(time.Hour), 2, "incorrect number of messages in the last hour")
+	assertEqual(t, CountMessagesBetween(time.Now().Add(-3*time.Hour), time.Now().Add(-time.Hour)), 1, "incorrect number of messages between times")
+	assertEqual(t, CountMessagesBetween(time.Now().Add(-3*time.Hour), time.Now()), 3, "incorrect number of messages between times")
+}
+
+func TestGetGrowthRateByHour(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing mailbox growth rate")
+
+	for i := 0; i < 6; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	// backdate two messages by two hours, & one beyond the last 24 hours
+	if _, err := db.Exec("UPDATE mailbox SET Created = ? WHERE ID IN (SELECT ID FROM mailbox LIMIT 2)", time.Now().Add(-2*time.Hour).UnixMilli()); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	if _, err := db.Exec("UPDATE mailbox SET Created = ? WHERE ID IN (SELECT ID FROM mailbox ORDER BY Created DESC LIMIT 1)", time.Now().Add(-48*time.Hour).UnixMilli()); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	rate, err := GetMailboxGrowthRate()
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, rate, float64(5)/24, "incorrect growth rate")
+
+	rates, err := GetGrowthRateByHour(3)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(rates), 3, "incorrect number of hours")
+	assertEqual(t, rates[0].Count, 2, "incorrect count for the oldest hour")
+	assertEqual(t, rates[1].Count, 0, "incorrect count for an hour without messages")
+	assertEqual(t, rates[2].Count, 3, "incorrect count for the current hour")
+	assertEqual(t, rates[2].Hour, time.Now().UTC().Truncate(time.Hour), "incorrect current hour")
+
+	if _, err := GetGrowthRateByHour(0); err == nil {
+		t.Log("expected an error for invalid hours")
+		t.Fail()
+	}
+}
+
+func TestListAfterID(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing keyset pagination")
+
+	for i := 0; i < 25; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	all, err := List(0, 100)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	results := []MessageSummary{}
+	afterID := ""
+	for {
+		page, err := ListAfterID(afterID, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		if len(page) == 0 {
+			break
+		}
+		results = append(results, page...)
+		afterID = page[len(page)-1].ID
+	}
+
+	assertEqual(t, len(results), 25, "incorrect number of messages")
+	for i := range all {
+		assertEqual(t, results[i].ID, all[i].ID, "keyset pagination does not match offset pagination")
+	}
+
+	page, err := List(20, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(page), 5, "incorrect number of messages on the last page")
+	assertEqual(t, page[0].ID, all[20].ID, "incorrect offset pagination")
+
+	if _, err := ListAfterID("missing", 10); err == nil {
+		t.Log("expected an error for a missing message")
+		t.Fail()
+	}
+}
+
+func BenchmarkListAfterID(b *testing.B) {
+	setup()
+	defer Close()
+
+	// insert the message summaries directly, storing 100k messages is too slow
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	created := time.Now().UnixMilli()
+	for i := 0; i < 100000; i++ {
+		if _, err := tx.Exec("INSERT INTO mailbox(Created, ID, MessageID, Subject, Metadata, Size, Inline, Attachments, SearchText, Read, Snippet) values(?,?,'','Subject','{}',100,0,0,'',0,'')", created-int64(i/10), fmt.Sprintf("id-%06d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	// the last page
+	afterID := "id-099950"
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ListAfterID(afterID, 50); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetMessageStats(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message stats")
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	// created, size & read state
+	messages := []struct {
+		created time.Time
+		size    int
+		read    bool
+	}{
+		{hour.Add(-2 * time.Hour), 100, false},
+		{hour.Add(-2*time.Hour + 59*time.Minute), 200, true},
+		{hour.Add(time.Second), 300, false},
+		{hour.Add(-5 * time.Hour), 5000, false}, // before since
+	}
+
+	for _, m := range messages {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if _, err := db.Exec("UPDATE mailbox SET Created = ?, Size = ? WHERE ID = ?", m.created.UnixMilli(), m.size, id); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if m.read {
+			if err := MarkRead(id); err != nil {
+				t.Log("error ", err)
+				t.FailNow()
+			}
+		}
+	}
+
+	buckets, err := GetMessageStats(hour.Add(-2*time.Hour+30*time.Minute), time.Hour)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(buckets), 3, "incorrect number of buckets")
+	assertEqual(t, buckets[0].Timestamp, hour.Add(-2*time.Hour), "incorrect first bucket time")
+	assertEqual(t, buckets[0].Count, 2, "incorrect first bucket count")
+	assertEqual(t, buckets[0].TotalSizeBytes, int64(300), "incorrect first bucket size")
+	assertEqual(t, buckets[0].Unread, 1, "incorrect first bucket unread")
+	assertEqual(t, buckets[1].Count, 0, "incorrect count for a bucket without messages")
+	assertEqual(t, buckets[2].Timestamp, hour, "incorrect last bucket time")
+	assertEqual(t, buckets[2].Count, 1, "incorrect last bucket count")
+	assertEqual(t, buckets[2].TotalSizeBytes, int64(300), "incorrect last bucket size")
+	assertEqual(t, buckets[2].Unread, 1, "incorrect last bucket unread")
+
+	if _, err := GetMessageStats(hour, 0); err == nil {
+		t.Error("expected an error for an invalid granularity")
+	}
+
+	if _, err := GetMessageStats(hour.Add(-24*time.Hour), time.Second); err == nil {
+		t.Error("expected an error for too many buckets")
+	}
+}
+
+func TestGetSizeHistogram(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message size histogram")
+
+	for _, size := range []int{0, 1023, 1024, 10239, 10240, 50000, 5000000} {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if _, err := db.Exec("UPDATE mailbox SET Size = ? WHERE ID = ?", size, id); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	buckets, err := GetSizeHistogram(4)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	expected := []SizeBucket{
+		{Min: 0, Max: 1024, Count: 2},
+		{Min: 1024, Max: 10240, Count: 2},
+		{Min: 10240, Max: 102400, Count: 2},
+		{Min: 102400, Max: 0, Count: 1},
+	}
+
+	assertEqual(t, len(buckets), len(expected), "incorrect number of buckets")
+	for i, b := range expected {
+		assertEqual(t, buckets[i], b, fmt.Sprintf("incorrect bucket %d", i))
+	}
+
+	if _, err := GetSizeHistogram(1); err == nil {
+		t.Error("expected an error for an invalid number of buckets")
+	}
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// ExportMbox writes the given messages to w in mbox (mboxrd) format, in the order provided.
+// Nothing is written if any of the messages do not exist.
+func ExportMbox(w io.Writer, ids []string) error {
+	tsStart := time.Now()
+
+	ids = uniqueIDs(ids)
+
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	type envelope struct {
+		from    string
+		created int64
+	}
+
+	envelopes := make(map[string]envelope, len(ids))
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	for _, chunk := range chunkBy(args, 1000) {
+		var id, from string
+		var created int64
+		q := sqlf.From("mailbox").
+			Select("ID").To(&id).
+			Select("EnvelopeFrom").To(&from).
+			Select("Created").To(&created).
+			Where("ID").In(chunk...)
+
+		if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+			envelopes[id] = envelope{from: from, created: created}
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if _, ok := envelopes[id]; !ok {
+			return fmt.Errorf("%s: message not found", id)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+
+	for _, id := range ids {
+		var email string
+		q := sqlf.From("mailbox_data").
+			Select("Email").To(&email).
+			Where("ID = ?", id)
+
+		if err := q.QueryRowAndClose(nil, db); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%s: message not found", id)
+			}
+
+			return err
+		}
+
+		raw, err := dbDecoder.DecodeAll([]byte(email), nil)
+		if err != nil {
+			return fmt.Errorf("error decompressing message %s: %s", id, err.Error())
+		}
+
+		e := envelopes[id]
+		if err := writeMboxMessage(bw, e.from, time.UnixMilli(e.created), raw); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	setDBLastAction()
+
+	logger.Log().Debugf("[db] exported %d messages to mbox in %s", len(ids), time.Since(tsStart))
+
+	return nil
+}
+
+// ExportAllMbox writes all messages to w in mbox (mboxrd) format, oldest first
+func ExportAllMbox(w io.Writer) error {
+	ids, err := AllMessageIDs()
+	if err != nil {
+		return err
+	}
+
+	return ExportMbox(w, ids)
+}
+
+// AllMessageIDs returns the IDs of all messages, oldest first
+func AllMessageIDs() ([]string, error) {
+	ids := []string{}
+
+	var id string
+	q := sqlf.From("mailbox").
+		Select("ID").To(&id).
+		OrderBy("Created ASC", "ID ASC")
+
+	err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		ids = append(ids, id)
+	})
+
+	return ids, err
+}
+
+// WriteMboxMessage writes a single message preceded by its "From " envelope line, escaping
+// any (quoted) "From " lines in the message, followed by a blank line separator
+func writeMboxMessage(w io.Writer, returnPath string, created time.Time, raw []byte) error {
+	if returnPath == "" {
+		returnPath = mboxReturnPath(raw)
+	}
+
+	if _, err := fmt.Fprintf(w, "From %s %s\n", returnPath, created.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			if _, err := w.Write([]byte(">")); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+
+	separator := "\n"
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		separator = "\n\n"
+	}
+
+	_, err := io.WriteString(w, separator)
+
+	return err
+}
+
+// MboxReturnPath returns the address of the Return-Path (or From) header of a message,
+// for messages without a stored envelope sender
+func mboxReturnPath(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "MAILER-DAEMON"
+	}
+
+	for _, h := range []string{"Return-Path", "From"} {
+		if a, err := mail.ParseAddress(msg.Header.Get(h)); err == nil && a.Address != "" {
+			return a.Address
+		}
+	}
+
+	return "MAILER-DAEMON"
+}
+
+// ImportProgress is the progress of the current (or last) mbox import
+type ImportProgress struct {
+	// Whether an import is currently running
+	Running bool
+	// Number of messages imported
+	Imported int
+	// Number of messages skipped (duplicates or rejected messages)
+	Skipped int
+}
+
+var (
+	importProgress      ImportProgress
+	importProgressMutex sync.RWMutex
+)
+
+// GetImportProgress returns the progress of the current (or last) mbox import
+func GetImportProgress() ImportProgress {
+	importProgressMutex.RLock()
+	defer importProgressMutex.RUnlock()
+
+	return importProgress
+}
+
+func setImportProgress(p ImportProgress) {
+	importProgressMutex.Lock()
+	importProgress = p
+	importProgressMutex.Unlock()
+}
+
+// ImportMbox stores all messages of an mbox (mboxo or mboxrd) file, un-escaping any quoted
+// "From " lines. Messages with a Message-ID which already exists are skipped, as are messages
+// rejected by validation rules, storage hooks or blocked attachments.
+// Only one import can run at a time.
+func ImportMbox(r io.Reader) (imported, skipped int, err error) {
+	tsStart := time.Now()
+
+	importProgressMutex.Lock()
+	if importProgress.Running {
+		importProgressMutex.Unlock()
+		return 0, 0, errors.New("an import is already running")
+	}
+	importProgress = ImportProgress{Running: true}
+	importProgressMutex.Unlock()
+
+	defer func() {
+		setImportProgress(ImportProgress{Imported: imported, Skipped: skipped})
+	}()
+
+	importMessage := func(raw []byte) error {
+		// strip the blank line separating messages
+		if bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+			raw = raw[:len(raw)-2]
+		} else if bytes.HasSuffix(raw, []byte("\n\n")) {
+			raw = raw[:len(raw)-1]
+		}
+
+		id, err := ImportEML(raw)
+		if err != nil {
+			if !isRejectedMessageError(err) {
+				return err
+			}
+			logger.Log().Warnf("[db] skipping import of message: %s", err.Error())
+		}
+
+		if id == "" {
+			skipped++
+		} else {
+			imported++
+		}
+
+		setImportProgress(ImportProgress{Running: true, Imported: imported, Skipped: skipped})
+
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	var msg []byte
+	started := false
+
+	for {
+		line, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return imported, skipped, readErr
+		}
+
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if started {
+				if err := importMessage(msg); err != nil {
+					return imported, skipped, err
+				}
+			}
+			started = true
+			msg = []byte{}
+		} else if started {
+			// un-escape quoted "From " lines (eg: ">From " or ">>From ")
+			if bytes.HasPrefix(line, []byte(">")) && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				line = line[1:]
+			}
+			msg = append(msg, line...)
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			return imported, skipped, errors.New("invalid mbox file: missing \"From \" line")
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if started {
+		if err := importMessage(msg); err != nil {
+			return imported, skipped, err
+		}
+	}
+
+	logger.Log().Infof("[db] imported %d messages from mbox in %s (%d skipped)", imported, time.Since(tsStart), skipped)
+
+	return imported, skipped, nil
+}
+
+// ImportEML stores a single raw message, returning the database ID. If a message with the
+// same Message-ID already exists then the message is skipped, and an empty ID is returned.
+func ImportEML(body []byte) (string, error) {
+	if msg, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		messageID := strings.Trim(msg.Header.Get("Message-ID"), "<>")
+		if messageID != "" && MessageIDExists(messageID) {
+			logger.Log().Debugf("[db] duplicate message found, skipping import of %s", messageID)
+			return "", nil
+		}
+	}
+
+	return Store(&body)
+}
+
+// IsRejectedMessageError returns whether the error is the result of a message being
+// rejected (rather than failing to be stored)
+func isRejectedMessageError(err error) bool {
+	return errors.Is(err, ErrBlockedAttachment) || errors.Is(err, ErrStorageHook) || errors.Is(err, ErrValidationRule) || errors.Is(err, ErrDuplicateMessageID)
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// ParseMDN returns the details of a Message Disposition Notification (RFC 3798) message,
+// such as a read receipt. An error is returned if the message is not an MDN.
+func ParseMDN(id string) (*MDNReport, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	if !isMDN(env) {
+		return nil, errors.New("message is not a disposition notification")
+	}
+
+	for _, p := range env.Root.DepthMatchAll(func(p *enmime.Part) bool {
+		return p.ContentType == "message/disposition-notification"
+	}) {
+		// the notification fields may not include a trailing separator
+		msg, err := mail.ReadMessage(bytes.NewReader(append(p.Content, []byte("\r\n\r\n")...)))
+		if err != nil {
+			continue
+		}
+
+		return &MDNReport{
+			FinalRecipient:    mdnFieldValue(msg.Header.Get("Final-Recipient")),
+			OriginalMessageID: strings.Trim(msg.Header.Get("Original-Message-Id"), "<>"),
+			Disposition:       msg.Header.Get("Disposition"),
+			ReportingAgent:    strings.TrimSpace(msg.Header.Get("Reporting-Ua")),
+		}, nil
+	}
+
+	return nil, errors.New("disposition notification part not found")
+}
+
+// Returns whether the envelope is an MDN (multipart/report; report-type=disposition-notification)
+func isMDN(env *enmime.Envelope) bool {
+	mediaType, params, err := mime.ParseMediaType(env.Root.Header.Get("Content-Type"))
+
+	return err == nil && mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "disposition-notification")
+}
+
+// Returns the value of a typed MDN field, eg: "rfc822; user@example.com" returns "user@example.com"
+func mdnFieldValue(v string) string {
+	if _, value, found := strings.Cut(v, ";"); found {
+		return strings.TrimSpace(value)
+	}
+
+	return strings.TrimSpace(v)
+}
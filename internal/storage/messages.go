@@ -1,20 +1,32 @@
 package storage
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/mail"
+	"os"
+	"path"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/cache"
+	"github.com/axllent/mailpit/internal/errorreport"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/metrics"
 	"github.com/axllent/mailpit/server/webhook"
 	"github.com/axllent/mailpit/server/websockets"
 	"github.com/jhillyerd/enmime"
@@ -22,9 +34,46 @@ import (
 	"github.com/lithammer/shortuuid/v4"
 )
 
+// ErrBlockedAttachment is returned by Store() when a message contains an attachment
+// matching config.BlockedAttachmentTypes
+var ErrBlockedAttachment = errors.New("message contains a blocked attachment type")
+
+// ErrDuplicateMessageID is returned by Store() when a message with the same Message-ID
+// already exists and config.DuplicateAction is set to reject
+var ErrDuplicateMessageID = errors.New("message with the same Message-ID already exists")
+
 // Store will save an email to the database tables.
 // Returns the database ID of the saved message.
 func Store(body *[]byte) (string, error) {
+	id, err := store(body)
+	if err != nil && !errors.Is(err, ErrBlockedAttachment) && !errors.Is(err, ErrStorageHook) && !errors.Is(err, ErrValidationRule) && !errors.Is(err, ErrDuplicateMessageID) {
+		errorreport.CaptureError(err, "store", "")
+	}
+
+	// enforce the hard limit immediately rather than waiting for the cron
+	if err == nil && config.HardMaxMessages > 0 && FastCountTotal() > int64(config.HardMaxMessages) {
+		pruneMessagesOver(config.HardMaxMessages)
+	}
+
+	return id, err
+}
+
+func store(body *[]byte) (string, error) {
+	// pre-storage processing, leaving the original message untouched for the caller
+	if len(config.StorageHooks) > 0 {
+		processed, err := runStorageHooks(*body)
+		if err != nil {
+			return "", err
+		}
+		body = &processed
+	}
+
+	if len(config.ValidationRules) > 0 {
+		if err := applyValidationRules(*body); err != nil {
+			return "", err
+		}
+	}
+
 	// Parse message body with enmime
 	env, err := enmime.ReadEnvelope(bytes.NewReader(*body))
 	if err != nil {
@@ -32,6 +81,10 @@ func Store(body *[]byte) (string, error) {
 		return "", nil
 	}
 
+	if contentType, blocked := blockedAttachmentType(env); blocked {
+		return "", fmt.Errorf("%w (%s)", ErrBlockedAttachment, contentType)
+	}
+
 	from := &mail.Address{}
 	fromJSON := addressToSlice(env, "From")
 	if len(fromJSON) > 0 {
@@ -49,6 +102,19 @@ func Store(body *[]byte) (string, error) {
 	}
 
 	messageID := strings.Trim(env.Root.Header.Get("Message-ID"), "<>")
+
+	// messages without a Message-ID are never considered duplicates
+	if messageID != "" && (config.DuplicateAction == "ignore" || config.DuplicateAction == "reject") && MessageIDExists(messageID) {
+		if config.DuplicateAction == "reject" {
+			return "", ErrDuplicateMessageID
+		}
+
+		logger.Log().Debugf("[db] duplicate message found, ignoring %s", messageID)
+		metrics.DuplicateDropped()
+
+		return "", nil
+	}
+
 	created := time.Now()
 
 	// use message date instead of created date
@@ -69,13 +135,49 @@ func Store(body *[]byte) (string, error) {
 		return "", err
 	}
 
-	// extract tags from body matches based on --tag, plus addresses & X-Tags header
+	// extract tags from body matches based on --tag, recipient rules based on --tag-recipient,
+	// plus addresses & X-Tags header
 	tagStr := findTagsInRawMessage(body) + "," +
+		obj.tagsFromRecipientRules() + "," +
 		obj.tagsFromPlusAddresses() + "," +
 		strings.TrimSpace(env.Root.Header.Get("X-Tags"))
 
+	// tag HTML-only & text-only messages
+	if config.TagHTMLOnly != "" && env.HTML != "" && !hasTextPart(env) {
+		tagStr += "," + config.TagHTMLOnly
+	}
+	if config.TagTextOnly != "" && env.HTML == "" && hasTextPart(env) {
+		tagStr += "," + config.TagTextOnly
+	}
+
 	tagData := uniqueTagsFromString(tagStr)
 
+	// overwrite the latest existing message with the same Message-ID, keeping its ID & tags
+	existingID, existingSize := "", 0
+	if config.DuplicateAction == "overwrite" && messageID != "" {
+		q := sqlf.From("mailbox").
+			Select("ID").To(&existingID).
+			Select("Size").To(&existingSize).
+			Where("MessageID = ?", messageID).
+			OrderBy("Created DESC").
+			Limit(1)
+
+		if err := q.QueryRowAndClose(nil, db); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+
+		if existingID != "" {
+			id = existingID
+			tagData = uniqueTagsFromString(strings.Join(append(getMessageTags(id), tagData...), ","))
+		}
+	}
+
+	// group the message into a conversation by its In-Reply-To & References headers
+	threadID, err := messageThreadID(db, messageID, threadReferences(env.Root.Header.Get))
+	if err != nil {
+		return "", err
+	}
+
 	// begin a transaction to ensure both the message
 	// and data are stored successfully
 	ctx := context.Background()
@@ -92,21 +194,62 @@ func Store(body *[]byte) (string, error) {
 	inline := len(env.Inlines)
 	attachments := len(env.Attachments)
 	snippet := tools.CreateSnippet(env.Text, env.HTML)
-
-	// insert mail summary data
-	_, err = tx.Exec("INSERT INTO mailbox(Created, ID, MessageID, Subject, Metadata, Size, Inline, Attachments, SearchText, Read, Snippet) values(?,?,?,?,?,?,?,?,?,0,?)",
-		created.UnixMilli(), id, messageID, subject, string(summaryJSON), size, inline, attachments, searchText, snippet)
+	priority := messagePriority(env.GetHeader)
+	mdn := 0
+	if isMDN(env) {
+		mdn = 1
+	}
+	headers := customHeaders(env)
+	contentType := strings.ToLower(env.Root.ContentType)
+	domain := senderDomain(from)
+	precedence := strings.ToLower(strings.TrimSpace(env.GetHeader("Precedence")))
+
+	if existingID != "" {
+		// update mail summary data
+		_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "UPDATE mailbox SET Created = ?, Subject = ?, Metadata = ?, Size = ?, Inline = ?, Attachments = ?, SearchText = ?, Read = 0, Snippet = ?, Priority = ?, IsMDN = ?, CustomHeaders = ?, ContentType = ?, SenderDomain = ?, Precedence = ?, ThreadID = ? WHERE ID = ?",
+			created.UnixMilli(), subject, string(summaryJSON), size, inline, attachments, searchText, snippet, priority, mdn, headers, contentType, domain, precedence, threadID, id)
+	} else {
+		// insert mail summary data
+		_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "INSERT INTO mailbox(Created, ID, MessageID, Subject, Metadata, Size, Inline, Attachments, SearchText, Read, Snippet, Priority, IsMDN, CustomHeaders, ContentType, SenderDomain, Precedence, ThreadID) values(?,?,?,?,?,?,?,?,?,0,?,?,?,?,?,?,?,?)",
+			created.UnixMilli(), id, messageID, subject, string(summaryJSON), size, inline, attachments, searchText, snippet, priority, mdn, headers, contentType, domain, precedence, threadID)
+	}
 	if err != nil {
 		return "", err
 	}
 
 	// insert compressed raw message
 	compressed := dbEncoder.EncodeAll(*body, make([]byte, 0, size))
-	_, err = tx.Exec("INSERT INTO mailbox_data(ID, Email) values(?,?)", id, string(compressed))
+	if existingID != "" {
+		_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "UPDATE mailbox_data SET Email = ? WHERE ID = ?", string(compressed), id)
+	} else {
+		_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "INSERT INTO mailbox_data(ID, Email) values(?,?)", id, string(compressed))
+	}
 	if err != nil {
 		return "", err
 	}
 
+	if err := storeAttachmentHashes(tx, id, attachmentHashes(env)); err != nil {
+		return "", err
+	}
+
+	if err := storeMessageRecipients(tx, id, obj.recipients()); err != nil {
+		return "", err
+	}
+
+	if err := storeMessageHeaders(tx, id, env.Root.Header); err != nil {
+		return "", err
+	}
+
+	if existingID != "" {
+		// DSN parameters & bounce references are stored again for the new message,
+		// and link check results no longer apply
+		for _, table := range []string{"message_dsn", "message_bounces", "link_check_results", "link_checks"} {
+			if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "DELETE FROM "+table+" WHERE ID = ?", id); err != nil {
+				return "", err
+			}
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return "", err
 	}
@@ -118,6 +261,13 @@ func Store(body *[]byte) (string, error) {
 		}
 	}
 
+	// cross-reference DSN bounce messages to the original message
+	if originalID := bounceOriginalMessageID(env); originalID != "" {
+		if err := storeBounceReference(id, originalID); err != nil {
+			return "", err
+		}
+	}
+
 	c := &MessageSummary{}
 	if err := json.Unmarshal(summaryJSON, c); err != nil {
 		return "", err
@@ -132,10 +282,27 @@ func Store(body *[]byte) (string, error) {
 	c.Tags = tagData
 	c.Snippet = snippet
 
-	websockets.Broadcast("new", c)
-	webhook.Send(c)
+	if existingID != "" {
+		cache.Remove(existingID)
+		addDeletedSize(int64(existingSize))
+		atomic.StoreInt64(&compressedSize, -1)
+		// the existing message has changed, reload messages to adjust
+		websockets.Broadcast("prune", nil)
+	} else {
+		atomic.AddInt64(&messageCounter, 1)
+		addCompressedSize(int64(len(compressed)))
+		metrics.MessageStored()
+		websockets.Broadcast("new", c)
+	}
+	if !auth.IsSelfTestMessage(messageID) {
+		webhook.Send(c)
+	}
+
+	if config.SMTPDevVerbose {
+		printMessageSummary(os.Stdout, c)
+	}
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	BroadcastMailboxStats()
 
@@ -145,15 +312,124 @@ func Store(body *[]byte) (string, error) {
 // List returns a subset of messages from the mailbox,
 // sorted latest to oldest
 func List(start, limit int) ([]MessageSummary, error) {
-	results := []MessageSummary{}
 	tsStart := time.Now()
 
+	q := listQuery(limit)
+	if start > 0 {
+		q.Offset(start)
+	}
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	elapsed := time.Since(tsStart)
+
+	logger.Log().Debugf("[db] list INBOX in %s", elapsed)
+
+	return results, nil
+}
+
+// ListSorted returns a subset of messages from the mailbox, sorted by the field in the given
+// direction. Messages with equal sort values are sorted latest to oldest.
+func ListSorted(start, limit int, field SortField, dir SortDir) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	sortColumn, sortDir, err := messageSortOrder(field, dir)
+	if err != nil {
+		return []MessageSummary{}, err
+	}
+
 	q := sqlf.From("mailbox m").
-		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet`).
-		OrderBy("m.Created DESC").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		OrderBy(sortColumn+" "+sortDir, "m.Created DESC", "m.ID DESC").
 		Limit(limit).
 		Offset(start)
 
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list INBOX sorted by %s in %s", sortColumn, time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListAfterID returns a subset of messages from the mailbox received before (older than) the
+// given message, sorted latest to oldest. This is considerably faster than paging with List()
+// on large mailboxes. The first page is returned if afterID is empty.
+func ListAfterID(afterID string, limit int) ([]MessageSummary, error) {
+	if afterID == "" {
+		return List(0, limit)
+	}
+
+	var created int64
+
+	q := sqlf.From("mailbox m").
+		Select("m.Created").To(&created).
+		Where("m.ID = ?", afterID)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return []MessageSummary{}, errors.New("message not found")
+		}
+
+		return []MessageSummary{}, err
+	}
+
+	return ListAfter(created, afterID, limit)
+}
+
+// ListAfter returns a subset of messages from the mailbox sorted after the message with the given
+// Created timestamp (unix milliseconds) & ID, sorted latest to oldest. The message itself need not exist.
+func ListAfter(created int64, afterID string, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := listQuery(limit)
+
+	var rowID int64
+	err := sqlf.From("mailbox").
+		Select("rowid").To(&rowID).
+		Where("ID = ?", afterID).
+		QueryRowAndClose(nil, db)
+
+	if err == nil {
+		// row value comparison allows SQLite to use the idx_created index range, which includes the rowid
+		q.Where("(m.Created, m.rowid) < (?, ?)", created, rowID)
+	} else if errors.Is(err, sql.ErrNoRows) {
+		// the message has since been deleted, so messages received at the same time may be repeated
+		q.Where("m.Created <= ?", created)
+	} else {
+		return []MessageSummary{}, err
+	}
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list INBOX after %s in %s", afterID, time.Since(tsStart))
+
+	return results, nil
+}
+
+// ListQuery returns the query for a page of messages from the mailbox, sorted latest to oldest.
+// Messages received at the same time are sorted latest to oldest by insertion for stable keyset pagination.
+func listQuery(limit int) *sqlf.Stmt {
+	return sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		OrderBy("m.Created DESC", "m.rowid DESC").
+		Limit(limit)
+}
+
+// QueryMessageSummaries returns the message summaries of a mailbox query. The query
+// must select m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments,
+// m.Read, m.Starred & m.Snippet (in that order).
+func queryMessageSummaries(q *sqlf.Stmt) ([]MessageSummary, error) {
+	results := []MessageSummary{}
+
 	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
 		var created int64
 		var id string
@@ -163,10 +439,11 @@ func List(start, limit int) ([]MessageSummary, error) {
 		var size int
 		var attachments int
 		var read int
+		var starred int
 		var snippet string
 		em := MessageSummary{}
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet); err != nil {
+		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &starred, &snippet); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 			return
 		}
@@ -183,6 +460,7 @@ func List(start, limit int) ([]MessageSummary, error) {
 		em.Size = size
 		em.Attachments = attachments
 		em.Read = read == 1
+		em.Starred = starred == 1
 		em.Snippet = snippet
 		// artificially generate ReplyTo if legacy data is missing Reply-To field
 		if em.ReplyTo == nil {
@@ -199,11 +477,7 @@ func List(start, limit int) ([]MessageSummary, error) {
 		results[i].Tags = getMessageTags(m.ID)
 	}
 
-	dbLastAction = time.Now()
-
-	elapsed := time.Since(tsStart)
-
-	logger.Log().Debugf("[db] list INBOX in %s", elapsed)
+	setDBLastAction()
 
 	return results, nil
 }
@@ -220,6 +494,7 @@ func GetMessage(id string) (*Message, error) {
 
 	env, err := enmime.ReadEnvelope(r)
 	if err != nil {
+		errorreport.CaptureError(err, "get-message", id)
 		return nil, err
 	}
 
@@ -278,6 +553,7 @@ func GetMessage(id string) (*Message, error) {
 	}
 
 	obj.HTML = env.HTML
+	obj.PreferPlainText = preferPlainText(env)
 	obj.Inline = []Attachment{}
 	obj.Attachments = []Attachment{}
 
@@ -299,6 +575,14 @@ func GetMessage(id string) (*Message, error) {
 		}
 	}
 
+	obj.AuthenticationResults = parseAuthenticationResults(env.Root.Header.Values("Authentication-Results"))
+	obj.MIMETree = MIMETree(env.Root)
+
+	obj.SMTPEnvelope, err = getMessageEnvelope(id)
+	if err != nil {
+		return nil, err
+	}
+
 	// get List-Unsubscribe links if set
 	obj.ListUnsubscribe = ListUnsubscribe{}
 	obj.ListUnsubscribe.Links = []string{}
@@ -318,13 +602,60 @@ func GetMessage(id string) (*Message, error) {
 		return &obj, err
 	}
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	return &obj, nil
 }
 
+// GetAttachmentsByMessageID returns the attachment summaries (as per Message.Attachments) of a message
+// without marking the message as read. The attachment content is not returned.
+func GetAttachmentsByMessageID(id string) ([]Attachment, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []Attachment{}
+	for _, a := range env.Attachments {
+		if a.FileName != "" || a.ContentID != "" {
+			attachments = append(attachments, AttachmentSummary(a))
+		}
+	}
+
+	setDBLastAction()
+
+	return attachments, nil
+}
+
+// GetMessagePrecedenceHeader returns the Precedence header value of a message (eg: bulk, junk or list),
+// or an empty string if the header is not set
+func GetMessagePrecedenceHeader(id string) (string, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(msg.Header.Get("Precedence")), nil
+}
+
 // GetMessageRaw returns an []byte of the full message
 func GetMessageRaw(id string) ([]byte, error) {
+	return GetMessageRawWithContext(context.Background(), id)
+}
+
+// GetMessageRawWithContext returns an []byte of the full message. The context is passed to the
+// database query, and the message is not decompressed if the context is cancelled.
+func GetMessageRawWithContext(ctx context.Context, id string) ([]byte, error) {
 	var i string
 	var msg string
 	q := sqlf.From("mailbox_data").
@@ -332,7 +663,12 @@ func GetMessageRaw(id string) ([]byte, error) {
 		Select(`Email`).To(&msg).
 		Where(`ID = ?`, id)
 
-	err := q.QueryRowAndClose(context.Background(), db)
+	if raw, ok := cache.Get(id); ok {
+		setDBLastAction()
+		return raw, nil
+	}
+
+	err := q.QueryRowAndClose(ctx, db)
 	if err != nil {
 		return nil, err
 	}
@@ -341,16 +677,171 @@ func GetMessageRaw(id string) ([]byte, error) {
 		return nil, errors.New("message not found")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	raw, err := dbDecoder.DecodeAll([]byte(msg), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error decompressing message: %s", err.Error())
 	}
 
-	dbLastAction = time.Now()
+	cache.Add(id, raw)
+
+	setDBLastAction()
 
 	return raw, err
 }
 
+// BulkGetMessageRaw returns the raw messages of the given IDs, mapped by ID. The messages
+// are fetched in batches and decompressed concurrently using config.DecompressionWorkers.
+// IDs which do not exist are ignored, and messages which cannot be decompressed are logged & skipped.
+func BulkGetMessageRaw(ids []string) (map[string][]byte, error) {
+	tsStart := time.Now()
+
+	compressed := make(map[string][]byte)
+
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	for _, chunk := range chunkBy(args, 1000) {
+		var id, email string
+		q := sqlf.From("mailbox_data").
+			Select(`ID`).To(&id).
+			Select(`Email`).To(&email).
+			Where("ID").In(chunk...)
+
+		if err := q.QueryAndClose(context.Background(), db, func(row *sql.Rows) {
+			compressed[id] = []byte(email)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	type result struct {
+		id  string
+		raw []byte
+		err error
+	}
+
+	jobs := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.DecompressionWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				raw, err := dbDecoder.DecodeAll(compressed[id], nil)
+				results <- result{id: id, raw: raw, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for id := range compressed {
+			jobs <- id
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	messages := make(map[string][]byte, len(compressed))
+
+	for r := range results {
+		if r.err != nil {
+			logger.Log().Errorf("[db] error decompressing message %s: %s", r.id, r.err.Error())
+			continue
+		}
+
+		messages[r.id] = r.raw
+	}
+
+	setDBLastAction()
+
+	logger.Log().Debugf("[db] fetched %d raw messages in %s", len(messages), time.Since(tsStart))
+
+	return messages, nil
+}
+
+// GetMessageAllRecipients returns the combined To, Cc & Bcc recipients of a message,
+// deduplicated by (case-insensitive) email address
+func GetMessageAllRecipients(id string) ([]*mail.Address, error) {
+	var metadata string
+	q := sqlf.From("mailbox").
+		Select(`Metadata`).To(&metadata).
+		Where(`ID = ?`, id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("message not found")
+		}
+
+		return nil, err
+	}
+
+	em := MessageSummary{}
+	if err := json.Unmarshal([]byte(metadata), &em); err != nil {
+		return nil, err
+	}
+
+	recipients := []*mail.Address{}
+	seen := map[string]bool{}
+
+	for _, list := range [][]*mail.Address{em.To, em.Cc, em.Bcc} {
+		for _, a := range list {
+			if a == nil {
+				continue
+			}
+
+			k := strings.ToLower(a.Address)
+			if seen[k] {
+				continue
+			}
+
+			seen[k] = true
+			recipients = append(recipients, a)
+		}
+	}
+
+	return recipients, nil
+}
+
+// GetMessageAttachmentCount returns the number of attachments of a message without
+// needing to retrieve & parse the raw message
+func GetMessageAttachmentCount(id string) (int, error) {
+	return messageCount(id, "Attachments")
+}
+
+// GetMessageInlineCount returns the number of inline attachments of a message without
+// needing to retrieve & parse the raw message
+func GetMessageInlineCount(id string) (int, error) {
+	return messageCount(id, "Inline")
+}
+
+// MessageCount returns the value of an integer count column of a message
+func messageCount(id, column string) (int, error) {
+	var count int
+	q := sqlf.From("mailbox").
+		Select(column).To(&count).
+		Where(`ID = ?`, id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errors.New("message not found")
+		}
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
 // GetAttachmentPart returns an *enmime.Part (attachment or inline) from a message
 func GetAttachmentPart(id, partID string) (*enmime.Part, error) {
 	raw, err := GetMessageRaw(id)
@@ -383,11 +874,199 @@ func GetAttachmentPart(id, partID string) (*enmime.Part, error) {
 		}
 	}
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	return nil, errors.New("attachment not found")
 }
 
+// GetAttachmentPartByFilename returns an *enmime.Part (attachment or inline) from a message by its
+// filename (case-insensitive). If multiple parts share the filename, the first is returned.
+func GetAttachmentPartByFilename(id, filename string) (*enmime.Part, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(raw)
+
+	env, err := enmime.ReadEnvelope(r)
+	if err != nil {
+		return nil, err
+	}
+
+	setDBLastAction()
+
+	var found *enmime.Part
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.Attachments, env.OtherParts} {
+		for _, a := range parts {
+			if !strings.EqualFold(a.FileName, filename) {
+				continue
+			}
+
+			if found != nil {
+				logger.Log().Warnf("[db] message %s contains multiple parts named %s, using part %s", id, filename, found.PartID)
+				return found, nil
+			}
+
+			found = a
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New("attachment not found")
+	}
+
+	return found, nil
+}
+
+// GetMessageRawPart returns the decoded content, MIME content type & file name (if any) of any
+// message part, including text & HTML parts. Text parts are converted to UTF-8 by enmime.
+func GetMessageRawPart(id, partID string) ([]byte, string, string, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	p := env.Root.DepthMatchFirst(func(p *enmime.Part) bool {
+		return p.PartID == partID
+	})
+	if p == nil {
+		return nil, "", "", errors.New("part not found")
+	}
+
+	if strings.HasPrefix(p.ContentType, "multipart/") {
+		return nil, "", "", errors.New("multipart container parts have no content")
+	}
+
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	} else if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+
+	setDBLastAction()
+
+	return p.Content, contentType, p.FileName, nil
+}
+
+// GetMessageHTMLWithCIDResolved returns the HTML part of a message with all cid: references
+// replaced by data URIs of the referenced parts, so the HTML can be displayed without the server
+func GetMessageHTMLWithCIDResolved(id string) (string, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	html := env.HTML
+	if html == "" {
+		return "", errors.New("message does not contain a HTML part")
+	}
+
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.OtherParts, env.Attachments} {
+		for _, p := range parts {
+			if p.ContentID == "" {
+				continue
+			}
+
+			contentType := p.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			uri := "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(p.Content)
+
+			re := regexp.MustCompile(`(?i)(=["\']?)(cid:` + regexp.QuoteMeta(p.ContentID) + `)(["|\'|\\s|\\/|>|;])`)
+			matches := re.FindAllStringSubmatch(html, -1)
+			for _, m := range matches {
+				html = strings.ReplaceAll(html, m[0], m[1]+uri+m[3])
+			}
+		}
+	}
+
+	setDBLastAction()
+
+	return html, nil
+}
+
+// BulkExportAttachments writes a ZIP archive of all attachments of the given messages to w,
+// with each attachment stored as <ID>/<filename>. The archive is streamed to w as it is created.
+func BulkExportAttachments(ids []string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	for _, id := range ids {
+		raw, err := GetMessageRaw(id)
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err.Error())
+		}
+
+		env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err.Error())
+		}
+
+		used := map[string]bool{}
+
+		for _, a := range env.Attachments {
+			name := ZipFileName(a, used)
+			used[name] = true
+
+			f, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     id + "/" + name,
+				Method:   zip.Deflate,
+				Modified: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			if _, err := f.Write(a.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	setDBLastAction()
+
+	return zw.Close()
+}
+
+// ZipFileName returns a safe & unique (within a message) file name for an attachment
+func ZipFileName(a *enmime.Part, used map[string]bool) string {
+	name := a.FileName
+	if name == "" {
+		name = a.ContentID
+	}
+
+	name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" || name == ".." {
+		name = "part-" + a.PartID
+	}
+
+	if !used[name] {
+		return name
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		n := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if !used[n] {
+			return n
+		}
+	}
+}
+
 // LatestID returns the latest message ID
 //
 // If a query argument is set in the request the function will return the
@@ -417,22 +1096,12 @@ func LatestID(r *http.Request) (string, error) {
 
 // MarkRead will mark a message as read
 func MarkRead(id string) error {
-	if !IsUnread(id) {
-		return nil
-	}
-
-	_, err := sqlf.Update("mailbox").
-		Set("Read", 1).
-		Where("ID = ?", id).
-		ExecAndClose(context.Background(), db)
-
-	if err == nil {
-		logger.Log().Debugf("[db] marked message %s as read", id)
-	}
-
-	BroadcastMailboxStats()
+	return MarkMessagesRead([]string{id})
+}
 
-	return err
+// MarkMessagesRead will mark the messages as read in a single transaction
+func MarkMessagesRead(ids []string) error {
+	return setMessagesRead(ids, true)
 }
 
 // MarkAllRead will mark all messages as read
@@ -455,7 +1124,7 @@ func MarkAllRead() error {
 
 	BroadcastMailboxStats()
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	return nil
 }
@@ -480,42 +1149,97 @@ func MarkAllUnread() error {
 
 	BroadcastMailboxStats()
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	return nil
 }
 
 // MarkUnread will mark a message as unread
 func MarkUnread(id string) error {
-	if IsUnread(id) {
+	return MarkMessagesUnread([]string{id})
+}
+
+// MarkMessagesUnread will mark the messages as unread in a single transaction
+func MarkMessagesUnread(ids []string) error {
+	return setMessagesRead(ids, false)
+}
+
+// SetMessagesRead updates the read status of the messages in a single transaction,
+// rolling back all changes if any update fails
+func setMessagesRead(ids []string, read bool) error {
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
 		return nil
 	}
 
-	_, err := sqlf.Update("mailbox").
-		Set("Read", 0).
-		Where("ID = ?", id).
-		ExecAndClose(context.Background(), db)
+	status, current := 0, 1
+	if read {
+		status, current = 1, 0
+	}
 
-	if err == nil {
-		logger.Log().Debugf("[db] marked message %s as unread", id)
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	var updated int64
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	for _, chunk := range chunkBy(ids, 1000) {
+		args := []interface{}{status, current}
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+
+		res, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `UPDATE mailbox SET Read = ? WHERE Read = ? AND ID IN (?`+strings.Repeat(",?", len(chunk)-1)+`)`, args...) // #nosec
+		if err != nil {
+			return err
+		}
+
+		n, _ := res.RowsAffected()
+		updated += n
 	}
 
-	dbLastAction = time.Now()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	setDBLastAction()
+
+	// nothing changed, so there are no stats to broadcast
+	if updated == 0 {
+		return nil
+	}
+
+	state := "unread"
+	if read {
+		state = "read"
+	}
+
+	logger.Log().Debugf("[db] marked %d messages as %s", updated, state)
 
 	BroadcastMailboxStats()
 
-	return err
+	return nil
 }
 
 // DeleteOneMessage will delete a single message from a mailbox
 func DeleteOneMessage(id string) error {
-	m, err := GetMessageRaw(id)
-	if err != nil {
-		return err
+	return DeleteMessages([]string{id})
+}
+
+// DeleteMessages will delete the messages from a mailbox in a single transaction. If any
+// of the messages do not exist, or any deletion fails, then no messages are deleted.
+func DeleteMessages(ids []string) error {
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return nil
 	}
 
-	size := len(m)
-	// begin a transaction to ensure both the message
+	// begin a transaction to ensure both the messages
 	// and data are deleted successfully
 	tx, err := db.BeginTx(context.Background(), nil)
 	if err != nil {
@@ -525,45 +1249,95 @@ func DeleteOneMessage(id string) error {
 	// roll back if it fails
 	defer tx.Rollback()
 
-	_, err = tx.Exec("DELETE FROM mailbox WHERE ID  = ?", id)
-	if err != nil {
-		return err
+	var size int64
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	for _, chunk := range chunkBy(ids, 1000) {
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		in := `(?` + strings.Repeat(",?", len(chunk)-1) + `)`
+
+		var found int
+		var chunkSize sql.NullInt64
+		if err := tx.QueryRow(`SELECT COUNT(*), SUM(Size) FROM mailbox WHERE ID IN `+in, args...).Scan(&found, &chunkSize); err != nil { // #nosec
+			return err
+		}
+
+		if found != len(chunk) {
+			return errors.New("message not found")
+		}
+
+		size += chunkSize.Int64
+
+		if err := logDeletedMessages(tx, chunk...); err != nil {
+			return err
+		}
+
+		for _, sqlDelete := range []string{
+			`DELETE FROM mailbox WHERE ID IN ` + in,
+			`DELETE FROM mailbox_data WHERE ID IN ` + in,
+			`DELETE FROM message_tags WHERE ID IN ` + in,
+			`DELETE FROM message_dsn WHERE ID IN ` + in,
+			`DELETE FROM message_bounces WHERE ID IN ` + in,
+			`DELETE FROM link_check_results WHERE ID IN ` + in,
+			`DELETE FROM link_checks WHERE ID IN ` + in,
+			`DELETE FROM attachment_hashes WHERE MessageID IN ` + in,
+			`DELETE FROM message_recipients WHERE ID IN ` + in,
+		} {
+			if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, sqlDelete, args...); err != nil {
+				return err
+			}
+		}
+
+		if err := deleteMessageHeaders(tx, chunk...); err != nil {
+			return err
+		}
 	}
 
-	_, err = tx.Exec("DELETE FROM mailbox_data WHERE ID  = ?", id)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
-	err = tx.Commit()
+	cache.Remove(ids...)
+	atomic.AddInt64(&messageCounter, -int64(len(ids)))
+	atomic.StoreInt64(&compressedSize, -1)
 
-	if err == nil {
-		logger.Log().Debugf("[db] deleted message %s", id)
+	if len(ids) == 1 {
+		logger.Log().Debugf("[db] deleted message %s", ids[0])
+	} else {
+		logger.Log().Debugf("[db] deleted %d messages", len(ids))
 	}
 
-	if err := DeleteAllMessageTags(id); err != nil {
+	if err := pruneUnusedTags(); err != nil {
 		return err
 	}
 
-	dbLastAction = time.Now()
-	addDeletedSize(int64(size))
+	setDBLastAction()
+	addDeletedSize(size)
 
-	logMessagesDeleted(1)
+	logMessagesDeleted(len(ids))
+
+	websockets.Broadcast("prune", nil)
 
 	BroadcastMailboxStats()
 
-	return err
+	return nil
 }
 
-// DeleteAllMessages will delete all messages from a mailbox
+// DeleteAllMessages will delete all messages from a mailbox, apart from starred messages
 func DeleteAllMessages() error {
 	var (
-		start = time.Now()
-		total int
+		start     = time.Now()
+		total     int
+		preserved = CountStarred()
 	)
 
 	_ = sqlf.From("mailbox").
 		Select("COUNT(*)").To(&total).
+		Where("Starred = 0").
 		QueryRowAndClose(nil, db)
 
 	// begin a transaction to ensure both the message
@@ -576,22 +1350,29 @@ func DeleteAllMessages() error {
 	// roll back if it fails
 	defer tx.Rollback()
 
-	_, err = tx.Exec("DELETE FROM mailbox")
-	if err != nil {
+	if err := logDeletedMessages(tx); err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM mailbox_data")
+	_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "DELETE FROM mailbox WHERE Starred = 0")
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM tags")
+	// delete the data of all messages no longer in the mailbox
+	for _, table := range []string{"mailbox_data", "message_tags", "message_dsn", "message_bounces", "link_check_results", "link_checks", "message_recipients", "message_headers"} {
+		_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "DELETE FROM "+table+" WHERE ID NOT IN (SELECT ID FROM mailbox)") // #nosec
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "DELETE FROM attachment_hashes WHERE MessageID NOT IN (SELECT ID FROM mailbox)")
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM message_tags")
+	_, err = dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, "DELETE FROM tags WHERE ID NOT IN (SELECT TagID FROM message_tags)")
 	if err != nil {
 		return err
 	}
@@ -600,19 +1381,23 @@ func DeleteAllMessages() error {
 		return err
 	}
 
+	cache.Purge()
+	atomic.StoreInt64(&messageCounter, int64(preserved))
+	atomic.StoreInt64(&compressedSize, -1)
+
 	elapsed := time.Since(start)
-	logger.Log().Debugf("[db] deleted %d messages in %s", total, elapsed)
+	logger.Log().Debugf("[db] deleted %d messages in %s (%d starred messages preserved)", total, elapsed, preserved)
 
 	vacuumDb()
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 	if err := SettingPut("DeletedSize", "0"); err != nil {
 		logger.Log().Warnf("[db] %s", err.Error())
 	}
 
 	logMessagesDeleted(total)
 
-	websockets.Broadcast("prune", nil)
+	websockets.Broadcast("prune", struct{ Preserved int }{preserved})
 	BroadcastMailboxStats()
 
 	return err
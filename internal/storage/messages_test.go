@@ -1,8 +1,29 @@
 package storage
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
 )
 
 func TestTextEmailInserts(t *testing.T) {
@@ -115,61 +136,2315 @@ func TestRetrieveMimeEmail(t *testing.T) {
 		t.Fail()
 	}
 	assertEqual(t, len(inlineData.Content), msg.Inline[0].Size, "inline attachment size does not match")
+
+	namedData, err := GetAttachmentPartByFilename(id, "sample pdf.PDF")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	} else {
+		assertEqual(t, namedData.PartID, msg.Attachments[0].PartID, "attachment part ID does not match")
+	}
+
+	if _, err := GetAttachmentPartByFilename(id, "missing.pdf"); err == nil {
+		t.Log("expected an error for a missing attachment")
+		t.Fail()
+	}
 }
 
-func TestMessageSummary(t *testing.T) {
+func TestBulkExportAttachments(t *testing.T) {
 	setup()
 	defer Close()
 
-	t.Log("Testing message summary")
+	t.Log("Testing bulk attachment export")
 
-	if _, err := Store(&testMimeEmail); err != nil {
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := Store(&testMimeEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	textID, err := Store(&testTextEmail)
+	if err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
+	ids = append(ids, textID)
 
-	summaries, err := List(0, 1)
+	buf := new(bytes.Buffer)
+	if err := BulkExportAttachments(ids, buf); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(zr.File), 2, "incorrect number of files in archive")
+
+	for i, f := range zr.File {
+		assertEqual(t, f.Name, ids[i]+"/Sample PDF.pdf", "archive file name does not match")
+
+		r, err := f.Open()
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+			continue
+		}
+
+		b, _ := io.ReadAll(r)
+		r.Close()
+
+		msg, err := GetMessage(ids[i])
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+			continue
+		}
+
+		assertEqual(t, len(b), msg.Attachments[0].Size, "archive file size does not match")
+	}
+
+	if err := BulkExportAttachments([]string{"does-not-exist"}, io.Discard); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestDuplicateActionOverwrite(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.DuplicateAction = "overwrite"
+	defer func() { config.DuplicateAction = "store" }()
+
+	t.Log("Testing duplicate message overwrite")
+
+	first := []byte("Message-ID: <duplicate@example.com>\r\nSubject: First\r\n\r\nFirst\r\n")
+	id, err := Store(&first)
 	if err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
 
-	assertEqual(t, len(summaries), 1, "Expected 1 result")
+	if err := SetMessageTags(id, []string{"Manual"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
 
-	msg := summaries[0]
+	if err := MarkRead(id); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
 
-	assertEqual(t, msg.From.Name, "Sender Smith", "\"From\" name does not match")
-	assertEqual(t, msg.From.Address, "sender2@example.com", "\"From\" address does not match")
-	assertEqual(t, msg.Subject, "inline + attachment", "subject does not match")
-	assertEqual(t, len(msg.To), 1, "incorrect number of recipients")
-	assertEqual(t, msg.To[0].Name, "Recipient Ross", "\"To\" name does not match")
-	assertEqual(t, msg.To[0].Address, "recipient2@example.com", "\"To\" address does not match")
-	assertEqual(t, msg.Snippet, "Message with inline image and attachment:", "\"Snippet\" does does not match")
-	assertEqual(t, msg.Attachments, 1, "Expected 1 attachment")
-	assertEqual(t, msg.MessageID, "33af2ac1-c33d-9738-35e3-a6daf90bbd89@gmail.com", "\"MessageID\" does not match")
+	second := []byte("Message-ID: <duplicate@example.com>\r\nSubject: Second\r\nX-Tags: Auto\r\n\r\nSecond message\r\n")
+	overwriteID, err := Store(&second)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, overwriteID, id, "existing message ID should be returned")
+	assertEqual(t, CountTotal(), 1, "duplicate message should not be stored")
+	assertEqual(t, CountUnread(), 1, "overwritten message should be unread")
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, msg.Subject, "Second", "message should be overwritten")
+	assertEqual(t, msg.Size, len(second), "message size should be updated")
+	assertEqual(t, strings.Join(msg.Tags, ","), "Auto,Manual", "existing tags should be kept")
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, string(raw), string(second), "raw message should be replaced")
 }
 
-func BenchmarkImportText(b *testing.B) {
+func TestDuplicateActions(t *testing.T) {
 	setup()
 	defer Close()
 
-	for i := 0; i < b.N; i++ {
-		if _, err := Store(&testTextEmail); err != nil {
-			b.Log("error ", err)
-			b.Fail()
+	defer func() { config.DuplicateAction = "store" }()
+
+	t.Log("Testing duplicate message actions")
+
+	duplicate := []byte("Message-ID: <duplicate@example.com>\r\nSubject: Duplicate\r\n\r\nDuplicate\r\n")
+	noMessageID := []byte("Subject: No Message-ID\r\n\r\nNo Message-ID\r\n")
+
+	for _, action := range []string{"store", "ignore", "reject"} {
+		if err := DeleteAllMessages(); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		config.DuplicateAction = action
+
+		for i := 0; i < 2; i++ {
+			if _, err := Store(&noMessageID); err != nil {
+				t.Log("error ", err)
+				t.Fail()
+			}
+		}
+
+		if _, err := Store(&duplicate); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		id, err := Store(&duplicate)
+		switch action {
+		case "store":
+			if err != nil || id == "" {
+				t.Logf("expected duplicate to be stored, got %q, %v", id, err)
+				t.Fail()
+			}
+			assertEqual(t, CountTotal(), 4, "duplicate message should be stored")
+		case "ignore":
+			if err != nil || id != "" {
+				t.Logf("expected duplicate to be ignored, got %q, %v", id, err)
+				t.Fail()
+			}
+			assertEqual(t, CountTotal(), 3, "duplicate message should be ignored")
+		case "reject":
+			if !errors.Is(err, ErrDuplicateMessageID) {
+				t.Logf("expected ErrDuplicateMessageID, got %v", err)
+				t.Fail()
+			}
+			assertEqual(t, CountTotal(), 3, "duplicate message should be rejected")
 		}
 	}
 }
 
-func BenchmarkImportMime(b *testing.B) {
+func TestBlockedAttachmentTypes(t *testing.T) {
 	setup()
 	defer Close()
 
-	for i := 0; i < b.N; i++ {
-		if _, err := Store(&testMimeEmail); err != nil {
-			b.Log("error ", err)
-			b.Fail()
+	defer func() { config.BlockedAttachmentTypes = []string{} }()
+
+	t.Log("Testing blocked attachment types")
+
+	for _, blocked := range [][]string{{"application/pdf"}, {".exe", ".pdf"}, {"image/jpeg"}} {
+		config.BlockedAttachmentTypes = blocked
+		_, err := Store(&testMimeEmail)
+		if !errors.Is(err, ErrBlockedAttachment) {
+			t.Logf("expected ErrBlockedAttachment for %v, got %v", blocked, err)
+			t.Fail()
+		}
+	}
+
+	assertEqual(t, CountTotal(), 0, "blocked message should not be stored")
+
+	config.BlockedAttachmentTypes = []string{"application/x-msdownload", ".exe"}
+	if _, err := Store(&testMimeEmail); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, CountTotal(), 1, "message should be stored")
+}
+
+func TestGetMessageHTMLImages(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message HTML images")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	images, err := GetMessageHTMLImages(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(images), 1, "incorrect number of images")
+	assertEqual(t, images[0].Src, "cid:part1.845LaYlX.wtWMpWwa@gmail.com", "incorrect image src")
+	assertEqual(t, images[0].ResolvedType, "image/jpeg", "incorrect cid image type")
+	assertEqual(t, images[0].IsInline, true, "cid image should be inline")
+	assertEqual(t, images[0].IsExternal, false, "cid image should not be external")
+	assertEqual(t, IsUnread(id), true, "message should not be marked read")
+
+	body := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Images\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		`<img src="https://example.com/logo.png" width="100" height="50">` +
+		`<img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=">` +
+		`<img src="">`)
+
+	id, err = Store(&body)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	images, err = GetMessageHTMLImages(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(images), 2, "incorrect number of images")
+	assertEqual(t, images[0].IsExternal, true, "image should be external")
+	assertEqual(t, images[0].ResolvedType, "image/png", "incorrect external image type")
+	assertEqual(t, images[0].Width, "100", "incorrect image width")
+	assertEqual(t, images[0].Height, "50", "incorrect image height")
+	assertEqual(t, images[1].IsInline, true, "data URI image should be inline")
+	assertEqual(t, images[1].ResolvedType, "image/gif", "incorrect data URI image type")
+}
+
+func TestGetMessageDKIMDetails(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing DKIM-Signature header details")
+
+	body := []byte("DKIM-Signature: v=1; a=RSA-SHA256; c=relaxed/relaxed; d=example.com; s=mail;\r\n" +
+		"\th=from:to : subject; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		"\tb=dzdVyOfAKCdLXdJOc9G2q8LoXSlEniSbav+yuU4zGeeruD00lszZ\r\n" +
+		"\t VoG4ZHRNiYzR\r\n" +
+		"From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: DKIM\r\n\r\n" +
+		"Test\r\n")
+
+	id, err := Store(&body)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	headers, err := GetMessageDKIMDetails(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(headers), 1, "incorrect number of DKIM signatures")
+	assertEqual(t, headers[0].Domain, "example.com", "incorrect DKIM domain")
+	assertEqual(t, headers[0].Selector, "mail", "incorrect DKIM selector")
+	assertEqual(t, headers[0].Algorithm, "rsa-sha256", "incorrect DKIM algorithm")
+	assertEqual(t, strings.Join(headers[0].HeaderFields, ","), "from,to,subject", "incorrect DKIM header fields")
+	assertEqual(t, headers[0].BodyHash, "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=", "incorrect DKIM body hash")
+	assertEqual(t, headers[0].Signature, "dzdVyOfAKCdLXdJOc9G2q8LoXSlEniSbav+yuU4zGeeruD00lszZVoG4ZHRNiYzR", "incorrect DKIM signature")
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	headers, err = GetMessageDKIMDetails(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(headers), 1, "incorrect number of DKIM signatures")
+	assertEqual(t, headers[0].Domain, "gmail.com", "incorrect DKIM domain")
+	assertEqual(t, headers[0].Selector, "20210112", "incorrect DKIM selector")
+	assertEqual(t, len(headers[0].HeaderFields), 7, "incorrect number of DKIM header fields")
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing Authentication-Results headers")
+
+	body := []byte("Authentication-Results: mx.google.com;\r\n" +
+		"\tdkim=pass header.i=@example.com header.s=20230601 header.b=\"abc/123\";\r\n" +
+		"\tspf=pass (google.com: domain of sender@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=sender@example.com;\r\n" +
+		"\tdmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com\r\n" +
+		"Authentication-Results: mx.example.net 1; arc=none; dkim/1=FAIL reason=\"signature verification failed; bad key\"\r\n" +
+		"From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Authentication results\r\n\r\n" +
+		"Test\r\n")
+
+	id, err := Store(&body)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	results := msg.AuthenticationResults
+	assertEqual(t, len(results), 5, "incorrect number of authentication results")
+	assertEqual(t, results[0].Method+"="+results[0].Result, "dkim=pass", "incorrect dkim result")
+	assertEqual(t, results[0].Properties["header.b"], "abc/123", "incorrect quoted property")
+	assertEqual(t, results[0].Properties["header.s"], "20230601", "incorrect dkim selector")
+	assertEqual(t, results[1].Method+"="+results[1].Result, "spf=pass", "incorrect spf result")
+	assertEqual(t, results[1].Properties["smtp.mailfrom"], "sender@example.com", "incorrect spf property")
+	assertEqual(t, len(results[1].Properties), 1, "comments should be ignored")
+	assertEqual(t, results[2].Method+"="+results[2].Result, "dmarc=pass", "incorrect dmarc result")
+	assertEqual(t, results[3].Method+"="+results[3].Result, "arc=none", "incorrect arc result")
+	assertEqual(t, results[4].Method+"="+results[4].Result, "dkim=fail", "incorrect versioned method result")
+	assertEqual(t, results[4].Properties["reason"], "signature verification failed; bad key", "incorrect reason")
+
+	// commonly seen malformed headers
+	tests := map[string]string{
+		// missing authserv-id
+		"spf=pass smtp.mailfrom=example.com": "spf=pass",
+		// methods without semicolon separators, with a non-standard action
+		"mx.example.com; spf=softfail smtp.mailfrom=example.com dkim=none dmarc=fail action=none header.from=example.com": "spf=softfail,dkim=none,dmarc=fail",
+		// no results
+		"mx.example.com; none": "",
+		// unbalanced comment & trailing semicolon
+		"mx.example.com; spf=neutral (unbalanced comment;": "spf=neutral",
+		// empty
+		"": "",
+	}
+
+	for header, expected := range tests {
+		found := []string{}
+		for _, r := range parseAuthenticationResults([]string{header}) {
+			found = append(found, r.Method+"="+r.Result)
 		}
+
+		assertEqual(t, strings.Join(found, ","), expected, fmt.Sprintf("incorrect results for %q", header))
+	}
+
+	results = parseAuthenticationResults([]string{"mx.example.com; dmarc=fail action=none header.from=example.com"})
+	assertEqual(t, results[0].Properties["action"], "none", "incorrect action property")
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err = GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	// ARC-Authentication-Results headers are not included
+	assertEqual(t, len(msg.AuthenticationResults), 3, "incorrect number of authentication results")
+	assertEqual(t, msg.AuthenticationResults[2].Properties["header.from"], "gmail.com", "incorrect dmarc property")
+
+	noResults := []byte("From: sender@example.com\r\nSubject: No results\r\n\r\nTest\r\n")
+	id, err = Store(&noResults)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err = GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(msg.AuthenticationResults), 0, "message without Authentication-Results headers")
+}
+
+func TestMIMETree(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing MIME part tree")
+
+	body := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: MIME tree\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=\"related\"\r\n\r\n" +
+		"--related\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"alternative\"\r\n\r\n" +
+		"--alternative\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Plain text\r\n" +
+		"--alternative\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>HTML <img src=\"cid:logo\"></p>\r\n" +
+		"--alternative--\r\n" +
+		"--related\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+		"Content-ID: <logo>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--related--\r\n")
+
+	id, err := Store(&body)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	root := msg.MIMETree
+	assertEqual(t, root.ContentType, "multipart/related", "incorrect root content type")
+	assertEqual(t, len(root.Children), 2, "incorrect number of related parts")
+
+	alternative := root.Children[0]
+	assertEqual(t, alternative.ContentType, "multipart/alternative", "incorrect nested content type")
+	assertEqual(t, len(alternative.Children), 2, "incorrect number of alternative parts")
+	assertEqual(t, alternative.Children[0].ContentType, "text/plain", "incorrect text part content type")
+	assertEqual(t, alternative.Children[1].ContentType, "text/html", "incorrect html part content type")
+	assertEqual(t, alternative.Children[1].PartID, "1.2", "incorrect html part ID")
+
+	image := root.Children[1]
+	assertEqual(t, image.ContentType, "image/png", "incorrect image content type")
+	assertEqual(t, image.ContentDisposition, "inline", "incorrect image content disposition")
+	assertEqual(t, image.Filename, "logo.png", "incorrect image file name")
+	assertEqual(t, image.Size, 8, "incorrect image size")
+	assertEqual(t, len(image.Children), 0, "image should not have child parts")
+
+	// the flat attachment lists are unchanged
+	assertEqual(t, len(msg.Inline), 1, "incorrect number of inline attachments")
+	assertEqual(t, msg.Inline[0].PartID, image.PartID, "inline attachment part ID does not match tree")
+}
+
+func TestParseMDN(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing MDN parsing")
+
+	body, err := os.ReadFile("testdata/mdn.eml")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	id, err := Store(&body)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	report, err := ParseMDN(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, report.FinalRecipient, "recipient@example.com", "incorrect final recipient")
+	assertEqual(t, report.OriginalMessageID, "original-1@example.com", "incorrect original Message-ID")
+	assertEqual(t, report.Disposition, "manual-action/MDN-sent-manually; displayed", "incorrect disposition")
+	assertEqual(t, report.ReportingAgent, "mail.example.com; Thunderbird 115", "incorrect reporting agent")
+
+	textID, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if _, err := ParseMDN(textID); err == nil {
+		t.Log("expected error parsing a message which is not an MDN")
+		t.Fail()
+	}
+
+	for msgID, expected := range map[string]int{id: 1, textID: 0} {
+		var isMDN int
+		if err := sqlf.From("mailbox").Select("IsMDN").To(&isMDN).Where("ID = ?", msgID).QueryRowAndClose(nil, db); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, isMDN, expected, "incorrect IsMDN value")
+	}
+}
+
+func TestGetMessageCharsets(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message part charsets")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	charsets, err := GetMessageCharsets(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(charsets), 2, "incorrect number of text parts")
+	for partID, charset := range charsets {
+		assertEqual(t, charset, "UTF-8", "incorrect charset for part "+partID)
+	}
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	charsets, err = GetMessageCharsets(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(charsets), 1, "incorrect number of text parts")
+	for _, charset := range charsets {
+		assertEqual(t, charset, "us-ascii", "incorrect charset")
+	}
+}
+
+func TestGetMessageAllRecipients(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing combined message recipients")
+
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: One <one@example.com>, two@example.com\r\n" +
+		"Cc: Two <TWO@example.com>, three@example.com\r\n" +
+		"Bcc: four@example.com, one@example.com\r\n" +
+		"Subject: Recipients\r\n\r\nTest\r\n")
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	recipients, err := GetMessageAllRecipients(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	addresses := []string{}
+	for _, a := range recipients {
+		addresses = append(addresses, a.Address)
+	}
+
+	assertEqual(t, strings.Join(addresses, ","), "one@example.com,two@example.com,three@example.com,four@example.com", "incorrect recipients")
+
+	if _, err := GetMessageAllRecipients("invalid"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestGetMessageDeliveryDetails(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message delivery details")
+
+	raw := []byte("Received: from relay.example.com (relay.example.com [192.0.2.2])\r\n" +
+		"        by mailpit (Mailpit) with ESMTP id abc123\r\n" +
+		"        for <recipient@example.com>; Wed, 14 Oct 2026 10:00:05 +0000 (UTC)\r\n" +
+		"Received: from client.example.com (unknown [192.0.2.1]) by relay.example.com with SMTP;\r\n" +
+		"        Wed, 14 Oct 2026 10:00:00 +0000\r\n" +
+		"From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Delivery\r\n\r\nTest\r\n")
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	d, err := GetMessageDeliveryDetails(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, d.SenderIP, "", "unexpected sender IP")
+	assertEqual(t, len(d.EnvelopeTo), 0, "unexpected envelope recipients")
+
+	received := time.Date(2026, 10, 14, 10, 0, 10, 0, time.UTC)
+	if err := SetMessageDelivery(id, DeliveryDetails{
+		EnvelopeFrom: "sender@example.com",
+		EnvelopeTo:   []string{"recipient@example.com", "bcc@example.com"},
+		SenderIP:     "192.0.2.2",
+		SessionID:    "abcdef",
+		ReceivedAt:   received,
+	}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	d, err = GetMessageDeliveryDetails(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, d.EnvelopeFrom, "sender@example.com", "incorrect envelope sender")
+	assertEqual(t, strings.Join(d.EnvelopeTo, ","), "recipient@example.com,bcc@example.com", "incorrect envelope recipients")
+	assertEqual(t, d.SenderIP, "192.0.2.2", "incorrect sender IP")
+	assertEqual(t, d.SessionID, "abcdef", "incorrect session ID")
+	assertEqual(t, d.ReceivedAt.Equal(received), true, "incorrect received time")
+	assertEqual(t, len(d.SMTPHops), 2, "incorrect number of SMTP hops")
+	assertEqual(t, d.SMTPHops[0].From, "client.example.com", "incorrect first hop sender")
+	assertEqual(t, d.SMTPHops[0].By, "relay.example.com", "incorrect first hop receiver")
+	assertEqual(t, d.SMTPHops[1].With, "ESMTP", "incorrect second hop protocol")
+	assertEqual(t, d.SMTPHops[1].ID, "abc123", "incorrect second hop ID")
+	assertEqual(t, d.SMTPHops[1].For, "recipient@example.com", "incorrect second hop recipient")
+	assertEqual(t, d.SMTPHops[1].Date.Equal(time.Date(2026, 10, 14, 10, 0, 5, 0, time.UTC)), true, "incorrect second hop date")
+
+	if _, err := GetMessageDeliveryDetails("missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestGetMessageDeliveryHops(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message delivery hops")
+
+	raw, err := os.ReadFile("testdata/received.eml")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	d, err := GetMessageDeliveryDetails(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	hops := d.SMTPHops
+	assertEqual(t, len(hops), 4, "incorrect number of hops")
+
+	// oldest first, with an unparsable date
+	assertEqual(t, hops[0].By, "build.example.net", "incorrect first hop receiver")
+	assertEqual(t, hops[0].Date.IsZero(), true, "expected a zero date")
+
+	// without a from or for clause
+	assertEqual(t, hops[1].From, "", "incorrect second hop sender")
+	assertEqual(t, hops[1].By, "2002:a17:90a:4b01:b0:28f:f1a2:b3c4", "incorrect second hop receiver")
+	assertEqual(t, hops[1].ID, "a1csp1234567pjd", "incorrect second hop ID")
+	assertEqual(t, hops[1].For, "", "incorrect second hop recipient")
+	assertEqual(t, hops[1].Date.Equal(time.Date(2026, 10, 13, 7, 15, 38, 0, time.UTC)), true, "incorrect second hop date")
+
+	assertEqual(t, hops[2].From, "mail-sor-f41.google.com", "incorrect third hop sender")
+	assertEqual(t, hops[2].With, "SMTPS", "incorrect third hop protocol")
+	assertEqual(t, hops[2].For, "jane@example.com", "incorrect third hop recipient")
+	assertEqual(t, hops[2].Date.Equal(time.Date(2026, 10, 13, 7, 15, 40, 0, time.UTC)), true, "incorrect third hop date")
+
+	assertEqual(t, hops[3].From, "mx.example.org", "incorrect fourth hop sender")
+	assertEqual(t, hops[3].By, "mail.example.com", "incorrect fourth hop receiver")
+	assertEqual(t, hops[3].With, "ESMTPS", "incorrect fourth hop protocol")
+	assertEqual(t, hops[3].ID, "4XjK2b1QZ8z9sQ", "incorrect fourth hop ID")
+	assertEqual(t, hops[3].For, "jane@example.com", "incorrect fourth hop recipient")
+	assertEqual(t, hops[3].Date.Equal(time.Date(2026, 10, 13, 7, 15, 42, 0, time.UTC)), true, "incorrect fourth hop date")
+	assertEqual(t, strings.HasPrefix(hops[3].Raw, "from mx.example.org (mx.example.org [203.0.113.25])"), true, "incorrect fourth hop raw header")
+
+	// the hop with an unparsable date is excluded
+	assertEqual(t, d.TransitTime, float64(4), "incorrect transit time")
+
+	assertEqual(t, parseReceivedDate("Wed Oct 14 10:00:05 2026").Equal(time.Date(2026, 10, 14, 10, 0, 5, 0, time.UTC)), true, "incorrect fallback date")
+}
+
+func TestResubmitMessage(t *testing.T) {
+	setup()
+	defer Close()
+	defer func() {
+		config.SMTPTags = []config.AutoTag{}
+		config.ResubmitMaxSize = 10 * 1024 * 1024
+	}()
+
+	t.Log("Testing message resubmission")
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Resubmit me\r\n\r\nTest\r\n")
+	id, err := Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetMessageDelivery(id, DeliveryDetails{
+		EnvelopeFrom: "bounces@example.com",
+		EnvelopeTo:   []string{"recipient@example.com", "bcc@example.com"},
+		SenderIP:     "192.0.2.2",
+		ReceivedAt:   time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tagging rules are changed after the message was stored
+	config.SMTPTags = []config.AutoTag{{Tag: "Resubmitted", Match: "resubmit me"}}
+
+	if err := ResubmitMessage(id); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := List(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of messages")
+	assertEqual(t, messages[0].ID != id, true, "resubmitted message has the original ID")
+	assertEqual(t, strings.Join(messages[0].Tags, ","), "Resubmitted", "incorrect resubmitted message tags")
+	assertEqual(t, messages[1].ID, id, "original message not found")
+	assertEqual(t, len(messages[1].Tags), 0, "original message tags changed")
+
+	e, err := getMessageEnvelope(messages[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, e.MailFrom, "bounces@example.com", "incorrect envelope sender")
+	assertEqual(t, strings.Join(e.RcptTo, ","), "recipient@example.com,bcc@example.com", "incorrect envelope recipients")
+	assertEqual(t, e.RemoteIP, "192.0.2.2", "incorrect sender IP")
+
+	config.ResubmitMaxSize = 10
+	assertEqual(t, ResubmitMessage(id), ErrResubmitTooLarge, "expected a max size error")
+
+	if err := ResubmitMessage("missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestGetMessageAttachmentCount(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message attachment counts")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	attachments, err := GetMessageAttachmentCount(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, attachments, 1, "incorrect attachment count")
+
+	inline, err := GetMessageInlineCount(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, inline, 1, "incorrect inline count")
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	attachments, err = GetMessageAttachmentCount(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, attachments, 0, "incorrect attachment count")
+
+	if _, err := GetMessageInlineCount("invalid"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestPreferredContentTypes(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing preferred content types")
+
+	defer func() { config.PreferredContentTypes = []string{"text/html", "text/plain"} }()
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if msg.HTML == "" {
+		t.Error("expected HTML content")
+	}
+	assertEqual(t, msg.PreferPlainText, false, "expected HTML to be preferred")
+
+	config.PreferredContentTypes = []string{"text/plain", "text/html"}
+
+	msg, err = GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, msg.PreferPlainText, true, "expected plain text to be preferred")
+
+	if msg.HTML == "" {
+		t.Error("expected HTML content")
+	}
+
+	if msg.Text == "" {
+		t.Error("expected text content")
+	}
+}
+
+func TestStorageHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("storage hook tests require a POSIX shell")
+	}
+
+	setup()
+	defer Close()
+
+	t.Log("Testing storage hooks")
+
+	config.StorageHooks = []config.StorageHook{
+		{Command: `sed 's/^Subject: .*/Subject: First hook/'`},
+		{Command: `sed 's/First hook/Second hook/'`},
+	}
+	defer func() { config.StorageHooks = nil }()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Original\r\n\r\nTest\r\n")
+	original := string(raw)
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, string(raw), original, "original message modified")
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, msg.Subject, "Second hook", "storage hooks not applied")
+
+	config.StorageHooks = []config.StorageHook{{Command: "echo failed >&2; exit 1"}}
+
+	if _, err := Store(&raw); !errors.Is(err, ErrStorageHook) {
+		t.Errorf("expected storage hook error, got %v", err)
+	}
+
+	assertEqualStats(t, 1, 0)
+}
+
+func TestStorageHookURL(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing storage hook URLs")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("Subject: Reject")) {
+			http.Error(w, "rejected", http.StatusForbidden)
+			return
+		}
+
+		_, _ = w.Write(append([]byte("X-Hook: processed\r\n"), body...))
+	}))
+	defer ts.Close()
+
+	config.StorageHooks = []config.StorageHook{{URL: ts.URL}}
+	defer func() { config.StorageHooks = nil }()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Original\r\n\r\nTest\r\n")
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	headers, err := GetMessageHeaders(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, headers.Get("X-Hook"), "processed", "storage hook URL not applied")
+
+	raw = []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Reject\r\n\r\nTest\r\n")
+
+	if _, err := Store(&raw); !errors.Is(err, ErrStorageHook) {
+		t.Errorf("expected storage hook error, got %v", err)
+	}
+
+	// responses larger than the maximum message size are rejected
+	config.SMTPMaxMessageSize = 50
+	defer func() { config.SMTPMaxMessageSize = 0 }()
+
+	raw = []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Too large\r\n\r\nTest\r\n")
+
+	if _, err := Store(&raw); !errors.Is(err, ErrStorageHook) {
+		t.Errorf("expected storage hook error, got %v", err)
+	}
+
+	assertEqualStats(t, 1, 1)
+}
+
+func TestValidationRules(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing validation rules")
+
+	config.ValidationRules = []config.ValidationRule{
+		{Name: "confidential", Field: "Subject", Pattern: `(?i)confidential`, Action: "reject", Regexp: regexp.MustCompile(`(?i)confidential`)},
+		{Name: "card number", Field: "body", Pattern: `\d{4}-\d{4}-\d{4}-\d{4}`, Action: "warn", Regexp: regexp.MustCompile(`\d{4}-\d{4}-\d{4}-\d{4}`)},
+	}
+	defer func() { config.ValidationRules = nil }()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Confidential report\r\n\r\nTest\r\n")
+	if _, err := Store(&raw); !errors.Is(err, ErrValidationRule) {
+		t.Errorf("expected validation rule error, got %v", err)
+	}
+
+	raw = []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Report\r\n\r\nCard 1234-5678-9012-3456\r\n")
+	if _, err := Store(&raw); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqualStats(t, 1, 1)
+}
+
+func TestGetMessagesByAttachmentHash(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing messages by attachment hash")
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := Store(&testMimeEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	if _, err := Store(&testTextEmail); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	msg, err := GetMessage(ids[0])
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if len(msg.Attachments) == 0 {
+		t.Fatal("expected message attachments")
+	}
+
+	part, err := GetAttachmentPart(ids[0], msg.Attachments[0].PartID)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	sum := sha256.Sum256(part.Content)
+	hash := hex.EncodeToString(sum[:])
+
+	results, err := GetMessagesByAttachmentHash(strings.ToUpper(hash))
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(results), 2, "incorrect number of messages with attachment hash")
+
+	if err := DeleteOneMessage(ids[1]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	results, err = GetMessagesByAttachmentHash(hash)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(results), 1, "incorrect number of messages after delete")
+	assertEqual(t, results[0].ID, ids[0], "incorrect message ID")
+}
+
+func TestBulkGetMessageRaw(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk raw messages")
+
+	ids := []string{}
+	for i := 0; i < 20; i++ {
+		msg := testTextEmail
+		if i%2 == 0 {
+			msg = testMimeEmail
+		}
+
+		id, err := Store(&msg)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	messages, err := BulkGetMessageRaw(append(ids, "missing"))
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), len(ids), "incorrect number of messages")
+
+	for _, id := range ids {
+		raw, err := GetMessageRaw(id)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, bytes.Equal(messages[id], raw), true, "raw message does not match")
+	}
+
+	// a corrupted message does not fail the other messages
+	if _, err := db.Exec(`UPDATE mailbox_data SET Email = ? WHERE ID = ?`, "corrupted", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err = BulkGetMessageRaw(ids)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(messages), len(ids)-1, "incorrect number of messages")
+	_, ok := messages[ids[0]]
+	assertEqual(t, ok, false, "corrupted message returned")
+}
+
+func TestGetMessageRawPart(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing raw message parts")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	content, contentType, fileName, err := GetMessageRawPart(id, "1.2.1")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, contentType, "text/html; charset=utf-8", "incorrect HTML part content type")
+	assertEqual(t, fileName, "", "HTML part should not have a file name")
+	assertEqual(t, bytes.Contains(content, []byte("<html")), true, "incorrect HTML part content")
+
+	attachment, err := GetAttachmentPart(id, "2")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	content, contentType, fileName, err = GetMessageRawPart(id, "2")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, contentType, "application/pdf", "incorrect attachment content type")
+	assertEqual(t, bytes.Equal(content, attachment.Content), true, "incorrect attachment content")
+	assertEqual(t, fileName, attachment.FileName, "incorrect attachment file name")
+
+	if _, _, _, err := GetMessageRawPart(id, "1.0"); err == nil {
+		t.Error("expected an error for a multipart container part")
+	}
+
+	if _, _, _, err := GetMessageRawPart(id, "9"); err == nil {
+		t.Error("expected an error for a missing part")
+	}
+}
+
+func TestGetMessageHTMLWithCIDResolved(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing HTML with resolved cid: references")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	html, err := GetMessageHTMLWithCIDResolved(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, strings.Contains(html, "cid:"), false, "cid: reference not resolved")
+	assertEqual(t, strings.Contains(html, "data:image/jpeg;base64,"), true, "inline image not embedded")
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if _, err := GetMessageHTMLWithCIDResolved(id); err == nil {
+		t.Error("expected an error for a message without HTML")
+	}
+}
+
+func TestMessageSummary(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message summary")
+
+	if _, err := Store(&testMimeEmail); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	summaries, err := List(0, 1)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 1, "Expected 1 result")
+
+	msg := summaries[0]
+
+	assertEqual(t, msg.From.Name, "Sender Smith", "\"From\" name does not match")
+	assertEqual(t, msg.From.Address, "sender2@example.com", "\"From\" address does not match")
+	assertEqual(t, msg.Subject, "inline + attachment", "subject does not match")
+	assertEqual(t, len(msg.To), 1, "incorrect number of recipients")
+	assertEqual(t, msg.To[0].Name, "Recipient Ross", "\"To\" name does not match")
+	assertEqual(t, msg.To[0].Address, "recipient2@example.com", "\"To\" address does not match")
+	assertEqual(t, msg.Snippet, "Message with inline image and attachment:", "\"Snippet\" does does not match")
+	assertEqual(t, msg.Attachments, 1, "Expected 1 attachment")
+	assertEqual(t, msg.MessageID, "33af2ac1-c33d-9738-35e3-a6daf90bbd89@gmail.com", "\"MessageID\" does not match")
+}
+
+func BenchmarkImportText(b *testing.B) {
+	setup()
+	defer Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			b.Log("error ", err)
+			b.Fail()
+		}
+	}
+}
+
+func BenchmarkImportMime(b *testing.B) {
+	setup()
+	defer Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Store(&testMimeEmail); err != nil {
+			b.Log("error ", err)
+			b.Fail()
+		}
+	}
+
+}
+
+func TestMailboxSize(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing mailbox size statistics")
+
+	assertEqual(t, GetMailboxSizeBytes(), int64(0), "Incorrect empty mailbox size")
+	assertEqual(t, GetMailboxCompressedSizeBytes(), int64(0), "Incorrect empty mailbox compressed size")
+	assertEqual(t, StatsGet().CompressionRatio, float64(0), "Incorrect empty mailbox compression ratio")
+
+	for i := 0; i < testRuns; i++ {
+		if _, err := Store(&testMimeEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	stats := StatsGet()
+
+	assertEqual(t, stats.Size, GetMailboxSizeBytes(), "Incorrect mailbox size")
+	assertEqual(t, stats.CompressedSize, GetMailboxCompressedSizeBytes(), "Incorrect mailbox compressed size")
+
+	if stats.Size < int64(testRuns*len(testMimeEmail)) {
+		t.Fatalf("Mailbox size %d is smaller than the stored messages", stats.Size)
+	}
+
+	if stats.CompressedSize == 0 || stats.CompressedSize >= stats.Size {
+		t.Fatalf("Unexpected mailbox compressed size %d (raw size %d)", stats.CompressedSize, stats.Size)
+	}
+
+	assertEqual(t, stats.CompressionRatio, float64(stats.Size)/float64(stats.CompressedSize), "Incorrect compression ratio")
+
+	compressed := int64(len(dbEncoder.EncodeAll(testMimeEmail, nil)))
+	assertEqual(t, stats.CompressedSize, int64(testRuns)*compressed, "Incorrect mailbox compressed size")
+
+	// the total is recalculated after messages are deleted
+	messages, err := List(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteMessages([]string{messages[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, GetMailboxCompressedSizeBytes(), int64(testRuns-1)*compressed, "Incorrect mailbox compressed size after delete")
+}
+
+func TestGetDatabaseSize(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing database size")
+
+	for i := 0; i < 10; i++ {
+		if _, err := Store(&testMimeEmail); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	info, err := GetDatabaseSize()
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if info.LogicalBytes == 0 {
+		t.Error("expected a logical database size")
+	}
+
+	if info.PhysicalBytes == 0 {
+		t.Error("expected a physical database size")
+	}
+
+	if info.FreePages < 0 {
+		t.Errorf("unexpected free pages %d", info.FreePages)
+	}
+
+	t.Log("Testing database vacuum")
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	vacuumed := atomic.LoadInt64(&lastVacuum)
+
+	if err := Vacuum(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	after, err := GetDatabaseSize()
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, after.FreePages, int64(0), "free pages not reclaimed")
+	assertEqual(t, after.WALBytes, int64(0), "WAL file not truncated")
+	assertEqual(t, atomic.LoadInt64(&lastVacuum) > vacuumed, true, "last vacuum time not updated")
+}
+
+func TestDBExecWithRetry(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing database busy retries")
+
+	// a separate connection holding the write lock
+	locker, err := sql.Open("sqlite", "file:"+dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Close()
+
+	conn, err := locker.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dbExecWithRetry(db, 2, time.Millisecond, "DELETE FROM mailbox")
+	if !isBusyError(err) {
+		t.Fatalf("expected a busy error, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+	}()
+
+	if _, err := dbExecWithRetry(db, 5, 20*time.Millisecond, "DELETE FROM mailbox"); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+}
+
+func TestGetAttachmentsByMessageID(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message attachments")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	attachments, err := GetAttachmentsByMessageID(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(attachments), len(msg.Attachments), "incorrect number of attachments")
+	assertEqual(t, attachments[0], msg.Attachments[0], "incorrect attachment summary")
+
+	// GetMessage marks the message as read, so re-check with a fresh unread message
+	id, err = Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if _, err := GetAttachmentsByMessageID(id); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, CountUnread(), 1, "message should not be marked as read")
+
+	if _, err := GetAttachmentsByMessageID("invalid"); err == nil {
+		t.Log("expected an error for an invalid message ID")
+		t.Fail()
+	}
+}
+
+func TestHardMaxMessages(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.HardMaxMessages = 3
+	defer func() { config.HardMaxMessages = 0 }()
+
+	t.Log("Testing hard max messages")
+
+	for i := 0; i < 5; i++ {
+		b := []byte(fmt.Sprintf("From: sender@example.com\r\nSubject: Message %d\r\n\r\nTest\r\n", i))
+		if _, err := Store(&b); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	assertEqual(t, CountTotal(), 3, "messages not pruned to the hard max")
+
+	messages, err := List(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, messages[2].Subject, "Message 2", "oldest messages should be pruned")
+	assertEqual(t, FastCountTotal(), int64(3), "incorrect fast message count after pruning")
+}
+
+func TestFastCountTotal(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing fast message count")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		b := []byte(fmt.Sprintf("From: sender@example.com\r\nSubject: Message %d\r\n\r\nTest\r\n", i))
+		id, err := Store(&b)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	assertEqual(t, FastCountTotal(), int64(5), "incorrect fast message count")
+
+	if err := DeleteOneMessage(ids[0]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, FastCountTotal(), int64(4), "incorrect fast message count after deleting a message")
+
+	if err := DeleteSearch(`subject:"Message 1"`); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, FastCountTotal(), int64(CountTotal()), "fast message count does not match after deleting a search")
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, FastCountTotal(), int64(0), "incorrect fast message count after deleting all messages")
+}
+
+func TestGetMessageRawWithContext(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing raw message retrieval with a context")
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := GetMessageRawWithContext(ctx, id); err == nil {
+		t.Log("expected an error with a cancelled context")
+		t.Fail()
+	}
+
+	raw, err := GetMessageRawWithContext(context.Background(), id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, string(raw), string(testTextEmail), "incorrect raw message")
+}
+
+func TestPrintMessageSummary(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing verbose message summary")
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	summaries, err := GetMessageSummaries([]string{id})
+	if err != nil || len(summaries) != 1 {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	summaries[0].Snippet = strings.Repeat("a", 100)
+
+	var buf bytes.Buffer
+	printMessageSummary(&buf, &summaries[0])
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assertEqual(t, len(lines), 5, "incorrect number of summary lines")
+	assertEqual(t, strings.HasPrefix(lines[1], "  From:    "), true, "missing From line")
+	assertEqual(t, lines[3], "  Subject: "+summaries[0].Subject, "incorrect Subject line")
+	assertEqual(t, lines[4], "  Snippet: "+strings.Repeat("a", 77)+"...", "snippet not truncated")
+}
+
+func TestBulkMessageOperations(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk message operations")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	if err := MarkMessagesRead(ids[:3]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, CountUnread(), 2, "incorrect number of unread messages")
+
+	if err := MarkMessagesUnread(ids[1:]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, CountUnread(), 4, "incorrect number of unread messages")
+
+	// wait for the pending stats broadcast, then mark messages which are already unread
+	time.Sleep(300 * time.Millisecond)
+	if err := MarkUnread(ids[1]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, bcStatsDelay, false, "stats broadcast when no messages were updated")
+
+	if err := DeleteMessages([]string{ids[0], ids[1], ids[1]}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, CountTotal(), 3, "incorrect number of messages after deleting")
+	assertEqual(t, FastCountTotal(), int64(3), "incorrect fast message count after deleting")
+
+	// a missing message deletes nothing
+	if err := DeleteMessages([]string{ids[2], "missing"}); err == nil {
+		t.Log("expected an error deleting a missing message")
+		t.Fail()
+	}
+	assertEqual(t, CountTotal(), 3, "messages deleted despite a missing message")
+
+	if err := DeleteOneMessage(ids[2]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, CountTotal(), 2, "incorrect number of messages after deleting one message")
+}
+
+func TestBulkMessageOperationsRollback(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk message operations roll back on failure")
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		ids = append(ids, id)
+	}
+
+	// fail updates of the last message only
+	if _, err := db.Exec(`CREATE TRIGGER fail_read BEFORE UPDATE OF Read ON mailbox WHEN NEW.ID = '` + ids[2] + `' BEGIN SELECT RAISE(ABORT, 'failed'); END`); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := MarkMessagesRead(ids); err == nil {
+		t.Log("expected an error marking messages as read")
+		t.Fail()
+	}
+	assertEqual(t, CountUnread(), 3, "messages marked as read despite a failure")
+
+	// fail after the messages have been deleted from the mailbox table
+	if _, err := db.Exec("DROP TABLE message_recipients"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := DeleteMessages(ids); err == nil {
+		t.Log("expected an error deleting messages")
+		t.Fail()
+	}
+	assertEqual(t, CountTotal(), 3, "messages deleted despite a failure")
+	assertEqual(t, FastCountTotal(), int64(3), "fast message count changed despite a failure")
+
+	for _, id := range ids {
+		if _, err := GetMessageRaw(id); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestExportMbox(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing mbox export")
+
+	raw := []byte("From: Sender <sender@example.com>\r\nTo: recipient@example.com\r\nSubject: mbox export\r\n\r\nFrom the start of a line\r\n>From a quoted line\r\nnot From here\r\n")
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := Store(&raw)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		ids = append(ids, id)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ExportMbox(buf, ids); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	out := buf.String()
+
+	envelopes := regexp.MustCompile(`(?m)^From sender@example\.com \w{3} \w{3} [ \d]\d \d{2}:\d{2}:\d{2} \d{4}\n`).FindAllString(out, -1)
+	assertEqual(t, len(envelopes), 2, "incorrect number of envelope lines")
+	assertEqual(t, len(regexp.MustCompile(`(?m)^From `).FindAllString(out, -1)), 2, "unescaped From lines in body")
+	assertEqual(t, strings.Count(out, "\r\n>From the start of a line\r\n"), 2, "From line not escaped")
+	assertEqual(t, strings.Count(out, "\r\n>>From a quoted line\r\n"), 2, "quoted From line not escaped")
+	assertEqual(t, strings.Count(out, "\r\nnot From here\r\n\n"), 2, "message not followed by a blank line")
+
+	all := new(bytes.Buffer)
+	if err := ExportAllMbox(all); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, all.Len(), len(out), "exported mbox of all messages does not match")
+
+	missing := new(bytes.Buffer)
+	if err := ExportMbox(missing, []string{ids[0], "does-not-exist"}); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+	assertEqual(t, missing.Len(), 0, "data written for a missing message")
+}
+
+func TestImportMbox(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing mbox import")
+
+	mbox := "From sender@example.com Mon Jan  2 15:04:05 2006\n" +
+		"From: Sender <sender@example.com>\nTo: recipient@example.com\nSubject: First\nMessage-ID: <first@example.com>\n\n" +
+		">From the start of a line\n>>From a quoted line\n> From a reply\nnot From here\n\n" +
+		"From sender@example.com Mon Jan  2 15:04:06 2006\n" +
+		"From: Sender <sender@example.com>\r\nTo: recipient@example.com\r\nSubject: Second\r\nMessage-ID: <second@example.com>\r\n\r\nSecond message\r\n\r\n" +
+		"From sender@example.com Mon Jan  2 15:04:07 2006\n" +
+		"From: Sender <sender@example.com>\nTo: recipient@example.com\nSubject: Duplicate\nMessage-ID: <first@example.com>\n\nDuplicate message\n\n"
+
+	imported, skipped, err := ImportMbox(strings.NewReader(mbox))
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, imported, 2, "incorrect number of messages imported")
+	assertEqual(t, skipped, 1, "incorrect number of messages skipped")
+	assertEqual(t, CountTotal(), 2, "incorrect number of messages stored")
+	assertEqual(t, GetImportProgress(), ImportProgress{Imported: 2, Skipped: 1}, "incorrect import progress")
+
+	id, err := GetIDByMessageID("first@example.com")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, string(raw), "From: Sender <sender@example.com>\nTo: recipient@example.com\nSubject: First\nMessage-ID: <first@example.com>\n\n"+
+		"From the start of a line\n>From a quoted line\n> From a reply\nnot From here\n", "From lines not un-escaped")
+
+	id, err = GetIDByMessageID("second@example.com")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	raw, err = GetMessageRaw(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, strings.HasSuffix(string(raw), "\r\n\r\nSecond message\r\n"), true, "mbox separator not removed")
+
+	// exported messages can be imported again
+	buf := new(bytes.Buffer)
+	if err := ExportAllMbox(buf); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	imported, skipped, err = ImportMbox(buf)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, imported, 2, "incorrect number of exported messages imported")
+	assertEqual(t, skipped, 0, "incorrect number of exported messages skipped")
+
+	if _, err := GetMessageRaw(id); err == nil {
+		t.Error("expected the original message to be deleted")
+	}
+
+	if _, _, err := ImportMbox(strings.NewReader("From: Sender <sender@example.com>\n\nNot an mbox file\n")); err == nil {
+		t.Error("expected an error for an invalid mbox file")
+	}
+
+	// single messages
+	eml := []byte("From: Sender <sender@example.com>\r\nSubject: EML\r\nMessage-ID: <eml@example.com>\r\n\r\nTest\r\n")
+	id, err = ImportEML(eml)
+	if err != nil || id == "" {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	id, err = ImportEML(eml)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, id, "", "duplicate message imported")
+	assertEqual(t, CountTotal(), 3, "incorrect number of messages stored")
+}
+
+func TestGetThread(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message threads")
+
+	store := func(messageID, headers string) string {
+		raw := []byte("From: sender@example.com\r\nSubject: Thread\r\nMessage-ID: <" + messageID + ">\r\n" + headers + "\r\nTest\r\n")
+		id, err := Store(&raw)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		return id
+	}
+
+	threadIDs := func(id string) []string {
+		t.Helper()
+
+		thread, err := GetThread(id)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		ids := []string{}
+		for _, m := range thread {
+			ids = append(ids, m.MessageID)
+		}
+		return ids
+	}
+
+	a := store("a@example.com", "")
+	b := store("b@example.com", "In-Reply-To: <a@example.com>\r\nReferences: <a@example.com>\r\n")
+	// the References header is missing, the thread is inherited from the parent
+	c := store("c@example.com", "In-Reply-To: <b@example.com>\r\n")
+	d := store("d@example.com", "")
+
+	// the parent does not exist
+	e := store("e@example.com", "In-Reply-To: <missing@example.com>\r\n")
+	f := store("f@example.com", "In-Reply-To: e@example.com\r\nReferences: missing@example.com e@example.com\r\n")
+
+	for _, id := range []string{a, b, c} {
+		assertEqual(t, strings.Join(threadIDs(id), ","), "a@example.com,b@example.com,c@example.com", "incorrect thread")
+	}
+
+	assertEqual(t, strings.Join(threadIDs(d), ","), "d@example.com", "incorrect thread")
+	assertEqual(t, strings.Join(threadIDs(e), ","), "e@example.com,f@example.com", "incorrect thread")
+	assertEqual(t, strings.Join(threadIDs(f), ","), "e@example.com,f@example.com", "incorrect thread")
+
+	// messages stored before threading are matched by their headers
+	if _, err := db.Exec("UPDATE mailbox SET ThreadID = '' WHERE ID = ?", c); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, strings.Join(threadIDs(c), ","), "b@example.com,c@example.com", "incorrect thread")
+
+	// reindexing assigns thread IDs to messages stored before threading
+	if _, err := db.Exec("UPDATE mailbox SET ThreadID = ''"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	ReindexAll()
+
+	var missing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mailbox WHERE ThreadID = ''").Scan(&missing); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, missing, 0, "thread IDs not assigned when reindexing")
+
+	for _, id := range []string{a, b, c} {
+		assertEqual(t, strings.Join(threadIDs(id), ","), "a@example.com,b@example.com,c@example.com", "incorrect thread after reindexing")
+	}
+
+	assertEqual(t, strings.Join(threadIDs(d), ","), "d@example.com", "incorrect thread after reindexing")
+	assertEqual(t, strings.Join(threadIDs(f), ","), "e@example.com,f@example.com", "incorrect thread after reindexing")
+
+	if _, err := GetThread("does-not-exist"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestStarredMessages(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing starred messages")
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetMessageTags(ids[0], []string{"Keep"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	if err := SetMessageTags(ids[1], []string{"Delete"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	for _, id := range ids[:3] {
+		if err := StarMessage(id); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	if err := UnstarMessage(ids[1]); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if err := StarMessage("does-not-exist"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+
+	starred, err := ListStarred(0, 50)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(starred), 2, "incorrect number of starred messages")
+	for _, m := range starred {
+		assertEqual(t, m.Starred, true, "message not starred")
+	}
+
+	messages, err := List(0, 50)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	for _, m := range messages {
+		assertEqual(t, m.Starred, m.ID == ids[0] || m.ID == ids[2], "incorrect starred status")
+	}
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, CountTotal(), 2, "starred messages were deleted")
+	for _, id := range []string{ids[0], ids[2]} {
+		if _, err := GetMessage(id); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+	if _, err := GetMessage(ids[1]); err == nil {
+		t.Error("expected unstarred message to be deleted")
+	}
+
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Keep", "incorrect tags after deleting all messages")
+
+	// unstarred messages are deleted
+	for _, id := range []string{ids[0], ids[2]} {
+		if err := UnstarMessage(id); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, CountTotal(), 0, "incorrect number of messages deleted")
+}
+
+func TestBackupDB(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing database backup")
+
+	for i := 0; i < 20; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	f, err := os.Create(backup)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := BackupDB(f); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := f.Close(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	bdb, err := sql.Open("sqlite", "file:"+backup)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	defer bdb.Close()
+
+	for _, table := range []string{"mailbox", "mailbox_data"} {
+		var total int
+		if err := bdb.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&total); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+		assertEqual(t, total, CountTotal(), "incorrect number of messages in backup "+table)
+	}
+}
+
+func TestGetMessageHeaders(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing stored X- headers")
+
+	raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\nX-Campaign-ID: abc\r\nX-Test-Run: 1\r\nX-Test-Run: 2\r\nSubject: Test\r\n\r\nTest\r\n")
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	headers, err := GetMessageHeaders(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(headers), 2, "incorrect number of headers")
+	assertEqual(t, headers.Get("X-Campaign-ID"), "abc", "incorrect header value")
+	assertEqual(t, strings.Join(headers.Values("X-Test-Run"), ","), "1,2", "incorrect header values")
+
+	if _, err := GetMessageHeaders("missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+
+	countHeaders := func() int {
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM message_headers").Scan(&total); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		return total
+	}
+
+	if err := DeleteMessages([]string{id}); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, countHeaders(), 0, "headers of deleted messages should be removed")
+
+	if _, err := Store(&raw); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := DeleteSearch("subject:Test"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, countHeaders(), 0, "headers of messages deleted by search should be removed")
+
+	if _, err := Store(&raw); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := DeleteAllMessages(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, countHeaders(), 0, "headers of all deleted messages should be removed")
+}
+
+func TestRegenerateSnippets(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing snippet regeneration")
+
+	bodies := map[string]string{}
+	for i := 0; i < snippetBatchSize+10; i++ {
+		raw := []byte(fmt.Sprintf("From: sender@example.com\r\nTo: to@example.com\r\nSubject: Test %d\r\nContent-Type: text/html\r\n\r\n<html><body><p>Hello <b>world</b> %d</p></body></html>\r\n", i, i))
+
+		id, err := Store(&raw)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		bodies[id] = fmt.Sprintf("Hello world %d", i)
+	}
+
+	if _, err := db.Exec("UPDATE mailbox SET Snippet = 'stale'"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	progress := make(chan int)
+	updates := []int{}
+	finished := make(chan struct{})
+	go func() {
+		for n := range progress {
+			updates = append(updates, n)
+		}
+		close(finished)
+	}()
+
+	if err := RegenerateSnippets(context.Background(), progress); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	<-finished
+
+	assertEqual(t, len(updates), 2, "expected progress after each batch")
+
+	for id, snippet := range bodies {
+		var s string
+		if err := db.QueryRow("SELECT Snippet FROM mailbox WHERE ID = ?", id).Scan(&s); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		assertEqual(t, s, snippet, "snippet not regenerated")
+	}
+
+	// concurrent regeneration is rejected
+	regenerateSnippetsMu.Lock()
+	err := RegenerateSnippets(context.Background(), nil)
+	regenerateSnippetsMu.Unlock()
+	if !errors.Is(err, ErrRegeneratingSnippets) {
+		t.Errorf("expected ErrRegeneratingSnippets, got %v", err)
+	}
+}
+
+func TestCloseIdleDB(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.DBIdleTimeout = 100 * time.Millisecond
+	defer func() { config.DBIdleTimeout = 0 }()
+
+	t.Log("Testing idle database close & reopen")
+
+	if _, err := Store(&testTextEmail); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	now := time.Now()
+	atomic.StoreInt64(&dbLastAction, now.UnixNano())
+
+	assertEqual(t, closeIdleDB(now.Add(50*time.Millisecond)), false, "database should not be closed before the idle timeout")
+	assertEqual(t, closeIdleDB(now.Add(200*time.Millisecond)), true, "database should be closed after the idle timeout")
+	assertEqual(t, db.Stats().OpenConnections, 0, "database connections should be closed")
+	assertEqual(t, closeIdleDB(now.Add(300*time.Millisecond)), false, "database should only be closed once")
+
+	// the database is reopened transparently
+	assertEqual(t, CountTotal(), 1, "incorrect message count")
+	assertEqual(t, isDBIdle(), false, "database should be reopened")
+	assertEqual(t, getDBLastAction().After(now), true, "reopening should record database activity")
+	assertEqual(t, db.Stats().OpenConnections, 1, "database connection should be kept open")
+
+	if _, err := Store(&testTextEmail); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, CountTotal(), 2, "incorrect message count")
+
+	// reads record database activity
+	atomic.StoreInt64(&dbLastAction, now.UnixNano())
+	if _, err := List(0, 1); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, getDBLastAction().After(now), true, "reads should record database activity")
+}
+
+func TestCorruptedDB(t *testing.T) {
+	logger.NoLogging = true
+	maxMessages := config.MaxMessages
+	config.MaxMessages = 0
+
+	dbPath := filepath.Join(t.TempDir(), "corrupt.db")
+
+	// valid SQLite database with the schema page overwritten with garbage
+	config.DataFile = dbPath
+	if err := InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+
+	f, err := os.OpenFile(dbPath, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xff}, 4096-100), 100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	config.DataFile = dbPath
+	defer func() {
+		config.DataFile = ""
+		config.DBOnCorruption = "fail"
+		config.MaxMessages = maxMessages
+	}()
+
+	t.Log("Testing corrupted database with fail action")
+
+	config.DBOnCorruption = "fail"
+	if err := InitDB(); err == nil || !isCorruptionError(err) {
+		t.Fatalf("expected corrupted database error, got %v", err)
+	}
+	Close()
+
+	t.Log("Testing invalid database file with truncate action")
+
+	// files which are not SQLite databases are never deleted
+	invalidPath := filepath.Join(t.TempDir(), "invalid.db")
+	invalid := bytes.Repeat([]byte("not a database "), 512)
+	if err := os.WriteFile(invalidPath, invalid, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.DataFile = invalidPath
+	config.DBOnCorruption = "truncate"
+	if err := InitDB(); err == nil || isCorruptionError(err) {
+		t.Fatalf("expected invalid database error, got %v", err)
+	}
+	Close()
+
+	if b, err := os.ReadFile(invalidPath); err != nil || !bytes.Equal(b, invalid) {
+		t.Fatalf("invalid database file was modified (%v)", err)
+	}
+
+	t.Log("Testing corrupted database with truncate action")
+
+	config.DataFile = dbPath
+
+	config.DBOnCorruption = "truncate"
+	if err := InitDB(); err != nil {
+		t.Fatalf("expected database to be recreated, got %v", err)
+	}
+	defer Close()
+
+	assertEqualStats(t, 0, 0)
+
+	raw, err := os.ReadFile("testdata/plain-text.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Store(&raw); err != nil {
+		t.Log("error ", err)
+		t.Fail()
 	}
 
+	assertEqualStats(t, 1, 1)
 }
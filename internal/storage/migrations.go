@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"strings"
 
 	"github.com/GuiaBolso/darwin"
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/leporo/sqlf"
 )
@@ -107,6 +110,251 @@ var (
 			CREATE UNIQUE INDEX IF NOT EXISTS idx_settings_key ON settings (Key);
 			INSERT INTO settings (Key, Value) VALUES("DeletedSize", (SELECT SUM(Size)/2 FROM mailbox));`,
 		},
+		{
+			Version:     1.6,
+			Description: "Create DSN tables",
+			Script: `CREATE TABLE IF NOT EXISTS message_dsn (
+				ID TEXT NOT NULL REFERENCES mailbox(ID),
+				Ret TEXT NOT NULL DEFAULT '',
+				EnvID TEXT NOT NULL DEFAULT '',
+				Recipients TEXT NOT NULL DEFAULT '{}'
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_message_dsn_id ON message_dsn (ID);
+
+			CREATE TABLE IF NOT EXISTS message_bounces (
+				ID TEXT NOT NULL REFERENCES mailbox(ID),
+				OriginalMessageID TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_message_bounces_id ON message_bounces (ID);
+			CREATE INDEX IF NOT EXISTS idx_message_bounces_original ON message_bounces (OriginalMessageID);`,
+		},
+		{
+			Version:     1.7,
+			Description: "Create priority column",
+			Script: `ALTER TABLE mailbox ADD COLUMN Priority INTEGER NOT NULL DEFAULT 3;
+			CREATE INDEX IF NOT EXISTS idx_priority ON mailbox (Priority);`,
+		},
+		{
+			Version:     1.8,
+			Description: "Remove case-insensitive collation from tag names",
+			Script: `CREATE TABLE IF NOT EXISTS tagstmp (
+				ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				Name TEXT
+			);
+			INSERT INTO tagstmp (ID, Name) SELECT ID, Name FROM tags;
+			DROP TABLE IF EXISTS tags;
+			ALTER TABLE tagstmp RENAME TO tags;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_tag_name ON tags (Name);
+			CREATE INDEX IF NOT EXISTS idx_tag_name_nocase ON tags (Name COLLATE NOCASE);`,
+		},
+		{
+			Version:     1.9,
+			Description: "Create SMTP transaction log table",
+			Script: `CREATE TABLE IF NOT EXISTS smtp_transactions (
+				ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				ClientIP TEXT NOT NULL,
+				EnvelopeFrom TEXT NOT NULL,
+				EnvelopeTo TEXT NOT NULL,
+				ReceivedAt INTEGER NOT NULL,
+				MessageID TEXT NOT NULL,
+				Status TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_smtp_transactions_received ON smtp_transactions (ReceivedAt);`,
+		},
+		{
+			Version:     2.0,
+			Description: "Create MDN column",
+			Script:      `ALTER TABLE mailbox ADD COLUMN IsMDN INTEGER NOT NULL DEFAULT 0;`,
+		},
+		{
+			Version:     2.1,
+			Description: "Create attachment hashes table",
+			Script: `CREATE TABLE IF NOT EXISTS attachment_hashes (
+				MessageID TEXT NOT NULL,
+				PartID TEXT NOT NULL,
+				Hash TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_attachment_hashes_message ON attachment_hashes (MessageID);
+			CREATE INDEX IF NOT EXISTS idx_attachment_hashes_hash ON attachment_hashes (Hash);`,
+		},
+		{
+			Version:     2.2,
+			Description: "Create deleted messages log table",
+			Script: `CREATE TABLE IF NOT EXISTS deleted_messages (
+				ID TEXT NOT NULL,
+				Created INTEGER NOT NULL,
+				Deleted INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_deleted_messages_deleted ON deleted_messages (Deleted);`,
+		},
+		{
+			Version:     2.3,
+			Description: "Create message recipients table",
+			Script: `CREATE TABLE IF NOT EXISTS message_recipients (
+				ID TEXT NOT NULL,
+				Address TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_message_recipients_id ON message_recipients (ID);
+			CREATE INDEX IF NOT EXISTS idx_message_recipients_address ON message_recipients (Address);
+			INSERT INTO message_recipients (ID, Address)
+				SELECT DISTINCT m.ID, LOWER(json_extract(r.value, '$.Address'))
+				FROM mailbox m, json_each(m.Metadata) f, json_each(f.value) r
+				WHERE f.key IN ('To', 'Cc', 'Bcc') AND f.type = 'array'
+				AND IFNULL(json_extract(r.value, '$.Address'), '') != '';`,
+		},
+		{
+			Version:     2.4,
+			Description: "Create SMTP connection log table",
+			Script: `CREATE TABLE IF NOT EXISTS smtp_connections (
+				ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				RemoteAddr TEXT NOT NULL,
+				ConnectedAt INTEGER NOT NULL,
+				DisconnectedAt INTEGER NOT NULL,
+				MessagesDelivered INTEGER NOT NULL DEFAULT 0,
+				BytesReceived INTEGER NOT NULL DEFAULT 0,
+				EHLOHostname TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_smtp_connections_connected ON smtp_connections (ConnectedAt);`,
+		},
+		{
+			Version:     2.5,
+			Description: "Create search history table",
+			Script: `CREATE TABLE IF NOT EXISTS search_history (
+				Query TEXT NOT NULL PRIMARY KEY,
+				SearchedAt INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_search_history_searched ON search_history (SearchedAt);`,
+		},
+		{
+			Version:     2.6,
+			Description: "Create custom headers column",
+			Script:      `ALTER TABLE mailbox ADD COLUMN CustomHeaders TEXT NOT NULL DEFAULT '{}';`,
+		},
+		{
+			Version:     2.7,
+			Description: "Create content type columns",
+			Script: `ALTER TABLE mailbox ADD COLUMN ContentType TEXT NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS idx_content_type ON mailbox (ContentType);
+			ALTER TABLE attachment_hashes ADD COLUMN ContentType TEXT NOT NULL DEFAULT '';`,
+		},
+		{
+			Version:     2.8,
+			Description: "Create delivery details columns",
+			Script: `ALTER TABLE mailbox ADD COLUMN SenderIP TEXT NOT NULL DEFAULT '';
+			ALTER TABLE mailbox ADD COLUMN EnvelopeFrom TEXT NOT NULL DEFAULT '';
+			ALTER TABLE mailbox ADD COLUMN EnvelopeTo TEXT NOT NULL DEFAULT '[]';
+			ALTER TABLE mailbox ADD COLUMN SessionID TEXT NOT NULL DEFAULT '';
+			ALTER TABLE mailbox ADD COLUMN ReceivedAt INTEGER NOT NULL DEFAULT 0;`,
+		},
+		{
+			Version:     2.9,
+			Description: "Create search history stats columns",
+			Script: `ALTER TABLE search_history ADD COLUMN UseCount INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE search_history ADD COLUMN TotalResults INTEGER NOT NULL DEFAULT 0;`,
+		},
+		{
+			Version:     3.0,
+			Description: "Create link check results table",
+			Script: `CREATE TABLE IF NOT EXISTS link_check_results (
+				ID TEXT NOT NULL PRIMARY KEY,
+				CheckedAt INTEGER NOT NULL,
+				Links INTEGER NOT NULL,
+				Failed INTEGER NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_link_check_results_checked ON link_check_results (CheckedAt);`,
+		},
+		{
+			Version:     3.1,
+			Description: "Create sender domain column",
+			Script: `ALTER TABLE mailbox ADD COLUMN SenderDomain TEXT NOT NULL DEFAULT '';
+			UPDATE mailbox SET SenderDomain = LOWER(SUBSTR(json_extract(Metadata, '$.From.Address'), INSTR(json_extract(Metadata, '$.From.Address'), '@') + 1))
+				WHERE INSTR(json_extract(Metadata, '$.From.Address'), '@') > 0;
+			CREATE INDEX IF NOT EXISTS idx_sender_domain ON mailbox (SenderDomain);`,
+		},
+		{
+			Version:     3.2,
+			Description: "Create precedence column",
+			Script: `ALTER TABLE mailbox ADD COLUMN Precedence TEXT NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS idx_precedence ON mailbox (Precedence);`,
+		},
+		{
+			Version:     3.3,
+			Description: "Create attachment size column",
+			Script:      `ALTER TABLE attachment_hashes ADD COLUMN Size INTEGER NOT NULL DEFAULT 0;`,
+		},
+		{
+			Version:     3.4,
+			Description: "Create webhook failures table",
+			Script: `CREATE TABLE IF NOT EXISTS webhook_failures (
+				ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				Created INTEGER NOT NULL,
+				Payload TEXT NOT NULL,
+				LastError TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_webhook_failures_created ON webhook_failures (Created);`,
+		},
+		{
+			Version:     3.5,
+			Description: "Create thread ID column",
+			Script: `ALTER TABLE mailbox ADD COLUMN ThreadID TEXT NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS idx_thread_id ON mailbox (ThreadID);`,
+		},
+		{
+			Version:     3.6,
+			Description: "Create link checks table",
+			Script: `CREATE TABLE IF NOT EXISTS link_checks (
+				ID TEXT NOT NULL,
+				URLHash TEXT NOT NULL,
+				FollowRedirects INTEGER NOT NULL,
+				URL TEXT NOT NULL,
+				StatusCode INTEGER NOT NULL,
+				Status TEXT NOT NULL,
+				CheckedAt INTEGER NOT NULL,
+				PRIMARY KEY (ID, URLHash, FollowRedirects)
+			);`,
+		},
+		{
+			Version:     3.7,
+			Description: "Create starred column",
+			Script: `ALTER TABLE mailbox ADD COLUMN Starred INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX IF NOT EXISTS idx_starred ON mailbox (Starred);`,
+		},
+		{
+			Version:     3.8,
+			Description: "Create message headers table",
+			Script: `CREATE TABLE IF NOT EXISTS message_headers (
+				ID TEXT NOT NULL,
+				Name TEXT NOT NULL,
+				Value TEXT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_message_headers_id ON message_headers (ID);`,
+		},
+		{
+			Version:     3.9,
+			Description: "Create saved searches table",
+			Script: `CREATE TABLE IF NOT EXISTS saved_searches (
+				ID TEXT NOT NULL PRIMARY KEY,
+				Name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+				Query TEXT NOT NULL,
+				Created INTEGER NOT NULL
+			);`,
+		},
+		{
+			Version:     4.0,
+			Description: "Create indexed sender address column",
+			Script: `ALTER TABLE mailbox ADD COLUMN FromAddress TEXT
+				GENERATED ALWAYS AS (IFNULL(json_extract(Metadata, '$.From.Address'), '')) VIRTUAL;
+			CREATE INDEX IF NOT EXISTS idx_from_address ON mailbox (FromAddress COLLATE NOCASE);`,
+		},
+		{
+			Version:     4.1,
+			Description: "Create IMAP UIDs table",
+			Script: `CREATE TABLE IF NOT EXISTS imap_uids (
+				UID INTEGER PRIMARY KEY AUTOINCREMENT,
+				ID TEXT NOT NULL UNIQUE
+			);
+			DELETE FROM settings WHERE Key = 'IMAPUIDValidity';`,
+		},
 	}
 )
 
@@ -120,19 +368,37 @@ func dbApplyMigrations() error {
 }
 
 // These functions are used to migrate data formats/structure on startup.
+// Migrations are cancelled if they exceed config.MigrationTimeout, and any
+// incomplete migrations will resume on the next startup.
 func dataMigrations() {
+	ctx := context.Background()
+	if config.MigrationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.MigrationTimeout)
+		defer cancel()
+	}
+
 	// ensure DeletedSize has a value if empty
 	if SettingGet("DeletedSize") == "" {
 		_ = SettingPut("DeletedSize", "0")
 	}
 
-	migrateTagsToManyMany()
+	migrateTagsToManyMany(ctx)
+
+	if !config.TagsCaseSensitive {
+		mergeCaseVariantTags(ctx)
+	}
+
+	if ctx.Err() != nil {
+		logger.Log().Errorf("[migration] data migrations exceeded the %s timeout and were cancelled", config.MigrationTimeout)
+		logger.Log().Warn("[migration] the database is partially migrated, remaining migrations will resume on the next startup")
+	}
 }
 
 // Migrate tags to ManyMany structure
 // Migration task implemented 12/2023
 // Can be removed end 06/2024 and Tags column & index dropped from mailbox
-func migrateTagsToManyMany() {
+func migrateTagsToManyMany(ctx context.Context) {
 	toConvert := make(map[string][]string)
 	q := sqlf.
 		Select("ID, Tags").
@@ -140,7 +406,7 @@ func migrateTagsToManyMany() {
 		Where("Tags != ?", "[]").
 		Where("Tags IS NOT NULL")
 
-	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+	if err := q.QueryAndClose(ctx, db, func(row *sql.Rows) {
 		var id string
 		var jsonTags string
 		if err := row.Scan(&id, &jsonTags); err != nil {
@@ -163,6 +429,10 @@ func migrateTagsToManyMany() {
 	if len(toConvert) > 0 {
 		logger.Log().Infof("[migration] converting %d message tags", len(toConvert))
 		for id, tags := range toConvert {
+			if ctx.Err() != nil {
+				return
+			}
+
 			if err := SetMessageTags(id, tags); err != nil {
 				logger.Log().Errorf("[migration] %s", err.Error())
 			} else {
@@ -182,7 +452,76 @@ func migrateTagsToManyMany() {
 	if _, err := sqlf.Update("mailbox").
 		Set("Tags", nil).
 		Where("Tags = ?", "[]").
-		ExecAndClose(nil, db); err != nil {
+		ExecAndClose(ctx, db); err != nil {
+		logger.Log().Errorf("[migration] %s", err.Error())
+	}
+}
+
+// Merge tags differing only in case (eg: "Bug" & "bug") into the oldest tag.
+// Case-variant tags can only exist if Mailpit was previously run with case-sensitive tags.
+func mergeCaseVariantTags(ctx context.Context) {
+	type tag struct {
+		ID   int
+		Name string
+	}
+
+	tags := []tag{}
+	var t tag
+
+	if err := sqlf.From("tags").
+		Select("ID").To(&t.ID).
+		Select("Name").To(&t.Name).
+		OrderBy("ID").
+		QueryAndClose(ctx, db, func(row *sql.Rows) {
+			tags = append(tags, t)
+		}); err != nil {
 		logger.Log().Errorf("[migration] %s", err.Error())
+		return
+	}
+
+	keep := make(map[string]int)
+	merged := 0
+
+	for _, t := range tags {
+		if ctx.Err() != nil {
+			return
+		}
+
+		k := strings.ToLower(t.Name)
+		keepID, ok := keep[k]
+		if !ok {
+			keep[k] = t.ID
+			continue
+		}
+
+		// move messages to the original tag unless already tagged
+		if _, err := sqlf.Update("message_tags").
+			Set("TagID", keepID).
+			Where("TagID = ?", t.ID).
+			Where("ID NOT IN (SELECT ID FROM message_tags WHERE TagID = ?)", keepID).
+			ExecAndClose(nil, db); err != nil {
+			logger.Log().Errorf("[migration] %s", err.Error())
+			continue
+		}
+
+		if _, err := sqlf.DeleteFrom("message_tags").
+			Where("TagID = ?", t.ID).
+			ExecAndClose(nil, db); err != nil {
+			logger.Log().Errorf("[migration] %s", err.Error())
+			continue
+		}
+
+		if _, err := sqlf.DeleteFrom("tags").
+			Where("ID = ?", t.ID).
+			ExecAndClose(nil, db); err != nil {
+			logger.Log().Errorf("[migration] %s", err.Error())
+			continue
+		}
+
+		merged++
+	}
+
+	if merged > 0 {
+		logger.Log().Infof("[migration] merged %d case-variant tags", merged)
 	}
 }
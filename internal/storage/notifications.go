@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/server/metrics"
 	"github.com/axllent/mailpit/server/websockets"
 )
 
@@ -12,7 +13,7 @@ var bcStatsDelay = false
 // BroadcastMailboxStats broadcasts the total number of messages
 // displayed to the web UI, as well as the total unread messages.
 // The lookup is very fast (< 10ms / 100k messages under load).
-// Rate limited to 4x per second.
+// Rate limited to 4x per second. The metrics gauges are updated at the same time if enabled.
 func BroadcastMailboxStats() {
 	if bcStatsDelay {
 		return
@@ -26,13 +27,29 @@ func BroadcastMailboxStats() {
 		b := struct {
 			Total   int
 			Unread  int
+			Tags    []TagStat
 			Version string
 		}{
 			Total:   CountTotal(),
 			Unread:  CountUnread(),
+			Tags:    GetTagStats(),
 			Version: config.Version,
 		}
 
+		if config.EnableMetrics {
+			updateMetrics(b.Unread)
+		}
+
 		websockets.Broadcast("stats", b)
 	}()
 }
+
+// UpdateMetrics sets the mailbox & storage metrics gauges
+func updateMetrics(unread int) {
+	var dbSize int64
+	if info, err := GetDatabaseSize(); err == nil {
+		dbSize = info.PhysicalBytes
+	}
+
+	metrics.SetMailboxStats(unread, GetMailboxSizeBytes(), dbSize)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"bytes"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PriorityHighest is the highest message priority
+	PriorityHighest = 1
+	// PriorityNormal is the default message priority
+	PriorityNormal = 3
+	// PriorityLowest is the lowest message priority
+	PriorityLowest = 5
+)
+
+// GetMessagePriority returns the normalized priority of a message based on its X-Priority,
+// Importance, X-MSMail-Priority or Priority headers, where 1 is the highest, 3 is normal
+// and 5 is the lowest priority.
+func GetMessagePriority(id string) (int, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return PriorityNormal, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return PriorityNormal, err
+	}
+
+	return messagePriority(msg.Header.Get), nil
+}
+
+// Returns the normalized message priority (1-5) from the message headers
+func messagePriority(header func(string) string) int {
+	// X-Priority: 1 (Highest) - 5 (Lowest)
+	if v := strings.TrimSpace(header("X-Priority")); v != "" {
+		if p, err := strconv.Atoi(v[:1]); err == nil && p >= PriorityHighest && p <= PriorityLowest {
+			return p
+		}
+	}
+
+	for _, h := range []string{"Importance", "X-MSMail-Priority", "Priority"} {
+		switch strings.ToLower(strings.TrimSpace(header(h))) {
+		case "high", "urgent":
+			return PriorityHighest
+		case "low", "non-urgent":
+			return PriorityLowest
+		case "normal":
+			return PriorityNormal
+		}
+	}
+
+	return PriorityNormal
+}
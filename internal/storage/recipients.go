@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"database/sql"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// GetMessagesByRecipient returns a subset of messages with the given address in the To, Cc or Bcc
+// fields (case-insensitive), sorted latest to oldest
+func GetMessagesByRecipient(address string, start, limit int) ([]MessageSummary, error) {
+	tsStart := time.Now()
+
+	q := sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		Where(`m.ID IN (SELECT ID FROM message_recipients WHERE Address = ?)`, strings.ToLower(strings.TrimSpace(address))).
+		OrderBy("m.Created DESC").
+		Limit(limit).
+		Offset(start)
+
+	results, err := queryMessageSummaries(q)
+	if err != nil {
+		return results, err
+	}
+
+	logger.Log().Debugf("[db] list messages by recipient in %s", time.Since(tsStart))
+
+	return results, nil
+}
+
+// StoreMessageRecipients replaces the indexed recipient addresses of a message within a transaction
+func storeMessageRecipients(tx *sql.Tx, id string, addresses []string) error {
+	if _, err := tx.Exec("DELETE FROM message_recipients WHERE ID = ?", id); err != nil {
+		return err
+	}
+
+	for _, a := range addresses {
+		if _, err := tx.Exec("INSERT INTO message_recipients(ID, Address) values(?,?)", id, a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Recipients returns the unique, lowercased To, Cc & Bcc addresses
+func (d DBMailSummary) recipients() []string {
+	addresses := []string{}
+
+	for _, list := range [][]*mail.Address{d.To, d.Cc, d.Bcc} {
+		for _, a := range list {
+			if a == nil || a.Address == "" {
+				continue
+			}
+
+			address := strings.ToLower(a.Address)
+			if !inArray(address, addresses) {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
@@ -5,8 +5,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
@@ -14,20 +18,35 @@ import (
 	"github.com/leporo/sqlf"
 )
 
+// ErrRegeneratingSnippets is returned by RegenerateSnippets() if snippets are already being regenerated
+var ErrRegeneratingSnippets = errors.New("snippets are already being regenerated")
+
+// snippetBatchSize is the number of messages updated at a time when regenerating snippets
+const snippetBatchSize = 500
+
+var regenerateSnippetsMu sync.Mutex
+
 // ReindexAll will regenerate the search text and snippet for a message
-// and update the database.
+// and update the database. Messages stored before threading was added are
+// assigned a thread ID, so messages are reindexed oldest first.
 func ReindexAll() {
 	ids := []string{}
-	var i string
+	messageIDs := map[string]string{}
+	threadIDs := map[string]string{}
+	var i, messageID, threadID string
 	chunkSize := 1000
 
 	finished := 0
 
 	err := sqlf.Select("ID").To(&i).
+		Select("MessageID").To(&messageID).
+		Select("ThreadID").To(&threadID).
 		From("mailbox").
-		OrderBy("Created DESC").
+		OrderBy("Created ASC", "rowid ASC").
 		QueryAndClose(nil, db, func(row *sql.Rows) {
 			ids = append(ids, i)
+			messageIDs[i] = messageID
+			threadIDs[i] = threadID
 		})
 
 	if err != nil {
@@ -42,19 +61,36 @@ func ReindexAll() {
 	logger.Log().Infof("reindexing %d messages", total)
 
 	type updateStruct struct {
-		ID         string
-		SearchText string
-		Snippet    string
-		Metadata   string
+		ID           string
+		SearchText   string
+		Snippet      string
+		Metadata     string
+		Priority     int
+		IsMDN        int
+		Headers      string
+		ContentType  string
+		SenderDomain string
+		Precedence   string
+		Hashes       []attachmentHash
+		Recipients   []string
+		Header       textproto.MIMEHeader
+		ThreadID     string
+		References   []string
 	}
 
 	for _, ids := range chunks {
 		updates := []updateStruct{}
 
+		messages, err := BulkGetMessageRaw(ids)
+		if err != nil {
+			logger.Log().Error(err)
+			continue
+		}
+
 		for _, id := range ids {
-			raw, err := GetMessageRaw(id)
-			if err != nil {
-				logger.Log().Error(err)
+			raw, ok := messages[id]
+			if !ok {
+				logger.Log().Errorf("[db] message not found: %s", id)
 				continue
 			}
 
@@ -96,6 +132,19 @@ func ReindexAll() {
 			u.SearchText = searchText
 			u.Snippet = snippet
 			u.Metadata = string(MetadataJSON)
+			u.Priority = messagePriority(env.GetHeader)
+			if isMDN(env) {
+				u.IsMDN = 1
+			}
+			u.Headers = customHeaders(env)
+			u.ContentType = strings.ToLower(env.Root.ContentType)
+			u.SenderDomain = senderDomain(from)
+			u.Precedence = strings.ToLower(strings.TrimSpace(env.GetHeader("Precedence")))
+			u.Hashes = attachmentHashes(env)
+			u.Recipients = obj.recipients()
+			u.Header = env.Root.Header
+			u.ThreadID = threadIDs[id]
+			u.References = threadReferences(env.Root.Header.Get)
 
 			updates = append(updates, u)
 		}
@@ -112,11 +161,34 @@ func ReindexAll() {
 
 		// insert mail summary data
 		for _, u := range updates {
-			_, err = tx.Exec("UPDATE mailbox SET SearchText = ?, Snippet = ?, Metadata = ? WHERE ID = ?", u.SearchText, u.Snippet, u.Metadata, u.ID)
+			if u.ThreadID == "" {
+				u.ThreadID, err = messageThreadID(tx, messageIDs[u.ID], u.References)
+				if err != nil {
+					logger.Log().Errorf("[db] %s", err.Error())
+					continue
+				}
+			}
+
+			_, err = tx.Exec("UPDATE mailbox SET SearchText = ?, Snippet = ?, Metadata = ?, Priority = ?, IsMDN = ?, CustomHeaders = ?, ContentType = ?, SenderDomain = ?, Precedence = ?, ThreadID = ? WHERE ID = ?", u.SearchText, u.Snippet, u.Metadata, u.Priority, u.IsMDN, u.Headers, u.ContentType, u.SenderDomain, u.Precedence, u.ThreadID, u.ID)
 			if err != nil {
 				logger.Log().Errorf("[db] %s", err.Error())
 				continue
 			}
+
+			if err := storeAttachmentHashes(tx, u.ID, u.Hashes); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				continue
+			}
+
+			if err := storeMessageRecipients(tx, u.ID, u.Recipients); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				continue
+			}
+
+			if err := storeMessageHeaders(tx, u.ID, u.Header); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				continue
+			}
 		}
 
 		if err := tx.Commit(); err != nil {
@@ -130,6 +202,96 @@ func ReindexAll() {
 	}
 }
 
+// RegenerateSnippets regenerates the snippet of every message from the raw message, eg: after
+// changes to tools.CreateSnippet(). Messages are updated in batches, and the number of messages
+// processed so far is sent to progress (if not nil) after each batch. The progress channel is
+// closed when done. Only one regeneration may run at a time.
+func RegenerateSnippets(ctx context.Context, progress chan<- int) error {
+	if progress != nil {
+		defer close(progress)
+	}
+
+	if !regenerateSnippetsMu.TryLock() {
+		return ErrRegeneratingSnippets
+	}
+	defer regenerateSnippetsMu.Unlock()
+
+	ids := []string{}
+	var i string
+
+	if err := sqlf.Select("ID").To(&i).
+		From("mailbox").
+		OrderBy("Created DESC").
+		QueryAndClose(ctx, db, func(row *sql.Rows) {
+			ids = append(ids, i)
+		}); err != nil {
+		return err
+	}
+
+	finished := 0
+
+	for _, chunk := range chunkBy(ids, snippetBatchSize) {
+		if len(chunk) == 0 {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		messages, err := BulkGetMessageRaw(chunk)
+		if err != nil {
+			return err
+		}
+
+		// a single UPDATE per batch using a CASE expression
+		cases := []string{}
+		caseArgs := []interface{}{}
+		inArgs := []interface{}{}
+
+		for _, id := range chunk {
+			raw, ok := messages[id]
+			if !ok {
+				// deleted since the IDs were fetched, or could not be decompressed
+				continue
+			}
+
+			env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+			if err != nil {
+				logger.Log().Errorf("[message] %s", err.Error())
+				continue
+			}
+
+			cases = append(cases, "WHEN ? THEN ?")
+			caseArgs = append(caseArgs, id, tools.CreateSnippet(env.Text, env.HTML))
+			inArgs = append(inArgs, id)
+		}
+
+		if len(cases) > 0 {
+			q := `UPDATE mailbox SET Snippet = CASE ID ` + strings.Join(cases, " ") + ` ELSE Snippet END ` +
+				`WHERE ID IN (?` + strings.Repeat(",?", len(inArgs)-1) + `)` // #nosec
+
+			if _, err := db.ExecContext(ctx, q, append(caseArgs, inArgs...)...); err != nil {
+				return err
+			}
+		}
+
+		finished += len(chunk)
+
+		if progress != nil {
+			select {
+			case progress <- finished:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	logger.Log().Infof("[db] regenerated %d message snippets", finished)
+
+	return nil
+}
+
 func chunkBy[T any](items []T, chunkSize int) (chunks [][]T) {
 	for chunkSize < len(items) {
 		items, chunks = items[chunkSize:], append(chunks, items[0:chunkSize:chunkSize])
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// ErrResubmitTooLarge is returned when resubmitting a message larger than config.ResubmitMaxSize
+var ErrResubmitTooLarge = errors.New("message exceeds the maximum resubmit size")
+
+// ResubmitMessage stores a new copy of the raw bytes of a stored message, processed as a newly
+// received message with the current tagging rules applied. The original message is not modified.
+// The copy keeps the original SMTP envelope, and is not relayed or forwarded.
+func ResubmitMessage(id string) error {
+	if config.DuplicateAction != "store" {
+		return fmt.Errorf("messages cannot be resubmitted with the %s duplicate action", config.DuplicateAction)
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	if config.ResubmitMaxSize > 0 && len(raw) > config.ResubmitMaxSize {
+		return ErrResubmitTooLarge
+	}
+
+	e, err := getMessageEnvelope(id)
+	if err != nil {
+		return err
+	}
+
+	newID, err := Store(&raw)
+	if err != nil {
+		return err
+	}
+
+	// messages not received via SMTP have no envelope to copy
+	if e.MailFrom == "" && len(e.RcptTo) == 0 {
+		return nil
+	}
+
+	return SetMessageDelivery(newID, DeliveryDetails{
+		EnvelopeFrom: e.MailFrom,
+		EnvelopeTo:   e.RcptTo,
+		SenderIP:     e.RemoteIP,
+		ReceivedAt:   time.Now(),
+	})
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// DBBusyRetryDelay is the initial delay before retrying a database operation which failed
+// with SQLITE_BUSY, doubling with each subsequent retry
+var dbBusyRetryDelay = 50 * time.Millisecond
+
+// Execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// DBExecWithRetry executes a query, retrying up to retries times with exponential backoff
+// if the database is busy (SQLITE_BUSY), eg: locked by another process
+func dbExecWithRetry(db execer, retries int, delay time.Duration, query string, args ...interface{}) (sql.Result, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := db.Exec(query, args...)
+		if err == nil || !isBusyError(err) || attempt >= retries {
+			return res, err
+		}
+
+		logger.Log().Debugf("[db] database busy, retrying in %s", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// IsBusyError returns whether the error is an SQLITE_BUSY error (including extended codes)
+func isBusyError(err error) bool {
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		return e.Code()&0xff == sqlite3.SQLITE_BUSY
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// SavedSearchLimit is the maximum number of saved searches
+const savedSearchLimit = 50
+
+var (
+	// ErrSavedSearchExists is returned when a saved search with the same name already exists
+	ErrSavedSearchExists = errors.New("a saved search with that name already exists")
+
+	// ErrSavedSearchLimit is returned when the maximum number of saved searches has been reached
+	ErrSavedSearchLimit = errors.New("the maximum of 50 saved searches has been reached")
+
+	// ErrSavedSearchNotFound is returned when the saved search does not exist
+	ErrSavedSearchNotFound = errors.New("saved search not found")
+)
+
+// GetSavedSearches returns all saved searches, sorted by name
+func GetSavedSearches() ([]SavedSearch, error) {
+	results := []SavedSearch{}
+
+	q := sqlf.From("saved_searches").
+		Select("ID, Name, Query, Created").
+		OrderBy("Name COLLATE NOCASE")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var s SavedSearch
+		var created int64
+
+		if err := row.Scan(&s.ID, &s.Name, &s.Query, &created); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		s.Created = time.UnixMilli(created)
+
+		results = append(results, s)
+	}); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// AddSavedSearch saves a search query under a unique (case-insensitive) name
+func AddSavedSearch(name, query string) (SavedSearch, error) {
+	s := SavedSearch{
+		ID:      shortuuid.New(),
+		Name:    strings.TrimSpace(name),
+		Query:   strings.TrimSpace(query),
+		Created: time.Now(),
+	}
+
+	if s.Name == "" {
+		return s, errors.New("saved search name is required")
+	}
+
+	if s.Query == "" {
+		return s, errors.New("saved search query is required")
+	}
+
+	var exists, total int
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(Name = ? COLLATE NOCASE), 0) FROM saved_searches`, s.Name).
+		Scan(&total, &exists); err != nil {
+		return s, err
+	}
+
+	if exists > 0 {
+		return s, ErrSavedSearchExists
+	}
+
+	if total >= savedSearchLimit {
+		return s, ErrSavedSearchLimit
+	}
+
+	if _, err := sqlf.InsertInto("saved_searches").
+		Set("ID", s.ID).
+		Set("Name", s.Name).
+		Set("Query", s.Query).
+		Set("Created", s.Created.UnixMilli()).
+		ExecAndClose(nil, db); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return s, ErrSavedSearchExists
+		}
+
+		return s, err
+	}
+
+	return s, nil
+}
+
+// DeleteSavedSearch deletes a saved search
+func DeleteSavedSearch(id string) error {
+	res, err := sqlf.DeleteFrom("saved_searches").
+		Where("ID = ?", id).
+		ExecAndClose(nil, db)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSavedSearchNotFound
+	}
+
+	return nil
+}
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/axllent/mailpit/internal/cache"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
 	"github.com/leporo/sqlf"
@@ -15,9 +17,16 @@ import (
 
 // Search will search a mailbox for search terms.
 // The search is broken up by segments (exact phrases can be quoted), and interprets specific terms such as:
-// is:read, is:unread, has:attachment, to:<term>, from:<term> & subject:<term>
+// is:read, is:unread, has:attachment, to:<term>, from:<term>, subject:<term>, attachment:<filename>,
+// mimetype:<type>, after:<date>, before:<date> & on:<date> (YYYY-MM-DD in UTC, or RFC 3339)
 // Negative searches also also included by prefixing the search term with a `-` or `!`
 func Search(search string, start, limit int) ([]MessageSummary, int, error) {
+	return SearchSorted(search, start, limit, SortCreated, SortDesc)
+}
+
+// SearchSorted is the same as Search, with the results sorted by the field in the given direction.
+// Messages with equal sort values are sorted latest to oldest.
+func SearchSorted(search string, start, limit int, field SortField, dir SortDir) ([]MessageSummary, int, error) {
 	results := []MessageSummary{}
 	allResults := []MessageSummary{}
 	tsStart := time.Now()
@@ -26,8 +35,13 @@ func Search(search string, start, limit int) ([]MessageSummary, int, error) {
 		limit = 50
 	}
 
-	q := searchQueryBuilder(search)
-	var err error
+	sortColumn, sortDir, err := messageSortOrder(field, dir)
+	if err != nil {
+		return results, nrResults, err
+	}
+
+	q := searchQueryBuilder(search).
+		OrderBy(sortColumn+" "+sortDir, "m.Created DESC", "m.ID DESC")
 
 	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
 		var created int64
@@ -39,10 +53,11 @@ func Search(search string, start, limit int) ([]MessageSummary, int, error) {
 		var attachments int
 		var snippet string
 		var read int
+		var starred int
 		var ignore string
 		em := MessageSummary{}
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
+		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &starred, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 			return
 		}
@@ -59,6 +74,7 @@ func Search(search string, start, limit int) ([]MessageSummary, int, error) {
 		em.Size = size
 		em.Attachments = attachments
 		em.Read = read == 1
+		em.Starred = starred == 1
 		em.Snippet = snippet
 
 		allResults = append(allResults, em)
@@ -66,7 +82,7 @@ func Search(search string, start, limit int) ([]MessageSummary, int, error) {
 		return results, nrResults, err
 	}
 
-	dbLastAction = time.Now()
+	setDBLastAction()
 
 	nrResults = len(allResults)
 
@@ -93,7 +109,8 @@ func Search(search string, start, limit int) ([]MessageSummary, int, error) {
 
 // DeleteSearch will delete all messages for search terms.
 // The search is broken up by segments (exact phrases can be quoted), and interprets specific terms such as:
-// is:read, is:unread, has:attachment, to:<term>, from:<term> & subject:<term>
+// is:read, is:unread, has:attachment, to:<term>, from:<term>, subject:<term>, attachment:<filename>,
+// mimetype:<type>, after:<date>, before:<date> & on:<date> (YYYY-MM-DD in UTC, or RFC 3339)
 // Negative searches also also included by prefixing the search term with a `-` or `!`
 func DeleteSearch(search string) error {
 	q := searchQueryBuilder(search)
@@ -111,10 +128,11 @@ func DeleteSearch(search string) error {
 		var attachments int
 		// var tags string
 		var read int
+		var starred int
 		var snippet string
 		var ignore string
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
+		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &starred, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 			return
 		}
@@ -160,6 +178,10 @@ func DeleteSearch(search string) error {
 				delIDs[i] = id
 			}
 
+			if err := logDeletedMessages(tx, ids...); err != nil {
+				return err
+			}
+
 			sqlDelete1 := `DELETE FROM mailbox WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
 
 			_, err = tx.Exec(sqlDelete1, delIDs...)
@@ -180,6 +202,54 @@ func DeleteSearch(search string) error {
 			if err != nil {
 				return err
 			}
+
+			sqlDelete4 := `DELETE FROM message_dsn WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete4, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			sqlDelete5 := `DELETE FROM message_bounces WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete5, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			sqlDelete6 := `DELETE FROM attachment_hashes WHERE MessageID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete6, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			sqlDelete7 := `DELETE FROM message_recipients WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete7, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			sqlDelete8 := `DELETE FROM link_check_results WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete8, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			sqlDelete9 := `DELETE FROM link_checks WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete9, delIDs...)
+			if err != nil {
+				return err
+			}
+
+			if err := deleteMessageHeaders(tx, ids...); err != nil {
+				return err
+			}
+
+			cache.Remove(ids...)
 		}
 
 		err = tx.Commit()
@@ -189,10 +259,12 @@ func DeleteSearch(search string) error {
 		}
 
 		if err == nil {
+			atomic.AddInt64(&messageCounter, -int64(total))
+			atomic.StoreInt64(&compressedSize, -1)
 			logger.Log().Debugf("[db] deleted %d messages matching %s", total, search)
 		}
 
-		dbLastAction = time.Now()
+		setDBLastAction()
 		addDeletedSize(int64(deleteSize))
 
 		logMessagesDeleted(total)
@@ -210,14 +282,13 @@ func searchQueryBuilder(searchString string) *sqlf.Stmt {
 
 	q := sqlf.From("mailbox m").
 		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read,
-			m.Snippet,
+			m.Starred, m.Snippet,
 			IFNULL(json_extract(Metadata, '$.To'), '{}') as ToJSON,
 			IFNULL(json_extract(Metadata, '$.From'), '{}') as FromJSON,
 			IFNULL(json_extract(Metadata, '$.Cc'), '{}') as CcJSON,
 			IFNULL(json_extract(Metadata, '$.Bcc'), '{}') as BccJSON,
 			IFNULL(json_extract(Metadata, '$.ReplyTo'), '{}') as ReplyToJSON
-		`).
-		OrderBy("m.Created DESC")
+		`)
 
 	for _, w := range args {
 		if cleanString(w) == "" {
@@ -285,6 +356,26 @@ func searchQueryBuilder(searchString string) *sqlf.Stmt {
 					q.Where("ReplyToJSON LIKE ?", "%"+escPercentChar(w)+"%")
 				}
 			}
+		} else if strings.HasPrefix(lw, "envfrom:") {
+			// SMTP envelope sender (MAIL FROM), blank for messages not received via SMTP
+			w = cleanString(w[8:])
+			if w != "" {
+				if exclude {
+					q.Where("m.EnvelopeFrom NOT LIKE ?", "%"+escPercentChar(w)+"%")
+				} else {
+					q.Where("m.EnvelopeFrom LIKE ?", "%"+escPercentChar(w)+"%")
+				}
+			}
+		} else if strings.HasPrefix(lw, "envto:") {
+			// SMTP envelope recipients (RCPT TO), stored as a JSON array
+			w = cleanString(w[6:])
+			if w != "" {
+				if exclude {
+					q.Where("m.EnvelopeTo NOT LIKE ?", "%"+escPercentChar(w)+"%")
+				} else {
+					q.Where("m.EnvelopeTo LIKE ?", "%"+escPercentChar(w)+"%")
+				}
+			}
 		} else if strings.HasPrefix(lw, "subject:") {
 			w = w[8:]
 			if w != "" {
@@ -307,11 +398,29 @@ func searchQueryBuilder(searchString string) *sqlf.Stmt {
 			w = cleanString(w[4:])
 			if w != "" {
 				if exclude {
-					q.Where(`m.ID NOT IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ?)`, w)
+					q.Where(`m.ID NOT IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, w)
 				} else {
-					q.Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ?)`, w)
+					q.Where(`m.ID IN (SELECT mt.ID FROM message_tags mt JOIN tags t ON mt.TagID = t.ID WHERE t.Name = ? COLLATE `+tagCollation()+`)`, w)
 				}
 			}
+		} else if start, _, ok := parseSearchDate(w, "after:"); ok {
+			if exclude {
+				q.Where("m.Created < ?", start)
+			} else {
+				q.Where("m.Created >= ?", start)
+			}
+		} else if _, end, ok := parseSearchDate(w, "before:"); ok {
+			if exclude {
+				q.Where("m.Created > ?", end)
+			} else {
+				q.Where("m.Created <= ?", end)
+			}
+		} else if start, end, ok := parseSearchDate(w, "on:"); ok {
+			if exclude {
+				q.Where("(m.Created < ? OR m.Created > ?)", start, end)
+			} else {
+				q.Where("m.Created >= ? AND m.Created <= ?", start, end)
+			}
 		} else if lw == "is:read" {
 			if exclude {
 				q.Where("Read = 0")
@@ -336,6 +445,31 @@ func searchQueryBuilder(searchString string) *sqlf.Stmt {
 			} else {
 				q.Where("Attachments > 0")
 			}
+		} else if strings.HasPrefix(lw, "header:") {
+			// header:<name>:<value> (case-insensitive) matches the stored message headers.
+			// Without a value, messages containing the header are matched.
+			name, value, _ := strings.Cut(w[7:], ":")
+			name = strings.TrimSpace(name)
+			if name != "" {
+				sub := `SELECT ID FROM message_headers WHERE Name = ? COLLATE NOCASE AND Value LIKE ?`
+				value = "%" + escPercentChar(strings.TrimSpace(value)) + "%"
+				if exclude {
+					q.Where("m.ID NOT IN ("+sub+")", name, value)
+				} else {
+					q.Where("m.ID IN ("+sub+")", name, value)
+				}
+			}
+		} else if strings.HasPrefix(lw, "attachment:") || strings.HasPrefix(lw, "mimetype:") {
+			// attachment filenames & MIME types are included in the search text
+			_, w, _ = strings.Cut(lw, ":")
+			w = cleanString(escPercentChar(w))
+			if w != "" {
+				if exclude {
+					q.Where("(m.Attachments = 0 OR SearchText NOT LIKE ?)", "%"+w+"%")
+				} else {
+					q.Where("m.Attachments > 0 AND SearchText LIKE ?", "%"+w+"%")
+				}
+			}
 		} else {
 			// search text
 			if exclude {
@@ -348,3 +482,24 @@ func searchQueryBuilder(searchString string) *sqlf.Stmt {
 
 	return q
 }
+
+// ParseSearchDate parses a date search term (eg: after:2024-01-15) with the given prefix, returning
+// the first & last millisecond of the day (UTC) for YYYY-MM-DD dates, or the exact time for RFC 3339 values
+func parseSearchDate(w, prefix string) (int64, int64, bool) {
+	if !strings.HasPrefix(strings.ToLower(w), prefix) {
+		return 0, 0, false
+	}
+
+	v := strings.ToUpper(strings.TrimSpace(w[len(prefix):]))
+
+	if d, err := time.Parse("2006-01-02", v); err == nil {
+		start := d.UnixMilli()
+		return start, d.AddDate(0, 0, 1).UnixMilli() - 1, true
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UnixMilli(), t.UnixMilli(), true
+	}
+
+	return 0, 0, false
+}
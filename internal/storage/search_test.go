@@ -2,9 +2,12 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jhillyerd/enmime"
 )
@@ -165,6 +168,382 @@ func TestSearchDelete1100(t *testing.T) {
 	assertEqual(t, total, 0, "0 search results expected")
 }
 
+func TestSearchHistory(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search history")
+
+	for _, q := range []string{"one", " ", "two", "three", "one"} {
+		AddSearchHistory(q, 1)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	queries, err := GetRecentSearches(10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, strings.Join(queries, ","), "one,three,two", "incorrect search history")
+
+	queries, err = GetRecentSearches(2)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(queries), 2, "incorrect number of recent searches")
+
+	for i := 0; i < searchHistoryLimit+10; i++ {
+		AddSearchHistory(fmt.Sprintf("query %d", i), 0)
+	}
+
+	queries, err = GetRecentSearches(searchHistoryLimit * 2)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(queries), searchHistoryLimit, "search history not limited")
+
+	if err := ClearSearchHistory(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	queries, err = GetRecentSearches(10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(queries), 0, "search history not cleared")
+}
+
+func TestSearchHistoryWithStats(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search history stats")
+
+	AddSearchHistory("one", 4)
+	time.Sleep(2 * time.Millisecond)
+	AddSearchHistory("two", 3)
+	time.Sleep(2 * time.Millisecond)
+	AddSearchHistory("one", 1)
+
+	stats, err := GetSearchHistoryWithStats(10)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(stats), 2, "incorrect number of search history stats")
+	assertEqual(t, stats[0].Query, "one", "incorrect latest query")
+	assertEqual(t, stats[0].UseCount, 2, "incorrect use count")
+	assertEqual(t, stats[0].AvgResults, 2.5, "incorrect average results")
+	assertEqual(t, stats[1].Query, "two", "incorrect query")
+	assertEqual(t, stats[1].UseCount, 1, "incorrect use count")
+	assertEqual(t, stats[1].AvgResults, 3.0, "incorrect average results")
+
+	if stats[0].LastUsed.Before(stats[1].LastUsed) {
+		t.Log("incorrect last used time")
+		t.Fail()
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing saved searches")
+
+	s, err := AddSavedSearch(" CI failures ", "tag:ci has:attachment")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, s.Name, "CI failures", "saved search name not trimmed")
+
+	if _, err := AddSavedSearch("Large", "larger:1M"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	searches, err := GetSavedSearches()
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, len(searches), 2, "incorrect number of saved searches")
+	assertEqual(t, searches[0].ID, s.ID, "incorrect saved search ID")
+	assertEqual(t, searches[0].Query, "tag:ci has:attachment", "incorrect saved search query")
+
+	if _, err := AddSavedSearch("ci FAILURES", "tag:ci"); !errors.Is(err, ErrSavedSearchExists) {
+		t.Errorf("expected duplicate saved search error, got %v", err)
+	}
+
+	if _, err := AddSavedSearch("Empty", " "); err == nil {
+		t.Error("expected error for empty query")
+	}
+
+	for i := 2; i < savedSearchLimit; i++ {
+		if _, err := AddSavedSearch(fmt.Sprintf("Search %d", i), "query"); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	if _, err := AddSavedSearch("One too many", "query"); !errors.Is(err, ErrSavedSearchLimit) {
+		t.Errorf("expected saved search limit error, got %v", err)
+	}
+
+	if err := DeleteSavedSearch(s.ID); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	searches, err = GetSavedSearches()
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, len(searches), savedSearchLimit-1, "saved search not deleted")
+
+	if err := DeleteSavedSearch(s.ID); !errors.Is(err, ErrSavedSearchNotFound) {
+		t.Errorf("expected saved search not found error, got %v", err)
+	}
+}
+
+func TestSearchDateRange(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search date ranges")
+
+	// messages either side of midnight UTC
+	timestamps := []string{
+		"2024-01-14T23:59:59.999Z",
+		"2024-01-15T00:00:00Z",
+		"2024-01-15T23:59:59.999Z",
+		"2024-01-16T00:00:00Z",
+	}
+
+	for _, ts := range timestamps {
+		d, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if _, err := db.Exec("UPDATE mailbox SET Created = ? WHERE ID = ?", d.UnixMilli(), id); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	tests := map[string]int{}
+	tests["on:2024-01-15"] = 2
+	tests["-on:2024-01-15"] = 2
+	tests["after:2024-01-15"] = 3
+	tests["before:2024-01-15"] = 3
+	tests["before:2024-01-14"] = 1
+	tests["after:2024-01-15 before:2024-01-15"] = 2
+	tests["after:2024-01-17"] = 0
+	tests["!after:2024-01-16"] = 3
+	tests["after:2024-01-15T23:59:59.999Z"] = 2
+	tests["after:2024-01-15T01:00:00+02:00"] = 4
+	tests["before:2024-01-16T00:30:00+01:00"] = 2
+	tests["before:2024-01-15t00:00:00z"] = 2
+	tests["before:15-01-2024"] = 0
+
+	for search, expected := range tests {
+		_, count, err := Search(search, 0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, count, expected, fmt.Sprintf("incorrect number of results for %q", search))
+	}
+}
+
+func TestSearchEnvelope(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search by SMTP envelope")
+
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if i == 0 {
+			continue // not received via SMTP
+		}
+
+		d := DeliveryDetails{
+			EnvelopeFrom: fmt.Sprintf("bounces-%d@example.net", i),
+			EnvelopeTo:   []string{fmt.Sprintf("hidden-%d@example.org", i)},
+			SenderIP:     "127.0.0.1",
+		}
+
+		if err := SetMessageDelivery(id, d); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	tests := map[string]int{}
+	tests["envfrom:bounces-1@example.net"] = 1
+	tests["envfrom:example.net"] = 2
+	tests["-envfrom:bounces-1@example.net"] = 2
+	tests["envto:hidden-2@example.org"] = 1
+	tests["envto:HIDDEN"] = 2
+	tests["!envto:hidden-2@example.org"] = 2
+	tests["envfrom:bounces-1@example.net envto:hidden-2@example.org"] = 0
+	// the envelope is not part of the message headers
+	tests["from:bounces-1@example.net"] = 0
+	tests["to:hidden-2@example.org"] = 0
+	tests["from:sender@example.com"] = 3
+
+	for search, expected := range tests {
+		_, count, err := Search(search, 0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, count, expected, fmt.Sprintf("incorrect number of results for %q", search))
+	}
+}
+
+func TestSearchAttachments(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment search")
+
+	attachments := map[string]string{
+		"Invoice-2024.pdf": "application/pdf",
+		"report.csv":       "text/csv",
+		"":                 "",
+	}
+
+	for filename, contentType := range attachments {
+		msg := enmime.Builder().
+			From("Sender", "sender@example.com").
+			To("Recipient", "recipient@example.com").
+			Subject("Attachment " + filename).
+			Text([]byte("the attached document"))
+
+		if filename != "" {
+			msg = msg.AddAttachment([]byte("attachment"), contentType, filename)
+		}
+
+		env, err := msg.Build()
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		buf := new(bytes.Buffer)
+		if err := env.Encode(buf); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		b := buf.Bytes()
+		if _, err := Store(&b); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	tests := map[string]int{}
+	tests["has:attachment"] = 2
+	tests["-has:attachment"] = 1
+	tests["attachment:invoice-2024.pdf"] = 1
+	tests["attachment:Invoice"] = 1
+	tests["attachment:.csv"] = 1
+	tests["!attachment:invoice"] = 2
+	tests["mimetype:application/pdf"] = 1
+	tests["mimetype:text/"] = 1
+	tests["mimetype:text/plain"] = 0
+	tests["mimetype:image/png"] = 0
+	tests["-mimetype:application/pdf"] = 2
+
+	for search, expected := range tests {
+		_, count, err := Search(search, 0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, count, expected, fmt.Sprintf("incorrect number of results for %q", search))
+	}
+}
+
+func TestSearchHighlighted(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search highlights")
+
+	raw := []byte("From: Sales Team <sales@example.com>\r\nTo: recipient@example.com\r\nSubject: Weekly report: Sales reports\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nThe ünïcode sales report is attached\r\n")
+	if _, err := Store(&raw); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	// overlapping terms (report & port) are merged, excluded terms & filters are ignored
+	results, total, err := SearchHighlighted(`report sales port -invoice is:unread subject:weekly`, 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, total, 1, "1 search result expected")
+	if len(results) != 1 {
+		t.FailNow()
+	}
+
+	h := results[0].Highlights
+
+	assertEqual(t, fmt.Sprintf("%v", h["Subject"]), "[{0 6} {7 13} {15 20} {21 27}]", "incorrect subject highlights")
+	assertEqual(t, fmt.Sprintf("%v", h["From.Name"]), "[{0 5}]", "incorrect from name highlights")
+	assertEqual(t, fmt.Sprintf("%v", h["From.Address"]), "[{0 5}]", "incorrect from address highlights")
+	// offsets are in characters rather than bytes
+	assertEqual(t, fmt.Sprintf("%v", h["Snippet"]), "[{12 17} {18 24}]", "incorrect snippet highlights")
+	assertEqual(t, results[0].Subject, "Weekly report: Sales reports", "incorrect message summary")
+
+	for field, spans := range h {
+		for i := 1; i < len(spans); i++ {
+			if spans[i].Start < spans[i-1].End {
+				t.Errorf("overlapping %s highlights: %v", field, spans)
+			}
+		}
+	}
+
+	// the search term is only highlighted in the subject
+	results, _, err = SearchHighlighted("subject:sales", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if len(results) == 1 {
+		assertEqual(t, fmt.Sprintf("%v", results[0].Highlights), "map[Subject:[{15 20}]]", "incorrect subject-only highlights")
+	} else {
+		t.Error("1 search result expected")
+	}
+}
+
 func TestEscPercentChar(t *testing.T) {
 	tests := map[string]string{}
 	tests["this is a test"] = "this is a test"
@@ -180,3 +559,53 @@ func TestEscPercentChar(t *testing.T) {
 		assertEqual(t, res, expected, "no match")
 	}
 }
+
+func TestSearchHeader(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search by header")
+
+	for _, campaign := range []string{"abc123", "def456"} {
+		raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\nX-Campaign-ID: " + campaign + "\r\nSubject: Campaign\r\n\r\nTest\r\n")
+		if _, err := Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	tests := map[string]int{}
+	tests["header:X-Campaign-ID:abc123"] = 1
+	tests["header:x-campaign-id:DEF456"] = 1
+	tests["-header:X-Campaign-ID:abc123"] = 1
+	tests["header:X-Campaign-ID"] = 2
+	tests["header:X-Campaign-ID:missing"] = 0
+	tests["header:Subject:campaign"] = 2
+	tests["header:X-Other"] = 0
+
+	for search, expected := range tests {
+		_, count, err := Search(search, 0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, count, expected, fmt.Sprintf("incorrect number of results for %q", search))
+	}
+
+	// headers are stored again when reindexing
+	if _, err := db.Exec("DELETE FROM message_headers"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	ReindexAll()
+
+	_, count, err := Search("header:X-Campaign-ID:abc123", 0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, count, 1, "incorrect number of results after reindexing")
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// SearchHistoryLimit is the maximum number of distinct queries kept in the search history
+const searchHistoryLimit = 100
+
+// AddSearchHistory records a user search query & its number of results in the search history.
+// Repeated queries update the time & usage stats of the existing entry, and only the latest 100
+// queries are kept.
+func AddSearchHistory(query string, results int) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return
+	}
+
+	if _, err := db.Exec(`INSERT INTO search_history (Query, SearchedAt, UseCount, TotalResults) VALUES (?, ?, 1, ?)
+		ON CONFLICT(Query) DO UPDATE SET SearchedAt = excluded.SearchedAt, UseCount = UseCount + 1,
+		TotalResults = TotalResults + excluded.TotalResults`, query, time.Now().UnixMilli(), results); err != nil {
+		logger.Log().Errorf("[db] error logging search history: %s", err.Error())
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM search_history WHERE Query NOT IN
+		(SELECT Query FROM search_history ORDER BY SearchedAt DESC LIMIT ?)`, searchHistoryLimit); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+}
+
+// GetRecentSearches returns up to n of the most recent distinct search queries, latest first
+func GetRecentSearches(n int) ([]string, error) {
+	results := []string{}
+
+	q := sqlf.From("search_history").
+		Select("Query").
+		OrderBy("SearchedAt DESC").
+		Limit(n)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var query string
+
+		if err := row.Scan(&query); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		results = append(results, query)
+	}); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// GetSearchHistoryWithStats returns up to n of the most recent distinct search queries along
+// with their usage stats, latest first
+func GetSearchHistoryWithStats(n int) ([]SearchHistoryStat, error) {
+	results := []SearchHistoryStat{}
+
+	q := sqlf.From("search_history").
+		Select("Query, SearchedAt, UseCount, TotalResults").
+		OrderBy("SearchedAt DESC").
+		Limit(n)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var s SearchHistoryStat
+		var searched int64
+		var total int
+
+		if err := row.Scan(&s.Query, &searched, &s.UseCount, &total); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		s.LastUsed = time.UnixMilli(searched)
+		if s.UseCount > 0 {
+			s.AvgResults = float64(total) / float64(s.UseCount)
+		}
+
+		results = append(results, s)
+	}); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// ClearSearchHistory deletes all search history
+func ClearSearchHistory() error {
+	_, err := sqlf.DeleteFrom("search_history").ExecAndClose(nil, db)
+
+	return err
+}
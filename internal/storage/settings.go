@@ -2,6 +2,8 @@ package storage
 
 import (
 	"database/sql"
+	"os"
+	"sync/atomic"
 
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/leporo/sqlf"
@@ -49,8 +51,8 @@ func getDeletedSize() int64 {
 	return result.Int64
 }
 
-// The total raw non-compressed messages size in bytes of all messages in the database
-func totalMessagesSize() int64 {
+// GetMailboxSizeBytes returns the total raw non-compressed size in bytes of all messages in the database
+func GetMailboxSizeBytes() int64 {
 	var result sql.NullInt64
 	err := sqlf.From("mailbox").
 		Select("SUM(Size)").To(&result).
@@ -63,6 +65,72 @@ func totalMessagesSize() int64 {
 	return result.Int64
 }
 
+// GetMailboxCompressedSizeBytes returns the total compressed size in bytes of all messages
+// as stored in the database. The total is only recalculated after messages are deleted.
+func GetMailboxCompressedSizeBytes() int64 {
+	if size := atomic.LoadInt64(&compressedSize); size >= 0 {
+		return size
+	}
+
+	var result sql.NullInt64
+	err := sqlf.From("mailbox_data").
+		Select("SUM(LENGTH(CAST(Email AS BLOB)))").To(&result).
+		QueryAndClose(nil, db, func(row *sql.Rows) {})
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return 0
+	}
+
+	atomic.CompareAndSwapInt64(&compressedSize, -1, result.Int64)
+
+	return result.Int64
+}
+
+// Add to the total compressed size, unless it is to be recalculated
+func addCompressedSize(n int64) {
+	for {
+		size := atomic.LoadInt64(&compressedSize)
+		if size < 0 || atomic.CompareAndSwapInt64(&compressedSize, size, size+n) {
+			return
+		}
+	}
+}
+
+// GetDatabaseSize returns the logical & physical size of the database, as well as
+// the size of the WAL file and the number of free pages
+func GetDatabaseSize() (DBSizeInfo, error) {
+	info := DBSizeInfo{}
+
+	var pageCount, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return info, err
+	}
+
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return info, err
+	}
+
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&info.FreePages); err != nil {
+		return info, err
+	}
+
+	info.LogicalBytes = pageCount * pageSize
+
+	f, err := os.Stat(dbFile)
+	if err != nil {
+		return info, err
+	}
+
+	info.PhysicalBytes = f.Size()
+
+	// the WAL file does not exist when fully checkpointed or not in WAL mode
+	if wal, err := os.Stat(dbFile + "-wal"); err == nil {
+		info.WALBytes = wal.Size()
+	}
+
+	return info, nil
+}
+
 // AddDeletedSize will add the value to the DeletedSize setting
 func addDeletedSize(v int64) {
 	if _, err := db.Exec("INSERT OR IGNORE INTO settings (Key, Value) VALUES(?, ?)", "DeletedSize", 0); err != nil {
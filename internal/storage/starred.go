@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// StarMessage will star a message, preserving it when all messages are deleted
+func StarMessage(id string) error {
+	return setMessageStarred(id, true)
+}
+
+// UnstarMessage will remove the star from a message
+func UnstarMessage(id string) error {
+	return setMessageStarred(id, false)
+}
+
+// ListStarred returns a paginated list of starred messages, sorted latest to oldest
+func ListStarred(start, limit int) ([]MessageSummary, error) {
+	q := listQuery(limit).
+		Where("m.Starred = 1").
+		Offset(start)
+
+	return queryMessageSummaries(q)
+}
+
+// CountStarred returns the number of starred messages
+func CountStarred() int {
+	var total int
+
+	_ = sqlf.From("mailbox").
+		Select("COUNT(*)").To(&total).
+		Where("Starred = 1").
+		QueryRowAndClose(nil, db)
+
+	return total
+}
+
+func setMessageStarred(id string, starred bool) error {
+	status := 0
+	if starred {
+		status = 1
+	}
+
+	res, err := dbExecWithRetry(db, config.DBBusyRetries, dbBusyRetryDelay, `UPDATE mailbox SET Starred = ? WHERE ID = ?`, status, id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("message not found")
+	}
+
+	state := "unstarred"
+	if starred {
+		state = "starred"
+	}
+
+	logger.Log().Debugf("[db] %s message %s", state, id)
+
+	setDBLastAction()
+
+	return nil
+}
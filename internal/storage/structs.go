@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"net/mail"
 	"time"
 
@@ -40,12 +41,65 @@ type Message struct {
 	Text string
 	// Message body HTML
 	HTML string
+	// Whether the plain text alternative should be displayed instead of the HTML,
+	// based on the preferred content types
+	PreferPlainText bool
 	// Message size in bytes
 	Size int
 	// Inline message attachments
 	Inline []Attachment
 	// Message attachments
 	Attachments []Attachment
+	// Authentication results (eg: SPF, DKIM & DMARC) of the Authentication-Results headers,
+	// as written by the receiving server (not verified)
+	AuthenticationResults []AuthResult
+	// MIME part tree of the message, including multipart container parts
+	MIMETree MIMENode
+	// SMTP envelope the message was received with, blank for messages not received via SMTP
+	SMTPEnvelope SMTPEnvelope
+}
+
+// SMTPEnvelope is the SMTP envelope of a message as received on the wire,
+// which may differ from the message headers
+//
+// swagger:model SMTPEnvelope
+type SMTPEnvelope struct {
+	// SMTP envelope sender (MAIL FROM)
+	MailFrom string
+	// SMTP envelope recipients (RCPT TO)
+	RcptTo []string
+	// IP address of the SMTP client
+	RemoteIP string
+}
+
+// MIMENode is a part of a message MIME part tree
+//
+// swagger:model MIMENode
+type MIMENode struct {
+	// Part ID
+	PartID string
+	// Content type
+	ContentType string
+	// Content disposition, eg: inline or attachment
+	ContentDisposition string
+	// File name
+	Filename string
+	// Size in bytes of the decoded part content
+	Size int
+	// Child parts (multipart parts only)
+	Children []MIMENode
+}
+
+// AuthResult is a single method result of an Authentication-Results header
+//
+// swagger:model AuthResult
+type AuthResult struct {
+	// Authentication method, eg: spf, dkim, dmarc or arc
+	Method string
+	// Result, eg: pass, fail, softfail, neutral or none
+	Result string
+	// Result properties, eg: smtp.mailfrom, header.d or reason
+	Properties map[string]string
 }
 
 // Attachment struct for inline and attachments
@@ -74,6 +128,8 @@ type MessageSummary struct {
 	MessageID string
 	// Read status
 	Read bool
+	// Starred status, starred messages are preserved when deleting all messages
+	Starred bool
 	// From address
 	From *mail.Address
 	// To address
@@ -98,11 +154,48 @@ type MessageSummary struct {
 	Snippet string
 }
 
+// HighlightedSummary is a message summary of a search result, including the locations of the
+// search terms in the Subject, Snippet, From.Name & From.Address fields
+//
+// swagger:model HighlightedSummary
+type HighlightedSummary struct {
+	MessageSummary
+	// Matches of the search terms, keyed by field name (fields without matches are omitted)
+	Highlights map[string][]MatchSpan
+}
+
+// MatchSpan is the location of a search term match within a field, as character (not byte)
+// offsets, where End is exclusive
+//
+// swagger:model MatchSpan
+type MatchSpan struct {
+	// Start offset
+	Start int
+	// End offset (exclusive)
+	End int
+}
+
 // MailboxStats struct for quick mailbox total/read lookups
 type MailboxStats struct {
 	Total  int
 	Unread int
-	Tags   []string
+	Tags   []TagStat
+	// Total raw (uncompressed) size in bytes of all messages
+	Size int64
+	// Total compressed size in bytes of all messages as stored in the database
+	CompressedSize int64
+	// Ratio of the raw size to the compressed size (0 if the mailbox is empty)
+	CompressionRatio float64
+}
+
+// TagStat contains the total & unread number of messages of a tag
+type TagStat struct {
+	// Tag name
+	Name string
+	// Total number of messages with the tag
+	Total int
+	// Number of unread messages with the tag
+	Unread int
 }
 
 // DBMailSummary struct for storing mail summary
@@ -129,6 +222,24 @@ func AttachmentSummary(a *enmime.Part) Attachment {
 	return o
 }
 
+// MIMETree returns the MIME part tree of a part and its descendants
+func MIMETree(p *enmime.Part) MIMENode {
+	n := MIMENode{
+		PartID:             p.PartID,
+		ContentType:        p.ContentType,
+		ContentDisposition: p.Disposition,
+		Filename:           p.FileName,
+		Size:               len(p.Content),
+		Children:           []MIMENode{},
+	}
+
+	for c := p.FirstChild; c != nil; c = c.NextSibling {
+		n.Children = append(n.Children, MIMETree(c))
+	}
+
+	return n
+}
+
 // ListUnsubscribe contains a summary of List-Unsubscribe & List-Unsubscribe-Post headers
 // including validation of the link structure
 type ListUnsubscribe struct {
@@ -141,3 +252,241 @@ type ListUnsubscribe struct {
 	// List-Unsubscribe-Post value if set
 	HeaderPost string
 }
+
+// DSN contains the Delivery Status Notification (RFC 3461) parameters
+// supplied via SMTP when the message was received
+type DSN struct {
+	// RET parameter (FULL or HDRS)
+	Ret string
+	// ENVID parameter
+	EnvID string
+	// Recipient NOTIFY & ORCPT parameters, keyed by recipient address
+	Recipients map[string]DSNRecipient
+}
+
+// DSNRecipient contains the DSN parameters of a single recipient
+type DSNRecipient struct {
+	// NOTIFY values
+	Notify []string
+	// Original recipient (ORCPT)
+	ORcpt string
+}
+
+// SMTPTransaction is a log entry of a single SMTP transaction
+//
+// swagger:model SMTPTransaction
+type SMTPTransaction struct {
+	// Client IP address
+	ClientIP string
+	// SMTP envelope sender (MAIL FROM)
+	EnvelopeFrom string
+	// SMTP envelope recipients (RCPT TO)
+	EnvelopeTo []string
+	// Time the transaction was received
+	ReceivedAt time.Time
+	// Message-ID header of the message, if received
+	MessageID string
+	// Transaction status: accepted, rejected, ignored or rate-limited
+	Status string
+}
+
+// SMTPConnection is a log entry of a single inbound SMTP connection
+//
+// swagger:model SMTPConnection
+type SMTPConnection struct {
+	// Remote IP address
+	RemoteAddr string
+	// Time the client connected
+	ConnectedAt time.Time
+	// Time the client disconnected
+	DisconnectedAt time.Time
+	// Number of messages delivered during the connection
+	MessagesDelivered int
+	// Total size in bytes of message data received during the connection
+	BytesReceived int
+	// Hostname supplied by the client with HELO / EHLO
+	EHLOHostname string
+}
+
+// WebhookFailure is a webhook delivery which failed all retries
+//
+// swagger:model WebhookFailure
+type WebhookFailure struct {
+	// Database ID
+	ID int
+	// Time the delivery failed
+	Created time.Time
+	// The webhook JSON payload
+	Payload json.RawMessage
+	// The error of the last delivery attempt
+	LastError string
+}
+
+// LinkCheck is the cached HTTP status of a single link of a message
+type LinkCheck struct {
+	URL        string
+	StatusCode int
+	Status     string
+	CheckedAt  time.Time
+}
+
+// DBSizeInfo contains the logical & physical size of the database
+//
+// swagger:model DBSizeInfo
+type DBSizeInfo struct {
+	// Size in bytes of all database pages (page count * page size)
+	LogicalBytes int64
+	// Size in bytes of the database file on disk
+	PhysicalBytes int64
+	// Size in bytes of the write-ahead log (WAL) file on disk
+	WALBytes int64
+	// Number of unused pages in the database, which can be reclaimed with a vacuum
+	FreePages int64
+}
+
+// SearchHistoryStat contains the usage statistics of a search query
+//
+// swagger:model SearchHistoryStat
+type SearchHistoryStat struct {
+	// Search query
+	Query string
+	// Time the query was last used
+	LastUsed time.Time
+	// Number of times the query has been used
+	UseCount int
+	// Average number of results returned by the query
+	AvgResults float64
+}
+
+// SavedSearch is a named search query
+//
+// swagger:model SavedSearch
+type SavedSearch struct {
+	// Saved search ID
+	ID string
+	// Saved search name
+	Name string
+	// Search query
+	Query string
+	// Time the search was saved
+	Created time.Time
+}
+
+// DeliveryDetails contains the SMTP envelope & session details of a message
+//
+// swagger:model DeliveryDetails
+type DeliveryDetails struct {
+	// SMTP envelope sender (MAIL FROM)
+	EnvelopeFrom string
+	// SMTP envelope recipients (RCPT TO)
+	EnvelopeTo []string
+	// IP address of the SMTP client
+	SenderIP string
+	// SMTP session ID
+	SessionID string
+	// Time the message was received by Mailpit
+	ReceivedAt time.Time
+	// Hops parsed from the Received headers, oldest first
+	SMTPHops []SMTPHop
+	// Transit time in seconds between the oldest & newest hops with a valid date
+	TransitTime float64
+}
+
+// SMTPHop is a single hop parsed from a Received header
+//
+// swagger:model SMTPHop
+type SMTPHop struct {
+	// Sending host
+	From string
+	// Receiving host
+	By string
+	// Protocol, eg: ESMTP
+	With string
+	// Queue or message ID assigned by the receiving host
+	ID string
+	// Recipient address, if included
+	For string
+	// Time the message was received by the host, zero if the date could not be parsed
+	Date time.Time
+	// Raw header value
+	Raw string
+}
+
+// ImageMeta is an image referenced in the HTML of a message
+//
+// swagger:model ImageMeta
+type ImageMeta struct {
+	// Image source as referenced in the HTML (URL, cid: reference or data URI)
+	Src string
+	// Content type of the image if known (inline parts & data URIs), else guessed from the file extension
+	ResolvedType string
+	// Width attribute of the image tag, if set
+	Width string
+	// Height attribute of the image tag, if set
+	Height string
+	// Whether the image is loaded from an external URL
+	IsExternal bool
+	// Whether the image is embedded in the message (cid: reference or data URI)
+	IsInline bool
+}
+
+// DKIMHeader contains the (unverified) details of a DKIM-Signature header
+type DKIMHeader struct {
+	// Signing domain (d=)
+	Domain string
+	// Selector (s=)
+	Selector string
+	// Signing algorithm (a=), eg: rsa-sha256
+	Algorithm string
+	// Signed header fields (h=)
+	HeaderFields []string
+	// Body hash (bh=)
+	BodyHash string
+	// Signature data (b=)
+	Signature string
+}
+
+// MDNReport contains the details of a Message Disposition Notification (RFC 3798),
+// eg: a read receipt
+type MDNReport struct {
+	// Recipient the notification was generated for (Final-Recipient)
+	FinalRecipient string
+	// Message-ID of the original message (Original-Message-ID)
+	OriginalMessageID string
+	// Disposition of the original message, eg: manual-action/MDN-sent-manually; displayed
+	Disposition string
+	// User agent which generated the notification (Reporting-UA)
+	ReportingAgent string
+}
+
+// HourlyRate is the number of messages received within an hour
+//
+// swagger:model HourlyRate
+type HourlyRate struct {
+	// Start of the hour (UTC)
+	Hour time.Time
+	// Number of messages received
+	Count int
+}
+
+// TimeBucket is the number of messages received within a period
+type TimeBucket struct {
+	// Start of the period (UTC)
+	Timestamp time.Time
+	// Number of messages received
+	Count int
+	// Total size of the messages in bytes
+	TotalSizeBytes int64
+	// Number of unread messages
+	Unread int
+}
+
+// SizeBucket is the number of messages within a size range
+type SizeBucket struct {
+	// Minimum message size in bytes (inclusive)
+	Min int64
+	// Maximum message size in bytes (exclusive), 0 if unbounded
+	Max int64
+	// Number of messages
+	Count int
+}
@@ -1,7 +1,12 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -9,6 +14,8 @@ import (
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/websockets"
+	"github.com/jhillyerd/enmime"
 	"github.com/leporo/sqlf"
 )
 
@@ -20,8 +27,8 @@ var (
 func SetMessageTags(id string, tags []string) error {
 	applyTags := []string{}
 	for _, t := range tags {
-		t = tools.CleanTag(t)
-		if t != "" && config.ValidTagRegexp.MatchString(t) && !inArray(t, applyTags) {
+		t = limitTagLength(tools.CleanTag(t))
+		if t != "" && config.ValidTagRegexp.MatchString(t) && !tagInArray(t, applyTags) {
 			applyTags = append(applyTags, t)
 		}
 	}
@@ -31,7 +38,7 @@ func SetMessageTags(id string, tags []string) error {
 
 	for _, t := range applyTags {
 		t = tools.CleanTag(t)
-		if t == "" || !config.ValidTagRegexp.MatchString(t) || inArray(t, currentTags) {
+		if t == "" || !config.ValidTagRegexp.MatchString(t) || tagInArray(t, currentTags) {
 			continue
 		}
 
@@ -44,7 +51,7 @@ func SetMessageTags(id string, tags []string) error {
 		currentTags = getMessageTags(id)
 
 		for _, t := range currentTags {
-			if !inArray(t, applyTags) {
+			if !tagInArray(t, applyTags) {
 				if err := DeleteMessageTag(id, t); err != nil {
 					return err
 				}
@@ -61,7 +68,7 @@ func AddMessageTag(id, name string) error {
 
 	q := sqlf.From("tags").
 		Select("ID").To(&tagID).
-		Where("Name = ?", name)
+		Where("Name = ? COLLATE "+tagCollation(), name)
 
 	// tag exists - add tag to message
 	if err := q.QueryRowAndClose(nil, db); err == nil {
@@ -88,6 +95,11 @@ func AddMessageTag(id, name string) error {
 		return err
 	}
 
+	if config.MaxTagCount > 0 && countTags() >= config.MaxTagCount {
+		logger.Log().Warnf("[tags] maximum number of tags (%d) reached, ignoring new tag \"%s\"", config.MaxTagCount, name)
+		return nil
+	}
+
 	logger.Log().Debugf("[tags] adding tag \"%s\" to %s", name, id)
 
 	// tag dos not exist, add new one
@@ -123,7 +135,7 @@ func AddMessageTag(id, name string) error {
 func DeleteMessageTag(id, name string) error {
 	if _, err := sqlf.DeleteFrom("message_tags").
 		Where("message_tags.ID = ?", id).
-		Where(`message_tags.Key IN (SELECT Key FROM message_tags LEFT JOIN tags ON TagID=tags.ID WHERE Name = ?)`, name).
+		Where(`message_tags.Key IN (SELECT Key FROM message_tags LEFT JOIN tags ON TagID=tags.ID WHERE Name = ? COLLATE `+tagCollation()+`)`, name).
 		ExecAndClose(nil, db); err != nil {
 		return err
 	}
@@ -142,22 +154,133 @@ func DeleteAllMessageTags(id string) error {
 	return pruneUnusedTags()
 }
 
+// RenameTag renames a tag. If a tag with the new name already exists then the tag is merged
+// into the existing tag.
+func RenameTag(oldName, newName string) error {
+	return MergeTags([]string{oldName}, newName)
+}
+
+// MergeTags merges the tags into the target tag, which is created (renamed) if it does not exist.
+// Messages with more than one of the tags are only tagged once with the target tag.
+func MergeTags(names []string, targetName string) error {
+	targetName = limitTagLength(tools.CleanTag(targetName))
+	if targetName == "" || !config.ValidTagRegexp.MatchString(targetName) {
+		return errors.New("invalid tag name")
+	}
+
+	unique := []string{}
+	for _, name := range names {
+		if !tagInArray(name, unique) {
+			unique = append(unique, name)
+		}
+	}
+	names = unique
+
+	if len(names) == 0 {
+		return errors.New("no tags to merge")
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	var targetID int
+	if err := tx.QueryRow(`SELECT ID FROM tags WHERE Name = ? COLLATE `+tagCollation(), targetName).Scan(&targetID); err != nil && !errors.Is(err, sql.ErrNoRows) { // #nosec
+		return err
+	}
+
+	for _, name := range names {
+		var id int
+		if err := tx.QueryRow(`SELECT ID FROM tags WHERE Name = ? COLLATE `+tagCollation(), name).Scan(&id); err != nil { // #nosec
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("tag not found: %s", name)
+			}
+
+			return err
+		}
+
+		if id == targetID {
+			continue
+		}
+
+		if targetID == 0 {
+			// the first tag becomes the target, and is renamed below
+			targetID = id
+			continue
+		}
+
+		// move the tag to messages which do not already have the target tag
+		if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay,
+			`UPDATE message_tags SET TagID = ? WHERE TagID = ? AND ID NOT IN (SELECT ID FROM message_tags WHERE TagID = ?)`,
+			targetID, id, targetID); err != nil {
+			return err
+		}
+
+		if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `DELETE FROM message_tags WHERE TagID = ?`, id); err != nil {
+			return err
+		}
+
+		if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `DELETE FROM tags WHERE ID = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := dbExecWithRetry(tx, config.DBBusyRetries, dbBusyRetryDelay, `UPDATE tags SET Name = ? WHERE ID = ?`, targetName, targetID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Log().Debugf("[tags] merged %s into \"%s\"", strings.Join(names, ", "), targetName)
+
+	setDBLastAction()
+
+	websockets.Broadcast("tags", GetAllTags())
+
+	BroadcastMailboxStats()
+
+	return nil
+}
+
 // GetAllTags returns all used tags
 func GetAllTags() []string {
 	var tags = []string{}
+
+	for _, t := range GetTagStats() {
+		tags = append(tags, t.Name)
+	}
+
+	return tags
+}
+
+// GetTagStats returns all tags with their total & unread number of messages
+func GetTagStats() []TagStat {
+	var stats = []TagStat{}
 	var name string
+	var total, unread int
 
 	if err := sqlf.
-		Select(`DISTINCT Name`).
-		From("tags").To(&name).
-		OrderBy("Name").
+		Select(`t.Name`).To(&name).
+		Select(`COUNT(m.ID)`).To(&total).
+		Select(`IFNULL(SUM(CASE WHEN m.Read = 0 THEN 1 ELSE 0 END), 0)`).To(&unread).
+		From("tags t").
+		LeftJoin("message_tags mt", "t.ID = mt.TagID").
+		LeftJoin("mailbox m", "mt.ID = m.ID").
+		GroupBy("t.ID").
+		OrderBy("t.Name COLLATE NOCASE").
 		QueryAndClose(nil, db, func(row *sql.Rows) {
-			tags = append(tags, name)
+			stats = append(stats, TagStat{Name: name, Total: total, Unread: unread})
 		}); err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
 	}
 
-	return tags
+	return stats
 }
 
 // GetAllTagsCount returns all used tags with their total messages
@@ -172,7 +295,7 @@ func GetAllTagsCount() map[string]int64 {
 		From("tags").
 		LeftJoin("message_tags", "tags.ID = message_tags.TagID").
 		GroupBy("message_tags.TagID").
-		OrderBy("Name").
+		OrderBy("Name COLLATE NOCASE").
 		QueryAndClose(nil, db, func(row *sql.Rows) {
 			tags[name] = total
 			// tags = append(tags, name)
@@ -270,6 +393,37 @@ func (d DBMailSummary) tagsFromPlusAddresses() string {
 	return strings.Join(tags, ",")
 }
 
+// Returns tags of recipient rules (--tag-recipient) matching any To or Cc addresses
+func (d DBMailSummary) tagsFromRecipientRules() string {
+	tags := []string{}
+	if len(config.RecipientTagRules) == 0 {
+		return ""
+	}
+
+	addresses := []*mail.Address{}
+	addresses = append(addresses, d.To...)
+	addresses = append(addresses, d.Cc...)
+
+	for _, r := range config.RecipientTagRules {
+		for _, a := range addresses {
+			if match, _ := path.Match(r.Pattern, strings.ToLower(a.Address)); match {
+				tags = append(tags, r.Tag)
+				break
+			}
+		}
+	}
+
+	return strings.Join(tags, ",")
+}
+
+// Returns whether the message contains a text/plain body part. The envelope Text cannot be
+// used as enmime generates this from the HTML part if the message has no text part.
+func hasTextPart(env *enmime.Envelope) bool {
+	return env.Root.BreadthMatchFirst(func(p *enmime.Part) bool {
+		return p.ContentType == "text/plain" && p.Disposition != "attachment"
+	}) != nil
+}
+
 // Get message tags from the database for a given database ID
 // Used when parsing a raw email.
 func getMessageTags(id string) []string {
@@ -281,7 +435,7 @@ func getMessageTags(id string) []string {
 		From("Tags").
 		LeftJoin("message_tags", "Tags.ID=message_tags.TagID").
 		Where(`message_tags.ID = ?`, id).
-		OrderBy("Name").
+		OrderBy("Name COLLATE NOCASE").
 		QueryAndClose(nil, db, func(row *sql.Rows) {
 			tags = append(tags, name)
 		}); err != nil {
@@ -302,12 +456,12 @@ func uniqueTagsFromString(s string) []string {
 
 	parts := strings.Split(s, ",")
 	for _, p := range parts {
-		w := tools.CleanTag(p)
+		w := limitTagLength(tools.CleanTag(p))
 		if w == "" {
 			continue
 		}
 		if config.ValidTagRegexp.MatchString(w) {
-			if !inArray(w, tags) {
+			if !tagInArray(w, tags) {
 				tags = append(tags, w)
 			}
 		} else {
@@ -319,3 +473,50 @@ func uniqueTagsFromString(s string) []string {
 
 	return tags
 }
+
+// LimitTagLength truncates a tag to config.MaxTagNameLength characters
+func limitTagLength(t string) string {
+	if config.MaxTagNameLength == 0 || len(t) <= config.MaxTagNameLength {
+		return t
+	}
+
+	truncated := strings.TrimSpace(t[:config.MaxTagNameLength])
+	logger.Log().Warnf("[tags] tag exceeds %d characters, truncating to \"%s\"", config.MaxTagNameLength, truncated)
+
+	return truncated
+}
+
+// CountTags returns the number of distinct tags
+func countTags() int {
+	var total int
+
+	_ = sqlf.From("tags").
+		Select("COUNT(*)").To(&total).
+		QueryRowAndClose(nil, db)
+
+	return total
+}
+
+// TagCollation returns the SQL collation used when matching tag names
+func tagCollation() string {
+	if config.TagsCaseSensitive {
+		return "BINARY"
+	}
+
+	return "NOCASE"
+}
+
+// Tests if a tag is within an array, respecting config.TagsCaseSensitive
+func tagInArray(k string, arr []string) bool {
+	if !config.TagsCaseSensitive {
+		return inArray(k, arr)
+	}
+
+	for _, v := range arr {
+		if v == k {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
 )
 
 func TestTags(t *testing.T) {
@@ -128,3 +132,395 @@ func TestTags(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRecipientTagRules(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing recipient tag rules")
+
+	config.RecipientTagRules = []config.RecipientTagRule{
+		{Pattern: "recipient@*", Tag: "Recipient"},
+		{Pattern: "cc+*@example.com", Tag: "Carbon Copy"},
+		{Pattern: "noreply@*", Tag: "No Reply"},
+	}
+	defer func() { config.RecipientTagRules = []config.RecipientTagRule{} }()
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "Recipient", strings.Join(getMessageTags(id), "|"), "Recipient tags not detected correctly")
+
+	id, err = Store(&testTagEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "BccTag|Carbon Copy|CcTag|FromFag|ToTag|X-tag1|X-tag2", strings.Join(getMessageTags(id), "|"), "Recipient tags not detected correctly")
+}
+
+func TestHTMLAndTextOnlyTags(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing HTML-only & text-only tags")
+
+	config.TagHTMLOnly = "HTML Only"
+	config.TagTextOnly = "Text Only"
+	defer func() {
+		config.TagHTMLOnly = ""
+		config.TagTextOnly = ""
+	}()
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "Text Only", strings.Join(getMessageTags(id), "|"), "Text-only tag not detected correctly")
+
+	htmlEmail := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: HTML\r\nContent-Type: text/html\r\n\r\n<p>HTML only</p>\r\n")
+
+	id, err = Store(&htmlEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "HTML Only", strings.Join(getMessageTags(id), "|"), "HTML-only tag not detected correctly")
+
+	id, err = Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "", strings.Join(getMessageTags(id), "|"), "Multipart message should not be tagged")
+}
+
+func TestTagsCaseSensitive(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.TagsCaseSensitive = true
+	defer func() { config.TagsCaseSensitive = false }()
+
+	t.Log("Testing case-sensitive tags")
+
+	id1, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	id2, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if err := SetMessageTags(id1, []string{"Bug", "bug"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	if err := SetMessageTags(id2, []string{"bug"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "Bug|bug", strings.Join(getMessageTags(id1), "|"), "Case-variant tags should be distinct")
+	assertEqual(t, "Bug|bug", strings.Join(GetAllTags(), "|"), "Case-variant tags should be distinct")
+
+	t.Log("Testing case-variant tag merging")
+
+	config.TagsCaseSensitive = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mergeCaseVariantTags(ctx)
+
+	assertEqual(t, "Bug|bug", strings.Join(GetAllTags(), "|"), "Cancelled merge should not modify tags")
+
+	mergeCaseVariantTags(context.Background())
+
+	assertEqual(t, "Bug", strings.Join(getMessageTags(id1), "|"), "Case-variant tags not merged")
+	assertEqual(t, "Bug", strings.Join(getMessageTags(id2), "|"), "Case-variant tags not merged")
+	assertEqual(t, "Bug", strings.Join(GetAllTags(), "|"), "Case-variant tags not merged")
+
+	if err := SetMessageTags(id2, []string{"BUG", "Other"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "Bug|Other", strings.Join(getMessageTags(id2), "|"), "Tags should be case-insensitive")
+}
+
+func TestTagLimits(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag name length limit")
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	config.MaxTagNameLength = 10
+	defer func() { config.MaxTagNameLength = 64 }()
+
+	if err := SetMessageTags(id, []string{"Short", "A very long tag name"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, "A very lon|Short", strings.Join(getMessageTags(id), "|"), "Long tag not truncated")
+	assertEqual(t, "Another ta|Tag", strings.Join(uniqueTagsFromString("Tag, Another tag name"), "|"), "Long tag not truncated")
+
+	t.Log("Testing tag count limit")
+
+	config.MaxTagCount = 3
+	defer func() { config.MaxTagCount = 1000 }()
+
+	if err := SetMessageTags(id, []string{"Short", "One", "Two", "Three"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	// "A very lon" is removed (& pruned) after the new tags are added
+	assertEqual(t, "One|Short", strings.Join(GetAllTags(), "|"), "Tag count limit not enforced")
+	assertEqual(t, "One|Short", strings.Join(getMessageTags(id), "|"), "Incorrect tags after limit reached")
+}
+
+func TestListByMultipleTags(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing list by multiple tags")
+
+	tagSets := [][]string{{"Red", "Blue"}, {"Red"}, {"Blue"}, {"Green"}}
+
+	for _, tags := range tagSets {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if err := SetMessageTags(id, tags); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	results, total, err := ListByMultipleTags([]string{"red", "Blue"}, "any", 0, 50)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 3, "incorrect total for any mode")
+	assertEqual(t, len(results), 3, "incorrect results for any mode")
+
+	results, total, err = ListByMultipleTags([]string{"Red", "blue", "RED"}, "all", 0, 50)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 1, "incorrect total for all mode")
+	assertEqual(t, len(results), 1, "incorrect results for all mode")
+
+	_, total, err = ListByMultipleTags([]string{"Red", "Green"}, "all", 0, 50)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 0, "incorrect total for unmatched all mode")
+
+	if _, _, err := ListByMultipleTags([]string{"Red"}, "invalid", 0, 50); err == nil {
+		t.Error("expected an error for an invalid tag mode")
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag stats")
+
+	ids := []string{}
+	for i := 0; i < 4; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+		ids = append(ids, id)
+
+		tags := []string{"alpha"}
+		if i < 2 {
+			tags = append(tags, "beta")
+		}
+		if err := SetMessageTags(id, tags); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	assertTagStats := func(expected []TagStat) {
+		t.Helper()
+
+		stats := GetTagStats()
+		assertEqual(t, fmt.Sprintf("%+v", stats), fmt.Sprintf("%+v", expected), "incorrect tag stats")
+		assertEqual(t, fmt.Sprintf("%+v", StatsGet().Tags), fmt.Sprintf("%+v", expected), "incorrect mailbox stats tags")
+
+		names := []string{}
+		for _, s := range expected {
+			names = append(names, s.Name)
+		}
+		assertEqual(t, strings.Join(GetAllTags(), ","), strings.Join(names, ","), "incorrect tag names")
+	}
+
+	assertTagStats([]TagStat{{"alpha", 4, 4}, {"beta", 2, 2}})
+
+	if err := MarkMessagesRead([]string{ids[0], ids[2]}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertTagStats([]TagStat{{"alpha", 4, 2}, {"beta", 2, 1}})
+
+	if err := MarkMessagesUnread([]string{ids[2]}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertTagStats([]TagStat{{"alpha", 4, 3}, {"beta", 2, 1}})
+
+	if err := DeleteMessages([]string{ids[1]}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertTagStats([]TagStat{{"alpha", 3, 2}, {"beta", 1, 0}})
+
+	// unused tags are removed
+	if err := DeleteMessages([]string{ids[0]}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertTagStats([]TagStat{{"alpha", 2, 2}})
+}
+
+func TestTagRetention(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.TagRetentionRules = []config.TagRetentionRule{{Tag: "debug", MaxMessages: 2, MaxAgeDays: 7}}
+	defer func() { config.TagRetentionRules = nil }()
+
+	t.Log("Testing tag retention rules")
+
+	for _, tag := range []string{"Debug", "Debug", "Debug", "Debug", "Debug", "Alerts", "Alerts", ""} {
+		b := []byte(fmt.Sprintf("From: sender@example.com\r\nSubject: %s\r\nX-Tags: %s\r\n\r\nTest\r\n", tag, tag))
+		if _, err := Store(&b); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	// backdate all messages, keeping three recent debug messages
+	old := time.Now().AddDate(0, 0, -10).UnixMilli()
+	if _, err := db.Exec(`UPDATE mailbox SET Created = ? WHERE rowid NOT IN (SELECT rowid FROM mailbox WHERE Subject = 'Debug' ORDER BY rowid DESC LIMIT 3)`, old); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	pruneTagRetention()
+
+	assertEqual(t, CountTotal(), 5, "incorrect number of messages after pruning")
+
+	stats := GetTagStats()
+	totals := map[string]int{}
+	for _, s := range stats {
+		totals[s.Name] = s.Total
+	}
+
+	assertEqual(t, totals["Debug"], 2, "debug messages should be pruned")
+	assertEqual(t, totals["Alerts"], 2, "other tags should not be pruned")
+}
+
+func TestMergeTags(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag rename & merge")
+
+	tags := [][]string{{"newsletter"}, {"newsletters"}, {"newsletter", "newsletters"}, {"news"}, {"Other"}}
+	for _, tag := range tags {
+		id, err := Store(&testMimeEmail)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+
+		if err := SetMessageTags(id, tag); err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	// rename to a new tag
+	if err := RenameTag("news", "Announcements"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	// rename to an existing tag merges
+	if err := RenameTag("newsletters", "newsletter"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	counts := GetAllTagsCount()
+	assertEqual(t, len(counts), 3, "incorrect number of tags")
+	assertEqual(t, counts["newsletter"], int64(3), "duplicate message tags should not be doubled")
+	assertEqual(t, counts["Announcements"], int64(1), "incorrect count for renamed tag")
+
+	if err := MergeTags([]string{"newsletter", "Announcements"}, "Newsletter"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	counts = GetAllTagsCount()
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Newsletter,Other", "incorrect tags after merge")
+	assertEqual(t, counts["Newsletter"], int64(4), "incorrect count for merged tag")
+	assertEqual(t, counts["Other"], int64(1), "other tags should not be affected")
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM message_tags`).Scan(&rows); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, rows, 5, "message tags should be deduplicated")
+
+	if err := RenameTag("does-not-exist", "Something"); err == nil {
+		t.Log("expected an error for a missing tag")
+		t.Fail()
+	}
+
+	if err := MergeTags([]string{"Other"}, " "); err == nil {
+		t.Log("expected an error for an invalid tag name")
+		t.Fail()
+	}
+}
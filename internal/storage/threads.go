@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/leporo/sqlf"
+)
+
+var messageIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// GetThread returns the conversation of a message (all messages of the same thread), sorted
+// oldest to latest. Messages stored before threading was added are matched by the Message-IDs
+// of their In-Reply-To & References headers.
+func GetThread(id string) ([]MessageSummary, error) {
+	var messageID, threadID string
+
+	q := sqlf.From("mailbox").
+		Select("MessageID").To(&messageID).
+		Select("ThreadID").To(&threadID).
+		Where("ID = ?", id)
+
+	if err := q.QueryRowAndClose(nil, db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return []MessageSummary{}, errors.New("message not found")
+		}
+
+		return []MessageSummary{}, err
+	}
+
+	q = sqlf.From("mailbox m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Starred, m.Snippet`).
+		OrderBy("m.Created ASC", "m.rowid ASC")
+
+	if threadID != "" {
+		q.Where("m.ThreadID = ?", threadID)
+	} else {
+		raw, err := GetMessageRaw(id)
+		if err != nil {
+			return []MessageSummary{}, err
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			return []MessageSummary{}, err
+		}
+
+		args := []interface{}{}
+		for _, ref := range threadReferences(msg.Header.Get) {
+			args = append(args, ref)
+		}
+
+		if messageID != "" {
+			args = append(args, messageID)
+		}
+
+		if len(args) > 999 {
+			args = args[len(args)-999:]
+		}
+
+		if len(args) > 0 {
+			q.Where("(m.ID = ? OR m.MessageID IN (?"+strings.Repeat(",?", len(args)-1)+"))", append([]interface{}{id}, args...)...) // #nosec
+		} else {
+			q.Where("m.ID = ?", id)
+		}
+	}
+
+	return queryMessageSummaries(q)
+}
+
+// ThreadReferences returns the Message-IDs of the References & In-Reply-To headers, starting
+// with the root of the conversation
+func threadReferences(header func(string) string) []string {
+	refs := []string{}
+	seen := map[string]bool{}
+
+	for _, h := range []string{"References", "In-Reply-To"} {
+		for _, ref := range parseMessageIDs(header(h)) {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	return refs
+}
+
+// ParseMessageIDs returns the Message-IDs (without angle brackets) of a header value
+func parseMessageIDs(v string) []string {
+	ids := []string{}
+
+	matches := messageIDRe.FindAllStringSubmatch(v, -1)
+	if len(matches) == 0 {
+		// some clients omit the angle brackets
+		for _, f := range strings.Fields(v) {
+			if strings.Contains(f, "@") {
+				ids = append(ids, strings.Trim(f, "<>,"))
+			}
+		}
+
+		return ids
+	}
+
+	for _, m := range matches {
+		ids = append(ids, m[1])
+	}
+
+	return ids
+}
+
+// MessageThreadID returns the thread ID (the Message-ID of the root message) of a new message.
+// The thread of an already stored referenced message is preferred, as clients do not always
+// include the full References header. The lookup is made with dbx so that a transaction sees
+// its own uncommitted thread IDs.
+func messageThreadID(dbx sqlf.Executor, messageID string, refs []string) (string, error) {
+	if len(refs) == 0 {
+		return messageID, nil
+	}
+
+	args := []interface{}{}
+	for _, ref := range refs {
+		args = append(args, ref)
+	}
+
+	// avoid exceeding SQLite's maximum number of host parameters
+	if len(args) > 1000 {
+		args = args[len(args)-1000:]
+	}
+
+	var threadID string
+	q := sqlf.From("mailbox").
+		Select("ThreadID").To(&threadID).
+		Where("MessageID").In(args...).
+		Where("ThreadID != ''").
+		OrderBy("Created ASC").
+		Limit(1)
+
+	if err := q.QueryRowAndClose(nil, dbx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return refs[0], nil
+		}
+
+		return "", err
+	}
+
+	return threadID, nil
+}
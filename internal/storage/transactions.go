@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+const (
+	// SMTPTransactionAccepted is the status of a transaction where the message was stored
+	SMTPTransactionAccepted = "accepted"
+	// SMTPTransactionRejected is the status of a transaction where the message or a recipient was rejected
+	SMTPTransactionRejected = "rejected"
+	// SMTPTransactionIgnored is the status of a transaction where the message was ignored (duplicate Message-ID)
+	SMTPTransactionIgnored = "ignored"
+	// SMTPTransactionRateLimited is the status of a transaction where the sender or message was rejected by a rate limit
+	SMTPTransactionRateLimited = "rate-limited"
+)
+
+// LogSMTPTransaction records an SMTP transaction if the transaction log is enabled
+// (config.SMTPTransactionLogRetention > 0)
+func LogSMTPTransaction(t SMTPTransaction) {
+	if config.SMTPTransactionLogRetention <= 0 {
+		return
+	}
+
+	if t.EnvelopeTo == nil {
+		t.EnvelopeTo = []string{}
+	}
+
+	if t.ReceivedAt.IsZero() {
+		t.ReceivedAt = time.Now()
+	}
+
+	to, _ := json.Marshal(t.EnvelopeTo)
+
+	if _, err := sqlf.InsertInto("smtp_transactions").
+		Set("ClientIP", t.ClientIP).
+		Set("EnvelopeFrom", t.EnvelopeFrom).
+		Set("EnvelopeTo", string(to)).
+		Set("ReceivedAt", t.ReceivedAt.UnixMilli()).
+		Set("MessageID", t.MessageID).
+		Set("Status", t.Status).
+		ExecAndClose(nil, db); err != nil {
+		logger.Log().Errorf("[db] error logging SMTP transaction: %s", err.Error())
+	}
+}
+
+// GetSMTPTransactionLog returns a subset of the logged SMTP transactions, sorted latest to oldest,
+// as well as the total number of logged transactions
+func GetSMTPTransactionLog(start, limit int) ([]SMTPTransaction, int, error) {
+	results := []SMTPTransaction{}
+	var total int
+
+	q := sqlf.From("smtp_transactions").
+		Select("ClientIP, EnvelopeFrom, EnvelopeTo, ReceivedAt, MessageID, Status").
+		OrderBy("ReceivedAt DESC", "ID DESC").
+		Limit(limit).
+		Offset(start)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var t SMTPTransaction
+		var to string
+		var received int64
+
+		if err := row.Scan(&t.ClientIP, &t.EnvelopeFrom, &to, &received, &t.MessageID, &t.Status); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		if err := json.Unmarshal([]byte(to), &t.EnvelopeTo); err != nil {
+			logger.Log().Errorf("[json] %s", err.Error())
+		}
+
+		t.ReceivedAt = time.UnixMilli(received)
+
+		results = append(results, t)
+	}); err != nil {
+		return results, 0, err
+	}
+
+	if err := sqlf.From("smtp_transactions").
+		Select("COUNT(*)").To(&total).
+		QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	return results, total, nil
+}
+
+// PruneSMTPTransactions deletes logged SMTP transactions older than config.SMTPTransactionLogRetention
+func pruneSMTPTransactions() {
+	if config.SMTPTransactionLogRetention <= 0 {
+		return
+	}
+
+	before := time.Now().Add(-config.SMTPTransactionLogRetention).UnixMilli()
+
+	res, err := sqlf.DeleteFrom("smtp_transactions").
+		Where("ReceivedAt < ?", before).
+		ExecAndClose(nil, db)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Log().Debugf("[db] pruned %d SMTP transaction log entries", n)
+	}
+}
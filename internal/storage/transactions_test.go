@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/server/webhook"
+)
+
+func TestSMTPTransactionLog(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing disabled SMTP transaction log")
+
+	LogSMTPTransaction(SMTPTransaction{ClientIP: "127.0.0.1", Status: SMTPTransactionAccepted})
+
+	_, total, err := GetSMTPTransactionLog(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 0, "Transactions should not be logged when disabled")
+
+	t.Log("Testing SMTP transaction log")
+
+	config.SMTPTransactionLogRetention = time.Hour
+	defer func() { config.SMTPTransactionLogRetention = 0 }()
+
+	LogSMTPTransaction(SMTPTransaction{
+		ClientIP:     "127.0.0.1",
+		EnvelopeFrom: "old@example.com",
+		EnvelopeTo:   []string{"to@example.com"},
+		ReceivedAt:   time.Now().Add(-2 * time.Hour),
+		Status:       SMTPTransactionAccepted,
+	})
+	LogSMTPTransaction(SMTPTransaction{
+		ClientIP:     "127.0.0.1",
+		EnvelopeFrom: "sender@example.com",
+		EnvelopeTo:   []string{"to@example.com", "cc@example.com"},
+		MessageID:    "test@example.com",
+		Status:       SMTPTransactionAccepted,
+	})
+	LogSMTPTransaction(SMTPTransaction{
+		ClientIP:     "10.0.0.1",
+		EnvelopeFrom: "sender@example.com",
+		EnvelopeTo:   []string{"blocked@example.com"},
+		Status:       SMTPTransactionRejected,
+	})
+
+	transactions, total, err := GetSMTPTransactionLog(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 3, "Incorrect number of logged transactions")
+	assertEqual(t, len(transactions), 3, "Incorrect number of returned transactions")
+	assertEqual(t, transactions[0].Status, SMTPTransactionRejected, "Transactions not sorted latest to oldest")
+	assertEqual(t, transactions[1].MessageID, "test@example.com", "Incorrect transaction Message-ID")
+	assertEqual(t, len(transactions[1].EnvelopeTo), 2, "Incorrect number of transaction recipients")
+
+	pruneSMTPTransactions()
+
+	transactions, total, err = GetSMTPTransactionLog(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 2, "Old transactions not pruned")
+	assertEqual(t, transactions[len(transactions)-1].EnvelopeFrom, "sender@example.com", "Incorrect transaction pruned")
+}
+
+func TestSMTPConnectionLog(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing disabled SMTP connection log")
+
+	LogSMTPConnection(SMTPConnection{RemoteAddr: "127.0.0.1"})
+
+	_, total, err := GetRecentConnections(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 0, "Connections should not be logged when disabled")
+
+	t.Log("Testing SMTP connection log")
+
+	config.SMTPConnectionLogEnabled = true
+	defer func() { config.SMTPConnectionLogEnabled = false }()
+
+	LogSMTPConnection(SMTPConnection{
+		RemoteAddr:        "127.0.0.1",
+		ConnectedAt:       time.Now().Add(-time.Minute),
+		MessagesDelivered: 2,
+		BytesReceived:     2048,
+		EHLOHostname:      "client.example.com",
+	})
+	LogSMTPConnection(SMTPConnection{
+		RemoteAddr:   "10.0.0.1",
+		ConnectedAt:  time.Now(),
+		EHLOHostname: "other.example.com",
+	})
+
+	connections, total, err := GetRecentConnections(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 2, "Incorrect number of logged connections")
+	assertEqual(t, len(connections), 2, "Incorrect number of returned connections")
+	assertEqual(t, connections[0].RemoteAddr, "10.0.0.1", "Connections not sorted latest to oldest")
+	assertEqual(t, connections[1].EHLOHostname, "client.example.com", "Incorrect connection EHLO hostname")
+	assertEqual(t, connections[1].MessagesDelivered, 2, "Incorrect connection messages delivered")
+	assertEqual(t, connections[1].BytesReceived, 2048, "Incorrect connection bytes received")
+
+	connections, _, err = GetRecentConnections(1, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(connections), 1, "Incorrect number of paginated connections")
+
+	config.SMTPConnectionLogRetention = 30 * time.Second
+	defer func() { config.SMTPConnectionLogRetention = 24 * time.Hour }()
+
+	pruneSMTPConnections()
+
+	connections, total, err = GetRecentConnections(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, total, 1, "Old connections not pruned")
+	assertEqual(t, connections[0].RemoteAddr, "10.0.0.1", "Incorrect connection pruned")
+}
+
+func TestWebhookFailures(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing webhook failures")
+
+	var attempts int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	delays := webhook.RetryDelays
+	config.WebhookURL = ts.URL
+	webhook.RetryDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond}
+	defer func() {
+		config.WebhookURL = ""
+		webhook.RetryDelays = delays
+	}()
+
+	webhook.Send(map[string]string{"ID": "test"})
+
+	var failures []WebhookFailure
+	var total int
+	for i := 0; i < 100 && total == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		var err error
+		failures, total, err = GetWebhookFailures(0, 10)
+		if err != nil {
+			t.Log("error ", err)
+			t.FailNow()
+		}
+	}
+
+	assertEqual(t, total, 1, "Incorrect number of webhook failures")
+	assertEqual(t, int(atomic.LoadInt64(&attempts)), 5, "Incorrect number of delivery attempts")
+	assertEqual(t, string(failures[0].Payload), `{"ID":"test"}`, "Incorrect webhook failure payload")
+	assertEqual(t, failures[0].LastError, "webhook returned a 503 status", "Incorrect webhook failure error")
+
+	// failures within the retention period are kept
+	pruneWebhookFailures()
+
+	_, total, err := GetWebhookFailures(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 1, "Recent webhook failures pruned")
+
+	if _, err := db.Exec(`UPDATE webhook_failures SET Created = ?`, time.Now().Add(-8*24*time.Hour).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+
+	pruneWebhookFailures()
+
+	_, total, err = GetWebhookFailures(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 0, "Old webhook failures not pruned")
+
+	LogWebhookFailure([]byte(`{"ID":"test"}`), errors.New("webhook returned a 503 status"))
+
+	if err := DeleteWebhookFailures(); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	_, total, err = GetWebhookFailures(0, 10)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, total, 0, "Webhook failures not deleted")
+}
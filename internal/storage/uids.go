@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/leporo/sqlf"
+)
+
+// MessageUID is a message with its IMAP UID, which (unlike the message ID) is numeric
+// and ascending. UIDs are never reused, even once a message is deleted.
+type MessageUID struct {
+	UID     uint32
+	ID      string
+	Created time.Time
+	Size    int
+	Read    bool
+}
+
+// ListMessageUIDs returns all messages with their UIDs, oldest first. UIDs are assigned
+// to new messages as they are listed, and those of deleted messages are released.
+func ListMessageUIDs() ([]MessageUID, error) {
+	results := []MessageUID{}
+
+	if _, err := dbExecWithRetry(db, config.DBBusyRetries, dbBusyRetryDelay, `INSERT OR IGNORE INTO imap_uids (ID)
+		SELECT ID FROM mailbox WHERE ID NOT IN (SELECT ID FROM imap_uids) ORDER BY Created, rowid`); err != nil {
+		return results, err
+	}
+
+	if _, err := dbExecWithRetry(db, config.DBBusyRetries, dbBusyRetryDelay, `DELETE FROM imap_uids WHERE ID NOT IN (SELECT ID FROM mailbox)`); err != nil {
+		return results, err
+	}
+
+	var uid int64
+	var id string
+	var created int64
+	var size, read int
+
+	q := sqlf.From("mailbox m").
+		Join("imap_uids u", "u.ID = m.ID").
+		Select("u.UID").To(&uid).
+		Select("m.ID").To(&id).
+		Select("m.Created").To(&created).
+		Select("m.Size").To(&size).
+		Select("m.Read").To(&read).
+		OrderBy("u.UID ASC")
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		results = append(results, MessageUID{
+			UID:     uint32(uid),
+			ID:      id,
+			Created: time.UnixMilli(created),
+			Size:    size,
+			Read:    read == 1,
+		})
+	}); err != nil {
+		return results, err
+	}
+
+	setDBLastAction()
+
+	return results, nil
+}
@@ -3,10 +3,12 @@ package storage
 import (
 	"net/mail"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/html2text"
 	"github.com/jhillyerd/enmime"
 )
@@ -47,9 +49,9 @@ func createSearchText(env *enmime.Envelope) string {
 	} else {
 		b.WriteString(env.Text + " ")
 	}
-	// add attachment filenames
+	// add attachment filenames & MIME types
 	for _, a := range env.Attachments {
-		b.WriteString(a.FileName + " ")
+		b.WriteString(a.FileName + " " + a.ContentType + " ")
 	}
 
 	d := cleanString(b.String())
@@ -57,6 +59,28 @@ func createSearchText(env *enmime.Envelope) string {
 	return d
 }
 
+// BlockedAttachmentType returns the content type of the first attachment or inline part matching
+// config.BlockedAttachmentTypes (by MIME type or file extension), if any
+func blockedAttachmentType(env *enmime.Envelope) (string, bool) {
+	if len(config.BlockedAttachmentTypes) == 0 {
+		return "", false
+	}
+
+	for _, parts := range [][]*enmime.Part{env.Attachments, env.Inlines} {
+		for _, a := range parts {
+			contentType := strings.ToLower(a.ContentType)
+			ext := strings.ToLower(filepath.Ext(a.FileName))
+			for _, t := range config.BlockedAttachmentTypes {
+				if t == contentType || (ext != "" && t == ext) {
+					return a.ContentType, true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
 // CleanString removes unwanted characters from stored search text and search queries
 func cleanString(str string) string {
 	// replace \uFEFF with space, see https://github.com/golang/go/issues/42274#issuecomment-1017258184
@@ -99,6 +123,21 @@ func inArray(k string, arr []string) bool {
 	return false
 }
 
+// UniqueIDs returns the IDs without duplicates, preserving their order
+func uniqueIDs(ids []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+
+	return unique
+}
+
 // Convert `%` to `%%` for SQL searches
 func escPercentChar(s string) string {
 	return strings.ReplaceAll(s, "%", "%%")
@@ -142,3 +181,43 @@ func escSearch(str string) string {
 
 	return string(dest)
 }
+
+// SenderDomain returns the lowercase domain of the From address, or an empty string if there is none
+func senderDomain(from *mail.Address) string {
+	if from == nil {
+		return ""
+	}
+
+	i := strings.LastIndex(from.Address, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(from.Address[i+1:])
+}
+
+// PreferPlainText returns whether the plain text alternative of a multipart/alternative
+// message should be displayed by default instead of the HTML, based on config.PreferredContentTypes
+func preferPlainText(env *enmime.Envelope) bool {
+	if env.HTML == "" || contentTypeRank("text/plain") >= contentTypeRank("text/html") {
+		return false
+	}
+
+	return env.Root.DepthMatchFirst(func(p *enmime.Part) bool {
+		return p.ContentType == "multipart/alternative" && p.DepthMatchFirst(func(c *enmime.Part) bool {
+			return c.ContentType == "text/plain" && c.Disposition != "attachment"
+		}) != nil
+	}) != nil
+}
+
+// ContentTypeRank returns the position of a content type in config.PreferredContentTypes,
+// with unlisted types ranked last
+func contentTypeRank(t string) int {
+	for i, c := range config.PreferredContentTypes {
+		if c == t {
+			return i
+		}
+	}
+
+	return len(config.PreferredContentTypes)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// ErrValidationRule is returned by Store() when a message matches one of config.ValidationRules
+// with a reject action
+var ErrValidationRule = errors.New("message rejected by validation rule")
+
+// ApplyValidationRules matches the raw message against each of config.ValidationRules in turn,
+// returning an error for the first matching rule with a reject action
+func applyValidationRules(body []byte) error {
+	var header mail.Header
+	var content []byte
+
+	// the headers & body are only parsed (without decoding) if required by a rule
+	parsed := false
+	parse := func() {
+		if parsed {
+			return
+		}
+		parsed = true
+
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			logger.Log().Warnf("[db] unable to parse message headers for validation: %s", err.Error())
+			return
+		}
+
+		header = msg.Header
+		content, _ = io.ReadAll(msg.Body)
+	}
+
+	for _, r := range config.ValidationRules {
+		var value []byte
+
+		switch r.Field {
+		case "raw":
+			value = body
+		case "body":
+			parse()
+			value = content
+		default:
+			parse()
+			value = []byte(strings.Join(header[r.Field], "\n"))
+		}
+
+		if !r.Regexp.Match(value) {
+			continue
+		}
+
+		parse()
+		sender := header.Get("From")
+
+		if r.Action == "warn" {
+			logger.Log().Warnf("[db] message from %s matched validation rule: %s", sender, r.Name)
+			continue
+		}
+
+		logger.Log().Warnf("[db] rejected message from %s, matched validation rule: %s", sender, r.Name)
+
+		return fmt.Errorf("%w (%s)", ErrValidationRule, r.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// verboseSnippetLength is the maximum length of the snippet printed by printMessageSummary
+const verboseSnippetLength = 80
+
+// PrintMessageSummary writes a short summary of a new message to w, used by config.SMTPDevVerbose
+// to follow incoming messages in the terminal
+func printMessageSummary(w io.Writer, m *MessageSummary) {
+	from := ""
+	if m.From != nil {
+		from = verboseAddress(m.From)
+	}
+
+	to := []string{}
+	for _, a := range m.To {
+		to = append(to, verboseAddress(a))
+	}
+
+	snippet := []rune(m.Snippet)
+	if len(snippet) > verboseSnippetLength {
+		snippet = append(snippet[:verboseSnippetLength-3], []rune("...")...)
+	}
+
+	fmt.Fprintf(w, "[message] %s (%d bytes)\n", m.Created.Format("2006/01/02 15:04:05"), m.Size)
+	fmt.Fprintf(w, "  From:    %s\n", from)
+	fmt.Fprintf(w, "  To:      %s\n", strings.Join(to, ", "))
+	fmt.Fprintf(w, "  Subject: %s\n", m.Subject)
+	fmt.Fprintf(w, "  Snippet: %s\n", string(snippet))
+}
+
+// VerboseAddress returns the address with the unencoded name (if set)
+func verboseAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+
+	return fmt.Sprintf("%s <%s>", a.Name, a.Address)
+}
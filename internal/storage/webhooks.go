@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// LogWebhookFailure records a webhook delivery which failed all retries
+func LogWebhookFailure(payload []byte, err error) {
+	if _, dbErr := sqlf.InsertInto("webhook_failures").
+		Set("Created", time.Now().UnixMilli()).
+		Set("Payload", string(payload)).
+		Set("LastError", err.Error()).
+		ExecAndClose(nil, db); dbErr != nil {
+		logger.Log().Errorf("[db] error logging webhook failure: %s", dbErr.Error())
+	}
+}
+
+// GetWebhookFailures returns a subset of the failed webhook deliveries, sorted latest to oldest,
+// as well as the total number of failed deliveries
+func GetWebhookFailures(start, limit int) ([]WebhookFailure, int, error) {
+	results := []WebhookFailure{}
+	var total int
+
+	q := sqlf.From("webhook_failures").
+		Select("ID, Created, Payload, LastError").
+		OrderBy("Created DESC", "ID DESC").
+		Limit(limit).
+		Offset(start)
+
+	if err := q.QueryAndClose(nil, db, func(row *sql.Rows) {
+		var f WebhookFailure
+		var created int64
+		var payload string
+
+		if err := row.Scan(&f.ID, &created, &payload, &f.LastError); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		f.Created = time.UnixMilli(created)
+		f.Payload = []byte(payload)
+
+		results = append(results, f)
+	}); err != nil {
+		return results, 0, err
+	}
+
+	if err := sqlf.From("webhook_failures").
+		Select("COUNT(*)").To(&total).
+		QueryRowAndClose(nil, db); err != nil {
+		return results, 0, err
+	}
+
+	return results, total, nil
+}
+
+// DeleteWebhookFailures deletes all failed webhook deliveries
+func DeleteWebhookFailures() error {
+	_, err := sqlf.DeleteFrom("webhook_failures").ExecAndClose(nil, db)
+	if err == nil {
+		logger.Log().Debug("[db] deleted all webhook failures")
+	}
+
+	return err
+}
+
+// PruneWebhookFailures removes failed webhook deliveries older than config.WebhookFailureLogRetention
+func pruneWebhookFailures() {
+	if config.WebhookFailureLogRetention <= 0 {
+		return
+	}
+
+	before := time.Now().Add(-config.WebhookFailureLogRetention).UnixMilli()
+
+	res, err := sqlf.DeleteFrom("webhook_failures").
+		Where("Created < ?", before).
+		ExecAndClose(nil, db)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Log().Debugf("[db] pruned %d webhook failure log entries", n)
+	}
+}
@@ -0,0 +1,68 @@
+// Package tls builds TLS configurations for the Mailpit servers
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// BuildSNITLSConfig returns a TLS configuration selecting the certificate by the requested
+// server name (SNI). Domains may contain a leading wildcard, eg: *.example.com.
+// A certificate without a domain is used as the default, else the first certificate.
+func BuildSNITLSConfig(certs []config.TLSCertConfig) (*tls.Config, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no TLS certificates provided")
+	}
+
+	domains := map[string]*tls.Certificate{}
+	var fallback *tls.Certificate
+
+	for _, c := range certs {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		domain := strings.ToLower(c.Domain)
+		if domain == "" {
+			fallback = &cert
+			continue
+		}
+
+		if _, exists := domains[domain]; !exists {
+			domains[domain] = &cert
+		}
+
+		if fallback == nil {
+			fallback = &cert
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return matchCertificate(domains, strings.ToLower(hello.ServerName), fallback), nil
+		},
+	}, nil
+}
+
+// MatchCertificate returns the certificate for the server name, trying an exact match
+// before a wildcard match of the parent domain
+func matchCertificate(domains map[string]*tls.Certificate, name string, fallback *tls.Certificate) *tls.Certificate {
+	name = strings.TrimSuffix(name, ".")
+
+	if cert, ok := domains[name]; ok {
+		return cert
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := domains["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+
+	return fallback
+}
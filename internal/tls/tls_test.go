@@ -0,0 +1,99 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestBuildSNITLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	certs := []config.TLSCertConfig{
+		{Domain: "mail.example.com"},
+		{Domain: "*.example.org"},
+	}
+
+	for i := range certs {
+		certs[i].CertFile, certs[i].KeyFile = writeCertificate(t, dir, certs[i].Domain)
+	}
+
+	c, err := BuildSNITLSConfig(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"mail.example.com": "mail.example.com",
+		"MAIL.example.com": "mail.example.com",
+		"www.example.org":  "*.example.org",
+		"example.org":      "mail.example.com", // wildcards do not match the parent domain
+		"unknown.test":     "mail.example.com",
+	} {
+		cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if leaf.Subject.CommonName != expected {
+			t.Errorf("%s: expected certificate %s, got %s", name, expected, leaf.Subject.CommonName)
+		}
+	}
+
+	if _, err := BuildSNITLSConfig([]config.TLSCertConfig{{Domain: "missing.test", CertFile: "missing.crt", KeyFile: "missing.key"}}); err == nil {
+		t.Error("expected an error for missing certificate files")
+	}
+}
+
+// WriteCertificate writes a self-signed certificate & key for the domain, returning the file paths
+func writeCertificate(t *testing.T, dir, domain string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, filepath.Base(domain))
+	if err := os.WriteFile(name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return name + ".crt", name + ".key"
+}
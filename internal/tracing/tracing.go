@@ -0,0 +1,97 @@
+// Package tracing exports OpenTelemetry traces to an OTLP endpoint
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceIDHeader is the message header used to propagate the trace context, containing
+// either a W3C traceparent value or a 32 character hexadecimal trace ID
+const TraceIDHeader = "X-Trace-ID"
+
+var (
+	initOnce sync.Once
+
+	traceIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Init configures the OpenTelemetry tracer provider to export spans to config.OTLPEndpoint.
+// The default (no-op) tracer provider is used if no endpoint is configured.
+func Init() {
+	initOnce.Do(func() {
+		if config.OTLPEndpoint == "" {
+			return
+		}
+
+		exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+		if err != nil {
+			logger.Log().Errorf("[tracing] %s", err.Error())
+			return
+		}
+
+		res := resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("mailpit"),
+			semconv.ServiceVersion(config.Version),
+		)
+
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+		))
+
+		logger.Log().Infof("[tracing] exporting traces to %s", config.OTLPEndpoint)
+	})
+}
+
+// Tracer returns the named tracer
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// ContextFromTraceID returns a context with the remote span context of a TraceIDHeader value,
+// or a background context if the value is empty or invalid
+func ContextFromTraceID(v string) context.Context {
+	ctx := context.Background()
+
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return ctx
+	}
+
+	if traceIDRe.MatchString(v) {
+		traceID, err := trace.TraceIDFromHex(v)
+		if err != nil {
+			return ctx
+		}
+
+		// a span ID is required for a valid parent, so generate one for the remote caller
+		var spanID trace.SpanID
+		if _, err := rand.Read(spanID[:]); err != nil {
+			return ctx
+		}
+
+		return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+			Remote:     true,
+		}))
+	}
+
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": v})
+}
@@ -0,0 +1,36 @@
+package tracing
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestContextFromTraceID(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "",
+		"invalid":                          "",
+		"4BF92F3577B34DA6A3CE929D0E0E4736": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+
+	for v, expected := range tests {
+		sc := trace.SpanContextFromContext(ContextFromTraceID(v))
+
+		if expected == "" {
+			if sc.IsValid() {
+				t.Errorf("expected no span context for %q", v)
+			}
+			continue
+		}
+
+		if !sc.IsValid() || !sc.IsRemote() {
+			t.Errorf("expected a valid remote span context for %q", v)
+			continue
+		}
+
+		if sc.TraceID().String() != expected {
+			t.Errorf("incorrect trace ID for %q, expected %s, got %s", v, expected, sc.TraceID().String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package watcher reloads runtime configuration files when they are changed
+package watcher
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Debounce is the delay after the last change to a file before it is reloaded,
+// as editors often trigger several events when saving a file
+var Debounce = 250 * time.Millisecond
+
+// Watch starts watching the configured password files, reloading the credentials
+// whenever a file changes. It does nothing if config.WatchConfigFiles is disabled.
+func Watch() {
+	if !config.WatchConfigFiles {
+		return
+	}
+
+	// map of watched files to the services they contain credentials for,
+	// as several services may share the same password file
+	files := map[string][]string{}
+	for service, file := range map[string]string{
+		"ui":   config.UIAuthFile,
+		"smtp": config.SMTPAuthFile,
+		"pop3": config.POP3AuthFile,
+	} {
+		if file == "" {
+			continue
+		}
+
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			logger.Log().Errorf("[watcher] %s", err.Error())
+			continue
+		}
+
+		files[abs] = append(files[abs], service)
+	}
+
+	if len(files) == 0 {
+		return
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Log().Errorf("[watcher] %s", err.Error())
+		return
+	}
+
+	// watch the parent directories as many editors replace files rather than writing to them
+	dirs := map[string]bool{}
+	for file := range files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+
+		if err := w.Add(dir); err != nil {
+			logger.Log().Errorf("[watcher] %s", err.Error())
+			continue
+		}
+
+		dirs[dir] = true
+		logger.Log().Debugf("[watcher] watching %s", dir)
+	}
+
+	go watch(w, files)
+}
+
+func watch(w *fsnotify.Watcher, files map[string][]string) {
+	defer w.Close()
+
+	timers := map[string]*time.Timer{}
+
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			services, found := files[filepath.Clean(event.Name)]
+			if !found || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+
+			file := filepath.Clean(event.Name)
+
+			if t, exists := timers[file]; exists {
+				t.Reset(Debounce)
+				continue
+			}
+
+			timers[file] = time.AfterFunc(Debounce, func() {
+				for _, service := range services {
+					reload(service, file)
+				}
+			})
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+
+			logger.Log().Errorf("[watcher] %s", err.Error())
+		}
+	}
+}
+
+// Reload the credentials for a service from the changed file
+func reload(service, file string) {
+	n, err := auth.ReloadAuthFile(service, file)
+	if err != nil {
+		logger.Log().Errorf("[%s] error reloading password file %s: %s", service, file, err.Error())
+		return
+	}
+
+	logger.Log().Infof("[%s] reloaded %d credentials from %s", service, n, file)
+}
@@ -0,0 +1,76 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+func TestWatchSharedFile(t *testing.T) {
+	logger.NoLogging = true
+	Debounce = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "passwords")
+
+	if err := os.WriteFile(file, []byte("old:{PLAIN}pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auth.SetSMTPAuth("old:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.SetPOP3Auth("old:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	config.WatchConfigFiles = true
+	config.SMTPAuthFile = file
+	config.POP3AuthFile = file
+	defer func() {
+		config.WatchConfigFiles = false
+		config.SMTPAuthFile = ""
+		config.POP3AuthFile = ""
+		auth.SMTPCredentials = nil
+		auth.POP3Credentials = nil
+	}()
+
+	Watch()
+
+	// a file written in place reloads every service using it
+	if err := os.WriteFile(file, []byte("written:{PLAIN}pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	assertReloaded(t, "written")
+
+	// as does a file replaced by a rename, as many editors do
+	tmp := filepath.Join(dir, "passwords.tmp")
+	if err := os.WriteFile(tmp, []byte("renamed:{PLAIN}pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+
+	assertReloaded(t, "renamed")
+}
+
+func assertReloaded(t *testing.T, user string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if auth.SMTPCredentials.Match(user, "pass") && auth.POP3Credentials.Match(user, "pass") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("expected SMTP & POP3 credentials to be reloaded for %q", user)
+}
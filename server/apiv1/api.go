@@ -2,19 +2,30 @@
 package apiv1
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/mail"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/cspcheck"
+	"github.com/axllent/mailpit/internal/export"
 	"github.com/axllent/mailpit/internal/htmlcheck"
 	"github.com/axllent/mailpit/internal/linkcheck"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/relay"
 	"github.com/axllent/mailpit/internal/spamassassin"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/tools"
@@ -29,7 +40,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	//
 	// # List messages
 	//
-	// Returns messages from the mailbox ordered from newest to oldest.
+	// Returns messages from the mailbox, ordered from newest to oldest unless sorted with `sort` & `order`.
 	//
 	//	Produces:
 	//	- application/json
@@ -49,13 +60,113 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	//	    required: false
 	//	    type: integer
 	//	    default: 50
+	//	  + name: tags
+	//	    in: query
+	//	    description: Only return messages with these tags (comma-separated)
+	//	    required: false
+	//	    type: string
+	//	  + name: tag_mode
+	//	    in: query
+	//	    description: Whether messages must match `any` or `all` of the tags (always `all` with `unread` or `has-attachments`)
+	//	    required: false
+	//	    type: string
+	//	    default: any
+	//	  + name: unread
+	//	    in: query
+	//	    description: Only return unread (`true`) or read (`false`) messages (not supported with `header`, `content_type` or `from_domain`)
+	//	    required: false
+	//	    type: boolean
+	//	  + name: has-attachments
+	//	    in: query
+	//	    description: Only return messages with (`true`) or without (`false`) attachments (not supported with `header`, `content_type` or `from_domain`)
+	//	    required: false
+	//	    type: boolean
+	//	  + name: header
+	//	    in: query
+	//	    description: Only return messages where this indexed header (see `--indexed-headers`) matches `value`
+	//	    required: false
+	//	    type: string
+	//	  + name: value
+	//	    in: query
+	//	    description: Header value to match, required with `header`
+	//	    required: false
+	//	    type: string
+	//	  + name: content_type
+	//	    in: query
+	//	    description: Only return messages, attachments or inline parts of this content type (`*` wildcards supported)
+	//	    required: false
+	//	    type: string
+	//	  + name: from_domain
+	//	    in: query
+	//	    description: Only return messages sent from this domain
+	//	    required: false
+	//	    type: string
+	//	  + name: cursor
+	//	    in: query
+	//	    description: Return the messages following the `next_cursor` of a previous page, replaces `start` (not supported with other filters). This is considerably faster than `start` for large mailboxes.
+	//	    required: false
+	//	    type: string
+	//	  + name: sort
+	//	    in: query
+	//	    description: "Sort field: created, size, subject or from (not supported with other filters or `cursor`)"
+	//	    required: false
+	//	    type: string
+	//	    default: created
+	//	  + name: order
+	//	    in: query
+	//	    description: "Sort order: asc or desc"
+	//	    required: false
+	//	    type: string
+	//	    default: desc
 	//
 	//	Responses:
 	//		200: MessagesSummaryResponse
 	//		default: ErrorResponse
-	start, limit := getStartLimit(r)
+	start, limit, err := getStartLimit(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	filtered := false
+	for _, p := range []string{"header", "content_type", "from_domain", "tags", "unread", "has-attachments"} {
+		if r.URL.Query().Get(p) != "" {
+			filtered = true
+		}
+	}
+
+	filter := storage.ListFilter{}
+	if filter.Unread, err = queryBool(r, "unread"); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+	if filter.HasAttachments, err = queryBool(r, "has-attachments"); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if cursor != "" && filtered {
+		httpError(w, "Error: cursor pagination is not supported with filters")
+		return
+	}
 
-	messages, err := storage.List(start, limit)
+	if filter.Unread != nil || filter.HasAttachments != nil {
+		for _, p := range []string{"header", "content_type", "from_domain"} {
+			if r.URL.Query().Get(p) != "" {
+				httpError(w, "Error: unread & has-attachments are not supported with "+p)
+				return
+			}
+		}
+	}
+
+	sorted := r.URL.Query().Get("sort") != "" || r.URL.Query().Get("order") != ""
+	if sorted && (cursor != "" || filtered) {
+		httpError(w, "Error: sorting is not supported with filters or cursor pagination")
+		return
+	}
+
+	sortField, sortDir, err := getSortOrder(r)
 	if err != nil {
 		httpError(w, err.Error())
 		return
@@ -63,28 +174,112 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 
 	stats := storage.StatsGet()
 
+	var messages []storage.MessageSummary
+	messagesCount := stats.Total
+
+	if header := r.URL.Query().Get("header"); header != "" {
+		messages, messagesCount, err = storage.GetMessagesByCustomHeader(header, r.URL.Query().Get("value"), start, limit)
+	} else if ct := r.URL.Query().Get("content_type"); ct != "" {
+		messages, messagesCount, err = storage.ListByContentType(ct, start, limit)
+	} else if domain := r.URL.Query().Get("from_domain"); domain != "" {
+		messages, messagesCount, err = storage.ListBySenderDomain(domain, start, limit)
+	} else if filter.Unread != nil || filter.HasAttachments != nil {
+		if tags := r.URL.Query().Get("tags"); tags != "" {
+			if mode := strings.ToLower(r.URL.Query().Get("tag_mode")); mode != "" && mode != "all" {
+				httpError(w, "Error: tag_mode must be `all` with unread or has-attachments")
+				return
+			}
+			filter.Tags = strings.Split(tags, ",")
+		}
+		messages, err = storage.ListWithFilter(start, limit, filter)
+		if err == nil {
+			messagesCount, err = storage.CountWithFilter(filter)
+		}
+	} else if tags := r.URL.Query().Get("tags"); tags != "" {
+		messages, messagesCount, err = storage.ListByMultipleTags(strings.Split(tags, ","), r.URL.Query().Get("tag_mode"), start, limit)
+	} else if cursor != "" {
+		var c messageCursor
+		c, err = decodeMessageCursor(cursor)
+		if err == nil {
+			start = 0
+			messages, err = storage.ListAfter(c.Created, c.ID, limit)
+		}
+	} else if sorted {
+		messages, err = storage.ListSorted(start, limit, sortField, sortDir)
+	} else {
+		messages, err = storage.List(start, limit)
+	}
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
 	var res MessagesSummary
 
+	if !filtered && !sorted && len(messages) > 0 && len(messages) == limit {
+		res.NextCursor = encodeMessageCursor(messages[len(messages)-1])
+	}
+
 	res.Start = start
 	res.Messages = messages
 	res.Count = len(messages) // legacy - now undocumented in API specs
 	res.Total = stats.Total
 	res.Unread = stats.Unread
-	res.Tags = stats.Tags
-	res.MessagesCount = stats.Total
+	res.Tags = tagNames(stats.Tags)
+	res.MessagesCount = messagesCount
 
 	bytes, _ := json.Marshal(res)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
-// Search returns the latest messages as JSON
-func Search(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/search messages MessagesSummary
+// MessageIDExists returns whether a message with the given Message-ID exists, along with its database ID
+func MessageIDExists(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/exists messages MessageExists
 	//
-	// # Search messages
+	// # Message-ID exists
+	//
+	// Returns whether a message with the given Message-ID header exists, and the database ID
+	// of the latest matching message. This allows a message to be polled for by its Message-ID.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: MessageExistsResponse
+	//		default: ErrorResponse
+	messageID := strings.TrimSpace(r.URL.Query().Get("message_id"))
+	if messageID == "" {
+		httpError(w, "Error: no message_id")
+		return
+	}
+
+	id, err := storage.GetIDByMessageID(messageID)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	res := MessageExists{
+		Exists: id != "",
+		ID:     id,
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetSMTPTransactions returns a paginated list of logged SMTP transactions as JSON
+func GetSMTPTransactions(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/smtp/transactions application SMTPTransactions
 	//
-	// Returns the latest messages matching a search.
+	// # SMTP transaction log
+	//
+	// Returns the logged SMTP transactions ordered from newest to oldest.
+	// The transaction log must be enabled with `--smtp-transaction-log`.
 	//
 	//	Produces:
 	//	- application/json
@@ -92,11 +287,6 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	//	Schemes: http, https
 	//
 	//	Parameters:
-	//	  + name: query
-	//	    in: query
-	//	    description: Search query
-	//	    required: true
-	//	    type: string
 	//	  + name: start
 	//	    in: query
 	//	    description: Pagination offset
@@ -111,69 +301,49 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	//	    default: 50
 	//
 	//	Responses:
-	//		200: MessagesSummaryResponse
+	//		200: SMTPTransactionLogResponse
 	//		default: ErrorResponse
-	search := strings.TrimSpace(r.URL.Query().Get("query"))
-	if search == "" {
-		httpError(w, "Error: no search query")
+	start, limit, err := getStartLimit(r)
+	if err != nil {
+		httpError(w, err.Error())
 		return
 	}
 
-	start, limit := getStartLimit(r)
-
-	messages, results, err := storage.Search(search, start, limit)
+	transactions, total, err := storage.GetSMTPTransactionLog(start, limit)
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	stats := storage.StatsGet()
-
-	var res MessagesSummary
-
-	res.Start = start
-	res.Messages = messages
-	res.Count = len(messages) // legacy - now undocumented in API specs
-	res.Total = stats.Total   // total messages in mailbox
-	res.MessagesCount = results
-	res.Unread = stats.Unread
-	res.Tags = stats.Tags
+	res := SMTPTransactionLog{
+		Total:        total,
+		Start:        start,
+		Transactions: transactions,
+	}
 
 	bytes, _ := json.Marshal(res)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
-// DeleteSearch will delete all messages matching a search
-func DeleteSearch(w http.ResponseWriter, r *http.Request) {
-	// swagger:route DELETE /api/v1/search messages DeleteSearch
+// PauseSMTP (method: POST) rejects new SMTP connections until resumed
+func PauseSMTP(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route POST /api/v1/smtp/pause application PauseSMTP
 	//
-	// # Delete messages by search
+	// # Pause SMTP server
 	//
-	// Delete all messages matching a search.
+	// Rejects new SMTP connections with a temporary (421) error until the SMTP server is resumed,
+	// so clients retry later. Existing connections are not affected.
 	//
 	//	Produces:
-	//	- application/json
+	//	- text/plain
 	//
 	//	Schemes: http, https
 	//
-	//	Parameters:
-	//	  + name: query
-	//	    in: query
-	//	    description: Search query
-	//	    required: true
-	//	    type: string
-	//
 	//	Responses:
 	//		200: OKResponse
 	//		default: ErrorResponse
-	search := strings.TrimSpace(r.URL.Query().Get("query"))
-	if search == "" {
-		httpError(w, "Error: no search query")
-		return
-	}
-
-	if err := storage.DeleteSearch(search); err != nil {
+	if err := smtpd.PauseSMTP(); err != nil {
 		httpError(w, err.Error())
 		return
 	}
@@ -182,117 +352,92 @@ func DeleteSearch(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
-// GetMessage (method: GET) returns the Message as JSON
-func GetMessage(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID} message Message
-	//
-	// # Get message summary
+// ResumeSMTP (method: POST) resumes accepting new SMTP connections after pausing
+func ResumeSMTP(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route POST /api/v1/smtp/resume application ResumeSMTP
 	//
-	// Returns the summary of a message, marking the message as read.
+	// # Resume SMTP server
 	//
-	// The ID can be set to `latest` to return the latest message.
+	// Resumes accepting new SMTP connections after the SMTP server has been paused.
 	//
 	//	Produces:
-	//	- application/json
+	//	- text/plain
 	//
 	//	Schemes: http, https
 	//
-	//	Parameters:
-	//	  + name: ID
-	//	    in: path
-	//	    description: Message database ID or "latest"
-	//	    required: true
-	//	    type: string
-	//
 	//	Responses:
-	//		200: Message
+	//		200: OKResponse
 	//		default: ErrorResponse
-
-	vars := mux.Vars(r)
-
-	id := vars["id"]
-
-	if id == "latest" {
-		var err error
-		id, err = storage.LatestID(r)
-		if err != nil {
-			w.WriteHeader(404)
-			fmt.Fprint(w, err.Error())
-			return
-		}
-	}
-
-	msg, err := storage.GetMessage(id)
-	if err != nil {
-		fourOFour(w)
+	if err := smtpd.ResumeSMTP(); err != nil {
+		httpError(w, err.Error())
 		return
 	}
 
-	bytes, _ := json.Marshal(msg)
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(bytes)
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
 }
 
-// DownloadAttachment (method: GET) returns the attachment data
-func DownloadAttachment(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/part/{PartID} message Attachment
+// GetSMTPConnections returns a paginated list of logged SMTP connections as JSON
+func GetSMTPConnections(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/smtp/connections application SMTPConnections
 	//
-	// # Get message attachment
+	// # SMTP connection log
 	//
-	// This will return the attachment part using the appropriate Content-Type.
+	// Returns the logged inbound SMTP connections ordered from newest to oldest.
+	// The connection log must be enabled with `--smtp-connection-log`.
 	//
 	//	Produces:
-	//	- application/*
-	//	- image/*
-	//	- text/*
+	//	- application/json
 	//
 	//	Schemes: http, https
 	//
 	//	Parameters:
-	//	  + name: ID
-	//	    in: path
-	//	    description: Message database ID
-	//	    required: true
-	//	    type: string
-	//	  + name: PartID
-	//	    in: path
-	//	    description: Attachment part ID
-	//	    required: true
-	//	    type: string
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
 	//
 	//	Responses:
-	//		200: BinaryResponse
+	//		200: SMTPConnectionLogResponse
 	//		default: ErrorResponse
+	start, limit, err := getStartLimit(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
 
-	vars := mux.Vars(r)
-
-	id := vars["id"]
-	partID := vars["partID"]
-
-	a, err := storage.GetAttachmentPart(id, partID)
+	connections, total, err := storage.GetRecentConnections(start, limit)
 	if err != nil {
-		fourOFour(w)
+		httpError(w, err.Error())
 		return
 	}
-	fileName := a.FileName
-	if fileName == "" {
-		fileName = a.ContentID
+
+	res := SMTPConnectionLog{
+		Total:       total,
+		Start:       start,
+		Connections: connections,
 	}
 
-	w.Header().Add("Content-Type", a.ContentType)
-	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
-	_, _ = w.Write(a.Content)
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
 
-// GetHeaders (method: GET) returns the message headers as JSON
-func GetHeaders(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/headers message Headers
-	//
-	// # Get message headers
+// GetWebhookFailures returns a paginated list of failed webhook deliveries as JSON
+func GetWebhookFailures(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/webhook-failures application WebhookFailures
 	//
-	// Returns the message headers as an array.
+	// # Webhook failures
 	//
-	// The ID can be set to `latest` to return the latest message headers.
+	// Returns the webhook deliveries which failed all retries, ordered from newest to oldest.
 	//
 	//	Produces:
 	//	- application/json
@@ -300,58 +445,1767 @@ func GetHeaders(w http.ResponseWriter, r *http.Request) {
 	//	Schemes: http, https
 	//
 	//	Parameters:
-	//	  + name: ID
-	//	    in: path
-	//	    description: Message database ID or "latest"
-	//	    required: true
-	//	    type: string
-	//
-	//	Responses:
-	//	  200: MessageHeaders
-	//	  default: ErrorResponse
-
-	vars := mux.Vars(r)
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: WebhookFailureLogResponse
+	//		default: ErrorResponse
+	start, limit, err := getStartLimit(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	failures, total, err := storage.GetWebhookFailures(start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	res := WebhookFailureLog{
+		Total:    total,
+		Start:    start,
+		Failures: failures,
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteWebhookFailures (method: DELETE) deletes all failed webhook deliveries
+func DeleteWebhookFailures(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route DELETE /api/v1/webhook-failures application DeleteWebhookFailures
+	//
+	// # Delete webhook failures
+	//
+	// Deletes all logged webhook deliveries which failed all retries.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+	if err := storage.DeleteWebhookFailures(); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// VacuumDatabase (method: POST) will vacuum the database to reclaim space from deleted messages
+func VacuumDatabase(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route POST /api/v1/admin/vacuum application VacuumDatabase
+	//
+	// # Vacuum database
+	//
+	// Vacuums the database to reclaim disk space from deleted messages. This is done automatically
+	// when the database is idle, so is generally not required.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	if err := storage.Vacuum(); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// BackupDatabase (method: GET) returns a copy of the database
+func BackupDatabase(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/admin/backup application BackupDatabase
+	//
+	// # Backup database
+	//
+	// Returns a consistent copy of the SQLite database, which can be taken while Mailpit is running.
+	// The copy is compacted, so may be smaller than the database file.
+	//
+	//	Produces:
+	//	- application/vnd.sqlite3
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"mailpit-backup.db\"")
+
+	if err := storage.BackupDB(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		httpError(w, err.Error())
+	}
+}
+
+// RegenerateSnippets (method: POST) regenerates all message snippets, streaming the progress as server-sent events
+func RegenerateSnippets(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/admin/regen-snippets application RegenerateSnippets
+	//
+	// # Regenerate snippets
+	//
+	// Regenerates the snippet of every message from the raw message, streaming the progress as
+	// server-sent events until completed. Regeneration continues if the client disconnects.
+	// Only one regeneration can run at a time.
+	//
+	//	Produces:
+	//	- text/event-stream
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: RegenerateSnippetsResponse
+	//		default: ErrorResponse
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Error: streaming is not supported")
+		return
+	}
+
+	p := RegenerateSnippetsProgress{Running: true, Total: int(storage.CountTotal())}
+	progress := make(chan int)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- storage.RegenerateSnippets(context.Background(), progress)
+	}()
+
+	// the progress channel is closed straight away if regeneration is already running
+	processed, ok := <-progress
+
+	var err error
+	if !ok {
+		err = <-done
+		if errors.Is(err, storage.ErrRegeneratingSnippets) {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	connected := true
+	send := func() {
+		if !connected {
+			return
+		}
+		data, _ := json.Marshal(p)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			connected = false
+			return
+		}
+		flusher.Flush()
+	}
+
+	if ok {
+		p.Processed = processed
+		send()
+
+		// regeneration continues if the client disconnects, so progress is always read until done
+		for n := range progress {
+			p.Processed = n
+			send()
+		}
+
+		err = <-done
+	}
+
+	p.Running = false
+	if err != nil {
+		p.Error = err.Error()
+	}
+	send()
+}
+
+// GetMessageSummaries (method: POST) returns the summaries of the provided message IDs as JSON
+func GetMessageSummaries(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/messages/summaries messages GetMessageSummaries
+	//
+	// # Get message summaries
+	//
+	// Returns the summaries of the provided message database IDs, in the order requested.
+	// IDs which do not exist are ignored.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: MessageSummariesResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+	var data struct {
+		IDs []string
+	}
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	summaries, err := storage.GetMessageSummaries(data.IDs)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(summaries)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// Search returns the latest messages as JSON
+func Search(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/search messages MessagesSummary
+	//
+	// # Search messages
+	//
+	// Returns the messages matching a search, ordered from newest to oldest unless sorted with `sort` & `order`.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: query
+	//	    in: query
+	//	    description: Search query
+	//	    required: true
+	//	    type: string
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//	  + name: highlight
+	//	    in: query
+	//	    description: Include the locations of the search terms in the Subject, Snippet & From fields of each message (`Highlights`)
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: sort
+	//	    in: query
+	//	    description: "Sort field: created, size, subject or from"
+	//	    required: false
+	//	    type: string
+	//	    default: created
+	//	  + name: order
+	//	    in: query
+	//	    description: "Sort order: asc or desc"
+	//	    required: false
+	//	    type: string
+	//	    default: desc
+	//
+	//	Responses:
+	//		200: MessagesSummaryResponse
+	//		default: ErrorResponse
+	search := strings.TrimSpace(r.URL.Query().Get("query"))
+	if search == "" {
+		httpError(w, "Error: no search query")
+		return
+	}
+
+	start, limit, err := getStartLimit(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	h := r.URL.Query().Get("highlight")
+	highlight := h == "true" || h == "1"
+
+	var messages []storage.MessageSummary
+	var highlighted []storage.HighlightedSummary
+	var results int
+
+	sortField, sortDir, err := getSortOrder(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if highlight {
+		highlighted, results, err = storage.SearchHighlightedSorted(search, start, limit, sortField, sortDir)
+	} else {
+		messages, results, err = storage.SearchSorted(search, start, limit, sortField, sortDir)
+	}
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if start == 0 {
+		// only record the first page of results in the search history
+		storage.AddSearchHistory(search, results)
+	}
+
+	stats := storage.StatsGet()
+
+	var res MessagesSummary
+
+	res.Start = start
+	res.Messages = messages
+	res.Count = len(messages) + len(highlighted) // legacy - now undocumented in API specs
+	res.Total = stats.Total                      // total messages in mailbox
+	res.MessagesCount = results
+	res.Unread = stats.Unread
+	res.Tags = tagNames(stats.Tags)
+
+	var bytes []byte
+	if highlight {
+		bytes, _ = json.Marshal(HighlightedMessagesSummary{MessagesSummary: res, Messages: highlighted})
+	} else {
+		bytes, _ = json.Marshal(res)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteSearch will delete all messages matching a search
+func DeleteSearch(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/search messages DeleteSearch
+	//
+	// # Delete messages by search
+	//
+	// Delete all messages matching a search.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: query
+	//	    in: query
+	//	    description: Search query
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+	search := strings.TrimSpace(r.URL.Query().Get("query"))
+	if search == "" {
+		httpError(w, "Error: no search query")
+		return
+	}
+
+	if err := storage.DeleteSearch(search); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GetSearchHistory (method: GET) returns the most recent distinct search queries as JSON
+func GetSearchHistory(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/search/history messages GetSearchHistory
+	//
+	// # Get search history
+	//
+	// Returns a JSON array of the most recent distinct search queries, latest first.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 10
+	//
+	//	Responses:
+	//		200: ArrayResponse
+	//		default: ErrorResponse
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			httpError(w, "Error: invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	queries, err := storage.GetRecentSearches(limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(queries)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// GetSearchHistoryStats (method: GET) returns the most recent distinct search queries with their usage stats as JSON
+func GetSearchHistoryStats(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/search/history/stats messages GetSearchHistoryStats
+	//
+	// # Get search history stats
+	//
+	// Returns the most recent distinct search queries, latest first, along with the number of times
+	// each query has been used and its average number of results.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 10
+	//
+	//	Responses:
+	//		200: SearchHistoryStatsResponse
+	//		default: ErrorResponse
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			httpError(w, "Error: invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	stats, err := storage.GetSearchHistoryWithStats(limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// ClearSearchHistory (method: DELETE) deletes the search history
+func ClearSearchHistory(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route DELETE /api/v1/search/history messages ClearSearchHistory
+	//
+	// # Clear search history
+	//
+	// Delete all recorded search queries.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+	if err := storage.ClearSearchHistory(); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GetSavedSearches (method: GET) returns all saved searches as JSON
+func GetSavedSearches(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/saved-searches messages GetSavedSearches
+	//
+	// # Get saved searches
+	//
+	// Returns all saved search queries, sorted by name.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SavedSearchesResponse
+	//		default: ErrorResponse
+	searches, err := storage.GetSavedSearches()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(searches)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// AddSavedSearch (method: POST) saves a named search query
+func AddSavedSearch(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/saved-searches messages AddSavedSearch
+	//
+	// # Save a search
+	//
+	// Saves a search query under a unique name, for a maximum of 50 saved searches.
+	// A 409 response is returned if a saved search with the same name (case-insensitive) already exists.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SavedSearchResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	search, err := storage.AddSavedSearch(data.Name, data.Query)
+	if errors.Is(err, storage.ErrSavedSearchExists) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	b, err := json.Marshal(search)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// DeleteSavedSearch (method: DELETE) deletes a saved search
+func DeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/saved-searches/{ID} messages DeleteSavedSearch
+	//
+	// # Delete a saved search
+	//
+	// Deletes a saved search query.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	if err := storage.DeleteSavedSearch(vars["id"]); err != nil {
+		if errors.Is(err, storage.ErrSavedSearchNotFound) {
+			fourOFour(w)
+			return
+		}
+
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GetMessage (method: GET) returns the Message as JSON
+func GetMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID} message Message
+	//
+	// # Get message summary
+	//
+	// Returns the summary of a message, marking the message as read.
+	//
+	// The ID can be set to `latest` to return the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: Message
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(msg)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DownloadAttachment (method: GET) returns the attachment data
+func DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/part/{PartID} message Attachment
+	//
+	// # Get message attachment
+	//
+	// This will return the attachment part using the appropriate Content-Type.
+	//
+	//	Produces:
+	//	- application/*
+	//	- image/*
+	//	- text/*
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//	  + name: PartID
+	//	    in: path
+	//	    description: Attachment part ID
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	partID := vars["partID"]
+
+	a, err := storage.GetAttachmentPart(id, partID)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+	fileName := a.FileName
+	if fileName == "" {
+		fileName = a.ContentID
+	}
+
+	w.Header().Add("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
+	_, _ = w.Write(a.Content)
+}
+
+// DownloadRawPart (method: GET) returns the decoded content of any message part as a download
+func DownloadRawPart(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/part/{PartID}/raw message RawPart
+	//
+	// # Download message part
+	//
+	// This will return the decoded content of any message part (including text & HTML parts)
+	// as a file download, named after the file name of the part if set. Text parts are returned as UTF-8.
+	//
+	//	Produces:
+	//	- application/*
+	//	- image/*
+	//	- text/*
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//	  + name: PartID
+	//	    in: path
+	//	    description: Message part ID
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	partID := vars["partID"]
+
+	content, contentType, fileName, err := storage.GetMessageRawPart(id, partID)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	// parts without a file name (eg: text & HTML parts) are named after the part ID
+	if fileName == "" {
+		fileName = "part-" + partID + partExtension(contentType)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	_, _ = w.Write(content)
+}
+
+// GetMessageHTMLPreviewURL returns the URL of the self-contained HTML preview of a message
+func GetMessageHTMLPreviewURL(id string) string {
+	return config.Webroot + "api/v1/message/" + id + "/render"
+}
+
+// RenderMessageHTML (method: GET) returns the self-contained HTML of a message
+func RenderMessageHTML(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/render message RenderMessageHTML
+	//
+	// # Render message HTML
+	//
+	// Returns the HTML part of the message with all inline (cid:) images embedded as data URIs,
+	// so the HTML can be displayed without further requests to Mailpit.
+	// The response is sandboxed via the Content-Security-Policy header and is not cached.
+	//
+	// The ID can be set to `latest` to return the latest message.
+	//
+	//	Produces:
+	//	- text/html
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: HTMLResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			fourOFour(w)
+			return
+		}
+	}
+
+	html, err := storage.GetMessageHTMLWithCIDResolved(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", config.MessagePreviewCSP)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(html))
+}
+
+// GetHeaders (method: GET) returns the message headers as JSON
+func GetHeaders(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/headers message Headers
+	//
+	// # Get message headers
+	//
+	// Returns the message headers as an array.
+	//
+	// The ID can be set to `latest` to return the latest message headers.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: MessageHeaders
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	data, err := storage.GetMessageRawWithContext(r.Context(), id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	reader := bytes.NewReader(data)
+	m, err := mail.ReadMessage(reader)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(m.Header)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetCustomHeaders (method: GET) returns the stored X- headers of a message
+func GetCustomHeaders(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/custom-headers message CustomHeaders
+	//
+	// # Get message X- headers
+	//
+	// Returns the custom `X-` headers of the message, eg: `X-Campaign-ID`. These are stored
+	// separately when the message is received, so unlike the message headers endpoint the raw
+	// message is not read. Messages received before upgrading to this version have no stored headers.
+	//
+	// The ID can be set to `latest` to return the latest message X- headers.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: MessageHeaders
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	headers, err := storage.GetMessageHeaders(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(headers)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageImages (method: GET) returns the images referenced in the message HTML
+func GetMessageImages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/images message MessageImages
+	//
+	// # Get message HTML images
+	//
+	// Returns all images referenced in the message HTML, including inline (cid:) images,
+	// data URIs and external images. External images are not fetched.
+	//
+	// The ID can be set to `latest` to return the latest message images.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: MessageImagesResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	images, err := storage.GetMessageHTMLImages(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(images)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageDelivery (method: GET) returns the SMTP delivery details of a message
+func GetMessageDelivery(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/delivery message MessageDelivery
+	//
+	// # Get message delivery details
+	//
+	// Returns the SMTP envelope sender & recipients, client IP address and session ID of a message,
+	// along with the hops parsed from its Received headers (oldest first) and the total transit time
+	// between the oldest & newest hops. Hops with unparsable dates have a zero date and are excluded
+	// from the transit time. The envelope & session details are blank for messages which were not received via SMTP.
+	//
+	// The ID can be set to `latest` to return the latest message delivery details.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: DeliveryDetailsResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	details, err := storage.GetMessageDeliveryDetails(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(details)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageAttachments (method: GET) returns the attachment summaries of a message
+func GetMessageAttachments(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/attachments message MessageAttachments
+	//
+	// # Get message attachments
+	//
+	// Returns the attachment summaries of a message, without marking the message as read.
+	//
+	// The ID can be set to `latest` to return the latest message attachments.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: AttachmentsResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	attachments, err := storage.GetAttachmentsByMessageID(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(attachments)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageNavigation (method: GET) returns the IDs of the previous & next messages in a sort order
+func GetMessageNavigation(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/nav message MessageNavigation
+	//
+	// # Get message navigation
+	//
+	// Returns the database IDs of the messages immediately before and after a message
+	// when all messages are sorted in the given order. A null ID is returned if there
+	// is no previous or next message.
+	//
+	// The ID can be set to `latest` to return the navigation for the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: MessageNavigationResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	prev, next, err := storage.GetMessageNavigation(id, r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	res := MessageNavigation{
+		Prev: prev,
+		Next: next,
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageThread (method: GET) returns the conversation of a message as JSON
+func GetMessageThread(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/thread message MessageThread
+	//
+	// # Get message thread
+	//
+	// Returns the summaries of all messages in the same conversation as the message (including
+	// the message itself), grouped by the In-Reply-To & References headers and sorted oldest to latest.
+	//
+	// The ID can be set to `latest` to return the thread of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: MessageSummariesResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	thread, err := storage.GetThread(id)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(thread)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DownloadRaw (method: GET) returns the full email source as plain text
+func DownloadRaw(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/raw message Raw
+	//
+	// # Get message source
+	//
+	// Returns the full email source as plain text.
+	//
+	// The ID can be set to `latest` to return the latest message source.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: TextResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	dl := r.FormValue("dl")
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	data, err := storage.GetMessageRawWithContext(r.Context(), id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if dl == "1" {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
+	}
+	_, _ = w.Write(data)
+}
+
+// DownloadMbox (method: GET) returns the selected or all messages as an mbox file
+func DownloadMbox(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/download messages DownloadMbox
+	//
+	// # Download messages as mbox
+	//
+	// Returns the selected messages (in the order provided), or all messages (oldest first) if no IDs
+	// are provided, as a single mbox file. If any of the provided messages do not exist then an error is returned.
+	//
+	//	Produces:
+	//	- application/mbox
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ids
+	//	    in: query
+	//	    description: Comma-separated message database IDs
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	ids := []string{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"mailpit-export.mbox\"")
+
+	sw := &streamWriter{ResponseWriter: w}
+
+	var err error
+	if len(ids) > 0 {
+		err = storage.ExportMbox(sw, ids)
+	} else {
+		err = storage.ExportAllMbox(sw)
+	}
+
+	if err != nil {
+		streamError(sw, err)
+	}
+}
+
+// DownloadZIP (method: GET) returns the selected or all messages as a ZIP archive of EML files & attachments
+func DownloadZIP(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/download-zip messages DownloadZIP
+	//
+	// # Download messages as ZIP
+	//
+	// Returns the selected messages (in the order provided), or all messages (oldest first) if `ids` is `all`,
+	// as a ZIP archive. Each message is stored as `<ID>.eml`, and its attachments as `<ID>/<filename>`.
+	// If any of the provided messages do not exist then an error is returned.
+	//
+	//	Produces:
+	//	- application/zip
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ids
+	//	    in: query
+	//	    description: Comma-separated message database IDs, or `all`
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	ids := []string{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 1 && ids[0] == "all" {
+		var err error
+		ids, err = storage.AllMessageIDs()
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	} else if len(ids) == 0 {
+		httpError(w, "Error: no IDs provided")
+		return
+	}
+
+	writeZIP(w, ids)
+}
+
+// DownloadSelectedZIP (method: POST) returns the provided messages as a ZIP archive of EML files & attachments
+func DownloadSelectedZIP(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/messages/download-zip messages DownloadSelectedZIP
+	//
+	// # Download selected messages as ZIP
+	//
+	// Returns the provided messages (in the order provided) as a ZIP archive. Each message is stored
+	// as `<ID>.eml`, and its attachments as `<ID>/<filename>`. This is the same as the GET request,
+	// but avoids URL length limits when downloading many messages.
+	// If any of the provided messages do not exist then an error is returned.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/zip
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	var data downloadZIPRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if len(data.IDs) == 0 {
+		httpError(w, "Error: no IDs provided")
+		return
+	}
+
+	writeZIP(w, data.IDs)
+}
+
+// WriteZIP writes the ZIP archive response of the messages
+func writeZIP(w http.ResponseWriter, ids []string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"mailpit-export.zip\"")
+
+	sw := &streamWriter{ResponseWriter: w}
+	if err := export.ExportZIP(sw, ids); err != nil {
+		streamError(sw, err)
+	}
+}
+
+// ImportMessages (method: POST) imports the messages of an uploaded mbox or EML file
+func ImportMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/messages/import messages ImportMessages
+	//
+	// # Import messages
+	//
+	// Imports the messages of an uploaded mbox file, or a single message (EML file). The file type
+	// is detected by the `.mbox` or `.eml` file extension, or otherwise by the file contents.
+	// Messages with a Message-ID which already exists in the mailbox are skipped.
+	// The progress of an mbox import can be followed via `/api/v1/messages/import/progress`.
+	//
+	//	Consumes:
+	//	- multipart/form-data
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: file
+	//	    in: formData
+	//	    description: The mbox or EML file
+	//	    required: true
+	//	    type: file
+	//
+	//	Responses:
+	//		200: ImportResultResponse
+	//		default: ErrorResponse
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		httpError(w, "Error: no file uploaded")
+		return
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	isMbox := ext == ".mbox"
+	if ext != ".mbox" && ext != ".eml" {
+		prefix, _ := br.Peek(5)
+		isMbox = string(prefix) == "From "
+	}
+
+	res := ImportResult{}
+
+	if isMbox {
+		res.Imported, res.Skipped, err = storage.ImportMbox(br)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	} else {
+		body, err := io.ReadAll(br)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		id, err := storage.ImportEML(body)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		if id == "" {
+			res.Skipped = 1
+		} else {
+			res.Imported = 1
+		}
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetImportProgress (method: GET) streams the progress of the current mbox import as server-sent events
+func GetImportProgress(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/import/progress messages ImportProgress
+	//
+	// # Get import progress
+	//
+	// Streams the progress of the current mbox import as server-sent events, until the import has
+	// completed. If no import is running then the result of the last import is sent.
+	//
+	//	Produces:
+	//	- text/event-stream
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ImportProgressResponse
+	//		default: ErrorResponse
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Error: streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		p := storage.GetImportProgress()
+		data, _ := json.Marshal(p)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		if !p.Running {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-	id := vars["id"]
+// DeleteMessages (method: DELETE) deletes all messages matching IDS.
+func DeleteMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/messages messages DeleteMessages
+	//
+	// # Delete messages
+	//
+	// Delete individual or all messages. If no IDs are provided then all messages are deleted,
+	// apart from starred messages.
+	// If any of the provided messages do not exist then no messages are deleted.
+	// If Mailpit is configured to prevent deleting all messages, then the confirmation token must be
+	// provided via the `X-Confirm-Delete` header to delete all messages.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
 
-	if id == "latest" {
-		var err error
-		id, err = storage.LatestID(r)
-		if err != nil {
-			w.WriteHeader(404)
-			fmt.Fprint(w, err.Error())
+	decoder := json.NewDecoder(r.Body)
+	var data struct {
+		IDs []string
+	}
+	err := decoder.Decode(&data)
+	if err != nil || len(data.IDs) == 0 {
+		if config.PreventDeleteAll && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Confirm-Delete")), []byte(config.DeleteAllConfirmToken)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "A valid X-Confirm-Delete header is required to delete all messages")
+			return
+		}
+
+		if err := storage.DeleteAllMessages(); err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	} else {
+		if err := storage.DeleteMessages(data.IDs); err != nil {
+			httpError(w, err.Error())
 			return
 		}
 	}
 
-	data, err := storage.GetMessageRaw(id)
+	w.Header().Add("Content-Type", "application/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// SetReadStatus (method: PUT) will update the status to Read/Unread for all provided IDs
+// If no IDs are provided then all messages are updated.
+func SetReadStatus(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/messages messages SetReadStatus
+	//
+	// # Set read status
+	//
+	// If no IDs are provided then all messages are updated.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data struct {
+		Read bool
+		IDs  []string
+	}
+
+	err := decoder.Decode(&data)
 	if err != nil {
-		fourOFour(w)
+		httpError(w, err.Error())
 		return
 	}
 
-	reader := bytes.NewReader(data)
-	m, err := mail.ReadMessage(reader)
+	ids := data.IDs
+
+	if len(ids) == 0 {
+		if data.Read {
+			err := storage.MarkAllRead()
+			if err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		} else {
+			err := storage.MarkAllUnread()
+			if err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		}
+	} else {
+		if data.Read {
+			if err := storage.MarkMessagesRead(ids); err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		} else {
+			if err := storage.MarkMessagesUnread(ids); err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		}
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GetStarredMessages (method: GET) returns a paginated list of starred messages as JSON
+func GetStarredMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/starred messages GetStarredMessages
+	//
+	// # List starred messages
+	//
+	// Returns starred messages ordered from newest to oldest.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: MessageSummariesResponse
+	//		default: ErrorResponse
+
+	start, limit, err := getStartLimit(r)
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	bytes, _ := json.Marshal(m.Header)
+	messages, err := storage.ListStarred(start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
 
+	bytes, _ := json.Marshal(messages)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
-// DownloadRaw (method: GET) returns the full email source as plain text
-func DownloadRaw(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/raw message Raw
+// StarMessage (method: PUT) stars a message
+func StarMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/message/{ID}/star message StarMessage
 	//
-	// # Get message source
+	// # Star message
 	//
-	// Returns the full email source as plain text.
+	// Stars a message. Starred messages are preserved when deleting all messages.
 	//
-	// The ID can be set to `latest` to return the latest message source.
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	if err := storage.StarMessage(mux.Vars(r)["id"]); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// UnstarMessage (method: DELETE) removes the star from a message
+func UnstarMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/message/{ID}/star message UnstarMessage
+	//
+	// # Unstar message
+	//
+	// Removes the star from a message.
 	//
 	//	Produces:
 	//	- text/plain
@@ -361,49 +2215,107 @@ func DownloadRaw(w http.ResponseWriter, r *http.Request) {
 	//	Parameters:
 	//	  + name: ID
 	//	    in: path
-	//	    description: Message database ID or "latest"
+	//	    description: Message database ID
 	//	    required: true
 	//	    type: string
 	//
 	//	Responses:
-	//		200: TextResponse
+	//		200: OKResponse
 	//		default: ErrorResponse
 
-	vars := mux.Vars(r)
+	if err := storage.UnstarMessage(mux.Vars(r)["id"]); err != nil {
+		httpError(w, err.Error())
+		return
+	}
 
-	id := vars["id"]
-	dl := r.FormValue("dl")
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
 
-	if id == "latest" {
-		var err error
-		id, err = storage.LatestID(r)
-		if err != nil {
-			w.WriteHeader(404)
-			fmt.Fprint(w, err.Error())
-			return
-		}
+// GetAllTags (method: GET) will get all tags currently in use
+func GetAllTags(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/tags tags GetAllTags
+	//
+	// # Get all current tags
+	//
+	// Returns a JSON array of all unique message tags.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ArrayResponse
+	//		default: ErrorResponse
+
+	tags := storage.GetAllTags()
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// SetMessageTags (method: PUT) will set the tags for all provided IDs
+func SetMessageTags(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags tags SetTags
+	//
+	// # Set message tags
+	//
+	// This will overwrite any existing tags for selected message database IDs. To remove all tags from a message, pass an empty tags array.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data struct {
+		Tags []string
+		IDs  []string
 	}
 
-	data, err := storage.GetMessageRaw(id)
+	err := decoder.Decode(&data)
 	if err != nil {
-		fourOFour(w)
+		httpError(w, err.Error())
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	if dl == "1" {
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
-	}
-	_, _ = w.Write(data)
+	ids := data.IDs
+
+	if len(ids) > 0 {
+		for _, id := range ids {
+			if err := storage.SetMessageTags(id, data.Tags); err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		}
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
 }
 
-// DeleteMessages (method: DELETE) deletes all messages matching IDS.
-func DeleteMessages(w http.ResponseWriter, r *http.Request) {
-	// swagger:route DELETE /api/v1/messages messages DeleteMessages
+// RenameTag (method: PUT) will rename a tag, merging it into an existing tag with the new name
+func RenameTag(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/{Tag} tags RenameTag
 	//
-	// # Delete messages
+	// # Rename a tag
 	//
-	// Delete individual or all messages. If no IDs are provided then all messages are deleted.
+	// Renames an existing tag. If a tag with the new name already exists, the tag is merged into it.
 	//
 	//	Consumes:
 	//	- application/json
@@ -417,37 +2329,36 @@ func DeleteMessages(w http.ResponseWriter, r *http.Request) {
 	//		200: OKResponse
 	//		default: ErrorResponse
 
+	tag := mux.Vars(r)["tag"]
+
 	decoder := json.NewDecoder(r.Body)
+
 	var data struct {
-		IDs []string
+		Name string
 	}
-	err := decoder.Decode(&data)
-	if err != nil || len(data.IDs) == 0 {
-		if err := storage.DeleteAllMessages(); err != nil {
-			httpError(w, err.Error())
-			return
-		}
-	} else {
-		for _, id := range data.IDs {
-			if err := storage.DeleteOneMessage(id); err != nil {
-				httpError(w, err.Error())
-				return
-			}
-		}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
 	}
 
-	w.Header().Add("Content-Type", "application/plain")
+	if err := storage.RenameTag(tag, data.Name); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
 	_, _ = w.Write([]byte("ok"))
 }
 
-// SetReadStatus (method: PUT) will update the status to Read/Unread for all provided IDs
-// If no IDs are provided then all messages are updated.
-func SetReadStatus(w http.ResponseWriter, r *http.Request) {
-	// swagger:route PUT /api/v1/messages messages SetReadStatus
+// MergeTags (method: POST) will merge tags into a single (new or existing) tag
+func MergeTags(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/tags/merge tags MergeTags
 	//
-	// # Set read status
+	// # Merge tags
 	//
-	// If no IDs are provided then all messages are updated.
+	// Merges the tags into the target tag, which is created if it does not exist.
+	// Messages with more than one of the tags will only be tagged once with the target tag.
 	//
 	//	Consumes:
 	//	- application/json
@@ -464,125 +2375,134 @@ func SetReadStatus(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	var data struct {
-		Read bool
-		IDs  []string
+		Tags   []string
+		Target string
 	}
 
-	err := decoder.Decode(&data)
-	if err != nil {
+	if err := decoder.Decode(&data); err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	ids := data.IDs
-
-	if len(ids) == 0 {
-		if data.Read {
-			err := storage.MarkAllRead()
-			if err != nil {
-				httpError(w, err.Error())
-				return
-			}
-		} else {
-			err := storage.MarkAllUnread()
-			if err != nil {
-				httpError(w, err.Error())
-				return
-			}
-		}
-	} else {
-		if data.Read {
-			for _, id := range ids {
-				if err := storage.MarkRead(id); err != nil {
-					httpError(w, err.Error())
-					return
-				}
-			}
-		} else {
-			for _, id := range ids {
-				if err := storage.MarkUnread(id); err != nil {
-					httpError(w, err.Error())
-					return
-				}
-			}
-		}
+	if err := storage.MergeTags(data.Tags, data.Target); err != nil {
+		httpError(w, err.Error())
+		return
 	}
 
 	w.Header().Add("Content-Type", "text/plain")
 	_, _ = w.Write([]byte("ok"))
 }
 
-// GetAllTags (method: GET) will get all tags currently in use
-func GetAllTags(w http.ResponseWriter, _ *http.Request) {
-	// swagger:route GET /api/v1/tags tags GetAllTags
+// ForwardMessage (method: POST) will forward a message unchanged via an external SMTP server.
+func ForwardMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/message/{ID}/forward message ForwardMessage
 	//
-	// # Get all current tags
+	// # Forward message
 	//
-	// Returns a JSON array of all unique message tags.
+	// Forward a message unchanged (excluding any Bcc header) via an external SMTP server, for instance to a
+	// staging SMTP relay. If `smtpAddr` is not set, the pre-configured SMTP relay server is used.
+	// Other SMTP servers must be allowed with `--smtp-forward-allowed-hosts`.
 	//
-	//	Produces:
+	//	Consumes:
 	//	- application/json
 	//
+	//	Produces:
+	//	- text/plain
+	//
 	//	Schemes: http, https
 	//
 	//	Responses:
-	//		200: ArrayResponse
+	//		200: OKResponse
 	//		default: ErrorResponse
 
-	tags := storage.GetAllTags()
+	vars := mux.Vars(r)
 
-	data, err := json.Marshal(tags)
-	if err != nil {
+	id := vars["id"]
+
+	if _, err := storage.GetMessageRawWithContext(r.Context(), id); err != nil {
+		fourOFour(w)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	data := forwardMessageRequestBody{}
+
+	if err := decoder.Decode(&data); err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(data)
+	if len(data.To) == 0 {
+		httpError(w, "No valid addresses found")
+		return
+	}
+
+	for _, to := range data.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			httpError(w, "Invalid email address: "+to)
+			return
+		}
+	}
+
+	if data.SMTPAddr == "" && !config.ReleaseEnabled {
+		httpError(w, "No SMTP relay server configured")
+		return
+	}
+
+	if err := relay.ForwardMessage(id, data.To, data.SMTPAddr); err != nil {
+		if errors.Is(err, relay.ErrForwardHostNotAllowed) {
+			httpError(w, err.Error())
+			return
+		}
+		logger.Log().Errorf("[smtp] error forwarding message: %s", err.Error())
+		httpError(w, "SMTP error: "+err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
 }
 
-// SetMessageTags (method: PUT) will set the tags for all provided IDs
-func SetMessageTags(w http.ResponseWriter, r *http.Request) {
-	// swagger:route PUT /api/v1/tags tags SetTags
-	//
-	// # Set message tags
+// ResubmitMessage (method: POST) will store a new copy of a message with the current tagging rules
+func ResubmitMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/message/{ID}/resubmit message ResubmitMessage
 	//
-	// This will overwrite any existing tags for selected message database IDs. To remove all tags from a message, pass an empty tags array.
+	// # Resubmit message
 	//
-	//	Consumes:
-	//	- application/json
+	// Stores a new copy of the raw message, processed as a newly received message with the current
+	// tagging rules applied. The copy keeps the original SMTP envelope, and is not relayed or forwarded.
+	// The original message is not modified. Messages larger than `--resubmit-max-size` cannot be resubmitted.
 	//
 	//	Produces:
 	//	- text/plain
 	//
 	//	Schemes: http, https
 	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//
 	//	Responses:
 	//		200: OKResponse
 	//		default: ErrorResponse
 
-	decoder := json.NewDecoder(r.Body)
+	vars := mux.Vars(r)
 
-	var data struct {
-		Tags []string
-		IDs  []string
-	}
+	id := vars["id"]
 
-	err := decoder.Decode(&data)
-	if err != nil {
-		httpError(w, err.Error())
+	if _, err := storage.GetMessageRawWithContext(r.Context(), id); err != nil {
+		fourOFour(w)
 		return
 	}
 
-	ids := data.IDs
-
-	if len(ids) > 0 {
-		for _, id := range ids {
-			if err := storage.SetMessageTags(id, data.Tags); err != nil {
-				httpError(w, err.Error())
-				return
-			}
-		}
+	if err := storage.ResubmitMessage(id); err != nil {
+		logger.Log().Errorf("[db] error resubmitting message %s: %s", id, err.Error())
+		httpError(w, err.Error())
+		return
 	}
 
 	w.Header().Add("Content-Type", "text/plain")
@@ -613,7 +2533,7 @@ func ReleaseMessage(w http.ResponseWriter, r *http.Request) {
 
 	id := vars["id"]
 
-	msg, err := storage.GetMessageRaw(id)
+	msg, err := storage.GetMessageRawWithContext(r.Context(), id)
 	if err != nil {
 		fourOFour(w)
 		return
@@ -817,11 +2737,69 @@ func LinkCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	statusCodes := []int{}
+	for _, l := range summary.Links {
+		statusCodes = append(statusCodes, l.StatusCode)
+	}
+	if err := storage.SetLinkCheckResult(msg.ID, statusCodes, summary.CheckedAt()); err != nil {
+		logger.Log().Errorf("[db] error storing link check result: %s", err.Error())
+	}
+
 	bytes, _ := json.Marshal(summary)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
+// CSPAnalysis returns the Content-Security-Policy analysis of a message's HTML
+func CSPAnalysis(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/csp-analysis Other CSPAnalysis
+	//
+	// # CSP analysis
+	//
+	// Returns the content of the message HTML which would be blocked by a strict Content-Security-Policy,
+	// similar to that enforced by most email clients, along with recommendations. This is static analysis
+	// only, no remote resources are fetched.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: CSPReport
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	report, err := cspcheck.AnalyzeCSP(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(report)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
 // SpamAssassinCheck returns a summary of SpamAssassin results (if enabled)
 func SpamAssassinCheck(w http.ResponseWriter, r *http.Request) {
 	// swagger:route GET /api/v1/message/{ID}/sa-check Other SpamAssassinCheck
@@ -855,7 +2833,7 @@ func SpamAssassinCheck(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	msg, err := storage.GetMessageRaw(id)
+	msg, err := storage.GetMessageRawWithContext(r.Context(), id)
 	if err != nil {
 		fourOFour(w)
 		return
@@ -881,6 +2859,32 @@ func fourOFour(w http.ResponseWriter) {
 	fmt.Fprint(w, "404 page not found")
 }
 
+// StreamWriter records whether a streamed response has started, after which
+// an error can no longer be returned to the client
+type streamWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	s.written = true
+	return s.ResponseWriter.Write(b)
+}
+
+// StreamError returns an error message (400 response) if nothing has been streamed yet,
+// otherwise the error is logged and the connection aborted so the client does not
+// mistake a truncated download for a complete one
+func streamError(w *streamWriter, err error) {
+	if !w.written {
+		w.Header().Del("Content-Disposition")
+		httpError(w, err.Error())
+		return
+	}
+
+	logger.Log().Errorf("[api] error streaming response: %s", err.Error())
+	panic(http.ErrAbortHandler)
+}
+
 // HTTPError returns a basic error message (400 response)
 func httpError(w http.ResponseWriter, msg string) {
 	w.Header().Set("Referrer-Policy", "no-referrer")
@@ -890,10 +2894,43 @@ func httpError(w http.ResponseWriter, msg string) {
 	fmt.Fprint(w, msg)
 }
 
-// Get the start and limit based on query params. Defaults to 0, 50
-func getStartLimit(req *http.Request) (start int, limit int) {
+// TagNames returns the names of the mailbox tag stats
+func tagNames(stats []storage.TagStat) []string {
+	names := []string{}
+	for _, t := range stats {
+		names = append(names, t.Name)
+	}
+
+	return names
+}
+
+// PartExtension returns a file extension for a MIME content type, if known
+func partExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	// mime.ExtensionsByType() returns alphabetically sorted results (eg: .htm before .html)
+	switch mediaType {
+	case "text/plain":
+		return ".txt"
+	case "text/html":
+		return ".html"
+	}
+
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+
+	return ""
+}
+
+// Get the start and limit based on query params. Defaults to 0, config.APIDefaultPageSize.
+// An error is returned if the limit exceeds config.APIMaxPageSize.
+func getStartLimit(req *http.Request) (start int, limit int, err error) {
 	start = 0
-	limit = 50
+	limit = config.APIDefaultPageSize
 
 	s := req.URL.Query().Get("start")
 	if n, err := strconv.Atoi(s); err == nil && n > 0 {
@@ -905,7 +2942,71 @@ func getStartLimit(req *http.Request) (start int, limit int) {
 		limit = n
 	}
 
-	return start, limit
+	if limit > config.APIMaxPageSize {
+		return start, limit, fmt.Errorf("limit cannot exceed %d", config.APIMaxPageSize)
+	}
+
+	return start, limit, nil
+}
+
+// Get the sort field & direction based on the `sort` & `order` query params.
+// Defaults to storage.SortCreated, storage.SortDesc.
+func getSortOrder(req *http.Request) (storage.SortField, storage.SortDir, error) {
+	field, err := storage.ParseSortField(req.URL.Query().Get("sort"))
+	if err != nil {
+		return "", "", err
+	}
+
+	dir, err := storage.ParseSortDir(req.URL.Query().Get("order"))
+	if err != nil {
+		return "", "", err
+	}
+
+	return field, dir, nil
+}
+
+// QueryBool returns the boolean value of a query parameter, or nil if it is not set
+func queryBool(req *http.Request, name string) (*bool, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %s", name, v)
+	}
+
+	return &b, nil
+}
+
+// MessageCursor is the keyset of the last message of a page, encoded as an opaque cursor
+type messageCursor struct {
+	Created int64  `json:"c"`
+	ID      string `json:"i"`
+}
+
+// EncodeMessageCursor returns the cursor for the messages following the message
+func encodeMessageCursor(m storage.MessageSummary) string {
+	b, _ := json.Marshal(messageCursor{Created: m.Created.UnixMilli(), ID: m.ID})
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeMessageCursor returns the keyset of a cursor
+func decodeMessageCursor(s string) (messageCursor, error) {
+	c := messageCursor{}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return c, errors.New("invalid cursor")
+	}
+
+	return c, nil
 }
 
 // GetOptions returns a blank response
@@ -0,0 +1,30 @@
+package apiv1
+
+import (
+	"net/http"
+
+	"github.com/axllent/mailpit/server/websockets"
+)
+
+// Events streams real-time events as server-sent events
+func Events(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/events application Events
+	//
+	// # Event stream
+	//
+	// Streams real-time events as server-sent events, an alternative to the web UI websocket for
+	// clients or proxies which do not support websockets. Each event is sent as `data: <json>`,
+	// with the same `Type` (eg: new, prune, stats) & `Data` as the websocket events.
+	// A keepalive comment is sent every 15 seconds.
+	//
+	//	Produces:
+	//	- text/event-stream
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TextResponse
+	//		default: ErrorResponse
+
+	websockets.ServeSSE(w, r)
+}
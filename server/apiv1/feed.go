@@ -0,0 +1,259 @@
+package apiv1
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// feedLimit is the number of messages included in the RSS & Atom feeds
+const feedLimit = 50
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Self          atomLink  `xml:"atom:link"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	Author      string  `xml:"author,omitempty"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Summary string      `xml:"summary"`
+	Updated string      `xml:"updated"`
+}
+
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+// GetMessagesRSS returns the latest messages as an RSS 2.0 feed
+func GetMessagesRSS(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/rss messages GetMessagesRSS
+	//
+	// # RSS feed
+	//
+	// Returns the 50 most recent messages as an RSS 2.0 feed, optionally filtered by a tag.
+	//
+	//	Produces:
+	//	- application/rss+xml
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: tag
+	//	    in: query
+	//	    description: Only include messages with this tag
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//		200: XMLResponse
+	//		default: ErrorResponse
+
+	messages, err := feedMessages(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	base := feedBaseURL(r)
+
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         feedTitle(r),
+			Self:          atomLink{Href: base + strings.TrimPrefix(r.URL.RequestURI(), config.Webroot), Rel: "self", Type: "application/rss+xml"},
+			Link:          base,
+			Description:   "The latest messages received by Mailpit",
+			LastBuildDate: feedUpdated(messages).Format(time.RFC1123Z),
+			Items:         []rssItem{},
+		},
+	}
+
+	for _, m := range messages {
+		link := base + "view/" + m.ID
+		item := rssItem{
+			Title:       m.Subject,
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			Description: m.Snippet,
+			PubDate:     m.Created.Format(time.RFC1123Z),
+		}
+
+		if m.From != nil && m.From.Address != "" {
+			item.Author = m.From.Address
+			if m.From.Name != "" {
+				item.Author += " (" + m.From.Name + ")"
+			}
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	writeXML(w, "application/rss+xml", feed)
+}
+
+// GetMessagesAtom returns the latest messages as an Atom 1.0 feed
+func GetMessagesAtom(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/atom messages GetMessagesAtom
+	//
+	// # Atom feed
+	//
+	// Returns the 50 most recent messages as an Atom 1.0 feed, optionally filtered by a tag.
+	//
+	//	Produces:
+	//	- application/atom+xml
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: tag
+	//	    in: query
+	//	    description: Only include messages with this tag
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//		200: XMLResponse
+	//		default: ErrorResponse
+
+	messages, err := feedMessages(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	base := feedBaseURL(r)
+	self := base + strings.TrimPrefix(r.URL.RequestURI(), config.Webroot)
+
+	feed := atomFeed{
+		Title: feedTitle(r),
+		ID:    self,
+		Links: []atomLink{
+			{Href: self, Rel: "self", Type: "application/atom+xml"},
+			{Href: base, Rel: "alternate", Type: "text/html"},
+		},
+		Updated: feedUpdated(messages).Format(time.RFC3339),
+		Entries: []atomEntry{},
+	}
+
+	for _, m := range messages {
+		link := base + "view/" + m.ID
+		entry := atomEntry{
+			Title:   m.Subject,
+			ID:      link,
+			Link:    atomLink{Href: link, Rel: "alternate", Type: "text/html"},
+			Summary: m.Snippet,
+			Updated: m.Created.Format(time.RFC3339),
+		}
+
+		if m.From != nil && m.From.Address != "" {
+			entry.Author = &atomAuthor{Name: m.From.Name, Email: m.From.Address}
+			if entry.Author.Name == "" {
+				entry.Author.Name = m.From.Address
+			}
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	writeXML(w, "application/atom+xml", feed)
+}
+
+// FeedMessages returns the latest messages for a feed, filtered by the optional tag
+func feedMessages(r *http.Request) ([]storage.MessageSummary, error) {
+	f := storage.ListFilter{}
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		f.Tags = []string{tag}
+	}
+
+	return storage.ListWithFilter(0, feedLimit, f)
+}
+
+// FeedBaseURL returns the absolute URL of the web UI, including the webroot
+func feedBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + config.Webroot
+}
+
+// FeedTitle returns the title of the feed
+func feedTitle(r *http.Request) string {
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		return "Mailpit: " + tag
+	}
+
+	return "Mailpit"
+}
+
+// FeedUpdated returns the time of the latest message, or the current time if there are no messages
+func feedUpdated(messages []storage.MessageSummary) time.Time {
+	if len(messages) > 0 {
+		return messages[0].Created
+	}
+
+	return time.Now()
+}
+
+// WriteXML writes the XML document with the given content type
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(b)
+}
@@ -3,8 +3,12 @@ package apiv1
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/axllent/mailpit/internal/stats"
+	"github.com/axllent/mailpit/internal/storage"
 )
 
 // AppInfo returns some basic details about the running app, and latest release.
@@ -31,3 +35,213 @@ func AppInfo(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
+
+// GetMessageStats returns the message totals, optionally counting the messages received within a period
+func GetMessageStats(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/stats application GetMessageStats
+	//
+	// # Get message stats
+	//
+	// Returns the message totals. The number of messages received within a period can be returned
+	// using either the `since` duration (eg: `1h` or `30m`), or `between` two RFC3339 times separated
+	// by a comma. With `since`, the messages can also be grouped into periods of the `granularity`
+	// duration (aligned to the Unix epoch) to show the message volume over time.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: since
+	//	    in: query
+	//	    description: Count messages received within the duration, eg: 1h
+	//	    required: false
+	//	    type: string
+	//	  + name: between
+	//	    in: query
+	//	    description: Count messages received between two RFC3339 times, eg: 2024-01-01T00:00:00Z,2024-01-02T00:00:00Z
+	//	    required: false
+	//	    type: string
+	//	  + name: granularity
+	//	    in: query
+	//	    description: Group messages received within `since` into periods of this duration, eg: 1h (max 1000 periods)
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//		200: MessageStatsResponse
+	//		default: ErrorResponse
+	since := r.URL.Query().Get("since")
+	between := r.URL.Query().Get("between")
+
+	if since != "" && between != "" {
+		httpError(w, "Error: since and between cannot be used together")
+		return
+	}
+
+	res := MessageStats{
+		Total:  storage.CountTotal(),
+		Unread: storage.CountUnread(),
+	}
+	res.MessagesCount = res.Total
+
+	if since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil || d <= 0 {
+			httpError(w, "Error: invalid since duration")
+			return
+		}
+
+		res.MessagesCount = storage.CountMessagesSince(d)
+
+		if g := r.URL.Query().Get("granularity"); g != "" {
+			granularity, err := time.ParseDuration(g)
+			if err != nil || granularity <= 0 {
+				httpError(w, "Error: invalid granularity duration")
+				return
+			}
+
+			res.Buckets, err = storage.GetMessageStats(time.Now().Add(-d), granularity)
+			if err != nil {
+				httpError(w, err.Error())
+				return
+			}
+		}
+	} else if r.URL.Query().Get("granularity") != "" {
+		httpError(w, "Error: granularity requires since")
+		return
+	}
+
+	if between != "" {
+		parts := strings.Split(between, ",")
+		if len(parts) != 2 {
+			httpError(w, "Error: between requires a start and end time")
+			return
+		}
+
+		from, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[0]))
+		if err != nil {
+			httpError(w, "Error: invalid between start time")
+			return
+		}
+
+		to, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[1]))
+		if err != nil {
+			httpError(w, "Error: invalid between end time")
+			return
+		}
+
+		if to.Before(from) {
+			httpError(w, "Error: between end time is before the start time")
+			return
+		}
+
+		res.MessagesCount = storage.CountMessagesBetween(from, to)
+	}
+
+	bytes, _ := json.Marshal(res)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMailboxGrowth returns the message growth rate of the mailbox, and the number of messages per hour
+func GetMailboxGrowth(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/stats/growth application GetMailboxGrowth
+	//
+	// # Get mailbox growth rate
+	//
+	// Returns the average number of messages received per hour over the last 24 hours, along with
+	// the number of messages received per hour (UTC) for the last number of hours, oldest first.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: hours
+	//	    in: query
+	//	    description: Number of hours, including the current hour (max 720)
+	//	    required: false
+	//	    type: integer
+	//	    default: 24
+	//
+	//	Responses:
+	//		200: MailboxGrowthResponse
+	//		default: ErrorResponse
+	hours := 24
+	if h := r.URL.Query().Get("hours"); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n < 1 || n > 720 {
+			httpError(w, "Error: invalid hours")
+			return
+		}
+		hours = n
+	}
+
+	rate, err := storage.GetMailboxGrowthRate()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	rates, err := storage.GetGrowthRateByHour(hours)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(MailboxGrowth{Rate: rate, Hours: rates})
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetSizeHistogram returns the number of messages within logarithmic size ranges
+func GetSizeHistogram(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/stats/sizes application GetSizeHistogram
+	//
+	// # Get message size histogram
+	//
+	// Returns the number of messages within logarithmic size ranges, ie: < 1 KB, 1-10 KB, 10-100 KB etc,
+	// where the last range contains all larger messages. A `Max` of 0 is unbounded.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: buckets
+	//	    in: query
+	//	    description: Number of size ranges (2-10)
+	//	    required: false
+	//	    type: integer
+	//	    default: 6
+	//
+	//	Responses:
+	//		200: SizeHistogramResponse
+	//		default: ErrorResponse
+	buckets := 6
+	if b := r.URL.Query().Get("buckets"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil {
+			httpError(w, "Error: invalid buckets")
+			return
+		}
+		buckets = n
+	}
+
+	res, err := storage.GetSizeHistogram(buckets)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(SizeHistogram{Buckets: res})
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -1,6 +1,7 @@
 package apiv1
 
 import (
+	"github.com/axllent/mailpit/internal/cspcheck"
 	"github.com/axllent/mailpit/internal/htmlcheck"
 	"github.com/axllent/mailpit/internal/linkcheck"
 	"github.com/axllent/mailpit/internal/spamassassin"
@@ -26,6 +27,10 @@ type MessagesSummary struct {
 	// Pagination offset
 	Start int `json:"start"`
 
+	// Cursor for the next page of messages (see the `cursor` parameter), only set for unfiltered
+	// lists when more messages may exist
+	NextCursor string `json:"next_cursor,omitempty"`
+
 	// All current tags
 	Tags []string `json:"tags"`
 
@@ -34,6 +39,109 @@ type MessagesSummary struct {
 	Messages []storage.MessageSummary `json:"messages"`
 }
 
+// HighlightedMessagesSummary is a summary of a list of search results, including the
+// locations of the search terms in each message
+type HighlightedMessagesSummary struct {
+	MessagesSummary
+
+	// Messages summary including the search term highlights
+	Messages []storage.HighlightedSummary `json:"messages"`
+}
+
+// MessageStats contains the message totals, and the number of messages received within
+// the requested period
+type MessageStats struct {
+	// Total number of messages in mailbox
+	Total int `json:"total"`
+
+	// Total number of unread messages in mailbox
+	Unread int `json:"unread"`
+
+	// Number of messages received within the requested period, or the total if not set
+	MessagesCount int `json:"messages_count"`
+
+	// Messages received within the `since` period, grouped by the `granularity` (if set)
+	Buckets []storage.TimeBucket `json:"buckets,omitempty"`
+}
+
+// MailboxGrowth contains the message growth rate of the mailbox
+type MailboxGrowth struct {
+	// Average number of messages received per hour over the last 24 hours
+	Rate float64 `json:"rate"`
+
+	// Number of messages received per hour, oldest first
+	Hours []storage.HourlyRate `json:"hours"`
+}
+
+// SizeHistogram contains the number of messages within logarithmic size ranges
+type SizeHistogram struct {
+	// Number of messages per size range, smallest first
+	Buckets []storage.SizeBucket `json:"buckets"`
+}
+
+// MessageExists is the result of a Message-ID lookup
+type MessageExists struct {
+	// Whether a message with the Message-ID exists
+	Exists bool `json:"exists"`
+
+	// Database ID of the latest message with the Message-ID, if found
+	ID string `json:"id"`
+}
+
+// ImportResult is the result of a message import
+type ImportResult struct {
+	// Number of messages imported
+	Imported int `json:"imported"`
+
+	// Number of messages skipped (duplicates or rejected messages)
+	Skipped int `json:"skipped"`
+}
+
+// MessageNavigation contains the IDs of the previous & next messages in a sort order
+type MessageNavigation struct {
+	// Database ID of the previous message, null if none
+	Prev *string `json:"prev"`
+
+	// Database ID of the next message, null if none
+	Next *string `json:"next"`
+}
+
+// SMTPTransactionLog is a paginated list of logged SMTP transactions
+type SMTPTransactionLog struct {
+	// Total number of logged transactions
+	Total int `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Logged transactions, latest to oldest
+	Transactions []storage.SMTPTransaction `json:"transactions"`
+}
+
+// SMTPConnectionLog is a paginated list of logged SMTP connections
+type SMTPConnectionLog struct {
+	// Total number of logged connections
+	Total int `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Logged connections, latest to oldest
+	Connections []storage.SMTPConnection `json:"connections"`
+}
+
+// WebhookFailureLog is a paginated list of failed webhook deliveries
+type WebhookFailureLog struct {
+	// Total number of failed deliveries
+	Total int `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Failed deliveries, latest to oldest
+	Failures []storage.WebhookFailure `json:"failures"`
+}
+
 // The following structs & aliases are provided for easy import
 // and understanding of the JSON structure.
 
@@ -46,11 +154,41 @@ type Message = storage.Message
 // Attachment summary
 type Attachment = storage.Attachment
 
+// ImageMeta - an image referenced in the message HTML
+type ImageMeta = storage.ImageMeta
+
+// SearchHistoryStat - the usage stats of a search query
+type SearchHistoryStat = storage.SearchHistoryStat
+
+// SavedSearch - a named search query
+type SavedSearch = storage.SavedSearch
+
+// DeliveryDetails - the SMTP envelope & session details of a message
+type DeliveryDetails = storage.DeliveryDetails
+
+// ImportProgress - the progress of the current (or last) mbox import
+type ImportProgress = storage.ImportProgress
+
+// RegenerateSnippetsProgress is the progress of snippet regeneration
+type RegenerateSnippetsProgress struct {
+	// Whether snippets are still being regenerated
+	Running bool
+	// Number of messages processed
+	Processed int
+	// Total number of messages
+	Total int
+	// Error message if regeneration failed
+	Error string `json:",omitempty"`
+}
+
 // HTMLCheckResponse summary
 type HTMLCheckResponse = htmlcheck.Response
 
 // LinkCheckResponse summary
 type LinkCheckResponse = linkcheck.Response
 
+// CSPReport summary
+type CSPReport = cspcheck.CSPReport
+
 // SpamAssassinResponse summary
 type SpamAssassinResponse = spamassassin.Result
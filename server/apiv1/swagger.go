@@ -13,6 +13,33 @@ type infoResponse struct {
 	Body stats.AppInformation
 }
 
+// Message stats
+// swagger:response MessageStatsResponse
+type messageStatsResponse struct {
+	// Message totals
+	//
+	// in: body
+	Body MessageStats
+}
+
+// Mailbox growth rate
+// swagger:response MailboxGrowthResponse
+type mailboxGrowthResponse struct {
+	// Mailbox growth rate
+	//
+	// in: body
+	Body MailboxGrowth
+}
+
+// Size histogram
+// swagger:response SizeHistogramResponse
+type sizeHistogramResponse struct {
+	// Message size histogram
+	//
+	// in: body
+	Body SizeHistogram
+}
+
 // Web UI configuration
 // swagger:response WebUIConfigurationResponse
 type webUIConfigurationResponse struct {
@@ -30,14 +57,224 @@ type messagesSummaryResponse struct {
 	Body MessagesSummary
 }
 
+// Message exists
+// swagger:response MessageExistsResponse
+type messageExistsResponse struct {
+	// The Message-ID lookup result
+	// in: body
+	Body MessageExists
+}
+
+// Import result
+// swagger:response ImportResultResponse
+type importResultResponse struct {
+	// The import result
+	// in: body
+	Body ImportResult
+}
+
+// Import progress
+// swagger:response ImportProgressResponse
+type importProgressResponse struct {
+	// Server-sent events of the import progress
+	// in: body
+	Body ImportProgress
+}
+
+// Snippet regeneration progress
+// swagger:response RegenerateSnippetsResponse
+type regenerateSnippetsResponse struct {
+	// Server-sent events of the regeneration progress
+	// in: body
+	Body RegenerateSnippetsProgress
+}
+
+// Message summaries
+// swagger:response MessageSummariesResponse
+type messageSummariesResponse struct {
+	// The message summaries
+	// in: body
+	Body []MessageSummary
+}
+
+// SMTP transaction log
+// swagger:response SMTPTransactionLogResponse
+type smtpTransactionLogResponse struct {
+	// The SMTP transaction log
+	// in: body
+	Body SMTPTransactionLog
+}
+
+// SMTP connection log
+// swagger:response SMTPConnectionLogResponse
+type smtpConnectionLogResponse struct {
+	// The SMTP connection log
+	// in: body
+	Body SMTPConnectionLog
+}
+
+// Webhook failure log
+// swagger:response WebhookFailureLogResponse
+type webhookFailureLogResponse struct {
+	// The failed webhook deliveries
+	// in: body
+	Body WebhookFailureLog
+}
+
+// Message HTML images
+// swagger:response MessageImagesResponse
+type messageImagesResponse struct {
+	// The images referenced in the message HTML
+	// in: body
+	Body []ImageMeta
+}
+
+// Message delivery details
+// swagger:response DeliveryDetailsResponse
+type deliveryDetailsResponse struct {
+	// The SMTP delivery details
+	// in: body
+	Body DeliveryDetails
+}
+
+// Message attachments
+// swagger:response AttachmentsResponse
+type attachmentsResponse struct {
+	// The attachment summaries
+	// in: body
+	Body []Attachment
+}
+
+// Search history stats
+// swagger:response SearchHistoryStatsResponse
+type searchHistoryStatsResponse struct {
+	// The search queries & their usage stats
+	// in: body
+	Body []SearchHistoryStat
+}
+
+// Saved searches
+// swagger:response SavedSearchesResponse
+type savedSearchesResponse struct {
+	// The saved searches
+	// in: body
+	Body []SavedSearch
+}
+
+// Saved search
+// swagger:response SavedSearchResponse
+type savedSearchResponse struct {
+	// The saved search
+	// in: body
+	Body SavedSearch
+}
+
+// swagger:parameters AddSavedSearch
+type addSavedSearchParams struct {
+	// in: body
+	Body *addSavedSearchRequestBody
+}
+
+// Saved search request
+// swagger:model addSavedSearchRequestBody
+type addSavedSearchRequestBody struct {
+	// Unique name of the saved search
+	//
+	// required: true
+	// example: CI failures
+	Name string `json:"name"`
+
+	// Search query
+	//
+	// required: true
+	// example: tag:ci has:attachment
+	Query string `json:"query"`
+}
+
+// swagger:parameters DeleteSavedSearch
+type deleteSavedSearchParams struct {
+	// Saved search ID
+	//
+	// in: path
+	// required: true
+	ID string
+}
+
+// Message navigation
+// swagger:response MessageNavigationResponse
+type messageNavigationResponse struct {
+	// The previous & next message IDs
+	// in: body
+	Body MessageNavigation
+}
+
 // Message headers
 // swagger:model MessageHeaders
 type messageHeaders map[string][]string
 
+// swagger:parameters MessageExists
+type messageExistsParams struct {
+	// Message-ID header value
+	//
+	// in: query
+	// description: Message-ID header value
+	// required: true
+	MessageID string `json:"message_id"`
+}
+
+// swagger:parameters MessageNavigation
+type messageNavigationParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+
+	// Sort field: created, size, subject or from
+	//
+	// in: query
+	// description: Sort field: created, size, subject or from
+	// required: false
+	// default: created
+	Sort string `json:"sort"`
+
+	// Sort order: asc or desc
+	//
+	// in: query
+	// description: Sort order: asc or desc
+	// required: false
+	// default: desc
+	Order string `json:"order"`
+}
+
+// swagger:parameters GetMessageSummaries
+type getMessageSummariesParams struct {
+	// in: body
+	Body *getMessageSummariesRequestBody
+}
+
+// Message summaries request
+// swagger:model getMessageSummariesRequestBody
+type getMessageSummariesRequestBody struct {
+	// Array of message database IDs
+	//
+	// required: true
+	// example: ["5dec4247-812e-4b77-9101-e25ad406e9ea", "8ac66bbc-2d9a-4c41-ad99-00aa75fa674e"]
+	IDs []string `json:"ids"`
+}
+
 // swagger:parameters DeleteMessages
 type deleteMessagesParams struct {
 	// in: body
 	Body *deleteMessagesRequestBody
+
+	// Confirmation token, required to delete all messages if Mailpit is configured to prevent deleting all messages
+	//
+	// in: header
+	// name: X-Confirm-Delete
+	// required: false
+	XConfirmDelete string `json:"X-Confirm-Delete"`
 }
 
 // Delete request
@@ -95,6 +332,51 @@ type setTagsRequestBody struct {
 	IDs []string `json:"ids"`
 }
 
+// swagger:parameters RenameTag
+type renameTagParams struct {
+	// The tag name to rename
+	//
+	// in: path
+	// description: The tag name to rename
+	// required: true
+	Tag string
+
+	// in: body
+	Body *renameTagRequestBody
+}
+
+// Rename tag request
+// swagger:model renameTagRequestBody
+type renameTagRequestBody struct {
+	// New tag name
+	//
+	// required: true
+	// example: Newsletter
+	Name string `json:"name"`
+}
+
+// swagger:parameters MergeTags
+type mergeTagsParams struct {
+	// in: body
+	Body *mergeTagsRequestBody
+}
+
+// Merge tags request
+// swagger:model mergeTagsRequestBody
+type mergeTagsRequestBody struct {
+	// Array of tag names to merge
+	//
+	// required: true
+	// example: ["newsletter", "newsletters"]
+	Tags []string `json:"tags"`
+
+	// The tag to merge the tags into
+	//
+	// required: true
+	// example: Newsletter
+	Target string `json:"target"`
+}
+
 // swagger:parameters ReleaseMessage
 type releaseMessageParams struct {
 	// Message database ID
@@ -118,6 +400,50 @@ type releaseMessageRequestBody struct {
 	To []string `json:"to"`
 }
 
+// swagger:parameters ForwardMessage
+type forwardMessageParams struct {
+	// Message database ID
+	//
+	// in: path
+	// description: Message database ID
+	// required: true
+	ID string
+
+	// in: body
+	Body *forwardMessageRequestBody
+}
+
+// Forward request
+// swagger:model forwardMessageRequestBody
+type forwardMessageRequestBody struct {
+	// Array of email addresses to forward the message to
+	//
+	// required: true
+	// example: ["user1@example.com", "user2@example.com"]
+	To []string `json:"to"`
+
+	// SMTP server address (host:port), defaults to the pre-configured SMTP relay server
+	//
+	// example: smtp.example.com:587
+	SMTPAddr string `json:"smtpAddr"`
+}
+
+// swagger:parameters DownloadSelectedZIP
+type downloadSelectedZIPParams struct {
+	// in: body
+	Body *downloadZIPRequestBody
+}
+
+// Download ZIP request
+// swagger:model downloadZIPRequestBody
+type downloadZIPRequestBody struct {
+	// Array of message database IDs
+	//
+	// required: true
+	// example: ["4oRBnPtCXgAqZniRhzLNmS", "hXayS6wnCgNnt6aFTvmOF6"]
+	IDs []string `json:"ids"`
+}
+
 // swagger:parameters HTMLCheck
 type htmlCheckParams struct {
 	// Message database ID or "latest"
@@ -168,6 +494,10 @@ type textResponse string
 // swagger:response HTMLResponse
 type htmlResponse string
 
+// XML response
+// swagger:response XMLResponse
+type xmlResponse string
+
 // HTTP error response will return with a >= 400 response code
 // swagger:response ErrorResponse
 type errorResponse string
@@ -100,6 +100,7 @@ func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
 	}
 
 	html := linkInlineImages(msg)
+	w.Header().Set("Content-Security-Policy", config.MessagePreviewCSP)
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write([]byte(html))
 }
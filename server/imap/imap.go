@@ -0,0 +1,137 @@
+// Package imap is a minimal read-only IMAP4rev1 server for Mailpit, exposing all messages
+// as a single INBOX so that standard mail clients can be used to view messages.
+// Any login credentials are accepted unless SMTP or web UI authentication is configured,
+// in which case the login must match either.
+//
+// See RFC: https://datatracker.ietf.org/doc/html/rfc3501
+package imap
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// errReadOnly is returned for commands which would create or modify mailboxes or messages
+var errReadOnly = errors.New("Mailpit IMAP is read-only")
+
+// Run will start the IMAP server if enabled
+func Run() {
+	if config.IMAPListen == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.IMAPListen)
+	if err != nil {
+		logger.Log().Errorf("[imap] %s", err.Error())
+		return
+	}
+
+	logger.Log().Infof("[imap] starting on %s", config.IMAPListen)
+
+	if err := newServer().Serve(listener); err != nil {
+		logger.Log().Errorf("[imap] %s", err.Error())
+	}
+}
+
+func newServer() *server.Server {
+	s := server.New(&imapBackend{})
+	// the IMAP server does not support TLS, so credentials can only be sent in plain text
+	s.AllowInsecureAuth = true
+	s.ErrorLog = logger.Log()
+
+	return s
+}
+
+type imapBackend struct{}
+
+// Login accepts any credentials unless SMTP or web UI authentication is configured
+func (b *imapBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if !validLogin(username, password) {
+		logger.Log().Warnf("[imap] failed login by %s from %s", username, connInfo.RemoteAddr.String())
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	logger.Log().Debugf("[imap] login by %s from %s", username, connInfo.RemoteAddr.String())
+
+	return &user{username: username}, nil
+}
+
+// ValidLogin returns whether the credentials match the SMTP or web UI credentials,
+// or true if neither are configured
+func validLogin(username, password string) bool {
+	if auth.SMTPCredentials == nil && auth.UICredentials == nil {
+		return true
+	}
+
+	return (auth.SMTPCredentials != nil && auth.SMTPCredentials.Match(username, password)) ||
+		(auth.UICredentials != nil && auth.UICredentials.Match(username, password))
+}
+
+type user struct {
+	username string
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{&mailbox{}}, nil
+}
+
+// GetMailbox returns a snapshot of the mailbox, as sequence numbers must not change
+// until the mailbox is selected again
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, "INBOX") {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	messages, err := storage.ListMessageUIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	return &mailbox{messages: messages, deleted: map[uint32]bool{}}, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return errReadOnly
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// UIDValidity is stored in the database, as UIDs are only unique to a database
+func uidValidity() uint32 {
+	v, err := strconv.ParseUint(storage.SettingGet("IMAPUIDValidity"), 10, 32)
+	if err == nil && v > 0 {
+		return uint32(v)
+	}
+
+	v = uint64(time.Now().Unix())
+	if err := storage.SettingPut("IMAPUIDValidity", strconv.FormatUint(v, 10)); err != nil {
+		logger.Log().Errorf("[imap] %s", err.Error())
+	}
+
+	return uint32(v)
+}
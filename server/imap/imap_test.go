@@ -0,0 +1,237 @@
+package imap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+var testEmail = []byte("From: Sender <sender@example.com>\r\n" +
+	"To: Recipient <recipient@example.com>\r\n" +
+	"Subject: IMAP test\r\n" +
+	"Message-ID: <imap-test@example.com>\r\n" +
+	"\r\n" +
+	"Hello from Mailpit\r\n")
+
+func TestIMAP(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	t.Log("Testing IMAP server")
+
+	id, err := storage.Store(&testEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	s := newServer()
+	go func() { _ = s.Serve(listener) }()
+	defer s.Close()
+
+	c, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	defer func() { _ = c.Logout() }()
+
+	if err := c.Login("any", "thing"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	status, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, status.Messages, uint32(1), "incorrect number of messages")
+	assertEqual(t, status.UnseenSeqNum, uint32(1), "incorrect first unseen message")
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(1)
+
+	section := &imap.BodySectionName{}
+	messages := make(chan *imap.Message, 1)
+	if err := c.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, section.FetchItem()}, messages); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	msg := <-messages
+	if msg == nil {
+		t.Log("no message fetched")
+		t.FailNow()
+	}
+
+	assertEqual(t, msg.Envelope.Subject, "IMAP test", "incorrect subject")
+	assertEqual(t, msg.Envelope.MessageId, "<imap-test@example.com>", "incorrect Message-ID")
+
+	body, err := io.ReadAll(msg.GetBody(section))
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, string(body), string(testEmail), "incorrect message body")
+	assertEqual(t, storage.IsUnread(id), false, "fetched message should be marked read")
+
+	if err := c.Store(seqSet, imap.FormatFlagsOp(imap.RemoveFlags, true), []interface{}{imap.SeenFlag}, nil); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, storage.IsUnread(id), true, "message should be marked unread")
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "IMAP")
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(uids), 1, "incorrect number of search results")
+	assertEqual(t, uids[0], msg.Uid, "incorrect search result UID")
+
+	if err := c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if err := c.Expunge(nil); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, storage.CountTotal(), 0, "expunged message should be deleted")
+
+	if err := c.Create("Archive"); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Log("expected a read-only error, got ", err)
+		t.Fail()
+	}
+}
+
+func TestIMAPAuth(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	t.Log("Testing IMAP authentication")
+
+	if err := auth.SetSMTPAuth("user:{PLAIN}pass"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	defer func() { auth.SMTPCredentials = nil }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	s := newServer()
+	go func() { _ = s.Serve(listener) }()
+	defer s.Close()
+
+	c, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	defer func() { _ = c.Logout() }()
+
+	if err := c.Login("any", "thing"); err == nil {
+		t.Log("expected invalid credentials to be rejected")
+		t.Fail()
+	}
+
+	if err := c.Login("user", "pass"); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+}
+
+func TestIMAPUIDs(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	t.Log("Testing IMAP UIDs are not reused")
+
+	if _, err := storage.Store(&testEmail); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	id, err := storage.Store(&testEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	messages, err := storage.ListMessageUIDs()
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of messages")
+	lastUID := messages[1].UID
+
+	// delete the newest message & store another
+	if err := storage.DeleteMessages([]string{id}); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	if _, err := storage.Store(&testEmail); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	messages, err = storage.ListMessageUIDs()
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(messages), 2, "incorrect number of messages")
+	if messages[1].UID <= lastUID {
+		t.Fatalf("UID %d was reused", messages[1].UID)
+	}
+}
+
+func setup() {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		panic(err)
+	}
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	message = fmt.Sprintf("%s: \"%v\" != \"%v\"", message, a, b)
+	t.Fatal(message)
+}
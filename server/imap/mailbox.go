@@ -0,0 +1,288 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// mailbox is the INBOX, mapping messages to sequence numbers (position) & UIDs (row ID).
+// Messages flagged as deleted are only deleted from Mailpit when expunged.
+type mailbox struct {
+	messages []storage.MessageUID
+	deleted  map[uint32]bool
+}
+
+func (m *mailbox) Name() string {
+	return "INBOX"
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: "INBOX"}, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(m.Name(), items)
+	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+
+	var unseen, uidNext uint32
+	for i, msg := range m.messages {
+		if !msg.Read {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+		if msg.UID >= uidNext {
+			uidNext = msg.UID + 1
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = uidValidity()
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	for i := range m.messages {
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(m.id(uid, i)) {
+			continue
+		}
+
+		fetched, err := m.fetch(seqNum, &m.messages[i], items)
+		if err != nil {
+			logger.Log().Warnf("[imap] error fetching message %s: %s", m.messages[i].ID, err.Error())
+			continue
+		}
+
+		ch <- fetched
+	}
+
+	return nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	ids := []uint32{}
+
+	for i, msg := range m.messages {
+		raw, err := storage.GetMessageRaw(msg.ID)
+		if err != nil {
+			continue
+		}
+
+		e, err := message.Read(bytes.NewReader(raw))
+		if err != nil && !message.IsUnknownCharset(err) {
+			continue
+		}
+
+		if ok, err := backendutil.Match(e, uint32(i+1), msg.UID, msg.Created, m.flags(msg), criteria); err != nil || !ok {
+			continue
+		}
+
+		ids = append(ids, m.id(uid, i))
+	}
+
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errReadOnly
+}
+
+// UpdateMessagesFlags marks messages as read or unread (\Seen), and flags them for deletion
+// (\Deleted). Other flags are not stored.
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	for i := range m.messages {
+		if !seqSet.Contains(m.id(uid, i)) {
+			continue
+		}
+
+		msg := &m.messages[i]
+		updated := backendutil.UpdateFlags(m.flags(*msg), op, flags)
+
+		seen := hasFlag(updated, imap.SeenFlag)
+		if seen != msg.Read {
+			var err error
+			if seen {
+				err = storage.MarkRead(msg.ID)
+			} else {
+				err = storage.MarkUnread(msg.ID)
+			}
+			if err != nil {
+				return err
+			}
+			msg.Read = seen
+		}
+
+		m.deleted[msg.UID] = hasFlag(updated, imap.DeletedFlag)
+	}
+
+	return nil
+}
+
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return errReadOnly
+}
+
+// Expunge deletes all messages flagged as deleted
+func (m *mailbox) Expunge() error {
+	ids := []string{}
+	remaining := []storage.MessageUID{}
+
+	for _, msg := range m.messages {
+		if m.deleted[msg.UID] {
+			ids = append(ids, msg.ID)
+		} else {
+			remaining = append(remaining, msg)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := storage.DeleteMessages(ids); err != nil {
+		return err
+	}
+
+	m.messages = remaining
+	m.deleted = map[uint32]bool{}
+
+	return nil
+}
+
+// ID returns the UID or sequence number of the message at index i
+func (m *mailbox) id(uid bool, i int) uint32 {
+	if uid {
+		return m.messages[i].UID
+	}
+
+	return uint32(i + 1)
+}
+
+func (m *mailbox) flags(msg storage.MessageUID) []string {
+	flags := []string{}
+	if msg.Read {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if m.deleted[msg.UID] {
+		flags = append(flags, imap.DeletedFlag)
+	}
+
+	return flags
+}
+
+// Fetch returns the requested items of a message, only loading the raw message if required.
+// Fetching a body section (other than BODY.PEEK) marks the message as read.
+func (m *mailbox) fetch(seqNum uint32, msg *storage.MessageUID, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+
+	var raw []byte
+	headerAndBody := func() (textproto.Header, io.Reader, error) {
+		if raw == nil {
+			var err error
+			if raw, err = storage.GetMessageRaw(msg.ID); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+
+		body := bufio.NewReader(bytes.NewReader(raw))
+		hdr, err := textproto.ReadHeader(body)
+
+		return hdr, body, err
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			// set after all items, as fetching a body section may mark the message as read
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Created
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(msg.Size)
+		case imap.FetchUid:
+			fetched.Uid = msg.UID
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+
+			if !section.Peek && !msg.Read {
+				if err := storage.MarkRead(msg.ID); err != nil {
+					return nil, err
+				}
+				msg.Read = true
+			}
+		}
+	}
+
+	if _, ok := fetched.Items[imap.FetchFlags]; ok {
+		fetched.Flags = m.flags(*msg)
+	}
+
+	return fetched, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
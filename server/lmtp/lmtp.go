@@ -0,0 +1,68 @@
+// Package lmtp is the LMTP (RFC 2033) daemon, allowing Mailpit to be used as a local delivery target
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/smtpd"
+)
+
+// socketMode is the file mode of the unix socket, allowing access to the owner & group only
+const socketMode = 0660
+
+// Run will start the LMTP server on the configured port and/or unix socket.
+// The LMTP server is disabled if neither are set.
+func Run() {
+	if config.LMTPPort > 0 {
+		host, _, err := net.SplitHostPort(config.SMTPListen)
+		if err != nil {
+			logger.Log().Errorf("[lmtp] %s", err.Error())
+			return
+		}
+
+		go listen("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", config.LMTPPort)))
+	}
+
+	if config.LMTPSocket != "" {
+		// remove a stale socket from a previous run
+		if fi, err := os.Stat(config.LMTPSocket); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				logger.Log().Errorf("[lmtp] %s exists and is not a socket", config.LMTPSocket)
+				return
+			}
+
+			if err := os.Remove(config.LMTPSocket); err != nil {
+				logger.Log().Errorf("[lmtp] %s", err.Error())
+				return
+			}
+		}
+
+		go listen("unix", config.LMTPSocket)
+	}
+}
+
+func listen(network, addr string) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		logger.Log().Errorf("[lmtp] %s", err.Error())
+		return
+	}
+
+	if network == "unix" {
+		// allow local MTAs in the same group (eg: postfix) to connect
+		if err := os.Chmod(addr, socketMode); err != nil {
+			logger.Log().Warnf("[lmtp] %s", err.Error())
+		}
+	}
+
+	logger.Log().Infof("[lmtp] starting on %s", addr)
+
+	if err := smtpd.NewLMTPServer().Serve(ln); err != nil && !errors.Is(err, smtpd.ErrServerClosed) {
+		logger.Log().Errorf("[lmtp] %s", err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package lmtp
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/smtpd"
+)
+
+func TestSocket(t *testing.T) {
+	logger.NoLogging = true
+	smtpd.DisableReverseDNS = true
+
+	config.LMTPPort = 0
+	config.LMTPSocket = filepath.Join(t.TempDir(), "lmtp.sock")
+	defer func() { config.LMTPSocket = "" }()
+
+	// a stale socket from a previous run is replaced
+	ln, err := net.Listen("unix", config.LMTPSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := ln.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+	_ = ln.Close()
+
+	Run()
+
+	// the socket permissions are set once listening
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fi, err := os.Stat(config.LMTPSocket)
+		if err == nil && fi.Mode().Perm() == socketMode {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("socket not created with mode %o (%v)", socketMode, err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("unix", config.LMTPSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, msg, err := tp.ReadResponse(220); err != nil || !strings.Contains(msg, "LMTP") {
+		t.Fatalf("unexpected greeting %q (%v)", msg, err)
+	}
+
+	if err := tp.PrintfLine("LHLO client"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, msg, err := tp.ReadResponse(250); err != nil || !strings.Contains(msg, "PIPELINING") {
+		t.Fatalf("unexpected LHLO response %q (%v)", msg, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package metrics exposes mailbox, storage & SMTP metrics in the Prometheus format
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	messagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailpit_messages_total",
+		Help: "Total number of messages stored since Mailpit started",
+	})
+
+	messagesUnread = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailpit_messages_unread",
+		Help: "Number of unread messages in the mailbox",
+	})
+
+	storageBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailpit_storage_bytes",
+		Help: "Total size in bytes of all messages in the mailbox",
+	})
+
+	smtpReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailpit_smtp_received_total",
+		Help: "Total number of messages accepted by the SMTP server",
+	})
+
+	smtpErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailpit_smtp_errors_total",
+		Help: "Total number of messages rejected by or failed in the SMTP server",
+	})
+
+	duplicatesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailpit_duplicates_dropped_total",
+		Help: "Total number of messages ignored due to a duplicate Message-ID",
+	})
+
+	dbSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailpit_db_size_bytes",
+		Help: "Size in bytes of the SQLite database file",
+	})
+
+	dbCorruptionsRecovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailpit_db_corruptions_recovered_total",
+		Help: "Total number of corrupted databases deleted & recreated on startup",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		messagesTotal,
+		messagesUnread,
+		storageBytes,
+		smtpReceived,
+		smtpErrors,
+		duplicatesDropped,
+		dbSizeBytes,
+		dbCorruptionsRecovered,
+	)
+}
+
+// Handler returns the HTTP handler for the metrics endpoint. Responses are not compressed,
+// as this is handled by the HTTP middleware.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{DisableCompression: true})
+}
+
+// MessageStored increments the number of stored messages
+func MessageStored() {
+	messagesTotal.Inc()
+}
+
+// SMTPReceived increments the number of messages accepted via SMTP
+func SMTPReceived() {
+	smtpReceived.Inc()
+}
+
+// SMTPError increments the number of messages rejected (or failed) via SMTP
+func SMTPError() {
+	smtpErrors.Inc()
+}
+
+// DuplicateDropped increments the number of messages ignored due to a duplicate Message-ID
+func DuplicateDropped() {
+	duplicatesDropped.Inc()
+}
+
+// DBCorruptionRecovered increments the number of corrupted databases recreated on startup
+func DBCorruptionRecovered() {
+	dbCorruptionsRecovered.Inc()
+}
+
+// SetMailboxStats sets the mailbox & storage gauges
+func SetMailboxStats(unread int, mailboxSize, dbSize int64) {
+	messagesUnread.Set(float64(unread))
+	storageBytes.Set(float64(mailboxSize))
+	dbSizeBytes.Set(float64(dbSize))
+}
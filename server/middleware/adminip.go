@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// AdminIPMiddleware restricts admin API requests to clients within config.AdminIPRanges.
+// Requests are not restricted if no ranges are configured.
+func AdminIPMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.AdminIPRanges) == 0 || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		ip := remoteIP(r)
+
+		if !ipInRanges(ip, config.AdminIPRanges) {
+			logger.Log().Warnf("[http] denied admin request %s %s from %s", r.Method, r.URL.Path, ip)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Access denied.\n"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// IPInRanges returns whether the IP address is within any of the CIDR ranges
+func ipInRanges(ip string, ranges []string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, r := range ranges {
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			continue
+		}
+
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
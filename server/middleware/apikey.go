@@ -0,0 +1,97 @@
+// Package middleware contains HTTP middleware used by the web UI & API
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// UISessionCookie is the name of the cookie set when the web UI is loaded,
+// allowing the web UI to use the API without an API key
+const UISessionCookie = "mailpit_ui"
+
+// uiSessionToken is a random token generated at startup for web UI sessions
+var uiSessionToken = generateToken()
+
+// APIKeyMiddleware requires a valid API key for all API requests when config.APIKey is set.
+// The key is read from the X-API-Key header, falling back to the api_key query parameter.
+// Requests made by the web UI are identified by the UI session cookie and are not affected.
+func APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.APIKey == "" || r.Method == http.MethodOptions ||
+			!strings.HasPrefix(r.URL.Path, config.Webroot+"api/") || isUIRequest(r) || TokenAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = r.URL.Query().Get("api_key")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(key), []byte(config.APIKey)) != 1 {
+			logger.Log().Warnf("[http] invalid API key from %s", remoteIP(r))
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Invalid API key.\n"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetUISessionCookie sets the web UI session cookie if an API key or API tokens are configured,
+// so the web UI can use the API without a key or token. The cookie is issued with the web UI,
+// so the web UI (and the API via the web UI) is only protected by web UI authentication, if set.
+func SetUISessionCookie(w http.ResponseWriter) {
+	if config.APIKey == "" && auth.APITokens == nil {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     UISessionCookie,
+		Value:    uiSessionToken,
+		Path:     config.Webroot,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// IsUIRequest returns whether the request contains a valid web UI session cookie
+func isUIRequest(r *http.Request) bool {
+	c, err := r.Cookie(UISessionCookie)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(uiSessionToken)) == 1
+}
+
+// RemoteIP returns the IP address of the client
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// GenerateToken returns a random 32 character hex string
+func generateToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
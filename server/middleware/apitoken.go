@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+type tokenContextKey struct{}
+
+// APITokenMiddleware enforces scoped API tokens (via the `Authorization: Bearer <token>` header)
+// when config.APITokenFile is set. Read tokens may only make GET requests, write tokens may also
+// make POST, PUT & DELETE requests, and admin tokens may additionally use the admin endpoints.
+// Requests without a bearer token are only allowed with web UI Basic Auth or the web UI session
+// cookie, which is issued with the web UI whether or not web UI authentication is configured.
+func APITokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.APITokens == nil || r.Method == http.MethodOptions ||
+			!strings.HasPrefix(r.URL.Path, config.Webroot+"api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			if _, _, basic := r.BasicAuth(); (basic && auth.UICredentials != nil) || isUIRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Mailpit"`)
+			httpError(w, http.StatusUnauthorized, "API token required.")
+			return
+		}
+
+		scope := auth.APITokenScope(token)
+		if scope == 0 {
+			logger.Log().Warnf("[http] invalid API token from %s", remoteIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Mailpit", error="invalid_token"`)
+			httpError(w, http.StatusUnauthorized, "Invalid API token.")
+			return
+		}
+
+		if required := requiredScope(r); scope < required {
+			logger.Log().Warnf("[http] API token with %s scope denied %s %s from %s", scope, r.Method, r.URL.Path, remoteIP(r))
+			httpError(w, http.StatusForbidden, "Insufficient API token scope, "+required.String()+" required.")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, scope)))
+	})
+}
+
+// TokenAuthenticated returns whether the request was authenticated with a valid API token,
+// in which case no further (Basic Auth or API key) authentication is required
+func TokenAuthenticated(r *http.Request) bool {
+	_, ok := r.Context().Value(tokenContextKey{}).(auth.APIScope)
+
+	return ok
+}
+
+// RequiredScope returns the API token scope required for the request
+func requiredScope(r *http.Request) auth.APIScope {
+	if strings.HasPrefix(r.URL.Path, config.Webroot+"api/v1/admin/") {
+		return auth.ScopeAdmin
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return auth.ScopeRead
+	default:
+		return auth.ScopeWrite
+	}
+}
+
+// BearerToken returns the token from the Authorization header, if set
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(h[7:]), true
+}
+
+// HTTPError writes a plain text error response
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(msg + "\n"))
+}
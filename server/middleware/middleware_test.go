@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+func TestAPITokenMiddleware(t *testing.T) {
+	logger.NoLogging = true
+
+	if err := auth.SetAPITokens([]byte("read-token:\n  scope: read\nwrite-token:\n  scope: write\nadmin-token:\n  scope: admin\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.APITokens = nil }()
+
+	h := APITokenMiddleware(okHandler())
+
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/api/v1/messages", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/messages", "invalid", http.StatusUnauthorized},
+		{"GET", "/api/v1/messages", "read-token", http.StatusOK},
+		{"DELETE", "/api/v1/messages", "read-token", http.StatusForbidden},
+		{"DELETE", "/api/v1/messages", "write-token", http.StatusOK},
+		{"POST", "/api/v1/admin/vacuum", "write-token", http.StatusForbidden},
+		{"GET", "/api/v1/admin/backup", "read-token", http.StatusForbidden},
+		{"POST", "/api/v1/admin/vacuum", "admin-token", http.StatusOK},
+		{"GET", "/", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		assertEqual(t, serve(h, req), test.code, fmt.Sprintf("%s %s with token %q", test.method, test.path, test.token))
+	}
+
+	// the web UI session cookie is issued & accepted without web UI authentication
+	rec := httptest.NewRecorder()
+	SetUISessionCookie(rec)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != UISessionCookie {
+		t.Fatalf("expected the UI session cookie to be set with API tokens, got %v", cookies)
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/v1/messages", nil)
+	req.AddCookie(cookies[0])
+	assertEqual(t, serve(h, req), http.StatusOK, "UI session cookie without web UI authentication")
+
+	if err := auth.SetUIAuth("user:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.UICredentials = nil }()
+
+	req = httptest.NewRequest("DELETE", "/api/v1/messages", nil)
+	req.AddCookie(&http.Cookie{Name: UISessionCookie, Value: uiSessionToken})
+	assertEqual(t, serve(h, req), http.StatusOK, "UI session cookie with web UI authentication")
+
+	req = httptest.NewRequest("DELETE", "/api/v1/messages", nil)
+	req.AddCookie(&http.Cookie{Name: UISessionCookie, Value: "invalid"})
+	assertEqual(t, serve(h, req), http.StatusUnauthorized, "invalid UI session cookie")
+
+	// Basic Auth is verified by the HTTP middleware
+	req = httptest.NewRequest("GET", "/api/v1/messages", nil)
+	req.SetBasicAuth("user", "pass")
+	assertEqual(t, serve(h, req), http.StatusOK, "Basic Auth without a token")
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	logger.NoLogging = true
+
+	config.APIKey = "secret-key"
+	defer func() { config.APIKey = "" }()
+
+	h := APIKeyMiddleware(okHandler())
+
+	assertEqual(t, serve(h, httptest.NewRequest("GET", "/api/v1/messages", nil)), http.StatusUnauthorized, "request without an API key")
+	assertEqual(t, serve(h, httptest.NewRequest("GET", "/api/v1/messages?api_key=wrong", nil)), http.StatusUnauthorized, "request with an invalid API key")
+	assertEqual(t, serve(h, httptest.NewRequest("GET", "/api/v1/messages?api_key=secret-key", nil)), http.StatusOK, "request with a valid API key")
+	assertEqual(t, serve(h, httptest.NewRequest("GET", "/", nil)), http.StatusOK, "non-API request")
+
+	// the web UI works without web UI authentication, using the session cookie
+	rec := httptest.NewRecorder()
+	SetUISessionCookie(rec)
+	assertEqual(t, len(rec.Result().Cookies()), 1, "UI session cookie not issued without web UI authentication")
+
+	req := httptest.NewRequest("GET", "/api/v1/messages", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	assertEqual(t, serve(h, req), http.StatusOK, "UI session cookie without web UI authentication")
+
+	req = httptest.NewRequest("GET", "/api/events", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	assertEqual(t, serve(h, req), http.StatusOK, "UI events with the session cookie")
+
+	req = httptest.NewRequest("GET", "/api/v1/messages", nil)
+	req.AddCookie(&http.Cookie{Name: UISessionCookie, Value: "invalid"})
+	assertEqual(t, serve(h, req), http.StatusUnauthorized, "invalid UI session cookie")
+
+	if err := auth.SetUIAuth("user:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.UICredentials = nil }()
+
+	rec = httptest.NewRecorder()
+	SetUISessionCookie(rec)
+	assertEqual(t, len(rec.Result().Cookies()), 1, "UI session cookie not issued with web UI authentication")
+
+	req = httptest.NewRequest("GET", "/api/v1/messages", nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	assertEqual(t, serve(h, req), http.StatusOK, "UI session cookie with web UI authentication")
+
+	// no cookie is issued without an API key or API tokens
+	config.APIKey = ""
+	rec = httptest.NewRecorder()
+	SetUISessionCookie(rec)
+	assertEqual(t, len(rec.Result().Cookies()), 0, "UI session cookie issued without an API key")
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+func serve(h http.Handler, req *http.Request) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	message = fmt.Sprintf("%s: \"%v\" != \"%v\"", message, a, b)
+	t.Fatal(message)
+}
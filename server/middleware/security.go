@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// DefaultSecurityHeaders are added to all HTTP responses unless overridden via config.SecurityHeaders
+var DefaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "DENY",
+	"Referrer-Policy":        "no-referrer",
+}
+
+// HSTSHeader is added to all HTTP responses when the web UI is served over HTTPS
+const HSTSHeader = "max-age=31536000; includeSubDomains"
+
+// SecurityHeadersMiddleware adds the default security headers, plus any custom headers set in
+// config.SecurityHeaders, to all HTTP responses. A custom header with an empty value removes
+// the corresponding default header.
+func SecurityHeadersMiddleware(next http.Handler) http.Handler {
+	headers := securityHeaders()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SameOriginFramingMiddleware relaxes the default X-Frame-Options DENY header to SAMEORIGIN for
+// responses which the web UI displays in an iframe, such as the message source. A custom
+// X-Frame-Options header set via config.SecurityHeaders is not changed.
+func SameOriginFramingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if w.Header().Get("X-Frame-Options") == "DENY" {
+			if !isCustomHeader("X-Frame-Options") {
+				w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// IsCustomHeader returns whether a header is set via config.SecurityHeaders
+func isCustomHeader(name string) bool {
+	for k := range config.SecurityHeaders {
+		if http.CanonicalHeaderKey(k) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecurityHeaders returns the merged default & custom headers
+func securityHeaders() map[string]string {
+	headers := map[string]string{}
+	for k, v := range DefaultSecurityHeaders {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	if config.UITLSCert != "" && config.UITLSKey != "" || len(config.HTTPTLSCertificates) > 0 {
+		headers["Strict-Transport-Security"] = HSTSHeader
+	}
+
+	for k, v := range config.SecurityHeaders {
+		k = http.CanonicalHeaderKey(k)
+		if v == "" {
+			delete(headers, k)
+			continue
+		}
+
+		headers[k] = v
+	}
+
+	return headers
+}
@@ -20,8 +20,13 @@ import (
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/stats"
 	"github.com/axllent/mailpit/internal/storage"
+	sni "github.com/axllent/mailpit/internal/tls"
 	"github.com/axllent/mailpit/server/apiv1"
 	"github.com/axllent/mailpit/server/handlers"
+	"github.com/axllent/mailpit/server/imap"
+	"github.com/axllent/mailpit/server/lmtp"
+	"github.com/axllent/mailpit/server/metrics"
+	"github.com/axllent/mailpit/server/middleware"
 	"github.com/axllent/mailpit/server/pop3"
 	"github.com/axllent/mailpit/server/websockets"
 	"github.com/gorilla/mux"
@@ -51,6 +56,10 @@ func Listen() {
 
 	go pop3.Run()
 
+	go imap.Run()
+
+	go lmtp.Run()
+
 	r := apiRoutes()
 
 	// kubernetes probes
@@ -93,6 +102,10 @@ func Listen() {
 		logger.Log().Info("[http] enabling basic authentication")
 	}
 
+	if config.APIKey != "" {
+		logger.Log().Info("[http] enabling API key authentication")
+	}
+
 	// Mark the application here as ready
 	isReady.Store(true)
 
@@ -104,7 +117,23 @@ func Listen() {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	if config.UITLSCert != "" && config.UITLSKey != "" {
+	if len(config.HTTPTLSCertificates) > 0 {
+		certs := config.HTTPTLSCertificates
+		if config.UITLSCert != "" && config.UITLSKey != "" {
+			// the main certificate is the default for unmatched domains
+			certs = append([]config.TLSCertConfig{{CertFile: config.UITLSCert, KeyFile: config.UITLSKey}}, certs...)
+		}
+
+		tlsConfig, err := sni.BuildSNITLSConfig(certs)
+		if err != nil {
+			logger.Log().Fatalf("[http] %s", err.Error())
+		}
+
+		server.TLSConfig = tlsConfig
+
+		logger.Log().Infof("[http] accessible via https://%s%s", logger.CleanHTTPIP(config.HTTPListen), config.Webroot)
+		logger.Log().Fatal(server.ListenAndServeTLS("", ""))
+	} else if config.UITLSCert != "" && config.UITLSKey != "" {
 		logger.Log().Infof("[http] accessible via https://%s%s", logger.CleanHTTPIP(config.HTTPListen), config.Webroot)
 		logger.Log().Fatal(server.ListenAndServeTLS(config.UITLSCert, config.UITLSKey))
 	} else {
@@ -116,34 +145,92 @@ func Listen() {
 func apiRoutes() *mux.Router {
 	r := mux.NewRouter()
 
+	// security headers for all responses
+	r.Use(middleware.SecurityHeadersMiddleware)
+
+	// optional scoped API token authentication
+	r.Use(middleware.APITokenMiddleware)
+
+	// optional API key authentication
+	r.Use(middleware.APIKeyMiddleware)
+
 	// API V1
 	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.GetMessages)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.SetReadStatus)).Methods("PUT")
-	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.DeleteMessages)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DeleteMessages))).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/messages/exists", middleWareFunc(apiv1.MessageIDExists)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/summaries", middleWareFunc(apiv1.GetMessageSummaries)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/messages/download", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DownloadMbox))).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/download-zip", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DownloadZIP))).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/download-zip", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DownloadSelectedZIP))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/messages/import", middleWareFunc(middleware.AdminIPMiddleware(apiv1.ImportMessages))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/messages/import/progress", middleWareFunc(apiv1.GetImportProgress)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/rss", middleWareFunc(apiv1.GetMessagesRSS)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/atom", middleWareFunc(apiv1.GetMessagesAtom)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/starred", middleWareFunc(apiv1.GetStarredMessages)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/tags", middleWareFunc(apiv1.GetAllTags)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/tags", middleWareFunc(apiv1.SetMessageTags)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/merge", middleWareFunc(middleware.AdminIPMiddleware(apiv1.MergeTags))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/tags/{tag}", middleWareFunc(middleware.AdminIPMiddleware(apiv1.RenameTag))).Methods("PUT")
 	r.HandleFunc(config.Webroot+"api/v1/search", middleWareFunc(apiv1.Search)).Methods("GET")
-	r.HandleFunc(config.Webroot+"api/v1/search", middleWareFunc(apiv1.DeleteSearch)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/search", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DeleteSearch))).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/search/history", middleWareFunc(apiv1.GetSearchHistory)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/search/history/stats", middleWareFunc(apiv1.GetSearchHistoryStats)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/search/history", middleWareFunc(middleware.AdminIPMiddleware(apiv1.ClearSearchHistory))).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/saved-searches", middleWareFunc(apiv1.GetSavedSearches)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/saved-searches", middleWareFunc(apiv1.AddSavedSearch)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/saved-searches/{id}", middleWareFunc(apiv1.DeleteSavedSearch)).Methods("DELETE")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}", middleWareFunc(apiv1.DownloadAttachment)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}/thumb", middleWareFunc(apiv1.Thumbnail)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}/raw", middleWareFunc(apiv1.DownloadRawPart)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/headers", middleWareFunc(apiv1.GetHeaders)).Methods("GET")
-	r.HandleFunc(config.Webroot+"api/v1/message/{id}/raw", middleWareFunc(apiv1.DownloadRaw)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/custom-headers", middleWareFunc(apiv1.GetCustomHeaders)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/images", middleWareFunc(apiv1.GetMessageImages)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/delivery", middleWareFunc(apiv1.GetMessageDelivery)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/attachments", middleWareFunc(apiv1.GetMessageAttachments)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/nav", middleWareFunc(apiv1.GetMessageNavigation)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/thread", middleWareFunc(apiv1.GetMessageThread)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/raw", middleWareFunc(middleware.SameOriginFramingMiddleware(apiv1.DownloadRaw))).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/render", middleWareFunc(apiv1.RenderMessageHTML)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/release", middleWareFunc(apiv1.ReleaseMessage)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/resubmit", middleWareFunc(middleware.AdminIPMiddleware(apiv1.ResubmitMessage))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/forward", middleWareFunc(middleware.AdminIPMiddleware(apiv1.ForwardMessage))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/star", middleWareFunc(apiv1.StarMessage)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/star", middleWareFunc(apiv1.UnstarMessage)).Methods("DELETE")
 	if !config.DisableHTMLCheck {
 		r.HandleFunc(config.Webroot+"api/v1/message/{id}/html-check", middleWareFunc(apiv1.HTMLCheck)).Methods("GET")
 	}
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/link-check", middleWareFunc(apiv1.LinkCheck)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/csp-analysis", middleWareFunc(apiv1.CSPAnalysis)).Methods("GET")
 	if config.EnableSpamAssassin != "" {
 		r.HandleFunc(config.Webroot+"api/v1/message/{id}/sa-check", middleWareFunc(apiv1.SpamAssassinCheck)).Methods("GET")
 	}
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}", middleWareFunc(apiv1.GetMessage)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/smtp/transactions", middleWareFunc(apiv1.GetSMTPTransactions)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/smtp/connections", middleWareFunc(apiv1.GetSMTPConnections)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/webhook-failures", middleWareFunc(apiv1.GetWebhookFailures)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/webhook-failures", middleWareFunc(middleware.AdminIPMiddleware(apiv1.DeleteWebhookFailures))).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/admin/vacuum", middleWareFunc(middleware.AdminIPMiddleware(apiv1.VacuumDatabase))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/admin/backup", middleWareFunc(middleware.AdminIPMiddleware(apiv1.BackupDatabase))).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/admin/regen-snippets", middleWareFunc(middleware.AdminIPMiddleware(apiv1.RegenerateSnippets))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/smtp/pause", middleWareFunc(middleware.AdminIPMiddleware(apiv1.PauseSMTP))).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/smtp/resume", middleWareFunc(middleware.AdminIPMiddleware(apiv1.ResumeSMTP))).Methods("POST")
 	r.HandleFunc(config.Webroot+"api/v1/info", middleWareFunc(apiv1.AppInfo)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/stats", middleWareFunc(apiv1.GetMessageStats)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/stats/growth", middleWareFunc(apiv1.GetMailboxGrowth)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/stats/sizes", middleWareFunc(apiv1.GetSizeHistogram)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/events", middleWareFunc(apiv1.Events)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/webui", middleWareFunc(apiv1.WebUIConfig)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/swagger.json", middleWareFunc(swaggerBasePath)).Methods("GET")
 
 	// web UI websocket
 	r.HandleFunc(config.Webroot+"api/events", apiWebsocket).Methods("GET")
 
+	// Prometheus metrics
+	if config.EnableMetrics {
+		r.Path(config.Webroot + "metrics").Handler(middlewareHandler(metrics.Handler())).Methods("GET")
+	}
+
 	// return blank 200 response for OPTIONS requests for CORS
 	r.PathPrefix(config.Webroot + "api/v1/").Handler(middleWareFunc(apiv1.GetOptions)).Methods("OPTIONS")
 
@@ -166,11 +253,26 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Unwrap returns the underlying ResponseWriter, used by http.ResponseController
+func (w gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush flushes the compressed data to the client, required for streamed responses
+func (w gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		_ = gz.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // MiddleWareFunc http middleware adds optional basic authentication
 // and gzip compression.
 func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Referrer-Policy", "no-referrer")
 		w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
 
 		if AccessControlAllowOrigin != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
@@ -179,7 +281,7 @@ func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 			w.Header().Set("Access-Control-Allow-Headers", "*")
 		}
 
-		if auth.UICredentials != nil {
+		if auth.UICredentials != nil && !middleware.TokenAuthenticated(r) {
 			user, pass, ok := r.BasicAuth()
 
 			if !ok {
@@ -193,7 +295,7 @@ func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 
-		if auth.UICredentials != nil {
+		if auth.UICredentials != nil && !middleware.TokenAuthenticated(r) {
 			user, pass, ok := r.BasicAuth()
 
 			if !ok {
@@ -223,7 +325,6 @@ func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 // and gzip compression
 func middlewareHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Referrer-Policy", "no-referrer")
 		w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
 
 		if AccessControlAllowOrigin != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
@@ -232,7 +333,7 @@ func middlewareHandler(h http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Headers", "*")
 		}
 
-		if auth.UICredentials != nil {
+		if auth.UICredentials != nil && !middleware.TokenAuthenticated(r) {
 			user, pass, ok := r.BasicAuth()
 
 			if !ok {
@@ -334,6 +435,8 @@ func index(w http.ResponseWriter, _ *http.Request) {
 
 	buff.Bytes()
 
+	middleware.SetUISessionCookie(w)
+
 	w.Header().Add("Content-Type", "text/html")
 	_, _ = w.Write(buff.Bytes())
 }
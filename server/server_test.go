@@ -1,21 +1,33 @@
 package server
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/server/apiv1"
+	"github.com/axllent/mailpit/server/middleware"
 	"github.com/jhillyerd/enmime"
+	"github.com/prometheus/common/expfmt"
 )
 
 var (
@@ -176,6 +188,60 @@ func TestAPIv1ToggleReadStatus(t *testing.T) {
 	assertStatsEqual(t, ts.URL+"/api/v1/messages", 0, 100)
 }
 
+func TestAPIv1StarredMessages(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	for _, msg := range m.Messages[:2] {
+		if _, err := clientPut(ts.URL+"/api/v1/message/"+msg.ID+"/star", ""); err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+
+	if _, err := clientPut(ts.URL+"/api/v1/message/does-not-exist/star", ""); err == nil {
+		t.Error("expected an error starring a missing message")
+	}
+
+	if _, err := clientDelete(ts.URL+"/api/v1/message/"+m.Messages[1].ID+"/star", ""); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	b, err := clientGet(ts.URL + "/api/v1/messages/starred")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	starred := []storage.MessageSummary{}
+	if err := json.Unmarshal(b, &starred); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	assertEqual(t, len(starred), 1, "incorrect number of starred messages")
+	if len(starred) == 1 {
+		assertEqual(t, starred[0].ID, m.Messages[0].ID, "incorrect starred message")
+		assertEqual(t, starred[0].Starred, true, "message not starred")
+	}
+
+	// starred messages are preserved when deleting all messages
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", "{}"); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 1, 1)
+}
+
 func TestAPIv1Search(t *testing.T) {
 	setup()
 	defer storage.Close()
@@ -185,26 +251,1619 @@ func TestAPIv1Search(t *testing.T) {
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	// insert 100
-	t.Log("Insert 100 messages & tag")
+	// insert 100
+	t.Log("Insert 100 messages & tag")
+	insertEmailData(t)
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	// search
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "from-1@example.com", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "from:from-1@example.com", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-from:from-1@example.com", 99)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-FROM:FROM-1@EXAMPLE.COM", 99)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "to:from-1@example.com", 0)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "from:@example.com", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "subject:\"Subject line\"", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "subject:\"SUBJECT LINE 17 END\"", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "!thisdoesnotexist", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-ThisDoesNotExist", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "thisdoesnotexist", 0)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"Test tag 065\"", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"TEST TAG 065\"", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "!tag:\"Test tag 023\"", 99)
+
+	// highlighted results
+	data, err := clientGet(ts.URL + "/api/v1/search?highlight=true&query=" + url.QueryEscape("from-17@example.com \"line 17\""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := apiv1.HighlightedMessagesSummary{}
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, h.MessagesCount, 1, "wrong search results count")
+	if len(h.Messages) == 1 {
+		assertEqual(t, h.Messages[0].Subject, "Subject line 17 end", "wrong search result")
+		assertEqual(t, fmt.Sprintf("%v", h.Messages[0].Highlights), "map[From.Address:[{0 19}] Subject:[{8 15}]]", "wrong search highlights")
+	} else {
+		t.Error("expected 1 highlighted message")
+	}
+}
+
+func TestAPIv1Sorting(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?sort=subject&order=asc&limit=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(m.Messages), 3, "wrong number of sorted messages")
+	assertEqual(t, m.Messages[0].Subject, "Subject line 0 end", "wrong first sorted message")
+	assertEqual(t, m.Messages[1].Subject, "Subject line 1 end", "wrong second sorted message")
+	assertEqual(t, m.Messages[2].Subject, "Subject line 10 end", "wrong third sorted message")
+	assertEqual(t, m.NextCursor, "", "cursor returned for sorted messages")
+
+	m, err = fetchMessages(ts.URL + "/api/v1/messages?sort=from&order=desc&start=1&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, m.Messages[0].From.Address, "from-99@example.com", "wrong sorted message")
+
+	m, err = fetchMessages(ts.URL + "/api/v1/search?query=" + url.QueryEscape("subject:\"line 1\"") + "&sort=subject&order=desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, m.MessagesCount, 11, "wrong search results count")
+	assertEqual(t, m.Messages[0].Subject, "Subject line 19 end", "wrong first sorted search result")
+	assertEqual(t, m.Messages[10].Subject, "Subject line 1 end", "wrong last sorted search result")
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?sort=invalid"); err == nil {
+		t.Error("expected error for invalid sort field")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?sort=size&tags=" + url.QueryEscape("Test tag 001")); err == nil {
+		t.Error("expected error for sorting with filters")
+	}
+}
+
+func TestAPIv1MessageExists(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	msg := []byte("Message-ID: <exists-test@example.com>\r\nSubject: Exists test\r\n\r\nBody\r\n")
+	id, err := storage.Store(&msg)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	for messageID, expected := range map[string]apiv1.MessageExists{
+		"exists-test@example.com":   {Exists: true, ID: id},
+		"<exists-test@example.com>": {Exists: true, ID: id},
+		"missing@example.com":       {Exists: false, ID: ""},
+	} {
+		b, err := clientGet(ts.URL + "/api/v1/messages/exists?message_id=" + url.QueryEscape(messageID))
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		res := apiv1.MessageExists{}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		assertEqual(t, res, expected, "wrong Message-ID exists result")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages/exists"); err == nil {
+		t.Error("expected request without a message_id to fail")
+	}
+}
+
+func TestAPIv1MessageNavigation(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	small := []byte("Subject: Small\r\n\r\nBody\r\n")
+	smallID, err := storage.Store(&small)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	large := []byte("Subject: Large\r\n\r\nA much larger message body\r\n")
+	largeID, err := storage.Store(&large)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	b, err := clientGet(ts.URL + "/api/v1/message/" + largeID + "/nav?sort=size&order=asc")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	res := apiv1.MessageNavigation{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	if res.Prev == nil || *res.Prev != smallID {
+		t.Error("wrong previous message ID")
+	}
+	if res.Next != nil {
+		t.Error("expected no next message")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + smallID + "/nav?sort=invalid"); err == nil {
+		t.Error("expected request with an invalid sort field to fail")
+	}
+}
+
+func TestAPIv1PageSize(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m := apiv1.MessagesSummary{}
+
+	data, err := clientGet(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(m.Messages), config.APIDefaultPageSize, "wrong default page size")
+
+	if _, err := clientGet(ts.URL + fmt.Sprintf("/api/v1/messages?limit=%d", config.APIMaxPageSize)); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if _, err := clientGet(ts.URL + fmt.Sprintf("/api/v1/messages?limit=%d", config.APIMaxPageSize+1)); err == nil {
+		t.Error("expected request exceeding the maximum page size to fail")
+	}
+
+	if _, err := clientGet(ts.URL + fmt.Sprintf("/api/v1/search?query=subject&limit=%d", config.APIMaxPageSize+1)); err == nil {
+		t.Error("expected search exceeding the maximum page size to fail")
+	}
+}
+
+func TestAPIv1MessagesCursor(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	seen := map[string]bool{}
+	pages := 0
+	uri := ts.URL + "/api/v1/messages?limit=30"
+
+	for {
+		m, err := fetchMessages(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages++
+		for _, msg := range m.Messages {
+			if seen[msg.ID] {
+				t.Errorf("message %s returned twice", msg.ID)
+			}
+			seen[msg.ID] = true
+		}
+
+		if m.NextCursor == "" {
+			break
+		}
+
+		uri = ts.URL + "/api/v1/messages?limit=30&cursor=" + url.QueryEscape(m.NextCursor)
+	}
+
+	assertEqual(t, pages, 4, "wrong number of pages")
+	assertEqual(t, len(seen), 100, "wrong number of messages")
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?cursor=invalid"); err == nil {
+		t.Error("expected request with an invalid cursor to fail")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?tags=a&cursor=eyJjIjoxLCJpIjoiYSJ9"); err == nil {
+		t.Error("expected filtered request with a cursor to fail")
+	}
+}
+
+func TestAPIv1DownloadMbox(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status code")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), `attachment; filename="mailpit-export.mbox"`, "wrong Content-Disposition header")
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(regexp.MustCompile(`(?m)^From \S+ `).FindAll(data, -1)), 100, "wrong number of messages exported")
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(ts.URL + "/api/v1/messages/download?ids=" + m.Messages[0].ID + "," + m.Messages[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(regexp.MustCompile(`(?m)^From \S+ `).FindAll(data, -1)), 2, "wrong number of messages exported")
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages/download?ids=does-not-exist"); err == nil {
+		t.Error("expected export of a missing message to fail")
+	}
+}
+
+func TestAPIv1ImportMessages(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	upload := func(filename, data string) (apiv1.ImportResult, error) {
+		res := apiv1.ImportResult{}
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			return res, err
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			return res, err
+		}
+		if err := mw.Close(); err != nil {
+			return res, err
+		}
+
+		resp, err := http.Post(ts.URL+"/api/v1/messages/import", mw.FormDataContentType(), body)
+		if err != nil {
+			return res, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return res, fmt.Errorf("import returned status %d", resp.StatusCode)
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&res)
+
+		return res, err
+	}
+
+	mbox := "From sender@example.com Mon Jan  2 15:04:05 2006\n" +
+		"From: sender@example.com\nSubject: First\nMessage-ID: <first@example.com>\n\n>From the start of a line\n\n" +
+		"From sender@example.com Mon Jan  2 15:04:06 2006\n" +
+		"From: sender@example.com\nSubject: Second\nMessage-ID: <second@example.com>\n\nSecond message\n\n"
+
+	res, err := upload("export.mbox", mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res, apiv1.ImportResult{Imported: 2}, "wrong import result")
+
+	// the file type is detected from the contents
+	res, err = upload("export", mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res, apiv1.ImportResult{Skipped: 2}, "wrong import result for duplicate messages")
+
+	res, err = upload("message.eml", "From: sender@example.com\r\nSubject: EML\r\n\r\nTest\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res, apiv1.ImportResult{Imported: 1}, "wrong import result for EML file")
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 3, 3)
+
+	if _, err := upload("invalid.mbox", "Not an mbox file\n"); err == nil {
+		t.Error("expected an error for an invalid mbox file")
+	}
+
+	// the result of the last mbox import is sent when no import is running
+	data, err := clientGet(ts.URL + "/api/v1/messages/import/progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "data: {\"Running\":false,\"Imported\":0,\"Skipped\":0}\n\n", "wrong import progress")
+}
+
+func TestAPIv1Vacuum(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing database vacuum")
+
+	insertEmailData(t)
+
+	messages, err := storage.List(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	// deleting messages does not reclaim the space
+	if err := storage.DeleteMessages(ids); err != nil {
+		t.Fatal(err)
+	}
+
+	dbSize := func() int64 {
+		info, err := storage.GetDatabaseSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return info.PhysicalBytes + info.WALBytes
+	}
+
+	sizeBefore := dbSize()
+
+	if _, err := clientPost(ts.URL+"/api/v1/admin/vacuum", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sizeAfter := dbSize()
+
+	if sizeAfter >= sizeBefore {
+		t.Fatalf("database did not shrink after vacuum: %d >= %d bytes", sizeAfter, sizeBefore)
+	}
+}
+
+func TestAPIv1ForwardMessage(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing message forwarding")
+
+	addr, received := startTestSMTPServer(t)
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nBcc: hidden@example.com\r\nSubject: Forward\r\n\r\nTest\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["staging@example.com"]}`); err == nil {
+		t.Error("expected forwarding without an SMTP server to fail")
+	}
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["invalid"],"smtpAddr":"`+addr+`"}`); err == nil {
+		t.Error("expected forwarding to an invalid address to fail")
+	}
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["staging@example.com"],"smtpAddr":"`+addr+`"}`); err == nil {
+		t.Error("expected forwarding via a server which is not allowed to fail")
+	}
+
+	config.ForwardAllowedHosts = []string{addr}
+	defer func() { config.ForwardAllowedHosts = nil }()
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["staging@example.com"],"smtpAddr":"`+addr+`"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+	assertEqual(t, msg.from, "sender@example.com", "wrong MAIL FROM")
+	assertEqual(t, strings.Join(msg.to, ","), "staging@example.com", "wrong RCPT TO")
+	assertEqual(t, strings.Contains(msg.data, "Subject: Forward\n"), true, "message not forwarded unchanged")
+	assertEqual(t, strings.Contains(msg.data, "Bcc:"), false, "Bcc header should be removed")
+
+	// default relay server
+	host, port, _ := net.SplitHostPort(addr)
+	config.SMTPRelayConfig.Host = host
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	config.ReleaseEnabled = true
+	defer func() {
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
+		config.ReleaseEnabled = false
+	}()
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["default@example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = <-received
+	assertEqual(t, strings.Join(msg.to, ","), "default@example.com", "wrong RCPT TO")
+
+	// the relay recipient allowlist applies to allowed hosts too
+	config.SMTPRelayConfig.AllowedRecipientsRegexp = regexp.MustCompile(`@example\.com$`)
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/forward", `{"to":["staging@example.net"],"smtpAddr":"`+addr+`"}`); err == nil {
+		t.Error("expected forwarding to a recipient which is not allowed to fail")
+	}
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/invalid/forward", `{"to":["default@example.com"]}`); err == nil {
+		t.Error("expected forwarding a missing message to fail")
+	}
+}
+
+func TestAPIv1CustomHeaders(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\nX-Campaign-ID: abc\r\nX-Test-Run: 42\r\nX-Mailer: test\r\nSubject: Headers\r\n\r\nTest\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/custom-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := http.Header{}
+	if err := json.Unmarshal(data, &headers); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(headers), 3, "wrong number of headers")
+	assertEqual(t, headers.Get("X-Campaign-ID"), "abc", "wrong X-Campaign-ID")
+	assertEqual(t, headers.Get("X-Test-Run"), "42", "wrong X-Test-Run")
+	assertEqual(t, headers.Get("X-Mailer"), "test", "wrong X-Mailer")
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/missing/custom-headers"); err == nil {
+		t.Error("expected a missing message to fail")
+	}
+}
+
+func TestAPIv1MessageDelivery(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("Received: from relay.example.com (relay.example.com [192.0.2.2])\r\n" +
+		"        by mx.example.com with ESMTP id abc123\r\n" +
+		"        for <recipient@example.com>; Wed, 14 Oct 2026 10:00:05 +0000 (UTC)\r\n" +
+		"Received: from client.example.com (unknown [192.0.2.1]) by relay.example.com with SMTP;\r\n" +
+		"        Wed, 14 Oct 2026 11:59:55 +0200\r\n" +
+		"From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Delivery\r\n\r\nTest\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := clientGet(ts.URL + "/api/v1/message/" + id + "/delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := apiv1.DeliveryDetails{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(d.SMTPHops), 2, "hop count")
+	assertEqual(t, d.SMTPHops[0].From, "client.example.com", "oldest hop sender")
+	assertEqual(t, d.SMTPHops[1].By, "mx.example.com", "newest hop receiver")
+	assertEqual(t, d.TransitTime, float64(10), "transit time")
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/missing/delivery"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestAPIv1CSPAnalysis(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nSubject: CSP\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" +
+		`<p>Test</p><img src="http://example.com/image.png"><script>alert(1)</script>` + "\r\n")
+
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := clientGet(ts.URL + "/api/v1/message/latest/csp-analysis")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := apiv1.CSPReport{}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(report.Violations), 2, "violation count")
+	assertEqual(t, report.Violations[0].Directive, "img-src", "image violation directive")
+	assertEqual(t, report.Violations[1].Element, "script", "script violation element")
+	assertEqual(t, len(report.Recommendations), 2, "recommendation count")
+}
+
+func TestAPIv1RegenerateSnippets(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing snippet regeneration")
+
+	insertEmailData(t)
+
+	resp, err := http.Post(ts.URL+"/api/v1/admin/regen-snippets", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status code")
+	assertEqual(t, resp.Header.Get("Content-Type"), "text/event-stream", "wrong Content-Type")
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := strings.Split(strings.TrimSpace(string(data)), "\n\n")
+
+	p := apiv1.RegenerateSnippetsProgress{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-1], "data: ")), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, p.Running, false, "regeneration should be finished")
+	assertEqual(t, p.Processed, 100, "wrong number of processed messages")
+	assertEqual(t, p.Total, 100, "wrong total")
+	assertEqual(t, p.Error, "", "unexpected error")
+}
+
+func TestAPIv1DownloadZIP(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing ZIP download")
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		env, err := enmime.Builder().
+			From("Sender", "sender@example.com").
+			To("Recipient", "recipient@example.com").
+			Subject(fmt.Sprintf("ZIP %d", i)).
+			Text([]byte("Attached")).
+			AddAttachment([]byte("report"), "text/plain", "report.txt").
+			AddAttachment([]byte("duplicate"), "text/plain", "report.txt").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := env.Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		raw := buf.Bytes()
+		id, err := storage.Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	readZIP := func(data []byte) map[string]string {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := map[string]string{}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(r)
+			r.Close()
+			files[f.Name] = string(b)
+		}
+
+		return files
+	}
+
+	data, err := clientPost(ts.URL+"/api/v1/messages/download-zip", `{"ids":["`+ids[1]+`"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := readZIP(data)
+	assertEqual(t, len(files), 3, "wrong number of files")
+	assertEqual(t, files[ids[1]+"/report.txt"], "report", "wrong attachment content")
+	assertEqual(t, files[ids[1]+"/report-1.txt"], "duplicate", "wrong duplicate attachment content")
+	if !strings.Contains(files[ids[1]+".eml"], "Subject: ZIP 1") {
+		t.Error("expected the raw message")
+	}
+	assertEqual(t, storage.IsUnread(ids[1]), true, "exported message should not be marked read")
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages/download-zip?ids=all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assertEqual(t, resp.Header.Get("Content-Type"), "application/zip", "wrong Content-Type")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), `attachment; filename="mailpit-export.zip"`, "wrong Content-Disposition")
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files = readZIP(data)
+	assertEqual(t, len(files), 6, "wrong number of files")
+	for _, id := range ids {
+		if _, ok := files[id+".eml"]; !ok {
+			t.Errorf("expected %s.eml", id)
+		}
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages/download-zip?ids=does-not-exist"); err == nil {
+		t.Error("expected a missing message to fail")
+	}
+}
+
+func TestAPIv1Feeds(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	rss := struct {
+		Channel struct {
+			Link  string `xml:"link"`
+			Items []struct {
+				Title  string `xml:"title"`
+				Link   string `xml:"link"`
+				Author string `xml:"author"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}{}
+
+	b, err := clientGet(ts.URL + "/api/v1/messages/rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xml.Unmarshal(b, &rss); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, rss.Channel.Link, ts.URL+"/", "RSS channel link")
+	assertEqual(t, len(rss.Channel.Items), 50, "RSS item count")
+	assertEqual(t, rss.Channel.Items[0].Title, "Subject line 99 end", "RSS item title")
+	assertEqual(t, rss.Channel.Items[0].Author, "from-99@example.com (From 99)", "RSS item author")
+	assertEqual(t, strings.HasPrefix(rss.Channel.Items[0].Link, ts.URL+"/view/"), true, "RSS item link")
+
+	atom := struct {
+		Entries []struct {
+			Title  string `xml:"title"`
+			Author struct {
+				Email string `xml:"email"`
+			} `xml:"author"`
+		} `xml:"entry"`
+	}{}
+
+	b, err = clientGet(ts.URL + "/api/v1/messages/atom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xml.Unmarshal(b, &atom); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(atom.Entries), 50, "Atom entry count")
+	assertEqual(t, atom.Entries[49].Title, "Subject line 50 end", "Atom entry title")
+	assertEqual(t, atom.Entries[49].Author.Email, "from-50@example.com", "Atom entry author")
+
+	// filtered by tag
+	atom.Entries = nil
+
+	b, err = clientGet(ts.URL + "/api/v1/messages/atom?tag=" + url.QueryEscape("Test tag 010"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xml.Unmarshal(b, &atom); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(atom.Entries), 1, "Atom tag entry count")
+	assertEqual(t, atom.Entries[0].Title, "Subject line 10 end", "Atom tag entry title")
+}
+
+func TestAPIv1Events(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	assertEqual(t, res.StatusCode, http.StatusOK, "SSE status code")
+	assertEqual(t, res.Header.Get("Content-Type"), "text/event-stream", "SSE content type")
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			msg := enmime.Builder().
+				From("From", "from@example.com").
+				Subject(fmt.Sprintf("SSE message %d", i)).
+				Text([]byte("This is the email body")).
+				To("To", "to@example.com")
+
+			env, err := msg.Build()
+			if err != nil {
+				t.Log("error ", err)
+				return
+			}
+
+			buf := new(bytes.Buffer)
+			if err := env.Encode(buf); err != nil {
+				t.Log("error ", err)
+				return
+			}
+
+			b := buf.Bytes()
+			if _, err := storage.Store(&b); err != nil {
+				t.Log("error ", err)
+				return
+			}
+		}
+	}()
+
+	type event struct {
+		Type string
+		Data struct {
+			Subject string
+		}
+	}
+
+	events := []event{}
+	done := make(chan error, 1)
+
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			e := event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				done <- err
+				return
+			}
+
+			// mailbox stats are broadcast asynchronously, so may be interleaved
+			if e.Type == "stats" {
+				continue
+			}
+
+			events = append(events, e)
+			if len(events) == 3 {
+				done <- nil
+				return
+			}
+		}
+		done <- scanner.Err()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+
+	for i, e := range events {
+		assertEqual(t, e.Type, "new", "SSE event type")
+		assertEqual(t, e.Data.Subject, fmt.Sprintf("SSE message %d", i), "SSE event subject")
+	}
+}
+
+func TestAPIv1SavedSearches(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	b, err := clientPost(ts.URL+"/api/v1/saved-searches", `{"name":"CI failures","query":"tag:ci"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := apiv1.SavedSearch{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, saved.Name, "CI failures", "saved search name")
+	assertEqual(t, saved.Query, "tag:ci", "saved search query")
+
+	searches := []apiv1.SavedSearch{}
+	b, err = clientGet(ts.URL + "/api/v1/saved-searches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &searches); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(searches), 1, "saved search count")
+	assertEqual(t, searches[0].ID, saved.ID, "saved search ID")
+
+	res, err := http.Post(ts.URL+"/api/v1/saved-searches", "application/json", strings.NewReader(`{"name":"ci failures","query":"tag:other"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assertEqual(t, res.StatusCode, http.StatusConflict, "duplicate saved search status code")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/saved-searches/"+saved.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	searches, err = storage.GetSavedSearches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(searches), 0, "saved search not deleted")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/saved-searches/"+saved.ID, ""); err == nil {
+		t.Error("expected error deleting missing saved search")
+	}
+}
+
+func TestAPIv1Backup(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing database backup")
+
+	insertEmailData(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/admin/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status code")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), `attachment; filename="mailpit-backup.db"`, "wrong Content-Disposition header")
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, string(data[:16]), "SQLite format 3\x00", "backup is not an SQLite database")
+}
+
+func TestAPIv1DownloadRawPart(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("Testing raw message part downloads")
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Parts").
+		Text([]byte("Attached")).
+		AddAttachment([]byte("report"), "text/plain", "report.txt").
+		AddAttachment([]byte("résumé"), "text/plain", "résumé.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		// parts without a file name are named after the part ID
+		"1": `attachment; filename=part-1.txt`,
+		"2": `attachment; filename=report.txt`,
+		"3": `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.txt`,
+	}
+
+	for partID, disposition := range tests {
+		resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/part/" + partID + "/raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status code")
+		assertEqual(t, resp.Header.Get("Content-Disposition"), disposition, "wrong Content-Disposition header for part "+partID)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.EnableMetrics = true
+	defer func() { config.EnableMetrics = false }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	// the gauges are updated with the (delayed) mailbox stats broadcast
+	storage.BroadcastMailboxStats()
+	time.Sleep(600 * time.Millisecond)
+
+	data, err := clientGet(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(name string) float64 {
+		f, ok := families[name]
+		if !ok || len(f.GetMetric()) == 0 {
+			t.Errorf("metric %s not found", name)
+			return 0
+		}
+
+		m := f.GetMetric()[0]
+		if m.GetCounter() != nil {
+			return m.GetCounter().GetValue()
+		}
+
+		return m.GetGauge().GetValue()
+	}
+
+	if v := value("mailpit_messages_total"); v < 100 {
+		t.Errorf("expected at least 100 stored messages, got %v", v)
+	}
+	assertEqual(t, value("mailpit_messages_unread"), float64(100), "wrong number of unread messages")
+	if v := value("mailpit_storage_bytes"); v <= 0 {
+		t.Errorf("expected a mailbox size, got %v", v)
+	}
+	if v := value("mailpit_db_size_bytes"); v <= 0 {
+		t.Errorf("expected a database size, got %v", v)
+	}
+	value("mailpit_smtp_received_total")
+	value("mailpit_smtp_errors_total")
+}
+
+func TestAPIv1MessagesByTags(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	for mode, count := range map[string]int{"any": 2, "all": 0} {
+		m := apiv1.MessagesSummary{}
+
+		data, err := clientGet(ts.URL + "/api/v1/messages?tags=" + url.QueryEscape("Test tag 001,Test tag 002") + "&tag_mode=" + mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, m.MessagesCount, count, "wrong messages count for tag mode "+mode)
+		assertEqual(t, len(m.Messages), count, "wrong number of messages for tag mode "+mode)
+		assertEqual(t, m.Total, 100, "wrong total")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?tags=a&tag_mode=invalid"); err == nil {
+		t.Error("expected request with an invalid tag mode to fail")
+	}
+}
+
+func TestAPIv1MessagesWithFilter(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
 	insertEmailData(t)
-	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
 
-	// search
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "from-1@example.com", 1)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "from:from-1@example.com", 1)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "-from:from-1@example.com", 99)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "-FROM:FROM-1@EXAMPLE.COM", 99)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "to:from-1@example.com", 0)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "from:@example.com", 100)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "subject:\"Subject line\"", 100)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "subject:\"SUBJECT LINE 17 END\"", 1)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "!thisdoesnotexist", 100)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "-ThisDoesNotExist", 100)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "thisdoesnotexist", 0)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"Test tag 065\"", 1)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"TEST TAG 065\"", 1)
-	assertSearchEqual(t, ts.URL+"/api/v1/search", "!tag:\"Test tag 023\"", 99)
+	tests := map[string]int{
+		"unread=true":           100,
+		"unread=false":          0,
+		"has-attachments=false": 100,
+		"has-attachments=true":  0,
+		"unread=true&tags=" + url.QueryEscape("Test tag 001"): 1,
+		// tags must all match
+		"unread=true&tags=" + url.QueryEscape("Test tag 001,Test tag 002"): 0,
+	}
+
+	for query, count := range tests {
+		m, err := fetchMessages(ts.URL + "/api/v1/messages?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, m.MessagesCount, count, "wrong messages count for "+query)
+		assertEqual(t, m.Total, 100, "wrong total for "+query)
+	}
+
+	for _, query := range []string{"unread=maybe", "unread=true&tags=a,b&tag_mode=any", "unread=true&from_domain=example.com", "has-attachments=false&content_type=text/plain"} {
+		if _, err := clientGet(ts.URL + "/api/v1/messages?" + query); err == nil {
+			t.Errorf("expected request %s to fail", query)
+		}
+	}
+}
+
+func TestAPIv1RenderMessageHTML(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("HTML message").
+		HTML([]byte("<p>Hello</p>")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + apiv1.GetMessageHTMLPreviewURL(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "render status")
+	assertEqual(t, resp.Header.Get("Cache-Control"), "no-store", "Cache-Control header")
+	assertEqual(t, resp.Header.Get("Content-Security-Policy"), config.MessagePreviewCSP, "Content-Security-Policy header")
+
+	if _, err := clientGet(ts.URL + apiv1.GetMessageHTMLPreviewURL("missing")); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.APIKey = "secret-key"
+	defer func() { config.APIKey = "" }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages"); err == nil {
+		t.Error("expected request without an API key to fail")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?api_key=wrong-key"); err == nil {
+		t.Error("expected request with an invalid API key to fail")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?api_key=secret-key"); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/messages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", "secret-key")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "X-API-Key header")
+
+	// the web UI uses the API via the session cookie issued with the web UI
+	rec := httptest.NewRecorder()
+	middleWareFunc(index)(rec, httptest.NewRequest("GET", "/", nil))
+
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == middleware.UISessionCookie {
+			cookie = c
+		}
+	}
+
+	if cookie == nil {
+		t.Fatal("web UI session cookie not issued")
+	}
+
+	req, err = http.NewRequest("GET", ts.URL+"/api/v1/messages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "web UI session cookie")
+}
+
+func TestAPITokens(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	if err := auth.SetAPITokens([]byte("read-token:\n  scope: read\nwrite-token:\n  scope: write\nadmin-token:\n  scope: admin\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.APITokens = nil }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	do := func(method, uri, token, body string) int {
+		req, err := http.NewRequest(method, ts.URL+uri, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assertEqual(t, do("GET", "/api/v1/messages", "", ""), http.StatusUnauthorized, "request without a token")
+	assertEqual(t, do("GET", "/api/v1/messages", "wrong-token", ""), http.StatusUnauthorized, "request with an invalid token")
+
+	endpoints := []struct {
+		method, uri, body string
+		scope             auth.APIScope
+	}{
+		{"GET", "/api/v1/messages", "", auth.ScopeRead},
+		{"GET", "/api/v1/search?query=test", "", auth.ScopeRead},
+		{"GET", "/api/v1/tags", "", auth.ScopeRead},
+		{"GET", "/api/v1/info", "", auth.ScopeRead},
+		{"GET", "/api/v1/stats", "", auth.ScopeRead},
+		{"PUT", "/api/v1/messages", `{"IDs":[],"Read":true}`, auth.ScopeWrite},
+		{"PUT", "/api/v1/tags", `{"IDs":[],"Tags":[]}`, auth.ScopeWrite},
+		{"POST", "/api/v1/messages/summaries", `{"IDs":[]}`, auth.ScopeWrite},
+		{"DELETE", "/api/v1/search/history", "", auth.ScopeWrite},
+		{"DELETE", "/api/v1/messages", `{"IDs":[]}`, auth.ScopeWrite},
+		{"GET", "/api/v1/admin/backup", "", auth.ScopeAdmin},
+		{"POST", "/api/v1/admin/vacuum", "", auth.ScopeAdmin},
+	}
+
+	tokens := map[auth.APIScope]string{
+		auth.ScopeRead:  "read-token",
+		auth.ScopeWrite: "write-token",
+		auth.ScopeAdmin: "admin-token",
+	}
+
+	for scope, token := range tokens {
+		for _, e := range endpoints {
+			code := do(e.method, e.uri, token, e.body)
+			if scope < e.scope {
+				assertEqual(t, code, http.StatusForbidden, fmt.Sprintf("%s token %s %s", scope, e.method, e.uri))
+			} else {
+				assertEqual(t, code, http.StatusOK, fmt.Sprintf("%s token %s %s", scope, e.method, e.uri))
+			}
+		}
+	}
+
+	// the web UI uses the API via the session cookie issued with the web UI, without web UI authentication
+	rec := httptest.NewRecorder()
+	middleWareFunc(index)(rec, httptest.NewRequest("GET", "/", nil))
+	assertEqual(t, rec.Code, http.StatusOK, "web UI without web UI authentication")
+
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == middleware.UISessionCookie {
+			cookie = c
+		}
+	}
+
+	if cookie == nil {
+		t.Fatal("web UI session cookie not issued")
+	}
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/v1/search/history", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "web UI session cookie")
+
+	// Basic Auth continues to work independently of API tokens
+	if err := auth.SetUIAuth("user:{PLAIN}pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.UICredentials = nil }()
+
+	req, err = http.NewRequest("DELETE", ts.URL+"/api/v1/search/history", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("user", "pass")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "basic auth request")
+	assertEqual(t, do("GET", "/api/v1/messages", "read-token", ""), http.StatusOK, "token request with basic auth enabled")
+	assertEqual(t, do("GET", "/api/v1/messages", "", ""), http.StatusUnauthorized, "request without credentials")
+}
+
+func TestAdminIPRanges(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.AdminIPRanges = []string{"10.0.0.0/8"}
+	defer func() { config.AdminIPRanges = []string{} }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages"); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", `{"IDs":[]}`); err == nil {
+		t.Error("expected admin request from outside the admin IP ranges to fail")
+	}
+
+	adminRoutes := []struct{ method, path string }{
+		{"GET", "/api/v1/messages/download"},
+		{"GET", "/api/v1/messages/download-zip?ids=all"},
+		{"POST", "/api/v1/messages/download-zip"},
+		{"POST", "/api/v1/message/latest/forward"},
+		{"POST", "/api/v1/message/latest/resubmit"},
+		{"POST", "/api/v1/messages/import"},
+		{"POST", "/api/v1/smtp/pause"},
+		{"POST", "/api/v1/smtp/resume"},
+		{"POST", "/api/v1/tags/merge"},
+		{"PUT", "/api/v1/tags/example"},
+	}
+
+	for _, route := range adminRoutes {
+		req, err := http.NewRequest(route.method, ts.URL+route.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assertEqual(t, resp.StatusCode, http.StatusForbidden, fmt.Sprintf("%s %s from outside the admin IP ranges", route.method, route.path))
+	}
+
+	config.AdminIPRanges = []string{"127.0.0.1/32"}
+
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", `{"IDs":[]}`); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestPreventDeleteAll(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.PreventDeleteAll = true
+	config.DeleteAllConfirmToken = "secret"
+	defer func() {
+		config.PreventDeleteAll = false
+		config.DeleteAllConfirmToken = ""
+	}()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nSubject: Delete\r\n\r\nTest\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", `{"IDs":[]}`); err == nil {
+		t.Error("expected deleting all messages without a confirmation token to fail")
+	}
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/v1/messages", strings.NewReader(`{"IDs":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Confirm-Delete", "invalid")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusForbidden, "invalid confirmation token status")
+	assertEqual(t, storage.CountTotal(), 1, "messages should not be deleted")
+
+	// individual messages can be deleted without a token
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", `{"IDs":["`+id+`"]}`); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("DELETE", ts.URL+"/api/v1/messages", strings.NewReader(`{"IDs":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Confirm-Delete", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusOK, "valid confirmation token status")
+	assertEqual(t, storage.CountTotal(), 0, "messages should be deleted")
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	get := func(uri string) http.Header {
+		ts := httptest.NewServer(apiRoutes())
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.Header
+	}
+
+	// default headers
+	h := get("/api/v1/messages")
+	assertEqual(t, h.Get("X-Content-Type-Options"), "nosniff", "default X-Content-Type-Options header")
+	assertEqual(t, h.Get("X-Frame-Options"), "DENY", "default X-Frame-Options header")
+	assertEqual(t, h.Get("Referrer-Policy"), "no-referrer", "default Referrer-Policy header")
+	assertEqual(t, h.Get("Strict-Transport-Security"), "", "default Strict-Transport-Security header without HTTPS")
+
+	// the message source is displayed by the web UI in an iframe
+	msg := []byte("Subject: Frame test\r\n\r\nBody\r\n")
+	id, err := storage.Store(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, get("/api/v1/message/"+id+"/raw").Get("X-Frame-Options"), "SAMEORIGIN", "message source X-Frame-Options header")
+
+	// HSTS is added with HTTPS
+	config.UITLSCert = "cert.pem"
+	config.UITLSKey = "key.pem"
+	h = get("/api/v1/messages")
+	config.UITLSCert = ""
+	config.UITLSKey = ""
+	assertEqual(t, h.Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains", "Strict-Transport-Security header with HTTPS")
+
+	config.SecurityHeaders = map[string]string{
+		"x-frame-options":    "DENY",
+		"Referrer-Policy":    "",
+		"Permissions-Policy": "camera=()",
+	}
+	defer func() { config.SecurityHeaders = nil }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.Header.Get("X-Content-Type-Options"), "nosniff", "X-Content-Type-Options header")
+	assertEqual(t, resp.Header.Get("X-Frame-Options"), "DENY", "X-Frame-Options header")
+	assertEqual(t, resp.Header.Get("Referrer-Policy"), "", "Referrer-Policy header")
+	assertEqual(t, resp.Header.Get("Permissions-Policy"), "camera=()", "Permissions-Policy header")
+	assertEqual(t, resp.Header.Get("Strict-Transport-Security"), "", "Strict-Transport-Security header")
+
+	// a custom X-Frame-Options header is not relaxed for the message source
+	config.SecurityHeaders = map[string]string{"X-Frame-Options": "DENY"}
+	assertEqual(t, get("/api/v1/message/"+id+"/raw").Get("X-Frame-Options"), "DENY", "custom message source X-Frame-Options header")
 }
 
 func setup() {
@@ -307,6 +1966,76 @@ func fetchMessages(url string) (apiv1.MessagesSummary, error) {
 	return m, nil
 }
 
+type testSMTPMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// startTestSMTPServer starts a minimal loopback SMTP server, returning its address and a
+// channel receiving each delivered message
+func startTestSMTPServer(t *testing.T) (string, chan testSMTPMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan testSMTPMessage, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				tp := textproto.NewConn(c)
+				msg := testSMTPMessage{}
+				_ = tp.PrintfLine("220 localhost ESMTP")
+
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+
+					cmd := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						_ = tp.PrintfLine("250 localhost")
+					case strings.HasPrefix(cmd, "MAIL FROM:"):
+						msg.from = strings.Trim(line[10:], "<> ")
+						_ = tp.PrintfLine("250 OK")
+					case strings.HasPrefix(cmd, "RCPT TO:"):
+						msg.to = append(msg.to, strings.Trim(line[8:], "<> "))
+						_ = tp.PrintfLine("250 OK")
+					case cmd == "DATA":
+						_ = tp.PrintfLine("354 Go ahead")
+						data, err := tp.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						msg.data = string(data)
+						_ = tp.PrintfLine("250 OK")
+						received <- msg
+					case cmd == "QUIT":
+						_ = tp.PrintfLine("221 Bye")
+						return
+					default:
+						_ = tp.PrintfLine("250 OK")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
 func clientGet(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -373,6 +2102,31 @@ func clientPut(url, body string) ([]byte, error) {
 	return data, err
 }
 
+func clientPost(url, body string) ([]byte, error) {
+	client := new(http.Client)
+
+	b := strings.NewReader(body)
+	req, err := http.NewRequest("POST", url, b)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+
+	return data, err
+}
+
 func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
 	if a == b {
 		return
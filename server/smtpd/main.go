@@ -0,0 +1,635 @@
+// Package smtpd is the SMTP daemon
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/errorreport"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/ratelimit"
+	"github.com/axllent/mailpit/internal/relay"
+	"github.com/axllent/mailpit/internal/stats"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tracing"
+	"github.com/axllent/mailpit/server/metrics"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// DisableReverseDNS allows rDNS to be disabled
+	DisableReverseDNS bool
+)
+
+// SessionHeader is the header containing the SMTP session ID, added when config.InjectSessionHeader is enabled
+const SessionHeader = "X-Mailpit-Session"
+
+func mailHandler(origin net.Addr, sessionID, from string, to []string, data []byte, dsn *DSN) error {
+	defer errorreport.Recover("smtp")
+
+	if !config.SMTPStrictRFCHeaders {
+		// replace all <CR><CR><LF> (\r\r\n) with <CR><LF> (\r\n)
+		// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
+		data = bytes.ReplaceAll(data, []byte("\r\r\n"), []byte("\r\n"))
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		logger.Log().Errorf("[smtpd] error parsing message: %s", err.Error())
+		stats.LogSMTPRejected()
+		logTransaction(origin, from, to, "", storage.SMTPTransactionRejected)
+		return err
+	}
+
+	// check / set the Return-Path based on SMTP from
+	returnPath := strings.Trim(msg.Header.Get("Return-Path"), "<>")
+	if returnPath != from {
+		if returnPath != "" {
+			// replace Return-Path
+			re := regexp.MustCompile(`(?i)(^|\n)(Return\-Path: .*\n)`)
+			replaced := false
+			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
+				if replaced {
+					return r
+				}
+				replaced = true // only replace first occurrence
+
+				return re.ReplaceAll(r, []byte("${1}Return-Path: <"+from+">\r\n"))
+			})
+		} else {
+			// add Return-Path
+			data = append([]byte("Return-Path: <"+from+">\r\n"), data...)
+		}
+	}
+
+	messageID := strings.Trim(msg.Header.Get("Message-Id"), "<>")
+
+	// add a message ID if not set
+	if messageID == "" {
+		// generate unique ID
+		messageID = shortuuid.New() + "@mailpit"
+		// add unique ID
+		data = append([]byte("Message-Id: <"+messageID+">\r\n"), data...)
+	} else if config.IgnoreDuplicateIDs {
+		if storage.MessageIDExists(messageID) {
+			sessionLog().Debugf("[smtpd] duplicate message found, ignoring %s", messageID)
+			stats.LogSMTPIgnored()
+			metrics.DuplicateDropped()
+			logTransaction(origin, from, to, messageID, storage.SMTPTransactionIgnored)
+			return nil
+		}
+	}
+
+	// the message is relayed without any added Bcc header once stored
+	relayData := data
+
+	// build array of all addresses in the header to compare to the []to array
+	emails, hasBccHeader := scanAddressesInHeader(msg.Header)
+
+	missingAddresses := []string{}
+	for _, a := range to {
+		// loop through passed email addresses to check if they are in the headers
+		if _, err := mail.ParseAddress(a); err == nil {
+			_, ok := emails[strings.ToLower(a)]
+			if !ok {
+				missingAddresses = append(missingAddresses, a)
+			}
+		} else {
+			logger.Log().Warnf("[smtpd] ignoring invalid email address: %s", a)
+		}
+	}
+
+	// add missing email addresses to Bcc (eg: Laravel doesn't include these in the headers)
+	if len(missingAddresses) > 0 {
+		if hasBccHeader {
+			// email already has Bcc header, add to existing addresses
+			re := regexp.MustCompile(`(?i)(^|\n)(Bcc: )`)
+			replaced := false
+			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
+				if replaced {
+					return r
+				}
+				replaced = true // only replace first occurrence
+
+				return re.ReplaceAll(r, []byte("${1}Bcc: "+strings.Join(missingAddresses, ", ")+", "))
+			})
+
+		} else {
+			// prepend new Bcc header
+			bcc := []byte(fmt.Sprintf("Bcc: %s\r\n", strings.Join(missingAddresses, ", ")))
+			data = append(bcc, data...)
+		}
+
+		logger.Log().Debugf("[smtpd] added missing addresses to Bcc header: %s", strings.Join(missingAddresses, ", "))
+	}
+
+	_, span := tracing.Tracer("github.com/axllent/mailpit/server/smtpd").Start(
+		tracing.ContextFromTraceID(msg.Header.Get(tracing.TraceIDHeader)), "smtp.store",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("smtp.from", from),
+			attribute.StringSlice("smtp.to", to),
+			attribute.Int("smtp.size_bytes", len(data)),
+			attribute.String("smtp.message_id", messageID),
+		),
+	)
+
+	id, err := storage.Store(&data)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	if errors.Is(err, storage.ErrBlockedAttachment) {
+		sessionLog().Warnf("[smtpd] rejected message from %s: %s", cleanIP(origin), err.Error())
+		stats.LogSMTPRejected()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionRejected)
+		return errors.New("552 5.3.4 Message contains a blocked attachment type")
+	}
+	if errors.Is(err, storage.ErrValidationRule) {
+		sessionLog().Warnf("[smtpd] rejected message from %s: %s", cleanIP(origin), err.Error())
+		stats.LogSMTPRejected()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionRejected)
+		return errors.New("550 5.7.1 Message rejected by content rules")
+	}
+	if errors.Is(err, storage.ErrStorageHook) {
+		sessionLog().Warnf("[smtpd] rejected message from %s: %s", cleanIP(origin), err.Error())
+		stats.LogSMTPRejected()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionRejected)
+		return errors.New("554 5.6.0 Message rejected by storage hook")
+	}
+	if errors.Is(err, storage.ErrDuplicateMessageID) {
+		sessionLog().Warnf("[smtpd] rejected duplicate message %s from %s", messageID, cleanIP(origin))
+		stats.LogSMTPRejected()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionRejected)
+		return errors.New("550 5.7.1 Duplicate Message-ID")
+	}
+	if err != nil {
+		logger.Log().Errorf("[db] error storing message: %s", err.Error())
+		metrics.SMTPError()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionRejected)
+		return err
+	}
+
+	// the message was not stored (eg: an ignored duplicate), so there is nothing to deliver
+	if id == "" {
+		sessionLog().Debugf("[smtpd] message not stored, ignoring %s", messageID)
+		stats.LogSMTPIgnored()
+		logTransaction(origin, from, to, messageID, storage.SMTPTransactionIgnored)
+		return nil
+	}
+
+	if dsn != nil {
+		d := storage.DSN{Ret: dsn.Ret, EnvID: dsn.EnvID, Recipients: map[string]storage.DSNRecipient{}}
+		for addr, r := range dsn.Recipients {
+			d.Recipients[addr] = storage.DSNRecipient{Notify: r.Notify, ORcpt: r.ORcpt}
+		}
+
+		if err := storage.SetMessageDSN(id, d); err != nil {
+			logger.Log().Errorf("[db] error storing DSN parameters: %s", err.Error())
+		}
+	}
+
+	delivery := storage.DeliveryDetails{
+		EnvelopeFrom: from,
+		EnvelopeTo:   to,
+		SenderIP:     cleanIP(origin),
+		SessionID:    sessionID,
+		ReceivedAt:   time.Now(),
+	}
+
+	if err := storage.SetMessageDelivery(id, delivery); err != nil {
+		logger.Log().Errorf("[db] error storing delivery details: %s", err.Error())
+	}
+
+	sessionLog().Debugf("[smtpd] stored message %s (Message-ID: %s) from %s", id, messageID, cleanIP(origin))
+
+	stats.LogSMTPAccepted(len(data))
+	logTransaction(origin, from, to, messageID, storage.SMTPTransactionAccepted)
+
+	// the startup self-test message is not relayed or forwarded
+	if auth.IsSelfTestMessage(messageID) {
+		return nil
+	}
+
+	// if enabled, this will route the email 1:1 through to the preconfigured smtp server(s),
+	// using the relay rules for matching recipient domains
+	for _, route := range relay.Routes(to) {
+		if err := sendWithDSN(route.Config, from, route.Recipients, relayData, dsn); err != nil {
+			logger.Log().Warnf("[smtp] error relaying message via %s:%d: %s", route.Config.Host, route.Config.Port, err.Error())
+		} else {
+			logger.Log().Debugf("[smtp] relayed message from %s via %s:%d", from, route.Config.Host, route.Config.Port)
+		}
+	}
+
+	// forward the message to the addresses of any matching forward rules
+	relay.ForwardMatching(id, msg.Header)
+
+	data = nil // avoid memory leaks
+	relayData = nil
+
+	subject := msg.Header.Get("Subject")
+	sessionLog().Debugf("[smtpd] received (%s) from:%s subject:%q", cleanIP(origin), from, subject)
+
+	return nil
+}
+
+func authHandler(remoteAddr net.Addr, mechanism string, username []byte, password []byte, _ []byte) (bool, error) {
+	allow := auth.SMTPCredentials.Match(string(username), string(password)) ||
+		auth.SelfTestLogin(string(username), string(password))
+	if allow {
+		sessionLog().Debugf("[smtpd] allow %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+	} else {
+		sessionLog().Warnf("[smtpd] deny %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+	}
+
+	return allow, nil
+}
+
+// Allow any username and password
+func authHandlerAny(remoteAddr net.Addr, mechanism string, username []byte, _ []byte, _ []byte) (bool, error) {
+	sessionLog().Debugf("[smtpd] allow %s login %q from %s", mechanism, string(username), cleanIP(remoteAddr))
+
+	return true, nil
+}
+
+// HandlerRcpt used to optionally restrict recipients based on `--smtp-allowed-recipients`
+func handlerRcpt(remoteAddr net.Addr, from string, to string) bool {
+	if config.SMTPAllowedRecipientsRegexp == nil {
+		return true
+	}
+
+	result := config.SMTPAllowedRecipientsRegexp.MatchString(to)
+
+	if !result {
+		sessionLog().Warnf("[smtpd] rejected message to %s from %s (%s)", to, from, cleanIP(remoteAddr))
+		stats.LogSMTPRejected()
+		logTransaction(remoteAddr, from, []string{to}, "", storage.SMTPTransactionRejected)
+	}
+
+	return result
+}
+
+// Listen starts the SMTPD server
+func Listen() error {
+	tracing.Init()
+
+	if config.SMTPAuthAllowInsecure {
+		if auth.SMTPCredentials != nil {
+			logger.Log().Info("[smtpd] enabling login authentication (insecure)")
+		} else if config.SMTPAuthAcceptAny {
+			logger.Log().Info("[smtpd] enabling any authentication (insecure)")
+		}
+	} else {
+		if auth.SMTPCredentials != nil {
+			logger.Log().Info("[smtpd] enabling login authentication")
+		} else if config.SMTPAuthAcceptAny {
+			logger.Log().Info("[smtpd] enabling any authentication")
+		}
+	}
+
+	smtpType := "no encryption"
+
+	if config.SMTPTLSCert != "" {
+		if config.SMTPRequireSTARTTLS {
+			smtpType = "STARTTLS required"
+		} else if config.SMTPRequireTLS {
+			smtpType = "SSL/TLS required"
+		} else {
+			smtpType = "STARTTLS optional"
+			if !config.SMTPAuthAllowInsecure && auth.SMTPCredentials != nil {
+				smtpType = "STARTTLS required"
+			}
+			if config.SMTPAutoDetectTLS {
+				smtpType = "SSL/TLS or " + smtpType
+			}
+		}
+
+	}
+
+	addrs := config.SMTPListenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{config.SMTPListen}
+	}
+
+	errs := make(chan error, len(addrs))
+
+	for _, addr := range addrs {
+		network := "tcp"
+		if len(addrs) > 1 {
+			// bind IPv4 & IPv6 addresses separately, else [::] would also bind to IPv4 (dual-stack)
+			network = listenNetwork(addr)
+		}
+
+		logger.Log().Infof("[smtpd] starting on %s (%s)", addr, smtpType)
+
+		go func(addr, network string) {
+			errs <- listenAndServe(addr, network, mailHandler, authHandler)
+		}(addr, network)
+	}
+
+	// all listeners share the same handlers, so return the first error
+	return <-errs
+}
+
+// ListenNetwork returns the network (tcp4 or tcp6) for a listen address, or tcp if
+// the address is not an IP address
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "tcp"
+	}
+
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
+
+func listenAndServe(addr, network string, handler Handler, authHandler AuthHandler) error {
+	srv := &Server{
+		Addr:              addr,
+		Network:           network,
+		Handler:           handler,
+		HandlerRcpt:       handlerRcpt,
+		Appname:           "Mailpit",
+		Hostname:          config.SMTPHostname,
+		Banner:            config.SMTPBanner,
+		MaxSize:           config.SMTPMaxMessageSize,
+		AuthHandler:       nil,
+		AuthRequired:      false,
+		MaxRecipients:     config.SMTPMaxRecipients,
+		DisableReverseDNS: DisableReverseDNS,
+		EnableDSN:         config.SMTPDSNEnabled,
+		Enable8BitMIME:    config.SMTP8BitMIME,
+		EnableCHUNKING:    config.SMTPBDATEnabled,
+	}
+
+	if config.SMTPXCLIENTEnabled {
+		srv.XClientAllowed = config.SMTPXCLIENTTrustedIPs
+	}
+
+	if config.SMTPTraceLog || config.SMTPSessionLogFile != "" {
+		srv.Trace = sessionTrace
+	}
+
+	if config.SMTPConnectionLogEnabled {
+		srv.ConnectionClosed = logConnection
+	}
+
+	if config.InjectSessionHeader {
+		srv.SessionHeader = SessionHeader
+	}
+
+	if config.SMTPTarpitDelay > 0 {
+		srv.BannerDelay = tarpitDelay
+	}
+
+	if config.SMTPRateLimitReject {
+		srv.RateLimited = rateLimited
+	}
+
+	if messageRateLimitEnabled() {
+		srv.MessageRateLimited = messageRateLimited
+	}
+
+	if config.SMTPRateLimitReject || messageRateLimitEnabled() {
+		srv.RateLimitResponse = fmt.Sprintf("%d %s", config.SMTPRateLimitResponseCode, config.SMTPRateLimitMessage)
+		srv.RateLimitRejected = rateLimitRejected
+	}
+
+	if config.SMTPAuthAllowInsecure {
+		srv.AuthMechs = authMechs()
+	}
+
+	if auth.SMTPCredentials != nil {
+		srv.AuthMechs = authMechs()
+		srv.AuthHandler = authHandler
+		srv.AuthRequired = true
+	} else if config.SMTPAuthAcceptAny {
+		srv.AuthMechs = authMechs()
+		srv.AuthHandler = authHandlerAny
+	}
+
+	if config.SMTPTLSCert != "" {
+		srv.TLSRequired = config.SMTPRequireSTARTTLS
+		srv.TLSListener = config.SMTPRequireTLS // if true overrules srv.TLSRequired
+		srv.TLSAutoDetect = config.SMTPAutoDetectTLS
+		if err := srv.ConfigureTLS(config.SMTPTLSCert, config.SMTPTLSKey); err != nil {
+			return err
+		}
+	}
+
+	registerServer(srv)
+
+	return srv.ListenAndServe()
+}
+
+// TraceLog logs an SMTP command & response as structured log fields
+func traceLog(sessionID, cmd, arg, response string, latency time.Duration) {
+	sessionLog().WithFields(logrus.Fields{
+		"session_id": sessionID,
+		"cmd":        cmd,
+		"arg":        arg,
+		"response":   response,
+		"latency_ms": latency.Milliseconds(),
+	}).Info("[smtpd] trace")
+}
+
+// AdvertisedAuthMethods returns the space-separated SMTP authentication methods advertised to clients,
+// optionally restricted by config.SMTPAuthMethods. As per RFC 4954 section 4, the plaintext PLAIN & LOGIN
+// methods are not advertised without TLS unless insecure authentication is allowed.
+func AdvertisedAuthMethods() string {
+	methods := []string{}
+
+	if config.SMTPTLSCert == "" && !config.SMTPAuthAllowInsecure {
+		return ""
+	}
+
+	for _, m := range []string{"PLAIN", "LOGIN"} {
+		if len(config.SMTPAuthMethods) > 0 && !inList(m, config.SMTPAuthMethods) {
+			continue
+		}
+		methods = append(methods, m)
+	}
+
+	return strings.Join(methods, " ")
+}
+
+// AuthMechs returns the allowed authentication mechanisms for the SMTP server.
+// CRAM-MD5 is not supported as passwords are stored hashed.
+func authMechs() map[string]bool {
+	mechs := map[string]bool{"CRAM-MD5": false, "PLAIN": false, "LOGIN": false}
+	for _, m := range strings.Fields(AdvertisedAuthMethods()) {
+		mechs[m] = true
+	}
+
+	return mechs
+}
+
+func inList(k string, list []string) bool {
+	for _, v := range list {
+		if strings.EqualFold(k, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewLMTPServer returns an LMTP server which stores messages the same way as the SMTP server.
+// LMTP is intended for local delivery, so authentication & TLS are not supported.
+func NewLMTPServer() *Server {
+	hostname := config.SMTPHostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	srv := &Server{
+		Handler:           mailHandler,
+		HandlerRcpt:       handlerRcpt,
+		Appname:           "Mailpit",
+		Hostname:          hostname,
+		LMTP:              true,
+		Banner:            config.SMTPBanner,
+		MaxSize:           config.SMTPMaxMessageSize,
+		MaxRecipients:     config.SMTPMaxRecipients,
+		DisableReverseDNS: DisableReverseDNS,
+		EnableDSN:         config.SMTPDSNEnabled,
+		Enable8BitMIME:    config.SMTP8BitMIME,
+		EnableCHUNKING:    config.SMTPBDATEnabled,
+		Timeout:           5 * time.Minute,
+	}
+
+	if config.SMTPTraceLog || config.SMTPSessionLogFile != "" {
+		srv.Trace = sessionTrace
+	}
+
+	if config.SMTPConnectionLogEnabled {
+		srv.ConnectionClosed = logConnection
+	}
+
+	if config.InjectSessionHeader {
+		srv.SessionHeader = SessionHeader
+	}
+
+	return srv
+}
+
+// Log the SMTP transaction if the transaction log is enabled
+func logTransaction(origin net.Addr, from string, to []string, messageID, status string) {
+	storage.LogSMTPTransaction(storage.SMTPTransaction{
+		ClientIP:     cleanIP(origin),
+		EnvelopeFrom: from,
+		EnvelopeTo:   to,
+		MessageID:    messageID,
+		Status:       status,
+	})
+}
+
+// RateLimitRejected logs a MAIL command or message rejected by a rate limit
+func rateLimitRejected(origin net.Addr, from string, to []string) {
+	logTransaction(origin, from, to, "", storage.SMTPTransactionRateLimited)
+}
+
+// TarpitDelay records the client connection, returning config.SMTPTarpitDelay if the client
+// has exceeded the connection frequency threshold
+func tarpitDelay(ip net.IP) time.Duration {
+	ratelimit.RecordConnection(ip)
+
+	if !ratelimit.ShouldTarpit(ip) {
+		return 0
+	}
+
+	sessionLog().Warnf("[smtpd] tarpitting %s for %s", ip, config.SMTPTarpitDelay)
+
+	return config.SMTPTarpitDelay
+}
+
+// RateLimited returns whether the client has exceeded the connection frequency threshold.
+// Connections are already recorded by tarpitDelay when tarpitting is enabled.
+func rateLimited(ip net.IP) bool {
+	if config.SMTPTarpitDelay == 0 {
+		ratelimit.RecordConnection(ip)
+	}
+
+	if !ratelimit.ShouldTarpit(ip) {
+		return false
+	}
+
+	sessionLog().Warnf("[smtpd] rejecting messages from rate-limited client %s", ip)
+
+	return true
+}
+
+// Log the SMTP connection if the connection log is enabled
+func logConnection(info ConnectionInfo) {
+	storage.LogSMTPConnection(storage.SMTPConnection{
+		RemoteAddr:        cleanIP(info.RemoteAddr),
+		ConnectedAt:       info.ConnectedAt,
+		DisconnectedAt:    info.DisconnectedAt,
+		MessagesDelivered: info.MessagesDelivered,
+		BytesReceived:     info.BytesReceived,
+		EHLOHostname:      info.EHLOHostname,
+	})
+}
+
+func cleanIP(i net.Addr) string {
+	if _, ok := i.(*net.UnixAddr); ok {
+		return "127.0.0.1"
+	}
+
+	parts := strings.Split(i.String(), ":")
+
+	return parts[0]
+}
+
+// Returns a list of all lowercased emails found in To, Cc and Bcc,
+// as well as whether there is a Bcc field
+func scanAddressesInHeader(h mail.Header) (map[string]bool, bool) {
+	emails := make(map[string]bool)
+	hasBccHeader := false
+
+	if recipients, err := h.AddressList("To"); err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+	}
+
+	if recipients, err := h.AddressList("Cc"); err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+	}
+
+	recipients, err := h.AddressList("Bcc")
+	if err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+
+		hasBccHeader = true
+	}
+
+	return emails, hasBccHeader
+}
@@ -0,0 +1,806 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+func TestMailHandlerEnvelope(t *testing.T) {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	addr := startTestServer(t, &Server{
+		Hostname: "localhost",
+		Appname:  "Mailpit",
+		Handler:  mailHandler,
+	})
+
+	msg := "From: Sender <sender@example.com>\r\nTo: recipient@example.com\r\nSubject: Envelope\r\n\r\nTest\r\n"
+	if err := smtp.SendMail(addr, nil, "bounces@example.net", []string{"recipient@example.com", "hidden@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := storage.List(0, 1)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d (%v)", len(messages), err)
+	}
+
+	m, err := storage.GetMessage(messages[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From == nil || m.From.Address != "sender@example.com" {
+		t.Errorf("expected From header sender@example.com, got %v", m.From)
+	}
+
+	if m.SMTPEnvelope.MailFrom != "bounces@example.net" {
+		t.Errorf("expected MAIL FROM bounces@example.net, got %q", m.SMTPEnvelope.MailFrom)
+	}
+
+	if len(m.SMTPEnvelope.RcptTo) != 2 || m.SMTPEnvelope.RcptTo[0] != "recipient@example.com" || m.SMTPEnvelope.RcptTo[1] != "hidden@example.com" {
+		t.Errorf("unexpected RCPT TO %v", m.SMTPEnvelope.RcptTo)
+	}
+
+	if m.SMTPEnvelope.RemoteIP != "127.0.0.1" {
+		t.Errorf("expected remote IP 127.0.0.1, got %q", m.SMTPEnvelope.RemoteIP)
+	}
+
+	// messages not received via SMTP have a blank envelope
+	raw := []byte(msg)
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.SMTPEnvelope.MailFrom != "" || len(m.SMTPEnvelope.RcptTo) != 0 || m.SMTPEnvelope.RemoteIP != "" {
+		t.Errorf("expected a blank envelope, got %+v", m.SMTPEnvelope)
+	}
+}
+
+func startTestServer(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestMailHandlerRelay(t *testing.T) {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	relayed := make(chan []byte, 2)
+	relayAddr := startTestServer(t, &Server{
+		Hostname: "localhost",
+		Appname:  "Relay",
+		Handler: func(_ net.Addr, _ string, _ string, _ []string, data []byte, _ *DSN) error {
+			relayed <- data
+			return nil
+		},
+	})
+
+	host, port, _ := net.SplitHostPort(relayAddr)
+	config.SMTPRelayConfig.Host = host
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	config.SMTPRelayAllIncoming = true
+	config.BlockedAttachmentTypes = []string{"image/jpeg"}
+	defer func() {
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
+		config.SMTPRelayAllIncoming = false
+		config.BlockedAttachmentTypes = []string{}
+	}()
+
+	addr := startTestServer(t, &Server{
+		Hostname: "localhost",
+		Appname:  "Mailpit",
+		Handler:  mailHandler,
+	})
+
+	// rejected messages are not relayed
+	blocked := "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Blocked\r\n" +
+		"Content-Type: image/jpeg\r\nContent-Disposition: inline; filename=\"image.jpg\"\r\n\r\nimage\r\n"
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{"recipient@example.com"}, []byte(blocked)); err == nil {
+		t.Error("expected the blocked message to be rejected")
+	}
+
+	msg := "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Relay\r\n\r\nTest\r\n"
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{"recipient@example.com", "hidden@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-relayed
+	if !bytes.Contains(data, []byte("Subject: Relay")) {
+		t.Errorf("expected the stored message to be relayed, got %q", data)
+	}
+
+	if bytes.Contains(data, []byte("Bcc:")) {
+		t.Error("relayed message should not contain the added Bcc header")
+	}
+
+	// ignored duplicates are only relayed once
+	config.DuplicateAction = "ignore"
+	defer func() { config.DuplicateAction = "store" }()
+
+	duplicate := "Message-Id: <duplicate@example.com>\r\nFrom: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Duplicate\r\n\r\nTest\r\n"
+	for i := 0; i < 2; i++ {
+		if err := smtp.SendMail(addr, nil, "sender@example.com", []string{"recipient@example.com"}, []byte(duplicate)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if data := <-relayed; !bytes.Contains(data, []byte("Subject: Duplicate")) {
+		t.Errorf("expected the first duplicate to be relayed, got %q", data)
+	}
+
+	select {
+	case data := <-relayed:
+		t.Errorf("unexpected relayed message %q", data)
+	default:
+	}
+}
+
+func TestMailHandlerTLS(t *testing.T) {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	dir := t.TempDir()
+
+	certFile, keyFile, err := config.SelfSignedCertificate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is reused
+	if _, _, err := config.SelfSignedCertificate(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if reused, _ := os.ReadFile(certFile); !bytes.Equal(cert, reused) {
+		t.Error("expected the existing certificate to be reused")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"} // #nosec
+
+	for _, implicit := range []bool{true, false} {
+		srv := &Server{
+			Hostname:    "localhost",
+			Appname:     "Mailpit",
+			Handler:     mailHandler,
+			TLSListener: implicit,
+		}
+
+		if err := srv.ConfigureTLS(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if implicit {
+			// as ListenAndServe() does for TLSListener
+			ln = tls.NewListener(ln, srv.TLSConfig)
+		}
+
+		go func() { _ = srv.Serve(ln) }()
+		t.Cleanup(func() { _ = srv.Close() })
+
+		addr := ln.Addr().String()
+
+		var conn net.Conn
+		if implicit {
+			conn, err = tls.Dial("tcp", addr, tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", addr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := smtp.NewClient(conn, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !implicit {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, ok := c.TLSConnectionState(); !ok {
+			t.Fatal("expected a TLS connection")
+		}
+
+		subject := fmt.Sprintf("TLS implicit=%v", implicit)
+
+		if err := c.Mail("sender@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("recipient@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: " + subject + "\r\n\r\nTest\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Quit()
+
+		messages, err := storage.List(0, 1)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("expected a message, got %d (%v)", len(messages), err)
+		}
+
+		if messages[0].Subject != subject {
+			t.Errorf("expected subject %q, got %q", subject, messages[0].Subject)
+		}
+	}
+}
+
+func TestMaxSizeAndBanner(t *testing.T) {
+	logger.NoLogging = true
+
+	var delivered int32
+	addr := startTestServer(t, &Server{
+		Hostname: "localhost",
+		Appname:  "Mailpit",
+		Banner:   "Test ESMTP",
+		MaxSize:  100,
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, msg, err := tp.ReadResponse(220); err != nil || msg != "localhost Test ESMTP" {
+		t.Fatalf("unexpected greeting %q (%v)", msg, err)
+	}
+
+	cmd := func(expectCode int, format string, args ...any) string {
+		t.Helper()
+
+		if err := tp.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+
+		_, msg, err := tp.ReadResponse(expectCode)
+		if err != nil {
+			t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+		}
+
+		return msg
+	}
+
+	if ehlo := cmd(250, "EHLO client"); !strings.Contains(ehlo, "\nSIZE 100\n") {
+		t.Errorf("expected SIZE 100 in the EHLO response, got %q", ehlo)
+	}
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<recipient@example.com>")
+	cmd(354, "DATA")
+
+	body := "Subject: Too large\r\n\r\n" + strings.Repeat("This line is far too long.\r\n", 10) + "."
+	if msg := cmd(552, "%s", body); !strings.HasPrefix(msg, "5.3.4 ") {
+		t.Errorf("expected a 5.3.4 response, got %q", msg)
+	}
+
+	// the oversized message was discarded & the session continues
+	cmd(250, "RSET")
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<recipient@example.com>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: Small\r\n\r\nTest\r\n.")
+	cmd(221, "QUIT")
+
+	if n := atomic.LoadInt32(&delivered); n != 1 {
+		t.Errorf("expected 1 delivered message, got %d", n)
+	}
+}
+
+func TestPauseSMTP(t *testing.T) {
+	logger.NoLogging = true
+
+	srv := &Server{
+		Hostname: "localhost",
+		Appname:  "Mailpit",
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+
+	registerServer(srv)
+	defer func() {
+		serversMu.Lock()
+		servers = nil
+		serversMu.Unlock()
+	}()
+
+	greeting := func(expectCode int) {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, msg, err := textproto.NewConn(conn).ReadResponse(expectCode); err != nil {
+			t.Fatalf("unexpected greeting %q (%v)", msg, err)
+		}
+	}
+
+	if err := PauseSMTP(); err != nil {
+		t.Fatal(err)
+	}
+
+	greeting(421)
+
+	if err := ResumeSMTP(); err != nil {
+		t.Fatal(err)
+	}
+
+	greeting(220)
+}
+
+func TestLMTPSession(t *testing.T) {
+	logger.NoLogging = true
+
+	var delivered int32
+	addr := startTestServer(t, &Server{
+		Hostname: "localhost",
+		Appname:  "Mailpit",
+		LMTP:     true,
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, msg, err := tp.ReadResponse(220); err != nil || !strings.Contains(msg, "LMTP") {
+		t.Fatalf("unexpected greeting %q (%v)", msg, err)
+	}
+
+	// EHLO is not accepted by an LMTP server
+	if err := tp.PrintfLine("EHLO client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tp.ReadResponse(500); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.PrintfLine("LHLO client"); err != nil {
+		t.Fatal(err)
+	}
+	_, lhlo, err := tp.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lhlo, "\nPIPELINING\n") {
+		t.Errorf("expected PIPELINING in the LHLO response, got %q", lhlo)
+	}
+
+	// pipelined commands are sent in a single write, & each is replied to in order
+	if _, err := conn.Write([]byte("MAIL FROM:<sender@example.com>\r\nRCPT TO:<one@example.com>\r\nRCPT TO:<two@example.com>\r\nDATA\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []int{250, 250, 250, 354} {
+		if _, msg, err := tp.ReadResponse(code); err != nil {
+			t.Fatalf("expected %d to pipelined command, got %q (%v)", code, msg, err)
+		}
+	}
+
+	if err := tp.PrintfLine("Subject: LMTP\r\n\r\nTest\r\n."); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reply is returned for each recipient
+	for _, rcpt := range []string{"one@example.com", "two@example.com"} {
+		_, msg, err := tp.ReadResponse(250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(msg, "<"+rcpt+">") {
+			t.Errorf("expected a reply for %s, got %q", rcpt, msg)
+		}
+	}
+
+	if err := tp.PrintfLine("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tp.ReadResponse(221); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&delivered); n != 1 {
+		t.Errorf("expected 1 delivered message, got %d", n)
+	}
+}
+
+func TestBDATSession(t *testing.T) {
+	logger.NoLogging = true
+
+	var mu sync.Mutex
+	var messages [][]byte
+	addr := startTestServer(t, &Server{
+		Hostname:       "localhost",
+		Appname:        "Mailpit",
+		EnableCHUNKING: true,
+		MaxSize:        1000,
+		Handler: func(_ net.Addr, _ string, _ string, _ []string, data []byte, _ *DSN) error {
+			mu.Lock()
+			defer mu.Unlock()
+			messages = append(messages, data)
+			return nil
+		},
+	})
+
+	delivered := func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return messages
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := func(expectCode int, format string, args ...any) string {
+		t.Helper()
+
+		if err := tp.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+
+		_, msg, err := tp.ReadResponse(expectCode)
+		if err != nil {
+			t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+		}
+
+		return msg
+	}
+
+	// chunk data is sent without a line ending, the next command follows the chunk
+	chunk := func(expectCode int, data string, last bool) string {
+		t.Helper()
+
+		c := fmt.Sprintf("BDAT %d", len(data))
+		if last {
+			c += " LAST"
+		}
+
+		if _, err := conn.Write([]byte(c + "\r\n" + data)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, msg, err := tp.ReadResponse(expectCode)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+
+		return msg
+	}
+
+	if ehlo := cmd(250, "EHLO client"); !strings.Contains(ehlo, "\nCHUNKING\n") {
+		t.Errorf("expected CHUNKING in the EHLO response, got %q", ehlo)
+	}
+
+	// the chunk is read & discarded without a transaction
+	chunk(503, "Subject: Test\r\n", false)
+
+	// a message in multiple chunks, including line endings split across chunks
+	parts := []string{"Subject: Chunks\r", "\n\r\nFirst chunk.\r\n", "Second chunk.\r\n.\r\n", "Last chunk.\r\n"}
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<recipient@example.com>")
+	for _, p := range parts[:len(parts)-1] {
+		if msg := chunk(250, p, false); !strings.Contains(msg, fmt.Sprintf("%d octets", len(p))) {
+			t.Errorf("unexpected chunk response %q", msg)
+		}
+	}
+
+	// DATA is not permitted after BDAT
+	cmd(503, "DATA")
+
+	chunk(250, parts[len(parts)-1], true)
+
+	if len(delivered()) != 1 {
+		t.Fatalf("expected 1 delivered message, got %d", len(delivered()))
+	}
+
+	// the message is delivered as-is, with a Received header & without dot-unstuffing
+	if m := delivered()[0]; !bytes.HasPrefix(m, []byte("Received: ")) || !bytes.HasSuffix(m, []byte(strings.Join(parts, ""))) {
+		t.Errorf("unexpected message %q", m)
+	}
+
+	// the transaction is complete after BDAT LAST
+	chunk(503, "Subject: Test\r\n", true)
+
+	// an empty last chunk completes the message
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<recipient@example.com>")
+	chunk(250, "Subject: Empty last chunk\r\n\r\nTest\r\n", false)
+	chunk(250, "", true)
+
+	if m := delivered(); len(m) != 2 || !bytes.HasSuffix(m[1], []byte("Subject: Empty last chunk\r\n\r\nTest\r\n")) {
+		t.Fatalf("unexpected messages %q", m)
+	}
+
+	// exceeding the maximum size aborts the transaction
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<recipient@example.com>")
+	chunk(250, strings.Repeat("a", 600), false)
+	if msg := chunk(552, strings.Repeat("b", 600), false); !strings.HasPrefix(msg, "5.3.4 ") {
+		t.Errorf("expected a 5.3.4 response, got %q", msg)
+	}
+	chunk(503, "Subject: Test\r\n", true)
+
+	cmd(221, "QUIT")
+
+	if n := len(delivered()); n != 2 {
+		t.Errorf("expected 2 delivered messages, got %d", n)
+	}
+}
+
+func TestTLSAutoDetect(t *testing.T) {
+	logger.NoLogging = true
+
+	certFile, keyFile, err := config.SelfSignedCertificate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Hostname:         "localhost",
+		Appname:          "Mailpit",
+		TLSAutoDetect:    true,
+		TLSDetectTimeout: 200 * time.Millisecond,
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			return nil
+		},
+	}
+
+	if err := srv.ConfigureTLS(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestServer(t, srv)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"} // #nosec
+
+	// implicit TLS is detected from the ClientHello
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.TLSConnectionState(); !ok {
+		t.Error("expected an implicit TLS connection")
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS should not be advertised over implicit TLS")
+	}
+	_ = c.Quit()
+
+	// plaintext clients waiting for the banner receive it after the detection timeout
+	start := time.Now()
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = smtp.NewClient(plain, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < srv.TLSDetectTimeout {
+		t.Errorf("banner sent after %s, before the detection timeout", elapsed)
+	}
+	if err := c.StartTLS(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Quit()
+
+	// plaintext sent before the banner is detected immediately & not lost
+	plain, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	if _, err := plain.Write([]byte("NOOP\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tp := textproto.NewConn(plain)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejectedMailResetsTransaction(t *testing.T) {
+	logger.NoLogging = true
+
+	addr := startTestServer(t, &Server{
+		Hostname:  "localhost",
+		Appname:   "Mailpit",
+		EnableDSN: true,
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			return nil
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		cmd  string
+		code int
+	}{
+		{"EHLO client", 250},
+		{"MAIL FROM:<sender@example.com>", 250},
+		// an invalid MAIL discards the previous sender
+		{"MAIL FROM:<sender@example.com> RET=INVALID", 501},
+		{"RCPT TO:<recipient@example.com> NOTIFY=SUCCESS", 503},
+		{"RCPT TO:<recipient@example.com> ORCPT=rfc822;recipient@example.com", 503},
+		// the session continues normally
+		{"MAIL FROM:<sender@example.com>", 250},
+		{"RCPT TO:<recipient@example.com> NOTIFY=SUCCESS", 250},
+		{"QUIT", 221},
+	} {
+		if err := tp.PrintfLine("%s", c.cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, msg, err := tp.ReadResponse(c.code); err != nil {
+			t.Fatalf("%s: unexpected response %q (%v)", c.cmd, msg, err)
+		}
+	}
+}
+
+func TestBDATRejectedChunk(t *testing.T) {
+	logger.NoLogging = true
+
+	addr := startTestServer(t, &Server{
+		Hostname:          "localhost",
+		Appname:           "Mailpit",
+		EnableCHUNKING:    true,
+		AuthRequired:      true,
+		AuthMechs:         map[string]bool{"PLAIN": true},
+		AuthHandler:       func(net.Addr, string, []byte, []byte, []byte) (bool, error) { return true, nil },
+		DisableReverseDNS: true,
+		Handler: func(net.Addr, string, string, []string, []byte, *DSN) error {
+			return nil
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.PrintfLine("EHLO client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unauthenticated chunk is rejected & discarded, even without a size limit
+	size := 4 << 20
+	go func() {
+		_, _ = conn.Write([]byte(fmt.Sprintf("BDAT %d LAST\r\n", size)))
+		_, _ = conn.Write(bytes.Repeat([]byte("a"), size))
+		_, _ = conn.Write([]byte("NOOP\r\n"))
+	}()
+
+	if _, msg, err := tp.ReadResponse(530); err != nil {
+		t.Fatalf("expected the chunk to be rejected, got %q (%v)", msg, err)
+	}
+
+	// the session continues after the discarded chunk
+	if _, msg, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected NOOP after the discarded chunk, got %q (%v)", msg, err)
+	}
+}
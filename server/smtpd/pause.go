@@ -0,0 +1,59 @@
+package smtpd
+
+import (
+	"sync"
+
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+var (
+	// running SMTP servers, one per listen address
+	servers   []*Server
+	serversMu sync.Mutex
+	paused    bool
+)
+
+// Register a running server so it can be paused & resumed
+func registerServer(srv *Server) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	servers = append(servers, srv)
+}
+
+// PauseSMTP rejects new connections on all SMTP listeners with a temporary (421) error.
+// Existing connections are not affected and complete as normal.
+func PauseSMTP() error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	if paused {
+		return nil
+	}
+
+	for _, srv := range servers {
+		srv.Pause()
+		logger.Log().Infof("[smtpd] paused on %s", srv.Addr)
+	}
+	paused = true
+
+	return nil
+}
+
+// ResumeSMTP resumes accepting new connections on all SMTP listeners
+func ResumeSMTP() error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	for _, srv := range servers {
+		srv.Resume()
+		logger.Log().Infof("[smtpd] resumed on %s", srv.Addr)
+	}
+	paused = false
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package smtpd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/stats"
+	"golang.org/x/time/rate"
+)
+
+// ipLimiterExpiry is how long a client's rate limiter is kept after its last message
+const ipLimiterExpiry = 5 * time.Minute
+
+var (
+	// global message & recipient token buckets, nil if disabled
+	messageLimiter   *rate.Limiter
+	recipientLimiter *rate.Limiter
+	limitersOnce     sync.Once
+
+	// per-IP message token buckets
+	ipLimiters      sync.Map // map[string]*ipLimiter
+	ipLimiterSweep  time.Time
+	ipLimiterSweepM sync.Mutex
+)
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+// MessageRateLimitEnabled returns whether any of the SMTP message rate limits are set
+func messageRateLimitEnabled() bool {
+	return config.SMTPMaxMessagesPerMinute > 0 || config.SMTPMaxRecipientsPerSecond > 0 || config.SMTPMaxPerIPPerMinute > 0
+}
+
+// InitLimiters creates the global token buckets from the config
+func initLimiters() {
+	if config.SMTPMaxMessagesPerMinute > 0 {
+		messageLimiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(config.SMTPMaxMessagesPerMinute)), config.SMTPMaxMessagesPerMinute)
+	}
+
+	if config.SMTPMaxRecipientsPerSecond > 0 {
+		recipientLimiter = rate.NewLimiter(rate.Limit(config.SMTPMaxRecipientsPerSecond), config.SMTPMaxRecipientsPerSecond)
+	}
+}
+
+// MessageRateLimited draws a message (and its recipients) from the global & per-IP token buckets,
+// returning whether any of them are exhausted. Tokens are only consumed if the message is accepted.
+func messageRateLimited(ip net.IP, recipients int) bool {
+	limitersOnce.Do(initLimiters)
+
+	now := time.Now()
+	reservations := []*rate.Reservation{}
+
+	reserve := func(l *rate.Limiter, n int) bool {
+		if n > l.Burst() {
+			// a message with more recipients than the burst size can only ever use the full burst
+			n = l.Burst()
+		}
+
+		r := l.ReserveN(now, n)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			return false
+		}
+		reservations = append(reservations, r)
+
+		return true
+	}
+
+	ok := true
+
+	if l := clientLimiter(ip, now); l != nil {
+		ok = reserve(l, 1)
+	}
+
+	if ok && messageLimiter != nil {
+		ok = reserve(messageLimiter, 1)
+	}
+
+	if ok && recipientLimiter != nil {
+		ok = reserve(recipientLimiter, recipients)
+	}
+
+	if ok {
+		return false
+	}
+
+	// return the tokens drawn from the other buckets
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+
+	sessionLog().Warnf("[smtpd] rate limit exceeded, rejecting message from %s", ip)
+	stats.LogSMTPRejected()
+
+	return true
+}
+
+// ClientLimiter returns the per-IP token bucket of the client, or nil if per-IP limits are disabled.
+// Buckets of clients without any messages within ipLimiterExpiry are periodically removed.
+func clientLimiter(ip net.IP, now time.Time) *rate.Limiter {
+	if config.SMTPMaxPerIPPerMinute < 1 || ip == nil {
+		return nil
+	}
+
+	ipLimiterSweepM.Lock()
+	if now.Sub(ipLimiterSweep) > ipLimiterExpiry {
+		ipLimiters.Range(func(k, v any) bool {
+			l := v.(*ipLimiter)
+			l.mu.Lock()
+			expired := now.Sub(l.lastSeen) > ipLimiterExpiry
+			l.mu.Unlock()
+			if expired {
+				ipLimiters.Delete(k)
+			}
+			return true
+		})
+		ipLimiterSweep = now
+	}
+	ipLimiterSweepM.Unlock()
+
+	v, _ := ipLimiters.LoadOrStore(ip.String(), &ipLimiter{
+		limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(config.SMTPMaxPerIPPerMinute)), config.SMTPMaxPerIPPerMinute),
+	})
+
+	l := v.(*ipLimiter)
+	l.mu.Lock()
+	l.lastSeen = now
+	l.mu.Unlock()
+
+	return l.limiter
+}
@@ -0,0 +1,237 @@
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+func TestMessageRateLimitPerIP(t *testing.T) {
+	resetLimiters(t)
+	config.SMTPMaxPerIPPerMinute = 3
+
+	addr := startRateLimitedServer(t)
+
+	for i := 0; i < 3; i++ {
+		if err := sendTestMessage(addr, []string{"to@example.com"}); err != nil {
+			t.Fatalf("message %d should be accepted: %s", i+1, err)
+		}
+	}
+
+	assertRateLimited(t, sendTestMessage(addr, []string{"to@example.com"}))
+
+	// other clients are not affected
+	if messageRateLimited(net.ParseIP("192.0.2.1"), 1) {
+		t.Error("other clients should not be rate limited")
+	}
+}
+
+func TestMessageRateLimitGlobal(t *testing.T) {
+	resetLimiters(t)
+	config.SMTPMaxMessagesPerMinute = 5
+
+	addr := startRateLimitedServer(t)
+
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		err := sendTestMessage(addr, []string{"to@example.com"})
+		if err == nil {
+			accepted++
+			continue
+		}
+		assertRateLimited(t, err)
+	}
+
+	if accepted != 5 {
+		t.Errorf("expected 5 accepted messages, got %d", accepted)
+	}
+}
+
+func TestRecipientRateLimit(t *testing.T) {
+	resetLimiters(t)
+	config.SMTPMaxRecipientsPerSecond = 4
+	config.SMTPMaxPerIPPerMinute = 10
+
+	addr := startRateLimitedServer(t)
+
+	if err := sendTestMessage(addr, []string{"one@example.com", "two@example.com", "three@example.com"}); err != nil {
+		t.Fatalf("message should be accepted: %s", err)
+	}
+
+	assertRateLimited(t, sendTestMessage(addr, []string{"four@example.com", "five@example.com"}))
+
+	// the rejected message did not use a per-IP token
+	if l := clientLimiter(net.ParseIP("127.0.0.1"), time.Now()); l == nil || l.Tokens() < 8.9 {
+		t.Error("rejected messages should not draw from the per-IP bucket")
+	}
+}
+
+func TestMessageRateLimitResponse(t *testing.T) {
+	resetLimiters(t)
+	config.SMTPMaxPerIPPerMinute = 1
+
+	addr := startTestServer(t, &Server{
+		Hostname:           "localhost",
+		Appname:            "Mailpit",
+		Handler:            func(net.Addr, string, string, []string, []byte, *DSN) error { return nil },
+		MessageRateLimited: messageRateLimited,
+		RateLimitResponse:  "550 5.7.1 Rate limit exceeded",
+		EnableCHUNKING:     true,
+	})
+
+	if err := sendTestMessage(addr, []string{"to@example.com"}); err != nil {
+		t.Fatalf("message should be accepted: %s", err)
+	}
+
+	// DATA is rejected with the configured response
+	err := sendTestMessage(addr, []string{"to@example.com"})
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 || tpErr.Msg != "5.7.1 Rate limit exceeded" {
+		t.Errorf("expected the configured rate limit response, got %v", err)
+	}
+
+	// as is the first BDAT chunk
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	for _, c := range []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"EHLO client\r\n", 250},
+		{"MAIL FROM:<sender@example.com>\r\n", 250},
+		{"RCPT TO:<to@example.com>\r\n", 250},
+		{"BDAT 6 LAST\r\nTest\r\n", 550},
+	} {
+		if c.cmd != "" {
+			if _, err := conn.Write([]byte(c.cmd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, msg, err := tp.ReadResponse(c.code); err != nil {
+			t.Fatalf("%q: unexpected response %q (%v)", c.cmd, msg, err)
+		}
+	}
+}
+
+func TestRateLimitTransactionLog(t *testing.T) {
+	resetLimiters(t)
+	config.SMTPMaxPerIPPerMinute = 1
+	config.SMTPTransactionLogRetention = time.Hour
+	defer func() { config.SMTPTransactionLogRetention = 0 }()
+	config.DataFile = ""
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	addr := startTestServer(t, &Server{
+		Hostname:           "localhost",
+		Appname:            "Mailpit",
+		Handler:            func(net.Addr, string, string, []string, []byte, *DSN) error { return nil },
+		MessageRateLimited: messageRateLimited,
+		RateLimitRejected:  rateLimitRejected,
+	})
+
+	if err := sendTestMessage(addr, []string{"to@example.com"}); err != nil {
+		t.Fatalf("message should be accepted: %s", err)
+	}
+
+	// rate-limited messages are logged with the envelope
+	assertRateLimited(t, sendTestMessage(addr, []string{"one@example.com", "two@example.com"}))
+
+	assertTransaction(t, "sender@example.com", []string{"one@example.com", "two@example.com"})
+
+	// as are MAIL commands from rate-limited clients
+	addr = startTestServer(t, &Server{
+		Hostname:          "localhost",
+		Appname:           "Mailpit",
+		Handler:           func(net.Addr, string, string, []string, []byte, *DSN) error { return nil },
+		RateLimited:       func(net.IP) bool { return true },
+		RateLimitRejected: rateLimitRejected,
+	})
+
+	assertRateLimited(t, sendTestMessage(addr, []string{"to@example.com"}))
+
+	assertTransaction(t, "sender@example.com", []string{})
+}
+
+func assertTransaction(t *testing.T, from string, to []string) {
+	t.Helper()
+
+	transactions, _, err := storage.GetSMTPTransactionLog(0, 1)
+	if err != nil || len(transactions) != 1 {
+		t.Fatalf("expected a logged transaction (%v)", err)
+	}
+
+	tr := transactions[0]
+	if tr.Status != storage.SMTPTransactionRateLimited {
+		t.Errorf("expected status %q, got %q", storage.SMTPTransactionRateLimited, tr.Status)
+	}
+	if tr.ClientIP != "127.0.0.1" {
+		t.Errorf("expected client IP 127.0.0.1, got %q", tr.ClientIP)
+	}
+	if tr.EnvelopeFrom != from {
+		t.Errorf("expected sender %q, got %q", from, tr.EnvelopeFrom)
+	}
+	if strings.Join(tr.EnvelopeTo, ",") != strings.Join(to, ",") {
+		t.Errorf("expected recipients %v, got %v", to, tr.EnvelopeTo)
+	}
+}
+
+func resetLimiters(t *testing.T) {
+	logger.NoLogging = true
+
+	reset := func() {
+		config.SMTPMaxMessagesPerMinute = 0
+		config.SMTPMaxRecipientsPerSecond = 0
+		config.SMTPMaxPerIPPerMinute = 0
+		messageLimiter = nil
+		recipientLimiter = nil
+		limitersOnce = sync.Once{}
+		ipLimiters.Range(func(k, _ any) bool {
+			ipLimiters.Delete(k)
+			return true
+		})
+	}
+
+	reset()
+	t.Cleanup(reset)
+}
+
+func startRateLimitedServer(t *testing.T) string {
+	return startTestServer(t, &Server{
+		Hostname:           "localhost",
+		Appname:            "Mailpit",
+		Handler:            func(net.Addr, string, string, []string, []byte, *DSN) error { return nil },
+		MessageRateLimited: messageRateLimited,
+	})
+}
+
+func sendTestMessage(addr string, to []string) error {
+	msg := "From: sender@example.com\r\nTo: " + strings.Join(to, ", ") + "\r\nSubject: Test\r\n\r\nTest\r\n"
+
+	return smtp.SendMail(addr, nil, "sender@example.com", to, []byte(msg))
+}
+
+func assertRateLimited(t *testing.T, err error) {
+	t.Helper()
+
+	tpErr, ok := err.(*textproto.Error)
+	if !ok || tpErr.Code != 452 {
+		t.Errorf("expected a 452 rate limit response, got %v", err)
+	}
+}
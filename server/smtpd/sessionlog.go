@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	sessionLogger     *logrus.Logger
+	sessionLoggerOnce sync.Once
+)
+
+// SessionLog returns the logger for SMTP session entries. If config.SMTPSessionLogFile is set,
+// entries are written to that file (including debug entries), else the main logger is returned.
+func sessionLog() *logrus.Logger {
+	sessionLoggerOnce.Do(func() {
+		w, err := sessionLogWriter()
+		if err != nil {
+			logger.Log().Errorf("[smtpd] unable to open session log file: %s", err.Error())
+			return
+		}
+
+		if w == nil {
+			return
+		}
+
+		sessionLogger = logrus.New()
+		sessionLogger.Out = w
+		sessionLogger.SetLevel(logrus.DebugLevel)
+		sessionLogger.SetFormatter(logger.Log().Formatter)
+	})
+
+	if sessionLogger == nil {
+		return logger.Log()
+	}
+
+	return sessionLogger
+}
+
+// SessionLogWriter returns the writer for the SMTP session log file, or nil if not configured
+func sessionLogWriter() (io.Writer, error) {
+	if config.SMTPSessionLogFile == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(filepath.Clean(config.SMTPSessionLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664) // #nosec
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// SessionTrace is the SMTP server trace function, logging EHLO hostnames to the session log,
+// or every command & response if config.SMTPTraceLog is enabled
+func sessionTrace(sessionID, cmd, arg, response string, latency time.Duration) {
+	if config.SMTPTraceLog {
+		traceLog(sessionID, cmd, arg, response, latency)
+		return
+	}
+
+	switch cmd {
+	case "HELO", "EHLO", "LHLO":
+		sessionLog().Infof("[smtpd] session %s %s %s", sessionID, cmd, arg)
+	}
+}
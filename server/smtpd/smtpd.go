@@ -1,284 +1,1566 @@
-// Package smtpd is the SMTP daemon
+// Package smtpd implements a basic SMTP server.
+//
+// This is a modified version of https://github.com/mhale/smtpd to
+// add support for additional SMTP extensions used by Mailpit.
+// The original code is released into the public domain, see the
+// upstream license in the LICENSE file.
 package smtpd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
-	"net/mail"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/axllent/mailpit/config"
-	"github.com/axllent/mailpit/internal/auth"
-	"github.com/axllent/mailpit/internal/logger"
-	"github.com/axllent/mailpit/internal/stats"
-	"github.com/axllent/mailpit/internal/storage"
-	"github.com/lithammer/shortuuid/v4"
-	"github.com/mhale/smtpd"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	// DisableReverseDNS allows rDNS to be disabled
-	DisableReverseDNS bool
+	// Debug `true` enables verbose logging.
+	Debug      = false
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<([^>]+)>(\s(.*))?`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
 )
 
-func mailHandler(origin net.Addr, from string, to []string, data []byte) error {
-	if !config.SMTPStrictRFCHeaders {
-		// replace all <CR><CR><LF> (\r\r\n) with <CR><LF> (\r\n)
-		// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
-		data = bytes.ReplaceAll(data, []byte("\r\r\n"), []byte("\r\n"))
+// Handler function called upon successful receipt of an email.
+// The dsn is nil unless DSN is enabled and the client supplied DSN parameters.
+type Handler func(remoteAddr net.Addr, sessionID, from string, to []string, data []byte, dsn *DSN) error
+
+// DSN contains the Delivery Status Notification parameters (RFC 3461)
+// supplied with the MAIL & RCPT commands.
+type DSN struct {
+	// Ret is the RET parameter of the MAIL command (FULL or HDRS)
+	Ret string
+	// EnvID is the ENVID parameter of the MAIL command
+	EnvID string
+	// Recipients contains the RCPT parameters, keyed by recipient address
+	Recipients map[string]DSNRecipient
+}
+
+// DSNRecipient contains the DSN parameters supplied with a RCPT command
+type DSNRecipient struct {
+	// Notify contains the NOTIFY values (NEVER, or any combination of SUCCESS, FAILURE & DELAY)
+	Notify []string
+	// ORcpt is the original recipient (ORCPT parameter)
+	ORcpt string
+}
+
+// IsEmpty returns true if no DSN parameters were supplied
+func (d *DSN) IsEmpty() bool {
+	return d.Ret == "" && d.EnvID == "" && len(d.Recipients) == 0
+}
+
+// HandlerRcpt function called on RCPT. Return accept status.
+type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
+
+// AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
+type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
+
+var ErrServerClosed = errors.New("Server has been closed")
+
+// ListenAndServe listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections.
+func ListenAndServe(addr string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	return srv.ListenAndServe()
+}
+
+// ListenAndServeTLS listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections. Connections may be upgraded to TLS if the client requests it.
+func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	err := srv.ConfigureTLS(certFile, keyFile)
+	if err != nil {
+		return err
 	}
+	return srv.ListenAndServe()
+}
+
+type maxSizeExceededError struct {
+	limit int
+}
+
+func maxSizeExceeded(limit int) maxSizeExceededError {
+	return maxSizeExceededError{limit}
+}
+
+// Error uses the RFC 5321 response message in preference to RFC 1870.
+// RFC 3463 defines enhanced status code x.3.4 as "Message too big for system".
+func (err maxSizeExceededError) Error() string {
+	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded storage allocation (%d)", err.limit)
+}
+
+// LogFunc is a function capable of logging the client-server communication.
+type LogFunc func(remoteIP, verb, line string)
 
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+// TraceFunc is called once each command has been processed, with the command (eg: "MAIL FROM"),
+// its argument, the last response line sent to the client & the time taken to respond.
+type TraceFunc func(sessionID, cmd, arg, response string, latency time.Duration)
+
+// ConnectionInfo contains the details of a client connection once it has been closed.
+type ConnectionInfo struct {
+	RemoteAddr        net.Addr
+	EHLOHostname      string // Hostname as supplied with HELO, EHLO or LHLO
+	ConnectedAt       time.Time
+	DisconnectedAt    time.Time
+	MessagesDelivered int // Number of messages successfully passed to the Handler
+	BytesReceived     int // Total size of all message data received
+}
+
+// ConnectionFunc is called once a client connection has been closed.
+type ConnectionFunc func(info ConnectionInfo)
+
+// BannerDelayFunc returns how long to wait before sending the greeting to a new client.
+type BannerDelayFunc func(remoteIP net.IP) time.Duration
+
+// RateLimitedFunc returns whether a new client is rate limited.
+type RateLimitedFunc func(remoteIP net.IP) bool
+
+// MessageRateLimitedFunc returns whether a new message from a client to a number of recipients is rate limited.
+type MessageRateLimitedFunc func(remoteIP net.IP, recipients int) bool
+
+// RateLimitRejectedFunc is called when a MAIL command or message is rejected by a rate limit.
+type RateLimitRejectedFunc func(remoteAddr net.Addr, from string, to []string)
+
+// Server is an SMTP server.
+type Server struct {
+	Addr               string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	Appname            string
+	AuthHandler        AuthHandler
+	AuthMechs          map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired       bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	Banner             string          // Optional greeting text following the hostname, defaults to "<Appname> ESMTP Service ready"
+	BannerDelay        BannerDelayFunc // Optional delay before sending the greeting, eg: to tarpit abusive clients
+	ConnectionClosed   ConnectionFunc  // Optional callback once a client connection is closed
+	DisableReverseDNS  bool            // Disable reverse DNS lookups, enforces "unknown" hostname
+	EnableDSN          bool            // Enable the DSN (Delivery Status Notification) extension as per RFC 3461
+	EnableCHUNKING     bool            // Enable the CHUNKING (BDAT) extension as per RFC 3030
+	Enable8BitMIME     bool            // Advertise the 8BITMIME extension as per RFC 6152
+	Handler            Handler
+	HandlerRcpt        HandlerRcpt
+	Hostname           string
+	LMTP               bool // Use LMTP as per RFC 2033: LHLO replaces HELO & EHLO, and DATA returns a reply for each recipient
+	LogRead            LogFunc
+	LogWrite           LogFunc
+	MaxSize            int                    // Maximum message size allowed, in bytes
+	MaxRecipients      int                    // Maximum number of recipients, defaults to 100.
+	MessageRateLimited MessageRateLimitedFunc // Optional check before each message (DATA or the first BDAT chunk), rate-limited messages are rejected with RateLimitResponse
+	Network            string                 // Network to listen on: "tcp", "tcp4" or "tcp6", defaults to "tcp"
+	RateLimited        RateLimitedFunc        // Optional check for new clients, MAIL commands from rate-limited clients are rejected with RateLimitResponse
+	RateLimitRejected  RateLimitRejectedFunc  // Optional callback when a MAIL command or message is rejected by a rate limit
+	RateLimitResponse  string                 // Response to MAIL commands from rate-limited clients & rate-limited messages, defaults to "452 4.7.0 Too many messages, try again later"
+	SessionHeader      string                 // Optional header added to each message containing the session ID, eg: "X-Session"
+	Timeout            time.Duration
+	TLSConfig          *tls.Config
+	TLSListener        bool          // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSAutoDetect      bool          // Accept both implicit TLS & plaintext (with optional STARTTLS) connections on the same port. Ignored if TLS is not configured or TLSListener is enabled.
+	TLSDetectTimeout   time.Duration // Time to wait for a TLS ClientHello when TLSAutoDetect is enabled, defaults to 500ms
+	TLSRequired        bool          // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Trace              TraceFunc     // Optional tracing of every command & response
+
+	inShutdown   int32 // server was closed or shutdown
+	openSessions int32 // count of open sessions
+	mu           sync.Mutex
+	shutdownChan chan struct{} // let the sessions know we are shutting down
+	paused       int32         // new connections are rejected while paused
+
+	XClientAllowed []string // List of XCLIENT allowed IP addresses
+}
+
+// ConfigureTLS creates a TLS configuration from certificate and key files.
+func (srv *Server) ConfigureTLS(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		logger.Log().Errorf("[smtpd] error parsing message: %s", err.Error())
-		stats.LogSMTPRejected()
 		return err
 	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
 
-	// check / set the Return-Path based on SMTP from
-	returnPath := strings.Trim(msg.Header.Get("Return-Path"), "<>")
-	if returnPath != from {
-		if returnPath != "" {
-			// replace Return-Path
-			re := regexp.MustCompile(`(?i)(^|\n)(Return\-Path: .*\n)`)
-			replaced := false
-			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
-				if replaced {
-					return r
-				}
-				replaced = true // only replace first occurrence
+// ConfigureTLSWithPassphrase creates a TLS configuration from a certificate,
+// an encrypted key file and the associated passphrase:
+func (srv *Server) ConfigureTLSWithPassphrase(
+	certFile string,
+	keyFile string,
+	passphrase string,
+) error {
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	var pemBlock pem.Block
+	pemBlock.Type = keyDERBlock.Type
+	pemBlock.Bytes = keyPEMDecrypted
+	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// ListenAndServe listens on the TCP network address srv.Addr and then
+// calls Serve to handle requests on incoming connections.  If
+// srv.Addr is blank, ":25" is used.
+func (srv *Server) ListenAndServe() error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
+	}
+
+	if srv.Addr == "" {
+		srv.Addr = ":25"
+	}
+	if srv.Appname == "" {
+		srv.Appname = "smtpd"
+	}
+	if srv.Hostname == "" {
+		srv.Hostname, _ = os.Hostname()
+	}
+	if srv.Timeout == 0 {
+		srv.Timeout = 5 * time.Minute
+	}
+	if srv.Network == "" {
+		srv.Network = "tcp"
+	}
+
+	ln, err := srv.listen()
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+func (srv *Server) listen() (net.Listener, error) {
+	// If TLSListener is enabled, listen for TLS connections only.
+	if srv.TLSConfig != nil && srv.TLSListener {
+		return tls.Listen(srv.Network, srv.Addr, srv.TLSConfig)
+	}
+	return net.Listen(srv.Network, srv.Addr)
+}
+
+// Pause rejects new connections with a 421 response until Resume is called,
+// so clients retry later. Open sessions are not affected.
+func (srv *Server) Pause() {
+	atomic.StoreInt32(&srv.paused, 1)
+}
+
+// Resume accepts new connections again after Pause.
+func (srv *Server) Resume() {
+	atomic.StoreInt32(&srv.paused, 0)
+}
+
+// Reject a new connection while paused
+func (srv *Server) rejectPaused(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, _ = fmt.Fprintf(conn, "421 4.3.2 %s Service not available, try again later\r\n", srv.Hostname)
+}
+
+// Serve creates a new SMTP session after a network connection is established.
+func (srv *Server) Serve(ln net.Listener) error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
+	}
+
+	defer ln.Close()
+	for {
+
+		// if we are shutting down, don't accept new connections
+		select {
+		case <-srv.getShutdownChan():
+			return ErrServerClosed
+		default:
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		if atomic.LoadInt32(&srv.paused) != 0 {
+			go srv.rejectPaused(conn)
+			continue
+		}
+
+		atomic.AddInt32(&srv.openSessions, 1)
+
+		if srv.TLSConfig != nil && srv.TLSAutoDetect && !srv.TLSListener {
+			// detection waits for the client, so must not block accepting new connections
+			go func(conn net.Conn) {
+				srv.newSession(srv.detectTLS(conn)).serve()
+			}(conn)
+			continue
+		}
+
+		session := srv.newSession(conn)
+		go session.serve()
+	}
+}
+
+// The default time to wait for a TLS ClientHello before assuming a plaintext connection.
+// Plaintext clients wait for the banner, whereas TLS clients start the handshake immediately.
+const tlsDetectTimeout = 500 * time.Millisecond
+
+// A connection with its initial bytes buffered to detect the protocol.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
 
-				return re.ReplaceAll(r, []byte("${1}Return-Path: <"+from+">\r\n"))
-			})
+// Wrap the connection in TLS if the first byte is a TLS handshake record (0x16, ie: a ClientHello),
+// otherwise return the connection for plaintext SMTP (with optional STARTTLS). The first byte is
+// peeked with a read deadline, so detection completes as soon as the client sends anything, and
+// the peeked bytes are still read by the session.
+func (srv *Server) detectTLS(conn net.Conn) net.Conn {
+	pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	timeout := srv.TLSDetectTimeout
+	if timeout <= 0 {
+		timeout = tlsDetectTimeout
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	b, err := pc.r.Peek(1)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if err == nil && b[0] == 0x16 {
+		return tls.Server(pc, srv.TLSConfig)
+	}
+
+	return pc
+}
+
+type session struct {
+	srv           *Server
+	conn          net.Conn
+	br            *bufio.Reader
+	bw            *bufio.Writer
+	remoteIP      string // Remote IP address
+	remoteHost    string // Remote hostname according to reverse DNS lookup
+	remoteName    string // Remote hostname as supplied with EHLO
+	xClient       string // Information string as supplied with XCLIENT
+	xClientADDR   string // Information string as supplied with XCLIENT ADDR
+	xClientNAME   string // Information string as supplied with XCLIENT NAME
+	xClientTrust  bool   // Trust XCLIENT from current IP address
+	tls           bool
+	authenticated bool
+	rateLimited   bool          // Client is rate limited, see Server.RateLimited
+	id            string        // Random session ID used for tracing
+	trace         *commandTrace // Command currently being traced
+	connectedAt   time.Time     // Time the client connected
+	delivered     int           // Number of messages delivered during the session
+	bytesReceived int           // Total size of message data received during the session
+}
+
+// A command being traced, see Server.Trace.
+type commandTrace struct {
+	cmd      string
+	arg      string
+	response string
+	start    time.Time
+	end      time.Time
+}
+
+// Create new session from connection.
+func (srv *Server) newSession(conn net.Conn) (s *session) {
+	s = &session{
+		srv:         srv,
+		conn:        conn,
+		br:          bufio.NewReader(conn),
+		bw:          bufio.NewWriter(conn),
+		id:          newSessionID(),
+		connectedAt: time.Now(),
+	}
+
+	// Get remote end info for the Received header.
+	s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
+	if _, ok := s.conn.RemoteAddr().(*net.UnixAddr); ok {
+		// unix socket connections are always local
+		s.remoteIP = "127.0.0.1"
+	}
+	if !s.srv.DisableReverseDNS {
+		names, err := net.LookupAddr(s.remoteIP)
+		if err == nil && len(names) > 0 {
+			s.remoteHost = names[0]
 		} else {
-			// add Return-Path
-			data = append([]byte("Return-Path: <"+from+">\r\n"), data...)
+			s.remoteHost = "unknown"
 		}
+	} else {
+		s.remoteHost = "unknown"
 	}
 
-	messageID := strings.Trim(msg.Header.Get("Message-Id"), "<>")
+	// Set tls = true if TLS is already in use.
+	_, s.tls = s.conn.(*tls.Conn)
 
-	// add a message ID if not set
-	if messageID == "" {
-		// generate unique ID
-		messageID = shortuuid.New() + "@mailpit"
-		// add unique ID
-		data = append([]byte("Message-Id: <"+messageID+">\r\n"), data...)
-	} else if config.IgnoreDuplicateIDs {
-		if storage.MessageIDExists(messageID) {
-			logger.Log().Debugf("[smtpd] duplicate message found, ignoring %s", messageID)
-			stats.LogSMTPIgnored()
-			return nil
+	for _, checkIP := range srv.XClientAllowed {
+		if s.remoteIP == checkIP {
+			s.xClientTrust = true
 		}
 	}
+	return
+}
 
-	// if enabled, this will route the email 1:1 through to the preconfigured smtp server
-	if config.SMTPRelayAllIncoming {
-		if err := Send(from, to, data); err != nil {
-			logger.Log().Warnf("[smtp] error relaying message: %s", err.Error())
-		} else {
-			logger.Log().Debugf("[smtp] relayed message from %s via %s:%d", from, config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
+func (srv *Server) getShutdownChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
+	}
+
+	return srv.shutdownChan
+}
+
+func (srv *Server) closeShutdownChan() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
+	}
+
+	select {
+	case <-srv.shutdownChan:
+	default:
+		close(srv.shutdownChan)
+	}
+}
+
+// Close - closes the connection without waiting
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+	return nil
+}
+
+// Shutdown - waits for current sessions to complete before closing
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+
+	// wait for up to 30 seconds to allow the current sessions to
+	// end
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+
+	for i := 0; i < 300; i++ {
+
+		// wait for open sessions to close
+		if atomic.LoadInt32(&srv.openSessions) == 0 {
+			break
+		}
+
+		select {
+		case <-timer.C:
+			timer.Reset(100 * time.Millisecond)
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Function called to handle connection requests.
+func (s *session) serve() {
+	defer atomic.AddInt32(&s.srv.openSessions, -1)
+	defer s.conn.Close()
+	defer s.endTrace()
+	defer s.connectionClosed()
+
+	var from string
+	var gotFrom bool
+	var to []string
+	var dsn *DSN
+	var buffer bytes.Buffer
+	var chunks bytes.Buffer // BDAT chunks received so far (RFC 3030)
+	var bdat bool
+
+	if s.srv.BannerDelay != nil {
+		if d := s.srv.BannerDelay(net.ParseIP(s.remoteIP)); d > 0 {
+			time.Sleep(d)
 		}
 	}
 
-	// build array of all addresses in the header to compare to the []to array
-	emails, hasBccHeader := scanAddressesInHeader(msg.Header)
+	// Send banner.
+	s.writef("220 %s %s", s.srv.Hostname, s.banner())
 
-	missingAddresses := []string{}
-	for _, a := range to {
-		// loop through passed email addresses to check if they are in the headers
-		if _, err := mail.ParseAddress(a); err == nil {
-			_, ok := emails[strings.ToLower(a)]
-			if !ok {
-				missingAddresses = append(missingAddresses, a)
+	if s.srv.RateLimited != nil {
+		s.rateLimited = s.srv.RateLimited(net.ParseIP(s.remoteIP))
+	}
+
+loop:
+	for {
+		s.endTrace()
+
+		// Attempt to read a line from the socket.
+		// On timeout, send a timeout message and return from serve().
+		// On error, assume the client has gone away i.e. return from serve().
+		line, err := s.readLine()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 			}
-		} else {
-			logger.Log().Warnf("[smtpd] ignoring invalid email address: %s", a)
+			break
 		}
-	}
 
-	// add missing email addresses to Bcc (eg: Laravel doesn't include these in the headers)
-	if len(missingAddresses) > 0 {
-		if hasBccHeader {
-			// email already has Bcc header, add to existing addresses
-			re := regexp.MustCompile(`(?i)(^|\n)(Bcc: )`)
-			replaced := false
-			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
-				if replaced {
-					return r
+		verb, args := s.parseLine(line)
+		s.startTrace(verb, args)
+
+		switch verb {
+		case "HELO":
+			if s.srv.LMTP {
+				// RFC 2033 section 4.1 requires LHLO instead of HELO or EHLO.
+				s.writef("500 5.5.1 Command unrecognized, LMTP requires LHLO")
+				break
+			}
+			s.remoteName = args
+			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
+
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "EHLO", "LHLO":
+			if s.srv.LMTP != (verb == "LHLO") {
+				if s.srv.LMTP {
+					s.writef("500 5.5.1 Command unrecognized, LMTP requires LHLO")
+				} else {
+					s.writef("500 5.5.2 Syntax error, command unrecognized")
 				}
-				replaced = true // only replace first occurrence
+				break
+			}
+			s.remoteName = args
+			s.writef(s.makeEHLOResponse())
 
-				return re.ReplaceAll(r, []byte("${1}Bcc: "+strings.Join(missingAddresses, ", ")+", "))
-			})
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "MAIL":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if s.rateLimited {
+				sender := ""
+				if match := mailFromRE.FindStringSubmatch(args); match != nil {
+					sender = match[1]
+				}
+				s.rateLimitRejected(sender, nil)
+				s.writef("%s", s.rateLimitResponse())
+				break
+			}
 
-		} else {
-			// prepend new Bcc header
-			bcc := []byte(fmt.Sprintf("Bcc: %s\r\n", strings.Join(missingAddresses, ", ")))
-			data = append(bcc, data...)
+			// MAIL starts a new transaction, so a rejected MAIL leaves no sender
+			from = ""
+			gotFrom = false
+			dsn = nil
+
+			match := mailFromRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
+			} else {
+				params := parseParams(match[3])
+				valid := true
+
+				// Validate the SIZE parameter if one was sent.
+				if sizeParam, ok := params["SIZE"]; ok {
+					// Enforce the maximum message size if one is set.
+					size, err := strconv.Atoi(sizeParam)
+					if err != nil { // Bad SIZE parameter
+						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+						valid = false
+					} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
+						err = maxSizeExceeded(s.srv.MaxSize)
+						s.writef(err.Error())
+						valid = false
+					}
+				}
+
+				// Validate the BODY parameter if one was sent (RFC 6152).
+				if body, ok := params["BODY"]; valid && ok {
+					body = strings.ToUpper(body)
+					if body != "7BIT" && (body != "8BITMIME" || !s.srv.Enable8BitMIME) {
+						s.writef("555 5.5.4 Unsupported option: BODY=%s", body)
+						valid = false
+					}
+				}
+
+				// Reject any other unsupported parameters.
+				for k := range params {
+					if valid && !s.isSupportedMailParam(k) {
+						s.writef("555 5.5.4 Unsupported option: %s", k)
+						valid = false
+					}
+				}
+
+				// Validate the RET & ENVID parameters if DSN is enabled (RFC 3461 section 4.3 & 4.4).
+				dsn = nil
+				if valid && s.srv.EnableDSN {
+					dsn = &DSN{Recipients: map[string]DSNRecipient{}}
+					if ret, ok := params["RET"]; ok {
+						dsn.Ret = strings.ToUpper(ret)
+						if dsn.Ret != "FULL" && dsn.Ret != "HDRS" {
+							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid RET parameter)")
+							valid = false
+						}
+					}
+					if envID, ok := params["ENVID"]; ok {
+						dsn.EnvID = envID
+					}
+				}
+
+				if valid {
+					from = match[1]
+					gotFrom = true
+					s.writef("250 2.1.0 Ok")
+				}
+			}
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "RCPT":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
+				break
+			}
+
+			match := rcptToRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			} else {
+				// RFC 5321 specifies support for minimum of 100 recipients is required.
+				if s.srv.MaxRecipients == 0 {
+					s.srv.MaxRecipients = 100
+				}
+				if len(to) >= s.srv.MaxRecipients {
+					s.writef("452 4.5.3 Too many recipients")
+				} else {
+					accept := true
+					if s.srv.HandlerRcpt != nil {
+						accept = s.srv.HandlerRcpt(s.remoteAddr(), from, match[1])
+					}
+					if accept && s.srv.EnableDSN && dsn != nil {
+						accept = dsn.addRecipient(match[1], parseParams(match[3]))
+						if !accept {
+							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid NOTIFY parameter)")
+							break
+						}
+					}
+					if accept {
+						to = append(to, match[1])
+						s.writef("250 2.1.5 Ok")
+					} else {
+						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
+					}
+				}
+			}
+		case "DATA":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom || len(to) == 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
+				break
+			}
+			if bdat {
+				// RFC 3030 section 2: DATA & BDAT cannot be used in the same transaction.
+				s.writef("503 5.5.1 Bad sequence of commands (DATA not permitted after BDAT)")
+				break
+			}
+			if s.srv.MessageRateLimited != nil && s.srv.MessageRateLimited(net.ParseIP(s.remoteIP), len(to)) {
+				s.rateLimitRejected(from, to)
+				s.writef("%s", s.rateLimitResponse())
+				break
+			}
+
+			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
+
+			// Attempt to read message body from the socket.
+			// On timeout, send a timeout message and return from serve().
+			// On net.Error, assume the client has gone away i.e. return from serve().
+			// On other errors, allow the client to try again.
+			data, err := s.readData()
+			if err != nil {
+				switch err.(type) {
+				case net.Error:
+					if err.(net.Error).Timeout() {
+						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+					}
+					break loop
+				case maxSizeExceededError:
+					s.writef(err.Error())
+					continue
+				default:
+					s.writef("451 4.3.0 Requested action aborted: local error in processing")
+					continue
+				}
+			}
+
+			// Create Received header & write message body into buffer.
+			buffer.Reset()
+			buffer.Write(s.makeHeaders(to))
+			buffer.Write(data)
+
+			if !s.deliver(from, to, buffer.Bytes(), dsn) {
+				break
+			}
+
+			// Reset for next mail.
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "BDAT":
+			if !s.srv.EnableCHUNKING {
+				s.writef("500 5.5.2 Syntax error, command unrecognized")
+				break
+			}
+
+			// RFC 3030 section 2: BDAT <chunk-size> [LAST]
+			bdatArgs := strings.Fields(args)
+			if len(bdatArgs) < 1 || len(bdatArgs) > 2 || (len(bdatArgs) == 2 && strings.ToUpper(bdatArgs[1]) != "LAST") {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid BDAT parameters)")
+				break
+			}
+			size, err := strconv.Atoi(bdatArgs[0])
+			if err != nil || size < 0 {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid BDAT chunk size)")
+				break
+			}
+			last := len(bdatArgs) == 2
+
+			// The chunk always follows the command, so a rejected chunk is discarded
+			// from the socket without being buffered.
+			reject := ""
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				reject = "530 5.7.0 Must issue a STARTTLS command first"
+			} else if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				reject = "530 5.7.0 Authentication required"
+			} else if !gotFrom || len(to) == 0 {
+				reject = "503 5.5.1 Bad sequence of commands (MAIL & RCPT required before BDAT)"
+			} else if !bdat && s.srv.MessageRateLimited != nil && s.srv.MessageRateLimited(net.ParseIP(s.remoteIP), len(to)) {
+				reject = s.rateLimitResponse()
+				s.rateLimitRejected(from, to)
+				from = ""
+				gotFrom = false
+				dsn = nil
+				to = nil
+				buffer.Reset()
+				chunks.Reset()
+			}
+
+			if reject != "" {
+				if err := s.discardChunk(size); err != nil {
+					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+					}
+					break loop
+				}
+				s.writef("%s", reject)
+				break
+			}
+
+			// Any chunk failure aborts the mail transaction so that a partial message is never delivered.
+			if err := s.readChunk(&chunks, size); err != nil {
+				if netErr, ok := err.(net.Error); ok {
+					if netErr.Timeout() {
+						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+					}
+					break loop
+				}
+				if _, ok := err.(maxSizeExceededError); ok {
+					s.writef(err.Error())
+				} else {
+					s.writef("451 4.3.0 Requested action aborted: local error in processing")
+				}
+				from = ""
+				gotFrom = false
+				dsn = nil
+				to = nil
+				buffer.Reset()
+				chunks.Reset()
+				bdat = false
+				break
+			}
+
+			bdat = true
+
+			if !last {
+				s.writef("250 2.0.0 Ok: %d octets received", size)
+				break
+			}
+
+			// Prepend the Received header to the complete message.
+			buffer.Reset()
+			buffer.Write(s.makeHeaders(to))
+			buffer.Write(chunks.Bytes())
+
+			s.deliver(from, to, buffer.Bytes(), dsn)
+
+			// RFC 3030 section 2: the transaction is complete after BDAT LAST, successful or not.
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "QUIT":
+			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
+			break loop
+		case "RSET":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			s.writef("250 2.0.0 Ok")
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "NOOP":
+			s.writef("250 2.0.0 Ok")
+		case "XCLIENT":
+			if !s.xClientTrust {
+				s.writef("550 5.7.0 Insufficient authorization")
+				break
+			}
+			s.xClient = args
+			xCArgs := strings.Split(args, " ")
+			for _, xCArg := range xCArgs {
+				xCParse := strings.SplitN(strings.TrimSpace(xCArg), "=", 2)
+				if len(xCParse) != 2 {
+					continue
+				}
+				if strings.ToUpper(xCParse[0]) == "ADDR" && (net.ParseIP(xCParse[1]) != nil) {
+					s.xClientADDR = xCParse[1]
+				}
+				if strings.ToUpper(xCParse[0]) == "NAME" && len(xCParse[1]) > 0 {
+					if xCParse[1] != "[UNAVAILABLE]" {
+						s.xClientNAME = xCParse[1]
+					}
+				}
+			}
+			if len(s.xClientADDR) > 7 {
+				s.remoteIP = s.xClientADDR
+				if len(s.xClientNAME) > 4 {
+					s.remoteHost = s.xClientNAME
+				} else if !s.srv.DisableReverseDNS {
+					names, err := net.LookupAddr(s.remoteIP)
+					if err == nil && len(names) > 0 {
+						s.remoteHost = names[0]
+					} else {
+						s.remoteHost = "unknown"
+					}
+				} else {
+					s.remoteHost = "unknown"
+				}
+			}
+
+			// The XCLIENT command resets the session and the server responds with a new greeting
+			// as if the connection were received from the supplied client.
+			s.remoteName = ""
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+			s.writef("220 %s %s", s.srv.Hostname, s.banner())
+		case "HELP", "VRFY", "EXPN":
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("502 5.5.1 Command not implemented")
+		case "STARTTLS":
+			// Parameters are not allowed (RFC 3207 section 4).
+			if args != "" {
+				s.writef("501 5.5.2 Syntax error (no parameters allowed)")
+				break
+			}
+
+			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.TLSConfig == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// Handle case where STARTTLS is received when TLS is already in use.
+			if s.tls {
+				s.writef("503 5.5.1 Bad sequence of commands (TLS already in use)")
+				break
+			}
+
+			s.writef("220 2.0.0 Ready to start TLS")
+
+			// Establish a TLS connection with the client.
+			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
+			err := tlsConn.Handshake()
+			if err != nil {
+				s.writef("403 4.7.0 TLS handshake failed")
+				break
+			}
+
+			// TLS handshake succeeded, switch to using the TLS connection.
+			s.conn = tlsConn
+			s.br = bufio.NewReader(s.conn)
+			s.bw = bufio.NewWriter(s.conn)
+			s.tls = true
+
+			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
+			s.remoteName = ""
+			from = ""
+			gotFrom = false
+			dsn = nil
+			to = nil
+			buffer.Reset()
+			chunks.Reset()
+			bdat = false
+		case "AUTH":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.AuthHandler == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// Handle case where AUTH is received when already authenticated.
+			if s.authenticated {
+				s.writef("503 5.5.1 Bad sequence of commands (already authenticated for this session)")
+				break
+			}
+
+			// RFC 4954 specifies that AUTH is not permitted during mail transactions.
+			if gotFrom || len(to) > 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (AUTH not permitted during mail transaction)")
+				break
+			}
+
+			// RFC 4954 requires a mechanism parameter.
+			authType, authArgs := s.parseLine(args)
+			if authType == "" {
+				s.writef("501 5.5.4 Malformed AUTH input (argument required)")
+				break
+			}
+
+			// RFC 4954 requires rejecting unsupported authentication mechanisms with a 504 response.
+			allowedAuth := s.authMechs()
+			if allowed, found := allowedAuth[authType]; !found || !allowed {
+				s.writef("504 5.5.4 Unrecognized authentication type")
+				break
+			}
+
+			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments") should be returned
+			// when attempting to use an unsupported authentication type.
+			// Many servers return 5.7.4 ("Security features not supported") instead.
+			switch authType {
+			case "PLAIN":
+				s.authenticated, err = s.handleAuthPlain(authArgs)
+			case "LOGIN":
+				s.authenticated, err = s.handleAuthLogin(authArgs)
+			case "CRAM-MD5":
+				s.authenticated, err = s.handleAuthCramMD5()
+			}
+
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+					break loop
+				}
+
+				s.writef(err.Error())
+				break
+			}
+
+			if s.authenticated {
+				s.writef("235 2.7.0 Authentication successful")
+			} else {
+				s.writef("535 5.7.8 Authentication credentials invalid")
+			}
+		default:
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("500 5.5.2 Syntax error, command unrecognized")
 		}
+	}
+}
 
-		logger.Log().Debugf("[smtpd] added missing addresses to Bcc header: %s", strings.Join(missingAddresses, ", "))
+// Return the remote address of the client, which may have been overridden
+// by a trusted proxy via XCLIENT.
+func (s *session) remoteAddr() net.Addr {
+	if s.xClientADDR != "" {
+		if ip := net.ParseIP(s.xClientADDR); ip != nil {
+			return &net.TCPAddr{IP: ip}
+		}
 	}
 
-	_, err = storage.Store(&data)
-	if err != nil {
-		logger.Log().Errorf("[db] error storing message: %s", err.Error())
-		return err
+	return s.conn.RemoteAddr()
+}
+
+// Return the greeting text following the hostname in the banner.
+func (s *session) banner() string {
+	if s.srv.Banner != "" {
+		return s.srv.Banner
 	}
 
-	stats.LogSMTPAccepted(len(data))
+	return fmt.Sprintf("%s %s Service ready", s.srv.Appname, s.protocol())
+}
 
-	data = nil // avoid memory leaks
+// Return the response to rate-limited clients & messages.
+func (s *session) rateLimitResponse() string {
+	if s.srv.RateLimitResponse == "" {
+		return "452 4.7.0 Too many messages, try again later"
+	}
 
-	subject := msg.Header.Get("Subject")
-	logger.Log().Debugf("[smtpd] received (%s) from:%s subject:%q", cleanIP(origin), from, subject)
+	return s.srv.RateLimitResponse
+}
 
-	return nil
+// Notify the server that a MAIL command or message was rejected by a rate limit.
+func (s *session) rateLimitRejected(from string, to []string) {
+	if s.srv.RateLimitRejected != nil {
+		s.srv.RateLimitRejected(s.remoteAddr(), from, to)
+	}
 }
 
-func authHandler(remoteAddr net.Addr, mechanism string, username []byte, password []byte, _ []byte) (bool, error) {
-	allow := auth.SMTPCredentials.Match(string(username), string(password))
-	if allow {
-		logger.Log().Debugf("[smtpd] allow %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
-	} else {
-		logger.Log().Warnf("[smtpd] deny %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+// Return the protocol name used in the banner.
+func (s *session) protocol() string {
+	if s.srv.LMTP {
+		return "LMTP"
 	}
 
-	return allow, nil
+	return "ESMTP"
 }
 
-// Allow any username and password
-func authHandlerAny(remoteAddr net.Addr, mechanism string, username []byte, _ []byte, _ []byte) (bool, error) {
-	logger.Log().Debugf("[smtpd] allow %s login %q from %s", mechanism, string(username), cleanIP(remoteAddr))
+// Wrapper function for writing a complete line to the socket.
+func (s *session) writef(format string, args ...interface{}) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprint(s.bw, line+"\r\n")
+	err := s.bw.Flush()
 
-	return true, nil
+	if s.trace != nil {
+		// multi-line responses (eg: EHLO) are traced by their final line
+		s.trace.response = line[strings.LastIndex(line, "\n")+1:]
+		s.trace.end = time.Now()
+	}
+
+	if Debug {
+		verb := "WROTE"
+		if s.srv.LogWrite != nil {
+			s.srv.LogWrite(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
+		}
+	}
+
+	return err
 }
 
-// HandlerRcpt used to optionally restrict recipients based on `--smtp-allowed-recipients`
-func handlerRcpt(remoteAddr net.Addr, from string, to string) bool {
-	if config.SMTPAllowedRecipientsRegexp == nil {
-		return true
+// Start tracing a command if tracing is enabled. AUTH credentials are never traced.
+func (s *session) startTrace(verb, args string) {
+	if s.srv.Trace == nil {
+		return
+	}
+
+	cmd, arg := verb, args
+	switch verb {
+	case "MAIL", "RCPT":
+		if k, v, ok := strings.Cut(args, ":"); ok {
+			cmd = verb + " " + strings.ToUpper(strings.TrimSpace(k))
+			arg = strings.TrimSpace(v)
+		}
+	case "AUTH":
+		arg, _ = s.parseLine(args)
 	}
 
-	result := config.SMTPAllowedRecipientsRegexp.MatchString(to)
+	s.trace = &commandTrace{cmd: cmd, arg: arg, start: time.Now()}
+}
 
-	if !result {
-		logger.Log().Warnf("[smtpd] rejected message to %s from %s (%s)", to, from, cleanIP(remoteAddr))
-		stats.LogSMTPRejected()
+// Pass the current command trace (if any) to the trace function.
+func (s *session) endTrace() {
+	if s.trace == nil {
+		return
 	}
 
-	return result
+	t := s.trace
+	s.trace = nil
+	if t.end.IsZero() {
+		t.end = time.Now()
+	}
+
+	s.srv.Trace(s.id, t.cmd, t.arg, t.response, t.end.Sub(t.start))
+}
+
+// Generate a random session ID.
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
 }
 
-// Listen starts the SMTPD server
-func Listen() error {
-	if config.SMTPAuthAllowInsecure {
-		if auth.SMTPCredentials != nil {
-			logger.Log().Info("[smtpd] enabling login authentication (insecure)")
-		} else if config.SMTPAuthAcceptAny {
-			logger.Log().Info("[smtpd] enabling any authentication (insecure)")
+// Read a complete line from the socket.
+func (s *session) readLine() (string, error) {
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	line, err := s.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line) // Strip trailing \r\n
+
+	if Debug {
+		verb := "READ"
+		if s.srv.LogRead != nil {
+			s.srv.LogRead(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
 		}
+	}
+
+	return line, err
+}
+
+// Parse a line read from the socket.
+func (s *session) parseLine(line string) (verb string, args string) {
+	if idx := strings.Index(line, " "); idx != -1 {
+		verb = strings.ToUpper(line[:idx])
+		args = strings.TrimSpace(line[idx+1:])
 	} else {
-		if auth.SMTPCredentials != nil {
-			logger.Log().Info("[smtpd] enabling login authentication")
-		} else if config.SMTPAuthAcceptAny {
-			logger.Log().Info("[smtpd] enabling any authentication")
+		verb = strings.ToUpper(line)
+		args = ""
+	}
+	return verb, args
+}
+
+// Read the message data following a DATA command. Messages exceeding the maximum
+// message size are read until the end of the data & discarded.
+func (s *session) readData() ([]byte, error) {
+	var data []byte
+	var exceeded bool
+	for {
+		if s.srv.Timeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+		}
+
+		line, err := s.br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		// Handle end of data denoted by lone period (\r\n.\r\n)
+		if bytes.Equal(line, []byte(".\r\n")) {
+			break
+		}
+		// Remove leading period (RFC 5321 section 4.5.2)
+		if line[0] == '.' {
+			line = line[1:]
+		}
+
+		// Enforce the maximum message size limit.
+		if exceeded || s.srv.MaxSize > 0 && len(data)+len(line) > s.srv.MaxSize {
+			exceeded = true
+			data = nil
+			continue
+		}
+
+		data = append(data, line...)
+	}
+
+	if exceeded {
+		return nil, maxSizeExceeded(s.srv.MaxSize)
+	}
+
+	return data, nil
+}
+
+// Read a BDAT chunk of the given size from the socket into buf (RFC 3030). If the chunk would
+// exceed the maximum message size it is discarded, so no more than the maximum size is buffered.
+func (s *session) readChunk(buf *bytes.Buffer, size int) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	if s.srv.MaxSize > 0 && buf.Len()+size > s.srv.MaxSize {
+		if err := s.discardChunk(size); err != nil {
+			return err
 		}
+		return maxSizeExceeded(s.srv.MaxSize)
 	}
 
-	smtpType := "no encryption"
+	_, err := io.CopyN(buf, s.br, int64(size))
 
-	if config.SMTPTLSCert != "" {
-		if config.SMTPRequireSTARTTLS {
-			smtpType = "STARTTLS required"
-		} else if config.SMTPRequireTLS {
-			smtpType = "SSL/TLS required"
-		} else {
-			smtpType = "STARTTLS optional"
-			if !config.SMTPAuthAllowInsecure && auth.SMTPCredentials != nil {
-				smtpType = "STARTTLS required"
+	return err
+}
+
+// Discard a BDAT chunk of the given size from the socket without buffering it.
+func (s *session) discardChunk(size int) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	_, err := io.CopyN(io.Discard, s.br, int64(size))
+
+	return err
+}
+
+// Pass a complete message on to the handler & reply to the client, returning
+// whether the message was accepted.
+func (s *session) deliver(from string, to []string, data []byte, dsn *DSN) bool {
+	s.bytesReceived += len(data)
+
+	if s.srv.Handler != nil {
+		if dsn != nil && dsn.IsEmpty() {
+			dsn = nil
+		}
+		err := s.srv.Handler(s.remoteAddr(), s.id, from, to, data, dsn)
+		if err != nil {
+			reply := "451 4.3.5 Unable to process mail"
+			checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
+			if checkErrFormat.MatchString(err.Error()) {
+				reply = err.Error()
+			}
+
+			if s.srv.LMTP {
+				// RFC 2033 section 4.2 requires a reply for each successful recipient.
+				for range to {
+					s.writef(reply)
+				}
+			} else {
+				s.writef(reply)
 			}
+			return false
 		}
+	}
 
+	if s.srv.LMTP {
+		for _, rcpt := range to {
+			s.writef("250 2.1.5 <%s> Ok: delivered", rcpt)
+		}
+	} else {
+		s.writef("250 2.0.0 Ok: queued")
 	}
 
-	logger.Log().Infof("[smtpd] starting on %s (%s)", config.SMTPListen, smtpType)
+	s.delivered++
 
-	return listenAndServe(config.SMTPListen, mailHandler, authHandler)
+	return true
 }
 
-func listenAndServe(addr string, handler smtpd.Handler, authHandler smtpd.AuthHandler) error {
-	srv := &smtpd.Server{
-		Addr:              addr,
-		Handler:           handler,
-		HandlerRcpt:       handlerRcpt,
-		Appname:           "Mailpit",
-		Hostname:          "",
-		AuthHandler:       nil,
-		AuthRequired:      false,
-		MaxRecipients:     config.SMTPMaxRecipients,
-		DisableReverseDNS: DisableReverseDNS,
+// Call the ConnectionClosed callback, if configured, with the details of the session.
+func (s *session) connectionClosed() {
+	if s.srv.ConnectionClosed == nil {
+		return
 	}
 
-	if config.SMTPAuthAllowInsecure {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
+	s.srv.ConnectionClosed(ConnectionInfo{
+		RemoteAddr:        s.remoteAddr(),
+		EHLOHostname:      s.remoteName,
+		ConnectedAt:       s.connectedAt,
+		DisconnectedAt:    time.Now(),
+		MessagesDelivered: s.delivered,
+		BytesReceived:     s.bytesReceived,
+	})
+}
+
+// Parse the ESMTP parameters of a MAIL or RCPT command into a map of
+// uppercased keywords to values.
+func parseParams(args string) map[string]string {
+	params := map[string]string{}
+	for _, param := range strings.Fields(args) {
+		k, v, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(k)] = v
 	}
 
-	if auth.SMTPCredentials != nil {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
-		srv.AuthHandler = authHandler
-		srv.AuthRequired = true
-	} else if config.SMTPAuthAcceptAny {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
-		srv.AuthHandler = authHandlerAny
+	return params
+}
+
+// Whether the MAIL parameter is supported by the server. The AUTH
+// parameter (RFC 4954) is accepted but ignored.
+func (s *session) isSupportedMailParam(k string) bool {
+	switch k {
+	case "SIZE", "BODY", "AUTH":
+		return true
+	case "RET", "ENVID":
+		return s.srv.EnableDSN
 	}
 
-	if config.SMTPTLSCert != "" {
-		srv.TLSRequired = config.SMTPRequireSTARTTLS
-		srv.TLSListener = config.SMTPRequireTLS // if true overrules srv.TLSRequired
-		if err := srv.ConfigureTLS(config.SMTPTLSCert, config.SMTPTLSKey); err != nil {
-			return err
+	return false
+}
+
+// Add the DSN parameters of a recipient, returning false if the NOTIFY
+// parameter is invalid (RFC 3461 section 4.1).
+func (d *DSN) addRecipient(to string, params map[string]string) bool {
+	r := DSNRecipient{ORcpt: params["ORCPT"]}
+
+	if notify, ok := params["NOTIFY"]; ok {
+		for _, n := range strings.Split(strings.ToUpper(notify), ",") {
+			switch n {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if strings.Contains(notify, ",") {
+					return false
+				}
+			default:
+				return false
+			}
+			r.Notify = append(r.Notify, n)
 		}
 	}
 
-	return srv.ListenAndServe()
+	if len(r.Notify) > 0 || r.ORcpt != "" {
+		d.Recipients[to] = r
+	}
+
+	return true
+}
+
+// Create the Received header to comply with RFC 2821 section 3.8.2.
+// TODO: Work out what to do with multiple to addresses.
+func (s *session) makeHeaders(to []string) []byte {
+	var buffer bytes.Buffer
+	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
+	if s.srv.SessionHeader != "" {
+		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", s.srv.SessionHeader, s.id))
+	}
+	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
+	protocol := "SMTP"
+	if s.srv.LMTP {
+		protocol = "LMTP"
+	}
+	buffer.WriteString(fmt.Sprintf("        by %s (%s) with %s\r\n", s.srv.Hostname, s.srv.Appname, protocol))
+	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+	return buffer.Bytes()
 }
 
-func cleanIP(i net.Addr) string {
-	parts := strings.Split(i.String(), ":")
+// Determine allowed authentication mechanisms.
+// RFC 4954 specifies that plaintext authentication mechanisms such as LOGIN and PLAIN require a TLS connection.
+// This can be explicitly overridden e.g. setting s.srv.AuthMechs["LOGIN"] = true.
+func (s *session) authMechs() (mechs map[string]bool) {
+	mechs = map[string]bool{"LOGIN": s.tls, "PLAIN": s.tls, "CRAM-MD5": true}
+
+	for mech := range mechs {
+		allowed, found := s.srv.AuthMechs[mech]
+		if found {
+			mechs[mech] = allowed
+		}
+	}
 
-	return parts[0]
+	return
 }
 
-// Returns a list of all lowercased emails found in To, Cc and Bcc,
-// as well as whether there is a Bcc field
-func scanAddressesInHeader(h mail.Header) (map[string]bool, bool) {
-	emails := make(map[string]bool)
-	hasBccHeader := false
+// Create the greeting string sent in response to an EHLO command.
+func (s *session) makeEHLOResponse() (response string) {
+	response = fmt.Sprintf("250-%s greets %s\r\n", s.srv.Hostname, s.remoteName)
+
+	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
+	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
+
+	if s.srv.Enable8BitMIME {
+		response += "250-8BITMIME\r\n"
+	}
+
+	// RFC 2033 section 4.1 requires LMTP servers to support PIPELINING. Commands are read
+	// from a buffered reader & replied to in order, so pipelined commands are never lost.
+	if s.srv.LMTP {
+		response += "250-PIPELINING\r\n"
+	}
+
+	// Only list XCLIENT to trusted clients.
+	if s.xClientTrust {
+		response += "250-XCLIENT ADDR NAME\r\n"
+	}
+
+	if s.srv.EnableDSN {
+		response += "250-DSN\r\n"
+	}
 
-	if recipients, err := h.AddressList("To"); err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	if s.srv.EnableCHUNKING {
+		response += "250-CHUNKING\r\n"
+	}
+
+	// Only list STARTTLS if TLS is configured, but not currently in use.
+	if s.srv.TLSConfig != nil && !s.tls {
+		response += "250-STARTTLS\r\n"
+	}
+
+	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed.
+	if s.srv.AuthHandler != nil {
+		var mechs []string
+		for mech, allowed := range s.authMechs() {
+			if allowed {
+				mechs = append(mechs, mech)
+			}
+		}
+		if len(mechs) > 0 {
+			response += "250-AUTH " + strings.Join(mechs, " ") + "\r\n"
 		}
 	}
 
-	if recipients, err := h.AddressList("Cc"); err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	response += "250 ENHANCEDSTATUSCODES"
+	return
+}
+
+func (s *session) handleAuthLogin(arg string) (bool, error) {
+	var err error
+
+	if arg == "" {
+		s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
 		}
 	}
 
-	recipients, err := h.AddressList("Bcc")
-	if err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	username, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+	line, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
+
+	password, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.remoteAddr(), "LOGIN", username, password, nil)
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthPlain(arg string) (bool, error) {
+	var err error
+
+	// If fast mode (AUTH PLAIN [arg]) is not used, prompt for credentials.
+	if arg == "" {
+		s.writef("334 ")
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
 		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.remoteAddr(), "PLAIN", parts[1], parts[2], nil)
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthCramMD5() (bool, error) {
+	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(time.Now().Nanosecond()) + "@" + s.srv.Hostname + ">"
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte(shared)))
+
+	data, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
 
-		hasBccHeader = true
+	if data == "*" {
+		return false, errors.New("501 5.7.0 Authentication cancelled")
 	}
 
-	return emails, hasBccHeader
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	fields := strings.Split(string(buf), " ")
+	if len(fields) < 2 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.remoteAddr(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+
+	return authenticated, err
 }
@@ -3,11 +3,20 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/PaesslerAG/jsonpath"
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/errorreport"
 	"github.com/axllent/mailpit/internal/logger"
 	"golang.org/x/time/rate"
 )
@@ -19,14 +28,48 @@ var (
 	rl rate.Sometimes
 
 	rateLimiterSet bool
+
+	// RetryDelays are the delays before each retry of a failed delivery
+	RetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+	// FailureHandler is called with the payload & last error of deliveries which failed all retries
+	FailureHandler func(payload []byte, err error)
+
+	// queued deliveries when config.WebhookRateLimit is set
+	queue     chan []byte
+	queueOnce sync.Once
+
+	// failed deliveries awaiting a retry
+	retries        chan retry
+	retriesOnce    sync.Once
+	pendingRetries int64
+
+	// payload template parsed from config.WebhookTemplate, nil to send the JSON message summary
+	payloadTemplate *template.Template
 )
 
+// Retry is a failed delivery & the number of retries so far
+type retry struct {
+	payload []byte
+	attempt int
+	err     error
+}
+
 // Send will post the MessageSummary to a webhook (if configured)
 func Send(msg interface{}) {
 	if config.WebhookURL == "" {
 		return
 	}
 
+	if !matchesConditions(msg) {
+		return
+	}
+
+	if config.WebhookRateLimit > 0 {
+		enqueue(msg)
+		return
+	}
+
 	if !rateLimiterSet {
 		if RateLimit > 0 {
 			rl = rate.Sometimes{Interval: time.Duration(RateLimit) * time.Second}
@@ -39,34 +82,253 @@ func Send(msg interface{}) {
 
 	go func() {
 		rl.Do(func() {
-			b, err := json.Marshal(msg)
+			b, err := payload(msg)
 			if err != nil {
 				logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
 				return
 			}
 
-			req, err := http.NewRequest("POST", config.WebhookURL, bytes.NewBuffer(b))
-			if err != nil {
-				logger.Log().Errorf("[webhook] error: %s", err.Error())
-				return
-			}
+			deliver(b)
+		})
+	}()
+}
 
-			req.Header.Set("User-Agent", "Mailpit/"+config.Version)
-			req.Header.Set("Content-Type", "application/json")
+// LoadTemplate parses the config.WebhookTemplate file (if set), which is executed with the message
+// summary to render the webhook request body. Templates can use the json, dateFormat & truncate functions.
+func LoadTemplate() error {
+	payloadTemplate = nil
 
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Log().Errorf("[webhook] error sending data: %s", err.Error())
-				return
-			}
+	if config.WebhookTemplate == "" {
+		return nil
+	}
 
-			if resp.StatusCode < 200 || resp.StatusCode > 299 {
-				logger.Log().Warnf("[webhook] %s returned a %d status", config.WebhookURL, resp.StatusCode)
-				return
-			}
+	b, err := os.ReadFile(filepath.Clean(config.WebhookTemplate))
+	if err != nil {
+		return fmt.Errorf("[webhook] %s", err.Error())
+	}
+
+	t, err := template.New("webhook").Funcs(templateFuncs).Parse(string(b))
+	if err != nil {
+		return fmt.Errorf("[webhook] invalid template: %s", err.Error())
+	}
+
+	payloadTemplate = t
+
+	logger.Log().Infof("[webhook] using payload template %s", config.WebhookTemplate)
+
+	return nil
+}
+
+var templateFuncs = template.FuncMap{
+	// json returns the JSON encoding of a value
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// dateFormat formats a time using a Go layout, eg: {{ .Created | dateFormat "2006-01-02" }}
+	"dateFormat": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	// truncate shortens a string to a maximum number of characters, eg: {{ .Subject | truncate 50 }}
+	"truncate": func(n int, s string) string {
+		r := []rune(s)
+		if n < 0 || len(r) <= n {
+			return s
+		}
+
+		return string(r[:n])
+	},
+}
+
+// Payload returns the webhook request body of a message, rendered with the payload template
+// if one is configured, else the message JSON
+func payload(msg interface{}) ([]byte, error) {
+	if payloadTemplate == nil {
+		return json.Marshal(msg)
+	}
+
+	var buf bytes.Buffer
+	if err := payloadTemplate.Execute(&buf, msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Enqueue adds the delivery to the queue, which is drained at config.WebhookRateLimit
+// deliveries per second. The delivery is dropped if the queue is full.
+func enqueue(msg interface{}) {
+	queueOnce.Do(func() {
+		queue = make(chan []byte, config.WebhookQueueSize)
+		go drainQueue(rate.NewLimiter(rate.Limit(config.WebhookRateLimit), 1))
+		go logQueueDepth()
+	})
+
+	b, err := payload(msg)
+	if err != nil {
+		logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
+		return
+	}
+
+	select {
+	case queue <- b:
+	default:
+		logger.Log().Warnf("[webhook] queue is full (%d), dropping delivery", config.WebhookQueueSize)
+	}
+}
+
+// DrainQueue delivers queued webhooks as the rate limiter allows
+func drainQueue(limiter *rate.Limiter) {
+	for b := range queue {
+		if err := limiter.Wait(context.Background()); err != nil {
+			logger.Log().Errorf("[webhook] error: %s", err.Error())
+			continue
+		}
+
+		go deliver(b)
+	}
+}
+
+// LogQueueDepth logs the number of queued deliveries every minute
+func logQueueDepth() {
+	for range time.Tick(60 * time.Second) {
+		logger.Log().Debugf("[webhook] %d deliveries queued", len(queue))
+	}
+}
+
+// Deliver posts the JSON data to the webhook URL, retrying the delivery if it fails
+func deliver(b []byte) {
+	if err := post(b); err != nil {
+		retryLater(retry{payload: b, err: err})
+	}
+}
+
+// RetryLater queues a failed delivery for the next retry, or passes it to the FailureHandler
+// once all retries have failed or the retry queue is full
+func retryLater(r retry) {
+	if r.attempt >= len(RetryDelays) {
+		failed(r)
+		return
+	}
+
+	retriesOnce.Do(func() {
+		retries = make(chan retry, config.WebhookQueueSize)
+		go retryWorker()
+	})
+
+	if atomic.AddInt64(&pendingRetries, 1) > int64(config.WebhookQueueSize) {
+		atomic.AddInt64(&pendingRetries, -1)
+		logger.Log().Warnf("[webhook] retry queue is full (%d), dropping delivery", config.WebhookQueueSize)
+		failed(r)
+		return
+	}
+
+	retries <- r
+}
 
-			defer resp.Body.Close()
+// RetryWorker schedules each queued delivery to be retried after its back-off delay
+func retryWorker() {
+	for r := range retries {
+		r := r
+		time.AfterFunc(RetryDelays[r.attempt], func() {
+			atomic.AddInt64(&pendingRetries, -1)
+
+			r.attempt++
+			logger.Log().Debugf("[webhook] retrying delivery (attempt %d of %d)", r.attempt, len(RetryDelays))
+
+			if err := post(r.payload); err != nil {
+				r.err = err
+				retryLater(r)
+			}
 		})
-	}()
+	}
+}
+
+// Failed logs a delivery which could not be delivered, and passes it to the FailureHandler
+func failed(r retry) {
+	logger.Log().Errorf("[webhook] delivery failed after %d retries: %s", r.attempt, r.err.Error())
+
+	if FailureHandler != nil {
+		FailureHandler(r.payload, r.err)
+	}
+}
+
+// Post the JSON data to the webhook URL
+func post(b []byte) error {
+	req, err := http.NewRequest("POST", config.WebhookURL, bytes.NewBuffer(b))
+	if err != nil {
+		logger.Log().Errorf("[webhook] error: %s", err.Error())
+		return err
+	}
+
+	req.Header.Set("User-Agent", "Mailpit/"+config.Version)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Log().Errorf("[webhook] error sending data: %s", err.Error())
+		errorreport.CaptureError(err, "webhook", "")
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("webhook returned a %d status", resp.StatusCode)
+		logger.Log().Warnf("[webhook] %s returned a %d status", config.WebhookURL, resp.StatusCode)
+		errorreport.CaptureError(err, "webhook", "")
+		return err
+	}
+
+	return nil
+}
+
+// MatchesConditions returns whether the JSON of the message matches all of config.WebhookConditions
+func matchesConditions(msg interface{}) bool {
+	if len(config.WebhookConditions) == 0 {
+		return true
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
+		return false
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
+		return false
+	}
+
+	for _, c := range config.WebhookConditions {
+		result, err := jsonpath.Get(c.JSONPath, data)
+		if err != nil || !conditionValueMatches(result, c.Value) {
+			logger.Log().Debugf("[webhook] condition not matched: %s=%s", c.JSONPath, c.Value)
+			return false
+		}
+	}
+
+	return true
+}
+
+// ConditionValueMatches returns whether the JSONPath result, or any of its values
+// if the result is an array, equals the condition value
+func conditionValueMatches(result interface{}, value string) bool {
+	switch v := result.(type) {
+	case []interface{}:
+		for _, r := range v {
+			if conditionValueMatches(r, value) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return v == value
+	case nil:
+		return value == "null"
+	default:
+		return fmt.Sprint(v) == value
+	}
 }
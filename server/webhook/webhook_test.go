@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+)
+
+func TestMatchesConditions(t *testing.T) {
+	msg := map[string]interface{}{
+		"From":        map[string]string{"Address": "sender@example.com"},
+		"To":          []map[string]string{{"Address": "one@example.com"}, {"Address": "two@example.com"}},
+		"Attachments": 2,
+		"Read":        false,
+	}
+
+	defer func() { config.WebhookConditions = nil }()
+
+	tests := []struct {
+		conditions []config.WebhookCondition
+		expected   bool
+	}{
+		{nil, true},
+		{[]config.WebhookCondition{{JSONPath: "$.From.Address", Value: "sender@example.com"}}, true},
+		{[]config.WebhookCondition{{JSONPath: "$.From.Address", Value: "other@example.com"}}, false},
+		{[]config.WebhookCondition{{JSONPath: "$.To[*].Address", Value: "two@example.com"}}, true},
+		{[]config.WebhookCondition{{JSONPath: "$.Attachments", Value: "2"}, {JSONPath: "$.Read", Value: "false"}}, true},
+		{[]config.WebhookCondition{{JSONPath: "$.Attachments", Value: "2"}, {JSONPath: "$.Read", Value: "true"}}, false},
+		{[]config.WebhookCondition{{JSONPath: "$.Missing", Value: ""}}, false},
+	}
+
+	for i, test := range tests {
+		config.WebhookConditions = test.conditions
+		if matchesConditions(msg) != test.expected {
+			t.Errorf("test %d: expected %v", i, test.expected)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	delays := RetryDelays
+	RetryDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond}
+
+	var attempts, succeedAfter int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt64(&attempts, 1) <= atomic.LoadInt64(&succeedAfter) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	failures := make(chan string, 1)
+	config.WebhookURL = ts.URL
+	FailureHandler = func(payload []byte, err error) {
+		failures <- string(payload)
+	}
+
+	defer func() {
+		ts.Close()
+		config.WebhookURL = ""
+		FailureHandler = nil
+		RetryDelays = delays
+	}()
+
+	// every attempt fails
+	atomic.StoreInt64(&succeedAfter, 10)
+	deliver([]byte(`{"ID":"failed"}`))
+
+	select {
+	case payload := <-failures:
+		if payload != `{"ID":"failed"}` {
+			t.Errorf("unexpected failure payload: %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not passed to the failure handler")
+	}
+
+	if n := atomic.LoadInt64(&attempts); n != 5 {
+		t.Errorf("expected 5 delivery attempts, got %d", n)
+	}
+
+	// the second retry succeeds
+	atomic.StoreInt64(&attempts, 0)
+	atomic.StoreInt64(&succeedAfter, 2)
+	deliver([]byte(`{"ID":"delivered"}`))
+
+	time.Sleep(250 * time.Millisecond)
+
+	select {
+	case payload := <-failures:
+		t.Errorf("unexpected failure: %s", payload)
+	default:
+	}
+
+	if n := atomic.LoadInt64(&attempts); n != 3 {
+		t.Errorf("expected 3 delivery attempts, got %d", n)
+	}
+}
+
+func TestPayloadTemplate(t *testing.T) {
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+
+	tmpl := filepath.Join(t.TempDir(), "webhook.tmpl")
+	if err := os.WriteFile(tmpl, []byte(`{"text":{{ printf "New message: %s" .Subject | truncate 20 | json }},"date":"{{ .Created | dateFormat "2006-01-02" }}","to":{{ json .To }}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.WebhookURL = ts.URL
+	config.WebhookTemplate = tmpl
+
+	defer func() {
+		ts.Close()
+		config.WebhookURL = ""
+		config.WebhookTemplate = ""
+		payloadTemplate = nil
+	}()
+
+	if err := LoadTemplate(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := struct {
+		Subject string
+		Created time.Time
+		To      []string
+	}{
+		Subject: `Your "order" has shipped`,
+		Created: time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC),
+		To:      []string{"one@example.com", "two@example.com"},
+	}
+
+	b, err := payload(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(b)
+
+	expected := `{"text":"New message: Your \"o","date":"2024-01-15","to":["one@example.com","two@example.com"]}`
+
+	select {
+	case body := <-bodies:
+		if body != expected {
+			t.Errorf("unexpected body:\n%s\nexpected:\n%s", body, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	// invalid templates are rejected
+	if err := os.WriteFile(tmpl, []byte(`{{ .Subject | missing }}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadTemplate(); err == nil {
+		t.Error("expected an invalid template to fail")
+	}
+}
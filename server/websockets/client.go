@@ -5,9 +5,11 @@
 package websockets
 
 import (
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/auth"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/gorilla/websocket"
@@ -17,12 +19,6 @@ const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
 )
@@ -51,6 +47,9 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Whether the client failed to respond to a ping within the pong timeout.
+	stale bool
 }
 
 // ReadPump is used here solely to monitor the connection, not to actually receive messages.
@@ -59,10 +58,18 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 	}()
 
+	// any pong received within the pong timeout extends the read deadline
+	_ = c.conn.SetReadDeadline(time.Now().Add(config.WebSocketPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(config.WebSocketPongTimeout))
+	})
+
 	for {
 		_, _, err := c.conn.NextReader()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.stale = true
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Log().Errorf("[websocket] error: %v", err.Error())
 			}
 			break
@@ -76,7 +83,7 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(config.WebSocketPingInterval)
 	defer func() {
 		ticker.Stop()
 		c.hub.unregister <- c
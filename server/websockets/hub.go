@@ -3,7 +3,9 @@ package websockets
 
 import (
 	"encoding/json"
+	"time"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
@@ -41,6 +43,12 @@ func NewHub() *Hub {
 
 // Run runs the listener
 func (h *Hub) Run() {
+	ticker := time.NewTicker(config.WebSocketPingInterval)
+	defer ticker.Stop()
+
+	// number of stale clients removed since the last interval
+	stale := 0
+
 	for {
 		select {
 		case client := <-h.register:
@@ -50,7 +58,12 @@ func (h *Hub) Run() {
 			}
 		case client := <-h.unregister:
 			if _, ok := h.Clients[client]; ok {
-				logger.Log().Debugf("[websocket] client %s disconnected", client.conn.RemoteAddr().String())
+				if client.stale {
+					logger.Log().Debugf("[websocket] client %s timed out", client.conn.RemoteAddr().String())
+					stale++
+				} else {
+					logger.Log().Debugf("[websocket] client %s disconnected", client.conn.RemoteAddr().String())
+				}
 				delete(h.Clients, client)
 				close(client.send)
 			}
@@ -63,13 +76,24 @@ func (h *Hub) Run() {
 					delete(h.Clients, client)
 				}
 			}
+		case <-ticker.C:
+			if stale > 0 {
+				logger.Log().Infof("[websocket] removed %d stale connection(s)", stale)
+				stale = 0
+			}
 		}
 	}
 }
 
-// Broadcast will spawn a broadcast message to all connected clients
+// Broadcast will spawn a broadcast message to all connected websocket & server-sent event clients
 func Broadcast(t string, msg interface{}) {
-	if MessageHub == nil || len(MessageHub.Clients) == 0 {
+	sseMu.Lock()
+	sseConnected := len(sseClients) > 0
+	sseMu.Unlock()
+
+	wsConnected := MessageHub != nil && len(MessageHub.Clients) > 0
+
+	if !wsConnected && !sseConnected {
 		return
 	}
 
@@ -83,5 +107,11 @@ func Broadcast(t string, msg interface{}) {
 		return
 	}
 
-	go func() { MessageHub.Broadcast <- b }()
+	if sseConnected {
+		sseBroadcast(b)
+	}
+
+	if wsConnected {
+		go func() { MessageHub.Broadcast <- b }()
+	}
 }
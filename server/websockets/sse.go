@@ -0,0 +1,105 @@
+package websockets
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// sseKeepAliveInterval is the interval a keepalive comment is sent to server-sent event clients
+const sseKeepAliveInterval = 15 * time.Second
+
+var (
+	// registered server-sent event clients
+	sseClients = make(map[chan []byte]bool)
+	sseMu      sync.Mutex
+)
+
+// sseRegister registers a new server-sent event client, returning its channel of events
+func sseRegister() chan []byte {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+
+	c := make(chan []byte, 256)
+	sseClients[c] = true
+
+	return c
+}
+
+// sseUnregister removes a server-sent event client
+func sseUnregister(c chan []byte) {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+
+	delete(sseClients, c)
+}
+
+// sseBroadcast sends the event to all server-sent event clients. Clients which are not
+// keeping up with the events are disconnected.
+func sseBroadcast(b []byte) {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+
+	for c := range sseClients {
+		select {
+		case c <- b:
+		default:
+			delete(sseClients, c)
+			close(c)
+		}
+	}
+}
+
+// ServeSSE streams all broadcast events to the client as server-sent events,
+// for clients & proxies which do not support websockets.
+func ServeSSE(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// the stream is long-lived, so the server write timeout must not apply
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// register before responding so no events are missed once the client is connected
+	c := sseRegister()
+	defer sseUnregister(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	logger.Log().Debugf("[sse] client %s connected", r.RemoteAddr)
+
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Log().Debugf("[sse] client %s disconnected", r.RemoteAddr)
+			return
+		case b, ok := <-c:
+			if !ok {
+				logger.Log().Debugf("[sse] client %s too slow, disconnecting", r.RemoteAddr)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			f.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}